@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// minSnapshotTime is the least time worth starting snapshots in; the
+	// preemption path never has it
+	minSnapshotTime        = time.Minute
+	defaultSnapshotTimeout = 10 * time.Minute
+)
+
+// snapshotPoll spaces out checks of a snapshot that isn't READY yet.
+var snapshotPoll = 5 * time.Second
+
+// terminationStep is one action in the termination sequence.
+type terminationStep struct {
+	// permission is the instance-level IAM permission the step needs, if any.
+	permission string
+	// goneOK means an instance that no longer exists counts as success.
+	goneOK bool
+	// minTime is the least the step can get done in. With less left before
+	// the context's deadline, such as on the preemption path, it is skipped.
+	minTime time.Duration
+	// run performs the step, terminating for reason, and returns any
+	// warnings its operations raised
+	run func(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, reason TerminationReason) (warnings []string, err error)
+}
+
+// terminationSteps are the building blocks for TERMINATE_ACTION. A sequence
+// such as "snapshot,delete" runs them in order and stops at the first failure.
+var terminationSteps = map[string]terminationStep{
+	"snapshot": {run: snapshotDisks, minTime: minSnapshotTime},
+	"stop":     {permission: "compute.instances.stop", goneOK: true, run: stopInstance},
+	"suspend":  {permission: "compute.instances.suspend", goneOK: true, run: suspendInstance},
+	"delete":   {permission: deletePermission, goneOK: true, run: deleteInstance},
+}
+
+// parseTerminationSteps validates a comma-separated TERMINATE_ACTION value.
+func parseTerminationSteps(spec string) ([]string, error) {
+	var steps []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := terminationSteps[name]; !ok {
+			return nil, fmt.Errorf("unknown termination step %q", name)
+		}
+		steps = append(steps, name)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no termination steps in %q", spec)
+	}
+	return steps, nil
+}
+
+// deleteInstance doesn't wait for the operation: the VM running it goes
+// away. Warnings come from the operation as first returned.
+func deleteInstance(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, _ TerminationReason) ([]string, error) {
+	op, err := svc.Instances.Delete(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return operationWarnings(op), nil
+}
+
+// stopInstance stops the VM after labelling it with who stopped it and why,
+// since unlike a deleted VM it remains around to be inspected.
+func stopInstance(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, reason TerminationReason) ([]string, error) {
+	if err := labelTerminated(ctx, svc, projectID, zone, instanceName, reason); err != nil {
+		// Provenance is nice to have, stopping is what matters
+		log.Printf("Failed to label %s before stopping: %v", instanceName, err)
+	}
+	op, err := svc.Instances.Stop(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return operationWarnings(op), nil
+}
+
+// suspendInstance suspends the VM, keeping its memory and disks so it can
+// be resumed later, labelled like a stopped one.
+func suspendInstance(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, reason TerminationReason) ([]string, error) {
+	if err := labelTerminated(ctx, svc, projectID, zone, instanceName, reason); err != nil {
+		log.Printf("Failed to label %s before suspending: %v", instanceName, err)
+	}
+	op, err := svc.Instances.Suspend(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return operationWarnings(op), nil
+}
+
+// labelTerminated stamps terminated-by, terminated-reason and terminated-at
+// labels on the instance, keeping its existing labels.
+func labelTerminated(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, reason TerminationReason) error {
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance: %w", err)
+	}
+
+	labels := make(map[string]string, len(inst.Labels)+3)
+	for k, v := range inst.Labels {
+		labels[k] = v
+	}
+	labels["terminated-by"] = "spot-notifier"
+	labels["terminated-reason"] = string(reason)
+	labels["terminated-at"] = strconv.FormatInt(time.Now().Unix(), 10) // Label values can't hold ':'
+
+	req := &compute.InstancesSetLabelsRequest{Labels: labels, LabelFingerprint: inst.LabelFingerprint}
+	op, err := svc.Instances.SetLabels(projectID, zone, instanceName, req).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to set labels: %w", err)
+	}
+	_, err = waitZoneOperation(ctx, svc, projectID, zone, op)
+	return err
+}
+
+// snapshotDisks snapshots every persistent disk attached to the instance and
+// waits for the snapshots to finish, so a following delete can't race them.
+func snapshotDisks(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string, _ TerminationReason) ([]string, error) {
+	_, warnings, err := createSnapshots(ctx, svc, projectID, zone, instanceName)
+	return warnings, err
+}
+
+// createSnapshots does the work of snapshotDisks, also returning the paths
+// of the snapshots it created. The disks are snapshotted at the same time,
+// and each snapshot is waited on until it is READY.
+func createSnapshots(ctx context.Context, svc *compute.Service, projectID, zone, instanceName string) (snapshots, warnings []string, err error) {
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get instance: %w", err)
+	}
+
+	stamp := time.Now().UTC().Format("20060102-150405")
+	var (
+		mu    sync.Mutex
+		g     errgroup.Group
+		taken = make([]string, len(inst.Disks)) // in disk order
+	)
+	for i, disk := range inst.Disks {
+		if disk.Type != "PERSISTENT" || disk.Source == "" {
+			continue
+		}
+		g.Go(func() error {
+			diskName := path.Base(disk.Source)
+			snapshot := &compute.Snapshot{
+				Name:        snapshotName(diskName, stamp),
+				Description: fmt.Sprintf("Taken by spot-notifier before terminating %s", instanceName),
+			}
+
+			log.Printf("Snapshotting disk %s as %s", diskName, snapshot.Name)
+			op, err := svc.Disks.CreateSnapshot(projectID, zone, diskName, snapshot).Context(ctx).Do()
+			if err != nil {
+				return fmt.Errorf("failed to snapshot disk %s: %w", diskName, err)
+			}
+			w, err := waitZoneOperation(ctx, svc, projectID, zone, op)
+			mu.Lock()
+			warnings = append(warnings, w...)
+			mu.Unlock()
+			if err != nil {
+				return fmt.Errorf("snapshot of disk %s failed: %w", diskName, err)
+			}
+			if err := waitSnapshotReady(ctx, svc, projectID, snapshot.Name); err != nil {
+				return fmt.Errorf("snapshot of disk %s failed: %w", diskName, err)
+			}
+			taken[i] = fmt.Sprintf("projects/%s/global/snapshots/%s", projectID, snapshot.Name)
+			return nil
+		})
+	}
+	err = g.Wait()
+	for _, s := range taken {
+		if s != "" {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots, warnings, err
+}
+
+// waitSnapshotReady polls the snapshot until it is READY, which can trail
+// its creation while the data is uploaded.
+func waitSnapshotReady(ctx context.Context, svc *compute.Service, projectID, name string) error {
+	for {
+		snap, err := svc.Snapshots.Get(projectID, name).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot %s: %w", name, err)
+		}
+		switch snap.Status {
+		case "READY":
+			return nil
+		case "FAILED", "DELETING":
+			return fmt.Errorf("snapshot %s is %s", name, snap.Status)
+		}
+		select {
+		case <-time.After(snapshotPoll):
+		case <-ctx.Done():
+			return fmt.Errorf("snapshot %s still %s: %w", name, snap.Status, ctx.Err())
+		}
+	}
+}
+
+// snapshotName builds a valid resource name (max 63 chars) for a disk snapshot.
+func snapshotName(diskName, stamp string) string {
+	const maxLen = 63
+	suffix := "-" + stamp
+	if len(diskName)+len(suffix) > maxLen {
+		diskName = strings.TrimRight(diskName[:maxLen-len(suffix)], "-")
+	}
+	return diskName + suffix
+}
+
+// waitZoneOperation blocks until a zonal operation is done and returns its
+// warnings and error, if any.
+func waitZoneOperation(ctx context.Context, svc *compute.Service, projectID, zone string, op *compute.Operation) ([]string, error) {
+	for op.Status != "DONE" {
+		var err error
+		// Wait returns when the operation is done or after roughly two minutes
+		op, err = svc.ZoneOperations.Wait(projectID, zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for operation: %w", err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return operationWarnings(op), fmt.Errorf("operation %s: %s", op.Name, op.Error.Errors[0].Message)
+	}
+	return operationWarnings(op), nil
+}
+
+// operationWarnings formats an operation's non-fatal warnings, such as a
+// disk that was left behind.
+func operationWarnings(op *compute.Operation) []string {
+	var warnings []string
+	for _, w := range op.Warnings {
+		warnings = append(warnings, fmt.Sprintf("%s: %s", w.Code, w.Message))
+	}
+	return warnings
+}
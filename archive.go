@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	defaultArchivePrefix        = "spot-notifier/events"
+	defaultArchiveFlushInterval = 5 * time.Minute
+	defaultArchiveMaxBytes      = 256 << 10 // uncompressed
+	// archiveTimeout bounds each upload, the one at shutdown included
+	archiveTimeout = 10 * time.Second
+	// An unreachable bucket shouldn't eat the VM's memory over a long run
+	archiveMaxBuffered = 16 * defaultArchiveMaxBytes
+)
+
+// eventArchive buffers every event as a JSON line and writes the batch to
+// GCS as one gzipped object every interval or once maxBytes have built up,
+// named <prefix>/<instance ID>/<time of first event>-<seq>.jsonl.gz. A
+// failed upload stays buffered for the next flush.
+type eventArchive struct {
+	instanceID string
+	interval   time.Duration
+	maxBytes   int
+	// put writes an object; the GCS one in production
+	put func(ctx context.Context, name string, data []byte) error
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	first time.Time // of the oldest buffered event
+	seq   int
+
+	kick     chan struct{} // the buffer is full
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newGCSEventArchive(ctx context.Context, bucket, prefix, instanceID string, opts ...option.ClientOption) (*eventArchive, error) {
+	opts = append([]option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}, opts...)
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage service: %w", err)
+	}
+	return newEventArchive(instanceID, func(ctx context.Context, name string, data []byte) error {
+		name = prefix + "/" + name
+		obj := &storage.Object{Name: name, ContentType: "application/x-ndjson", ContentEncoding: "gzip"}
+		_, err := svc.Objects.Insert(bucket, obj).IfGenerationMatch(0).Media(bytes.NewReader(data)).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to write gs://%s/%s: %w", bucket, name, err)
+		}
+		return nil
+	}), nil
+}
+
+// newEventArchive returns an archive writing through put. Set interval and
+// maxBytes before start.
+func newEventArchive(instanceID string, put func(ctx context.Context, name string, data []byte) error) *eventArchive {
+	return &eventArchive{
+		instanceID: instanceID,
+		interval:   defaultArchiveFlushInterval,
+		maxBytes:   defaultArchiveMaxBytes,
+		put:        put,
+		kick:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// start runs the flush loop until close.
+func (a *eventArchive) start() {
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.kick:
+			case <-a.stop:
+				a.flush()
+				return
+			}
+			a.flush()
+		}
+	}()
+}
+
+// Notify only buffers the event, so it never holds up the other backends.
+func (a *eventArchive) Notify(ctx context.Context, event Event) error {
+	line, err := json.Marshal(eventPayload(event))
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	a.mu.Lock()
+	if a.buf.Len() == 0 {
+		a.first = event.Time
+	}
+	a.buf.Write(line)
+	a.buf.WriteByte('\n')
+	full := a.buf.Len() >= a.maxBytes
+	a.mu.Unlock()
+
+	if full {
+		select {
+		case a.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// flush uploads whatever is buffered as one object.
+func (a *eventArchive) flush() {
+	a.mu.Lock()
+	if a.buf.Len() == 0 {
+		a.mu.Unlock()
+		return
+	}
+	batch, first := bytes.Clone(a.buf.Bytes()), a.first
+	a.buf.Reset()
+	a.seq++
+	name := fmt.Sprintf("%s/%s-%03d.jsonl.gz", a.instanceID, first.UTC().Format("20060102T150405Z"), a.seq)
+	a.mu.Unlock()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(batch)
+	w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	err := a.put(ctx, name, gz.Bytes())
+	cancel()
+	if err == nil {
+		log.Printf("Archived %d bytes of events to %s", len(batch), name)
+		return
+	}
+
+	log.Printf("Event archive upload failed: %v", err)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(batch)+a.buf.Len() > archiveMaxBuffered {
+		log.Printf("Event archive is over %d bytes, dropping the oldest %d", archiveMaxBuffered, len(batch))
+		return
+	}
+	rest := bytes.Clone(a.buf.Bytes())
+	a.buf.Reset()
+	a.buf.Write(batch)
+	a.buf.Write(rest)
+	a.first = first
+}
+
+// close stops the loop and makes the final flush, waiting up to
+// archiveTimeout for it. It is safe on a nil archive.
+func (a *eventArchive) close() {
+	if a == nil {
+		return
+	}
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+	case <-time.After(archiveTimeout):
+		log.Printf("Final event archive upload timed out")
+	}
+}
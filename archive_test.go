@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventArchiveFlushesBatchesAndOnClose(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = map[string]string{}
+		fail    = true
+	)
+	archive := newEventArchive("123", func(ctx context.Context, name string, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			fail = false
+			return errors.New("bucket unavailable")
+		}
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		text, err := io.ReadAll(r)
+		objects[name] = string(text)
+		return err
+	})
+	archive.interval, archive.maxBytes = time.Hour, 1
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	archive.Notify(context.Background(), Event{Kind: EventLaunched, Time: at})
+	archive.flush() // Fails, the event stays buffered
+	archive.start()
+	archive.Notify(context.Background(), Event{Kind: EventPreempted, Time: at.Add(time.Minute)})
+	archive.close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var all string
+	for name, text := range objects {
+		if !strings.HasPrefix(name, "123/20240101T") || !strings.HasSuffix(name, ".jsonl.gz") {
+			t.Errorf("object name %q", name)
+		}
+		all += text
+	}
+	if strings.Count(all, "\n") != 2 || !strings.Contains(all, `"kind":"launched"`) || !strings.Contains(all, `"kind":"preempted"`) {
+		t.Errorf("archived %d objects:\n%s", len(objects), all)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	defaultAuditPrefix = "spot-notifier/audit"
+	// The record is for later; it must not hold up the VM going away
+	auditTimeout = 3 * time.Second
+)
+
+// auditRecord is the JSON written for each termination.
+type auditRecord struct {
+	Instance         instanceInfo      `json:"instance"`
+	Reason           TerminationReason `json:"reason"`
+	DetectedVia      string            `json:"detectedVia,omitempty"`
+	MaintenanceEvent string            `json:"maintenanceEvent,omitempty"`
+	Outcome          string            `json:"outcome"` // terminated, already-stopping, already-gone, dry-run, interrupted or failed
+	Detail           string            `json:"detail,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	Snapshots        []string          `json:"snapshots,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	Started          time.Time         `json:"started"`
+	Time             time.Time         `json:"time"`
+}
+
+// AuditLog keeps a durable record of every termination.
+type AuditLog interface {
+	Write(ctx context.Context, rec auditRecord) error
+}
+
+// gcsAuditLog writes each record as its own object, named
+// <prefix>/<instance ID>/<timestamp>.json so records list by prefix.
+type gcsAuditLog struct {
+	bucket string
+	prefix string
+	svc    *storage.Service
+}
+
+func newGCSAuditLog(ctx context.Context, bucket, prefix string, opts ...option.ClientOption) (*gcsAuditLog, error) {
+	opts = append([]option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}, opts...)
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage service: %w", err)
+	}
+	return &gcsAuditLog{bucket: bucket, prefix: prefix, svc: svc}, nil
+}
+
+func (a *gcsAuditLog) Write(ctx context.Context, rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	name := fmt.Sprintf("%s/%s/%s.json", a.prefix, rec.Instance.ID, rec.Time.UTC().Format("20060102T150405.000Z"))
+	obj := &storage.Object{Name: name, ContentType: "application/json"}
+	// A generation of 0 means never overwrite an existing record
+	_, err = a.svc.Objects.Insert(a.bucket, obj).IfGenerationMatch(0).Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", a.bucket, name, err)
+	}
+	log.Printf("Audit record written to gs://%s/%s", a.bucket, name)
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestGCSAuditLogWritesRecord(t *testing.T) {
+	fake := &fakeGCS{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	audit, err := newGCSAuditLog(context.Background(), "bkt", defaultAuditPrefix,
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := auditRecord{Instance: instanceInfo{ID: "42"}, Reason: ReasonTTLExpiry, Outcome: "terminated", Time: time.Now()}
+	if err := audit.Write(context.Background(), rec); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var got auditRecord
+	if err := json.Unmarshal(fake.data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reason != ReasonTTLExpiry || got.Outcome != "terminated" || got.Instance.ID != "42" {
+		t.Errorf("stored record = %+v", got)
+	}
+}
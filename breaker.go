@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 10 * time.Minute
+)
+
+// breakerNotifier wraps a backend and stops calling it after threshold
+// consecutive failures, for cooldown. While the breaker is open, events go
+// to the fallback backend if there is one and are dropped otherwise, so a
+// dead endpoint produces one loud error instead of one per notification.
+type breakerNotifier struct {
+	name      string
+	primary   Notifier
+	fallback  Notifier // optional
+	clock     Clock
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breakerNotifier) Notify(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	open := b.clock.Now().Before(b.openUntil)
+	b.mu.Unlock()
+
+	if open {
+		return b.sendFallback(ctx, event)
+	}
+
+	err := b.primary.Notify(ctx, event)
+
+	b.mu.Lock()
+	if err == nil {
+		if b.failures >= b.threshold {
+			log.Printf("%s notifications recovered", b.name)
+		}
+		b.failures = 0
+		b.mu.Unlock()
+		return nil
+	}
+	b.failures++
+	// Past the threshold this is the single probe after a cooldown
+	tripped := b.failures >= b.threshold
+	if tripped {
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+
+	if !tripped {
+		return err
+	}
+	log.Printf("ERROR: %s notifications failed %d times in a row, pausing them for %v: %v", b.name, b.failures, b.cooldown, err)
+	return b.sendFallback(ctx, event)
+}
+
+func (b *breakerNotifier) sendFallback(ctx context.Context, event Event) error {
+	if b.fallback == nil {
+		return nil // Already reported when the breaker opened
+	}
+	return b.fallback.Notify(ctx, event)
+}
+
+const defaultWebhookContentType = "application/json"
+
+// webhookNotifier posts the event as JSON to an arbitrary URL. The body is
+// newline-terminated, so it doubles as a one-line NDJSON document.
+type webhookNotifier struct {
+	url         string
+	contentType string // defaults to application/json
+	gzip        bool   // compress the body and set Content-Encoding
+	// payload, if set, renders the body from the Event instead, for
+	// endpoints that expect their own shape
+	payload *template.Template
+}
+
+// parseWebhookPayload parses WEBHOOK_PAYLOAD_TEMPLATE. Its json function
+// quotes a value, e.g. {"text": {{json .Message}}}.
+func parseWebhookPayload(text string) (*template.Template, error) {
+	t, err := template.New("webhook").Funcs(templateFuncs).Funcs(template.FuncMap{"json": jsonValue}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_PAYLOAD_TEMPLATE: %w", err)
+	}
+	return t, nil
+}
+
+func jsonValue(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event Event) error {
+	jsonData, err := n.body(event)
+	if err != nil {
+		return err
+	}
+	jsonData = append(jsonData, '\n')
+
+	body := jsonData
+	if n.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(jsonData)
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress event: %w", err)
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	contentType := defaultWebhookContentType
+	if eventFormat == formatCloudEvents {
+		contentType = cloudEventsContentType
+	}
+	req.Header.Set("Content-Type", cmp.Or(n.contentType, contentType))
+	if n.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) body(event Event) ([]byte, error) {
+	if n.payload == nil {
+		jsonData, err := json.Marshal(eventPayload(event))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
+		}
+		return jsonData, nil
+	}
+	var buf bytes.Buffer
+	if err := n.payload.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render webhook payload: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("webhook payload for %s is not valid JSON: %s", event.Kind, buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+type failingNotifier struct{ calls int }
+
+func (n *failingNotifier) Notify(context.Context, Event) error {
+	n.calls++
+	return errors.New("endpoint gone")
+}
+
+func TestBreakerRoutesToFallbackAfterSustainedFailure(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	clock := newFakeClock()
+	primary := &failingNotifier{}
+	fallback := &recordingNotifier{}
+	b := &breakerNotifier{name: "test", primary: primary, fallback: fallback, clock: clock, threshold: 2, cooldown: time.Minute}
+
+	ctx := context.Background()
+	if err := b.Notify(ctx, Event{}); err == nil {
+		t.Error("first failure was not reported")
+	}
+	if err := b.Notify(ctx, Event{}); err != nil {
+		t.Errorf("tripping the breaker returned %v, want the fallback result", err)
+	}
+	b.Notify(ctx, Event{})
+
+	if primary.calls != 2 {
+		t.Errorf("primary called %d times while open, want 2", primary.calls)
+	}
+	if len(fallback.events) != 2 {
+		t.Errorf("fallback got %d events, want 2", len(fallback.events))
+	}
+
+	clock.Advance(time.Minute)
+	b.Notify(ctx, Event{})
+	if primary.calls != 3 {
+		t.Errorf("primary not probed after cooldown (%d calls)", primary.calls)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const checkTimeout = 20 * time.Second
+
+// runCheck is the check subcommand: it validates the configuration and
+// checks what the agent needs from the VM, without notifying or touching
+// anything, and writes one line per check to w. It reports whether every
+// check passed, so a startup script can refuse to go on.
+func runCheck(w io.Writer) bool {
+	passed := true
+	report := func(name, detail string, err error) {
+		if err != nil {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", name, err)
+			passed = false
+			return
+		}
+		fmt.Fprintf(w, "ok    %s%s\n", name, detail)
+	}
+
+	report("spot-notifier-config attribute", "", initMetadata())
+	if val := os.Getenv("TERMINATE_AFTER_HOURS"); val != "" {
+		ttl, err := parseTTL("TERMINATE_AFTER_HOURS", val)
+		report("TERMINATE_AFTER_HOURS", ": "+formatDuration(ttl), err)
+	}
+	terminator := newComputeTerminator()
+	if spec := os.Getenv("TERMINATE_ACTION"); spec != "" {
+		steps, err := parseTerminationSteps(spec)
+		if err == nil {
+			terminator.steps = steps
+		}
+		report("TERMINATE_ACTION", ": "+strings.Join(steps, ", then "), err)
+	}
+	_, err := loadLiveConfig()
+	report("live settings", "", err)
+	_, err = loadTemplates()
+	report("message templates", "", err)
+
+	meta, errs := readMetadata([]string{
+		"instance/id", "instance/name", "instance/zone", "project/project-id",
+		"instance/scheduling/preemptible", "instance/scheduling/provisioning-model",
+	}, defaultMetadataPrefetch)
+	for _, key := range []string{"instance/id", "instance/name", "instance/zone", "project/project-id"} {
+		if err := errs[key]; err != nil {
+			if isNotOnGCP(err) {
+				err = fmt.Errorf("%w (not on a GCP VM? MOCK_METADATA=true mocks it)", err)
+			}
+			report("metadata server", "", err)
+			return false
+		}
+	}
+	name, zone, projectID := meta["instance/name"], path.Base(meta["instance/zone"]), meta["project/project-id"]
+	report("metadata server", fmt.Sprintf(": instance %s in %s, project %s", name, zone, projectID), nil)
+
+	switch model := classifyProvisioning(meta["instance/scheduling/preemptible"], meta["instance/scheduling/provisioning-model"]); model {
+	case ProvisioningStandard:
+		report("provisioning model", ": "+model+", only the TTL applies", nil)
+	case "":
+		report("provisioning model", ": Spot or preemptible", nil)
+	default:
+		report("provisioning model", ": "+model, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	store, err := newStateStore(ctx, meta["instance/id"])
+	if err == nil {
+		_, err = store.Load(ctx)
+	}
+	report("state store", "", err)
+
+	switch {
+	case mockMetadataFile != "":
+		report("termination permission", ": skipped with MOCK_METADATA", nil)
+	case os.Getenv("TERMINATION_CONTROLLER_URL") != "":
+		report("termination permission", ": delegated to TERMINATION_CONTROLLER_URL", nil)
+	default:
+		allowed, missing, err := terminator.canTerminate(ctx, projectID, zone, name)
+		if err == nil && !allowed {
+			err = fmt.Errorf("missing %s", strings.TrimSpace(missing))
+		}
+		report("termination permission", "", err)
+	}
+	return passed
+}
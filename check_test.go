@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckReportsEachProblem(t *testing.T) {
+	t.Setenv("MOCK_METADATA", "true")
+	t.Setenv("STATE_STORE", "memory")
+	t.Cleanup(func() { mockMetadataFile = "" })
+
+	var out strings.Builder
+	if !runCheck(&out) {
+		t.Errorf("check failed on a good configuration:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "ok    metadata server: instance mock-instance in us-central1-a") {
+		t.Errorf("check output lacks the instance:\n%s", out.String())
+	}
+
+	t.Setenv("TERMINATE_AFTER_HOURS", "soon")
+	t.Setenv("TERMINATE_ACTION", "explode")
+	out.Reset()
+	if runCheck(&out) {
+		t.Errorf("check passed with a bad TTL and action:\n%s", out.String())
+	}
+	for _, want := range []string{"FAIL  TERMINATE_AFTER_HOURS", "FAIL  TERMINATE_ACTION", "ok    message templates"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("check output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
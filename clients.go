@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	metadataTimeout      = 2 * time.Second
+	defaultNotifyTimeout = 10 * time.Second
+)
+
+// metadataClient is shared by every metadata read. The server is link-local,
+// so it never goes through a proxy and a couple of idle connections suffice.
+var metadataClient = &http.Client{
+	Timeout: metadataTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        2,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// notifyClient is shared by every outgoing notification. Unlike the
+// metadata client it honours HTTP(S)_PROXY and allows slower endpoints.
+var notifyClient = newNotifyClient(defaultNotifyTimeout, nil)
+
+// newNotifyClient builds the notification client. roots, if non-nil,
+// replaces the system trust store for TLS verification.
+func newNotifyClient(timeout time.Duration, roots *x509.CertPool) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          10,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       &tls.Config{RootCAs: roots},
+			TLSHandshakeTimeout:   5 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// loadCertPool returns the system trust store plus the PEM certificates in
+// path, for endpoints signed by a private CA.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
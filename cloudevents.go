@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// EVENT_FORMAT values. Native is the Event struct as is.
+const (
+	formatNative      = "native"
+	formatCloudEvents = "cloudevents"
+)
+
+// cloudEventsContentType is the structured-mode media type, used for the
+// webhook body and the Pub/Sub content-type attribute.
+const cloudEventsContentType = "application/cloudevents+json"
+
+// eventFormat is how the JSON backends (Pub/Sub, stdout, the event socket
+// and the fallback webhook) encode events. main sets it from EVENT_FORMAT.
+var eventFormat = formatNative
+
+// cloudEvent is a CloudEvents 1.0 envelope in structured mode.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	Source          string    `json:"source"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Event     `json:"data"`
+}
+
+// eventPayload returns what to encode for the event in eventFormat.
+func eventPayload(event Event) any {
+	if eventFormat != formatCloudEvents {
+		return event
+	}
+	inst := event.Instance
+	return cloudEvent{
+		SpecVersion: "1.0",
+		// Retries of the same event keep its time, so consumers can dedupe on it
+		ID:              fmt.Sprintf("%s/%s/%d", inst.ID, event.Kind, event.Time.UnixNano()),
+		Type:            "com.gcp.spot." + string(event.Kind),
+		Source:          fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/instances/%s", inst.Project, inst.Zone, inst.Name),
+		Subject:         inst.Name,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data:            event,
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configAttribute holds a JSON object of settings, keyed by the same names
+// as the environment variables, e.g. {"TERMINATE_AFTER_HOURS": "12"}.
+const configAttribute = "instance/attributes/spot-notifier-config"
+
+// metadataConfigKeys are the variables loadMetadataConfig set, which a
+// reload may overwrite. Everything else came from the real environment.
+var metadataConfigKeys = map[string]bool{}
+
+// loadMetadataConfig applies settings from the spot-notifier-config
+// attribute. The value may be plain or base64-encoded JSON. Variables that
+// are already set in the environment win, so a container can still override
+// what the VM was launched with. Calling it again replaces the settings it
+// applied before; if the attribute can't be read, they are left alone.
+func loadMetadataConfig() error {
+	raw, err := getMetadata(configAttribute)
+	if err != nil {
+		// Either the attribute isn't set or there's no metadata server, in
+		// which case startup fails with a clearer error right after this
+		return nil
+	}
+
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "{") {
+		decoded, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return fmt.Errorf("spot-notifier-config is neither JSON nor base64: %w", err)
+		}
+		raw = string(decoded)
+	}
+
+	settings := map[string]any{}
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return fmt.Errorf("failed to parse spot-notifier-config: %w", err)
+	}
+
+	for key := range metadataConfigKeys {
+		os.Unsetenv(key)
+	}
+	clear(metadataConfigKeys)
+
+	applied := 0
+	for key, value := range settings {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		metadataConfigKeys[key] = true
+		// Accept numbers and booleans as well as strings
+		if err := os.Setenv(key, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", key, err)
+		}
+		applied++
+	}
+	log.Printf("Applied %d of %d settings from spot-notifier-config", applied, len(settings))
+	return nil
+}
+
+// secretSetting matches the settings whose values are kept out of logs and
+// notifications: URLs can embed tokens, and keys and headers are credentials.
+var secretSetting = regexp.MustCompile(`URL|KEY|TOKEN|SECRET|PASSWORD|HEADERS|ROUTES|HOOK$`)
+
+// resolvedConfig lists every setting that isn't left at its default as
+// "KEY=value (source)", sorted, with secret values redacted.
+func resolvedConfig() []string {
+	var lines []string
+	for _, key := range slices.Concat(liveSettings, restartSettings) {
+		val, set := os.LookupEnv(key)
+		if !set {
+			continue
+		}
+		source := "env"
+		if metadataConfigKeys[key] {
+			source = "spot-notifier-config"
+		}
+		if secretSetting.MatchString(key) && val != "" {
+			val = "<redacted>"
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s (%s)", key, val, source))
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// logResolvedConfig logs resolvedConfig, so it is clear which source won.
+func logResolvedConfig() {
+	lines := resolvedConfig()
+	log.Printf("Effective configuration, %d settings set, everything else at its default:", len(lines))
+	for _, line := range lines {
+		log.Printf("  %s", line)
+	}
+}
+
+// groupConfig is the optional deletion of sibling instances on TTL.
+type groupConfig struct {
+	label         string // TERMINATE_GROUP_LABEL; empty turns it off
+	zones         string // TERMINATE_GROUP_ZONES, see resolveGroupZones
+	concurrency   int
+	confirmWindow time.Duration
+}
+
+// loadGroupConfig reads TERMINATE_GROUP_LABEL and the settings that go with it.
+func loadGroupConfig() (groupConfig, error) {
+	c := groupConfig{
+		label:       os.Getenv("TERMINATE_GROUP_LABEL"),
+		zones:       os.Getenv("TERMINATE_GROUP_ZONES"),
+		concurrency: defaultGroupConcurrency,
+	}
+	var err error
+	if val := os.Getenv("TERMINATE_CONCURRENCY"); val != "" {
+		if c.concurrency, err = strconv.Atoi(val); err != nil || c.concurrency < 1 {
+			return c, fmt.Errorf("invalid TERMINATE_CONCURRENCY: %q", val)
+		}
+	}
+	if val := os.Getenv("TERMINATE_GROUP_CONFIRM_WINDOW"); val != "" {
+		if c.confirmWindow, err = time.ParseDuration(val); err != nil {
+			return c, fmt.Errorf("invalid TERMINATE_GROUP_CONFIRM_WINDOW: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// actionConfig is how this VM is taken down once its time is up.
+type actionConfig struct {
+	steps           []string // TERMINATE_ACTION; nil to follow the instance's instanceTerminationAction
+	snapshotFirst   bool     // SNAPSHOT_BEFORE_DELETE
+	snapshotTimeout time.Duration
+	snapshotOnTTL   bool // SNAPSHOT_DISKS_ON_TTL
+}
+
+// loadActionConfig reads TERMINATE_ACTION and the SNAPSHOT_* settings.
+func loadActionConfig() (actionConfig, error) {
+	c := actionConfig{
+		snapshotFirst: os.Getenv("SNAPSHOT_BEFORE_DELETE") == "true",
+		snapshotOnTTL: os.Getenv("SNAPSHOT_DISKS_ON_TTL") == "true",
+	}
+	var err error
+	if spec := os.Getenv("TERMINATE_ACTION"); spec != "" {
+		if c.steps, err = parseTerminationSteps(spec); err != nil {
+			return c, fmt.Errorf("invalid TERMINATE_ACTION: %w", err)
+		}
+	}
+	if val := os.Getenv("SNAPSHOT_TIMEOUT"); val != "" {
+		if c.snapshotTimeout, err = time.ParseDuration(val); err != nil || c.snapshotTimeout < minSnapshotTime {
+			return c, fmt.Errorf("invalid SNAPSHOT_TIMEOUT: %q (want at least %v)", val, minSnapshotTime)
+		}
+	}
+	return c, nil
+}
+
+// loadPrimaryNotifier builds the backend NOTIFIER_TYPE picks. slack is the
+// breaker guarding the relay, which loadLiveConfig fills in.
+func loadPrimaryNotifier(slack *breakerNotifier) (Notifier, error) {
+	switch kind := cmp.Or(os.Getenv("NOTIFIER_TYPE"), "slack"); kind {
+	case "slack":
+		return newTimedNotifier("slack", slack)
+	case "webhook", "discord":
+		url := os.Getenv("NOTIFIER_URL")
+		if url == "" {
+			return nil, fmt.Errorf("NOTIFIER_TYPE=%s needs NOTIFIER_URL", kind)
+		}
+		var n Notifier = &discordNotifier{url: url}
+		if kind == "webhook" {
+			webhook := &webhookNotifier{url: url, contentType: os.Getenv("WEBHOOK_CONTENT_TYPE"), gzip: os.Getenv("WEBHOOK_GZIP") == "true"}
+			if text := os.Getenv("WEBHOOK_PAYLOAD_TEMPLATE"); text != "" {
+				var err error
+				if webhook.payload, err = parseWebhookPayload(text); err != nil {
+					return nil, err
+				}
+			}
+			n = webhook
+		}
+		return newTimedNotifier(kind, n)
+	case "stdout":
+		return &stdoutNotifier{out: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("invalid NOTIFIER_TYPE: %q (want slack, webhook, discord or stdout)", kind)
+	}
+}
+
+// computeEndpoint returns COMPUTE_ENDPOINT for a VM in zone, or "" for the
+// client's default. "{region}" in it stands for the zone's region, so one
+// regional endpoint can be written once for the whole fleet.
+func computeEndpoint(zone string) (string, error) {
+	val := os.Getenv("COMPUTE_ENDPOINT")
+	if val == "" {
+		return "", nil
+	}
+	endpoint := strings.ReplaceAll(val, "{region}", regionOf(zone))
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("invalid COMPUTE_ENDPOINT: %q", val)
+	}
+	return endpoint, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResolvedConfigShowsSourceAndRedactsSecrets(t *testing.T) {
+	t.Setenv("CHECK_INTERVAL", "10s")
+	t.Setenv("OPSGENIE_API_KEY", "hunter2")
+	t.Setenv("TERMINATE_AFTER_HOURS", "12")
+	metadataConfigKeys["TERMINATE_AFTER_HOURS"] = true
+	t.Cleanup(func() { clear(metadataConfigKeys) })
+
+	got := resolvedConfig()
+	for _, want := range []string{
+		"CHECK_INTERVAL=10s (env)",
+		"OPSGENIE_API_KEY=<redacted> (env)",
+		"TERMINATE_AFTER_HOURS=12 (spot-notifier-config)",
+	} {
+		if !slices.Contains(got, want) {
+			t.Errorf("resolvedConfig() = %q, missing %q", got, want)
+		}
+	}
+}
+
+func TestLoadGroupConfig(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want groupConfig
+		ok   bool
+	}{
+		{nil, groupConfig{concurrency: defaultGroupConcurrency}, true},
+		{
+			map[string]string{"TERMINATE_GROUP_LABEL": "job", "TERMINATE_GROUP_ZONES": "auto", "TERMINATE_CONCURRENCY": "4", "TERMINATE_GROUP_CONFIRM_WINDOW": "2m"},
+			groupConfig{label: "job", zones: "auto", concurrency: 4, confirmWindow: 2 * time.Minute}, true,
+		},
+		{map[string]string{"TERMINATE_CONCURRENCY": "0"}, groupConfig{}, false},
+		{map[string]string{"TERMINATE_CONCURRENCY": "many"}, groupConfig{}, false},
+		{map[string]string{"TERMINATE_GROUP_CONFIRM_WINDOW": "a while"}, groupConfig{}, false},
+	} {
+		for _, key := range []string{"TERMINATE_GROUP_LABEL", "TERMINATE_GROUP_ZONES", "TERMINATE_CONCURRENCY", "TERMINATE_GROUP_CONFIRM_WINDOW"} {
+			t.Setenv(key, tc.env[key])
+		}
+		got, err := loadGroupConfig()
+		if (err == nil) != tc.ok || tc.ok && got != tc.want {
+			t.Errorf("loadGroupConfig() with %v = %+v, %v; want %+v, ok %v", tc.env, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLoadActionConfig(t *testing.T) {
+	t.Setenv("TERMINATE_ACTION", "snapshot, stop")
+	t.Setenv("SNAPSHOT_TIMEOUT", "10m")
+	t.Setenv("SNAPSHOT_BEFORE_DELETE", "true")
+	t.Setenv("SNAPSHOT_DISKS_ON_TTL", "true")
+	c, err := loadActionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.steps, []string{"snapshot", "stop"}) || c.snapshotTimeout != 10*time.Minute || !c.snapshotFirst || !c.snapshotOnTTL {
+		t.Errorf("loadActionConfig() = %+v", c)
+	}
+
+	for key, val := range map[string]string{
+		"TERMINATE_ACTION": "shred",
+		"SNAPSHOT_TIMEOUT": "1s", // too short for any snapshot
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, val)
+			if _, err := loadActionConfig(); err == nil {
+				t.Errorf("loadActionConfig() accepted %s=%s", key, val)
+			}
+		})
+	}
+}
+
+func TestLoadActionConfigDefaultsToInstanceAction(t *testing.T) {
+	for _, key := range []string{"TERMINATE_ACTION", "SNAPSHOT_TIMEOUT", "SNAPSHOT_BEFORE_DELETE", "SNAPSHOT_DISKS_ON_TTL"} {
+		t.Setenv(key, "")
+	}
+	c, err := loadActionConfig()
+	if err != nil || c.steps != nil || c.snapshotTimeout != 0 || c.snapshotFirst || c.snapshotOnTTL {
+		t.Errorf("loadActionConfig() = %+v, %v, want no steps of its own", c, err)
+	}
+}
+
+func TestLoadPrimaryNotifier(t *testing.T) {
+	slack := &breakerNotifier{name: "Slack"}
+	for _, tc := range []struct {
+		kind, url string
+		want      string // the backend's type, inside its timedNotifier if timed
+		timed     bool
+	}{
+		{"", "", "*main.breakerNotifier", true},
+		{"webhook", "https://hook", "*main.webhookNotifier", true},
+		{"discord", "https://hook", "*main.discordNotifier", true},
+		{"stdout", "", "*main.stdoutNotifier", false},
+	} {
+		t.Setenv("NOTIFIER_TYPE", tc.kind)
+		t.Setenv("NOTIFIER_URL", tc.url)
+		n, err := loadPrimaryNotifier(slack)
+		if err != nil {
+			t.Errorf("NOTIFIER_TYPE=%q: %v", tc.kind, err)
+			continue
+		}
+		timed, ok := n.(*timedNotifier)
+		if ok {
+			n = timed.Notifier
+		}
+		if got := fmt.Sprintf("%T", n); got != tc.want || ok != tc.timed {
+			t.Errorf("NOTIFIER_TYPE=%q: backend = %s, timed %v; want %s, timed %v", tc.kind, got, ok, tc.want, tc.timed)
+		}
+	}
+
+	for kind, url := range map[string]string{"webhook": "", "discord": "", "pager": "https://hook"} {
+		t.Setenv("NOTIFIER_TYPE", kind)
+		t.Setenv("NOTIFIER_URL", url)
+		if _, err := loadPrimaryNotifier(slack); err == nil {
+			t.Errorf("NOTIFIER_TYPE=%s NOTIFIER_URL=%q: loadPrimaryNotifier() succeeded", kind, url)
+		}
+	}
+}
+
+func TestComputeEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		val, want string
+		ok        bool
+	}{
+		{"", "", true},
+		{"https://compute.example.com/", "https://compute.example.com/", true},
+		{"https://{region}-compute.example.com/", "https://us-central1-compute.example.com/", true},
+		{"compute.example.com", "", false},
+		{"ftp://compute.example.com/", "", false},
+		{"https://", "", false},
+	} {
+		t.Setenv("COMPUTE_ENDPOINT", tc.val)
+		got, err := computeEndpoint("us-central1-a")
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("COMPUTE_ENDPOINT=%q: computeEndpoint() = %q, %v; want %q, ok %v", tc.val, got, err, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlTimeout bounds how long a command waits for the monitoring loop,
+// which stops taking them once termination is under way.
+const controlTimeout = 5 * time.Second
+
+// controlCommand is a request to the control endpoint, applied by the
+// monitoring loop between polls so it never races with it.
+type controlCommand struct {
+	action string        // extend, cancel or status
+	by     time.Duration // for extend
+	reply  chan controlReply
+}
+
+// controlReply is what the control endpoint answers, whatever the command.
+type controlReply struct {
+	Message             string   `json:"message"`
+	TerminateAfterHours float64  `json:"terminateAfterHours"` // 0 for no TTL
+	UptimeSeconds       float64  `json:"uptimeSeconds"`
+	TimeLeftSeconds     *float64 `json:"timeLeftSeconds,omitempty"`
+	err                 error
+}
+
+// controlServer serves the control endpoint on CONTROL_ADDR, a host:port
+// or the path of a Unix socket. Anyone who can reach it can postpone the
+// TTL, so it is off unless asked for, and a socket is for its owner only.
+type controlServer struct {
+	srv      *http.Server
+	commands chan controlCommand
+}
+
+// controlListen listens on a Unix socket for addresses that are paths, and
+// over TCP otherwise.
+func controlListen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by an earlier run would fail the bind
+	if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict %s to its owner: %w", addr, err)
+	}
+	return ln, nil
+}
+
+func startControlServer(addr string) (*controlServer, error) {
+	ln, err := controlListen(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		log.Printf("WARNING: control endpoint %s is reachable from outside the VM", tcp)
+	}
+	c := &controlServer{commands: make(chan controlCommand)}
+	c.srv = &http.Server{Handler: c.handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := c.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control endpoint failed: %v", err)
+		}
+	}()
+	return c, nil
+}
+
+func (c *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		c.run(w, r, controlCommand{action: "status"})
+	})
+	mux.HandleFunc("POST /extend", func(w http.ResponseWriter, r *http.Request) {
+		by, err := time.ParseDuration(r.FormValue("by"))
+		if err != nil || by <= 0 {
+			http.Error(w, fmt.Sprintf("invalid by: %q (want a positive duration, e.g. 4h)", r.FormValue("by")), http.StatusBadRequest)
+			return
+		}
+		c.run(w, r, controlCommand{action: "extend", by: by})
+	})
+	mux.HandleFunc("POST /cancel", func(w http.ResponseWriter, r *http.Request) {
+		c.run(w, r, controlCommand{action: "cancel"})
+	})
+	return mux
+}
+
+// run hands cmd to the monitoring loop and writes its reply.
+func (c *controlServer) run(w http.ResponseWriter, r *http.Request, cmd controlCommand) {
+	ctx, cancel := context.WithTimeout(r.Context(), controlTimeout)
+	defer cancel()
+	cmd.reply = make(chan controlReply, 1)
+	select {
+	case c.commands <- cmd:
+	case <-ctx.Done():
+		http.Error(w, "the monitor is not taking commands, termination may be under way", http.StatusServiceUnavailable)
+		return
+	}
+	reply := <-cmd.reply
+	if reply.err != nil {
+		http.Error(w, reply.err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (c *controlServer) close() {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+	defer cancel()
+	if err := c.srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the control endpoint: %v", err)
+	}
+}
+
+// runControlCommand is the ctl subcommand: it sends args (status, extend
+// <duration> or cancel) to the control endpoint of the notifier running on
+// this VM and prints the reply.
+func runControlCommand(addr string, args []string) error {
+	if addr == "" {
+		return fmt.Errorf("CONTROL_ADDR is not set, set it to the running notifier's")
+	}
+	client, base := &http.Client{Timeout: 2 * controlTimeout}, "http://"+addr
+	if strings.HasPrefix(addr, "/") {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+			},
+		}
+		base = "http://control"
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		resp, err = client.Get(base + "/status")
+	case len(args) == 2 && args[0] == "extend":
+		resp, err = client.PostForm(base+"/extend", url.Values{"by": {args[1]}})
+	case len(args) == 1 && args[0] == "cancel":
+		resp, err = client.PostForm(base+"/cancel", nil)
+	default:
+		return fmt.Errorf("usage: spot-notifier ctl status | extend <duration> | cancel")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach the control endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	var reply controlReply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return fmt.Errorf("failed to decode reply: %w", err)
+	}
+	fmt.Println(reply.Message)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlExtendPostponesTTL(t *testing.T) {
+	m, clock, term, rec := newTestMonitor(t)
+	start := clock.Now()
+	store := &memoryStore{}
+	m.State = &savedState{store: store}
+	// Buffered, so the loop itself can queue the command it then picks up
+	control := make(chan controlCommand, 1)
+	m.Control = control
+	cmd := controlCommand{action: "extend", by: 2 * time.Hour, reply: make(chan controlReply, 1)}
+	m.Watchdog = func() {
+		if clock.Since(start) == 10*time.Minute {
+			control <- cmd
+		}
+	}
+
+	m.Run()
+
+	var reply controlReply
+	select {
+	case reply = <-cmd.reply:
+	default:
+		t.Fatal("the extend command was never answered")
+	}
+	if reply.err != nil || reply.TerminateAfterHours != 3 || !strings.Contains(reply.Message, "to 3h") {
+		t.Errorf("extend reply = %+v", reply)
+	}
+	if len(term.calls) != 1 || term.calls[0].Sub(start) < 3*time.Hour {
+		t.Errorf("terminated at %v, want after the extended TTL of 3h", term.calls)
+	}
+	if m.Data.TerminateAfter != 3*time.Hour {
+		t.Errorf("messages say the TTL is %v, want 3h", m.Data.TerminateAfter)
+	}
+	if saved, _ := store.Load(context.Background()); saved.TerminateAfter == nil || *saved.TerminateAfter != 3*time.Hour {
+		t.Errorf("saved TTL = %v, want 3h for a restart", saved.TerminateAfter)
+	}
+	var changed int
+	for _, e := range rec.events {
+		if e.Kind == EventTTLChanged {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("got %d %s events, want 1", changed, EventTTLChanged)
+	}
+}
+
+func TestControlCancelAndStatus(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	m.Data.Started = clock.Now().Add(-30 * time.Minute)
+	run := func(action string) controlReply {
+		cmd := controlCommand{action: action, reply: make(chan controlReply, 1)}
+		m.control(cmd)
+		return <-cmd.reply
+	}
+
+	if r := run("status"); r.TimeLeftSeconds == nil || *r.TimeLeftSeconds != 1800 {
+		t.Errorf("status = %+v, want 30m left", r)
+	}
+	m.Lifecycle = &lifecycle{clock: clock, send: func(transitionEvent) {}}
+	m.Lifecycle.enter(StateApproachingTTL, ReasonNone)
+	if r := run("cancel"); r.err != nil || m.TerminateAfter != 0 || r.TimeLeftSeconds != nil {
+		t.Errorf("cancel = %+v, TTL now %v", r, m.TerminateAfter)
+	}
+	if state := m.Lifecycle.current(); state != StateMonitoring {
+		t.Errorf("state after cancel = %s, want %s", state, StateMonitoring)
+	}
+	if r := run("cancel"); r.err == nil {
+		t.Error("cancelling without a TTL succeeded")
+	}
+
+	// Only the approaching-TTL state is left behind
+	m.TerminateAfter = time.Hour
+	m.Lifecycle.enter(StateGracePeriod, ReasonManual)
+	run("cancel")
+	if state := m.Lifecycle.current(); state != StateGracePeriod {
+		t.Errorf("state after cancel = %s, want %s left alone", state, StateGracePeriod)
+	}
+}
+
+func TestControlServerValidatesExtend(t *testing.T) {
+	c := &controlServer{commands: make(chan controlCommand)}
+	srv := httptest.NewServer(c.handler())
+	t.Cleanup(srv.Close)
+	go func() {
+		for cmd := range c.commands {
+			cmd.reply <- controlReply{Message: cmd.action + " " + cmd.by.String()}
+		}
+	}()
+	t.Cleanup(func() { close(c.commands) })
+
+	for by, want := range map[string]int{"4h": http.StatusOK, "soon": http.StatusBadRequest, "-1h": http.StatusBadRequest} {
+		resp, err := http.PostForm(srv.URL+"/extend", url.Values{"by": {by}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("extend by %s: status %d, want %d", by, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const controllerTimeout = 30 * time.Second
+
+var controllerClient = &http.Client{Timeout: controllerTimeout}
+
+// controllerTerminator asks a central controller to terminate the VM
+// instead of calling the Compute API, so VMs don't need delete permission.
+// Each request carries the VM's identity token with the controller URL as
+// audience, which the controller can verify to know who is asking.
+type controllerTerminator struct {
+	url string
+}
+
+// terminationRequest is the body POSTed to the controller.
+type terminationRequest struct {
+	Project  string `json:"project"`
+	Zone     string `json:"zone"`
+	Instance string `json:"instance"`
+}
+
+// Terminate succeeds once the controller acknowledges the request with a
+// 2xx status. A 409 means the instance is already being terminated.
+func (c *controllerTerminator) Terminate(ctx context.Context, projectID, zone, instanceName string) (TerminationResult, error) {
+	body, err := json.Marshal(terminationRequest{Project: projectID, Zone: zone, Instance: instanceName})
+	if err != nil {
+		return ResultTerminated, fmt.Errorf("failed to marshal termination request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return ResultTerminated, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token, err := getMetadata("instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(c.url)); err != nil {
+		log.Printf("Sending termination request without an identity token: %v", err)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	log.Printf("Asking controller to terminate instance %s in %s", instanceName, zone)
+	resp, err := controllerClient.Do(req)
+	if err != nil {
+		return ResultTerminated, fmt.Errorf("controller POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		log.Printf("Controller reports instance %s is already terminating", instanceName)
+		return ResultAlreadyStopping, nil
+	case resp.StatusCode >= 300:
+		return ResultTerminated, fmt.Errorf("controller returned non-2xx status: %d", resp.StatusCode)
+	}
+	log.Printf("Controller acknowledged termination of instance %s", instanceName)
+	return ResultTerminated, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// correlationAttribute lets whatever launched the VM hand the notifier the
+// ID its own records use.
+const correlationAttribute = "instance/attributes/correlation-id"
+
+// resolveCorrelationID returns the ID for CORRELATION_ID: the setting
+// itself, or "auto" for the correlation-id attribute and a random ID
+// without one. Unset, only the attribute turns it on.
+func resolveCorrelationID(setting string) string {
+	if setting != "" && setting != "auto" {
+		return setting
+	}
+	if id, err := getMetadata(correlationAttribute); err == nil && strings.TrimSpace(id) != "" {
+		return strings.TrimSpace(id)
+	}
+	if setting == "" {
+		return ""
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
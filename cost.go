@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/cloudbilling/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	costLookupTimeout = 15 * time.Second
+	// computeEngineService is the Compute Engine service in the Billing Catalog
+	computeEngineService = "services/6F81-5844-456A"
+)
+
+// fallbackSpotPrices are rough us-central1 Spot prices in USD per vCPU hour
+// and per GB of memory hour, for when the Billing Catalog can't be read.
+// Spot prices move and differ by region, so these only give a ballpark.
+var fallbackSpotPrices = map[string][2]float64{
+	"e2":  {0.00654, 0.00088},
+	"n1":  {0.00698, 0.00094},
+	"n2":  {0.00774, 0.00104},
+	"n2d": {0.00675, 0.00091},
+	"t2d": {0.00670, 0.00090},
+	"c2":  {0.00838, 0.00112},
+	"c2d": {0.00710, 0.00096},
+	"c3":  {0.00765, 0.00103},
+}
+
+// machineShape is what a machine type is billed on.
+type machineShape struct {
+	family string  // e.g. n2
+	cpus   float64 // vCPUs billed, a fraction for shared-core types
+	memory float64 // GB
+}
+
+// memoryPerCPU is the GB per vCPU of the predefined classes, by family
+// where it differs from the usual.
+var memoryPerCPU = map[string]float64{
+	"standard": 4, "highmem": 8, "highcpu": 1,
+	"n1-standard": 3.75, "n1-highmem": 6.5, "n1-highcpu": 0.9,
+	"c2-standard": 4, "c2d-highmem": 8,
+}
+
+// sharedCoreShapes are billed on a fraction of their vCPUs.
+var sharedCoreShapes = map[string]machineShape{
+	"e2-micro":  {"e2", 0.25, 1},
+	"e2-small":  {"e2", 0.5, 2},
+	"e2-medium": {"e2", 1, 4},
+	"f1-micro":  {"n1", 0.2, 0.6},
+	"g1-small":  {"n1", 0.5, 1.7},
+}
+
+// parseMachineShape works out the shape of a shared-core, predefined or
+// custom machine type from its name, e.g. n2-standard-8 or
+// n2-custom-4-16384. Odd types, like the GPU ones, aren't understood.
+func parseMachineShape(machineType string) (machineShape, bool) {
+	if shape, ok := sharedCoreShapes[machineType]; ok {
+		return shape, true
+	}
+	parts := strings.Split(machineType, "-")
+	// N1 custom types have no family prefix
+	if parts[0] == "custom" {
+		parts = append([]string{"n1"}, parts...)
+	}
+	if len(parts) < 3 {
+		return machineShape{}, false
+	}
+	cpus, err := strconv.Atoi(parts[2])
+	if err != nil || cpus <= 0 {
+		return machineShape{}, false
+	}
+	shape := machineShape{family: parts[0], cpus: float64(cpus)}
+	if parts[1] == "custom" && len(parts) >= 4 {
+		mb, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return machineShape{}, false
+		}
+		shape.memory = float64(mb) / 1024
+		return shape, true
+	}
+	ratio, ok := memoryPerCPU[parts[0]+"-"+parts[1]]
+	if !ok {
+		if ratio, ok = memoryPerCPU[parts[1]]; !ok {
+			return machineShape{}, false
+		}
+	}
+	shape.memory = ratio * shape.cpus
+	return shape, true
+}
+
+// hourlyCost prices shape at the given per vCPU and per GB hour prices.
+func hourlyCost(cpuPrice, memPrice float64, shape machineShape) float64 {
+	return cpuPrice*shape.cpus + memPrice*shape.memory
+}
+
+// estimateHourlyCost prices shape in region from the Billing Catalog, and
+// from fallbackSpotPrices if that fails. It returns 0 when neither knows
+// the family, and says which source it used.
+func estimateHourlyCost(ctx context.Context, shape machineShape, region string, opts ...option.ClientOption) (cost float64, source string, err error) {
+	cpu, mem, err := catalogSpotPrices(ctx, shape.family, region, opts...)
+	if err == nil {
+		return hourlyCost(cpu, mem, shape), "Billing Catalog", nil
+	}
+	if prices, ok := fallbackSpotPrices[shape.family]; ok {
+		return hourlyCost(prices[0], prices[1], shape), "approximate list price", err
+	}
+	return 0, "", err
+}
+
+// catalogSpotPrices looks up the Spot price per vCPU hour and per GB hour
+// of family in region, in USD, from the Compute Engine SKUs.
+func catalogSpotPrices(ctx context.Context, family, region string, opts ...option.ClientOption) (cpu, mem float64, err error) {
+	svc, err := cloudbilling.NewService(ctx, opts...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create billing service: %w", err)
+	}
+	// SKU descriptions read like "Spot Preemptible N2 Instance Core
+	// running in Americas"; the family sits between spaces, so N2 doesn't
+	// match N2D
+	name := " " + strings.ToUpper(family) + " "
+	err = svc.Services.Skus.List(computeEngineService).CurrencyCode("USD").Pages(ctx, func(resp *cloudbilling.ListSkusResponse) error {
+		for _, sku := range resp.Skus {
+			if sku.Category == nil || sku.Category.UsageType != "Preemptible" || !strings.Contains(sku.Description, name) ||
+				strings.Contains(sku.Description, "Custom") || strings.Contains(sku.Description, "Sole Tenancy") || !slices.Contains(sku.ServiceRegions, region) {
+				continue
+			}
+			price, ok := unitPrice(sku)
+			if !ok {
+				continue
+			}
+			switch {
+			case strings.Contains(sku.Description, "Instance Core") && cpu == 0:
+				cpu = price
+			case strings.Contains(sku.Description, "Instance Ram") && mem == 0:
+				mem = price
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list Compute Engine SKUs: %w", err)
+	}
+	if cpu == 0 || mem == 0 {
+		return 0, 0, fmt.Errorf("no Spot %s prices in %s in the Billing Catalog", family, region)
+	}
+	return cpu, mem, nil
+}
+
+// unitPrice is the SKU's current price per unit, from its last tier.
+func unitPrice(sku *cloudbilling.Sku) (float64, bool) {
+	if len(sku.PricingInfo) == 0 || sku.PricingInfo[0].PricingExpression == nil {
+		return 0, false
+	}
+	rates := sku.PricingInfo[0].PricingExpression.TieredRates
+	if len(rates) == 0 || rates[len(rates)-1].UnitPrice == nil {
+		return 0, false
+	}
+	money := rates[len(rates)-1].UnitPrice
+	return float64(money.Units) + float64(money.Nanos)/1e9, true
+}
+
+// formatUSD formats an amount of dollars, with more precision for the
+// small hourly prices.
+func formatUSD(v float64) string {
+	if v < 1 {
+		return fmt.Sprintf("$%.3f", v)
+	}
+	return fmt.Sprintf("$%.2f", v)
+}
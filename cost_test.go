@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/cloudbilling/v1"
+	"google.golang.org/api/option"
+)
+
+func TestParseMachineShape(t *testing.T) {
+	for _, tc := range []struct {
+		machineType string
+		want        machineShape
+		ok          bool
+	}{
+		{"n2-standard-8", machineShape{"n2", 8, 32}, true},
+		{"n1-standard-4", machineShape{"n1", 4, 15}, true},
+		{"e2-highcpu-16", machineShape{"e2", 16, 16}, true},
+		{"n2-custom-4-16384", machineShape{"n2", 4, 16}, true},
+		{"custom-2-7680", machineShape{"n1", 2, 7.5}, true},
+		{"e2-small", machineShape{"e2", 0.5, 2}, true},
+		{"a2-ultragpu-1g", machineShape{}, false},
+	} {
+		got, ok := parseMachineShape(tc.machineType)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("parseMachineShape(%q) = %+v, %v; want %+v, %v", tc.machineType, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestEstimateHourlyCostFromCatalog(t *testing.T) {
+	sku := func(desc, usage, region string, nanos int64) *cloudbilling.Sku {
+		return &cloudbilling.Sku{
+			Description:    desc,
+			Category:       &cloudbilling.Category{UsageType: usage},
+			ServiceRegions: []string{region},
+			PricingInfo: []*cloudbilling.PricingInfo{{PricingExpression: &cloudbilling.PricingExpression{
+				TieredRates: []*cloudbilling.TierRate{{UnitPrice: &cloudbilling.Money{CurrencyCode: "USD", Nanos: nanos}}},
+			}}},
+		}
+	}
+	skus := []*cloudbilling.Sku{
+		sku("N2 Instance Core running in Americas", "OnDemand", "us-central1", 31611000),
+		sku("Spot Preemptible N2D AMD Instance Core running in Americas", "Preemptible", "us-central1", 5000000),
+		sku("Spot Preemptible N2 Instance Core running in Frankfurt", "Preemptible", "europe-west3", 9000000),
+		sku("Spot Preemptible N2 Instance Core running in Americas", "Preemptible", "us-central1", 8000000),
+		sku("Spot Preemptible N2 Instance Ram running in Americas", "Preemptible", "us-central1", 1000000),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/"+computeEngineService+"/skus" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(cloudbilling.ListSkusResponse{Skus: skus})
+	}))
+	defer srv.Close()
+	opts := []option.ClientOption{option.WithEndpoint(srv.URL), option.WithoutAuthentication()}
+
+	cost, source, err := estimateHourlyCost(context.Background(), machineShape{"n2", 4, 16}, "us-central1", opts...)
+	if err != nil || source != "Billing Catalog" || math.Abs(cost-(4*0.008+16*0.001)) > 1e-9 {
+		t.Errorf("estimate = %v (%s), %v; want $0.048/h from the Billing Catalog", cost, source, err)
+	}
+
+	// Nothing for the region in the catalog: the table still gives a figure
+	cost, source, err = estimateHourlyCost(context.Background(), machineShape{"n2", 4, 16}, "asia-south2", opts...)
+	if err == nil || source != "approximate list price" || cost == 0 {
+		t.Errorf("estimate = %v (%s), %v; want the fallback price and the catalog error", cost, source, err)
+	}
+	if cost, _, err := estimateHourlyCost(context.Background(), machineShape{"z9", 4, 16}, "asia-south2", opts...); err == nil || cost != 0 {
+		t.Errorf("estimate for an unknown family = %v, %v; want no price", cost, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	defaultPreemptionWindow = time.Hour
+	defaultCounterObject    = "spot-notifier/preemptions.json"
+	// defaultFamilyThreshold flags a machine type and zone on its second
+	// preemption in the window; FAMILY_PREEMPTION_THRESHOLD=0 turns it off
+	defaultFamilyThreshold = 2
+	// defaultCapacityCheckInterval is how often the counter is read for
+	// capacity pressure; CAPACITY_CHECK_INTERVAL=0 turns it off
+	defaultCapacityCheckInterval = 5 * time.Minute
+	counterUpdateAttempts        = 5
+	// Preemption leaves ~30s; the count is context, not worth the deadline
+	counterTimeout = 3 * time.Second
+)
+
+// PreemptionCounter is shared by every notifier in a project, so an alert
+// can say whether one preemption is part of a wider capacity reclamation.
+type PreemptionCounter interface {
+	// Record adds a preemption of a VM in family at t and returns how many
+	// were recorded in the window ending at t, including this one: across
+	// the project, and for that family alone.
+	Record(ctx context.Context, t time.Time, window time.Duration, family string) (project, inFamily int, err error)
+}
+
+// preemptionReader is a PreemptionCounter that can report the counts
+// without adding a preemption, for the capacity pressure check.
+type preemptionReader interface {
+	Recent(ctx context.Context, t time.Time, window time.Duration, family string) (project, inFamily int, err error)
+}
+
+// gcsCounter keeps recent preemption times in one GCS object, updated with
+// generation preconditions so concurrent VMs don't lose each other's writes.
+type gcsCounter struct {
+	bucket string
+	object string
+	svc    *storage.Service
+}
+
+func newGCSCounter(ctx context.Context, bucket, object string, opts ...option.ClientOption) (*gcsCounter, error) {
+	opts = append([]option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}, opts...)
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage service: %w", err)
+	}
+	return &gcsCounter{bucket: bucket, object: object, svc: svc}, nil
+}
+
+// counterState is the JSON stored in the object.
+type counterState struct {
+	Preemptions []time.Time `json:"preemptions"`
+	// Families holds the same times keyed by machine type and zone
+	Families map[string][]time.Time `json:"families,omitempty"`
+}
+
+// instanceFamily is what the counter groups preemptions by: a machine type
+// in one zone, the unit that capacity is reclaimed in.
+func instanceFamily(inst instanceInfo) string {
+	return inst.MachineType + "/" + inst.Zone
+}
+
+func (c *gcsCounter) Record(ctx context.Context, t time.Time, window time.Duration, family string) (int, int, error) {
+	for attempt := 1; ; attempt++ {
+		state, generation, err := c.read(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Drop what has aged out, then count what's left
+		cutoff := t.Add(-window)
+		expired := func(p time.Time) bool { return p.Before(cutoff) }
+		state.Preemptions = slices.DeleteFunc(append(state.Preemptions, t), expired)
+		if state.Families == nil {
+			state.Families = map[string][]time.Time{}
+		}
+		state.Families[family] = append(state.Families[family], t)
+		for f, times := range state.Families {
+			if times = slices.DeleteFunc(times, expired); len(times) == 0 {
+				delete(state.Families, f)
+			} else {
+				state.Families[f] = times
+			}
+		}
+
+		err = c.write(ctx, state, generation)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed && attempt < counterUpdateAttempts {
+			continue // Another VM updated it first
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return len(state.Preemptions), len(state.Families[family]), nil
+	}
+}
+
+// Recent counts the preemptions recorded in the window ending at t.
+func (c *gcsCounter) Recent(ctx context.Context, t time.Time, window time.Duration, family string) (int, int, error) {
+	state, _, err := c.read(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := t.Add(-window)
+	recent := func(times []time.Time) int {
+		n := 0
+		for _, p := range times {
+			if !p.Before(cutoff) {
+				n++
+			}
+		}
+		return n
+	}
+	return recent(state.Preemptions), recent(state.Families[family]), nil
+}
+
+// read returns the stored state and its generation, 0 if it doesn't exist.
+func (c *gcsCounter) read(ctx context.Context) (counterState, int64, error) {
+	var state counterState
+	resp, err := c.svc.Objects.Get(c.bucket, c.object).Context(ctx).Download()
+	if isNotFound(err) {
+		return state, 0, nil
+	}
+	if err != nil {
+		return state, 0, fmt.Errorf("failed to read gs://%s/%s: %w", c.bucket, c.object, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return state, 0, fmt.Errorf("failed to read gs://%s/%s: %w", c.bucket, c.object, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		// Start over rather than fail every alert on a corrupt object
+		state = counterState{}
+	}
+	generation, _ := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+	return state, generation, nil
+}
+
+// write stores state if the object is still at generation (0: absent).
+func (c *gcsCounter) write(ctx context.Context, state counterState, generation int64) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal counter: %w", err)
+	}
+	obj := &storage.Object{Name: c.object, ContentType: "application/json"}
+	_, err = c.svc.Objects.Insert(c.bucket, obj).IfGenerationMatch(generation).Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", c.bucket, c.object, err)
+	}
+	return nil
+}
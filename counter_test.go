@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// fakeGCS serves one object with generations, and can make the next write
+// lose a race to simulate another VM updating the counter first.
+type fakeGCS struct {
+	mu         sync.Mutex
+	data       []byte
+	generation int64
+	raceOnce   bool
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == http.MethodGet {
+		if f.generation == 0 {
+			http.Error(w, `{"error":{"code":404}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(f.generation, 10))
+		w.Write(f.data)
+		return
+	}
+
+	if f.raceOnce {
+		f.raceOnce = false
+		f.generation++
+		f.data = []byte(`{"preemptions":["` + time.Now().UTC().Format(time.RFC3339) + `"]}`)
+	}
+	if want, _ := strconv.ParseInt(r.URL.Query().Get("ifGenerationMatch"), 10, 64); want != f.generation {
+		http.Error(w, `{"error":{"code":412}}`, http.StatusPreconditionFailed)
+		return
+	}
+
+	// Multipart upload: the object metadata, then the media
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	mr.NextPart()
+	part, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.data, _ = io.ReadAll(part)
+	f.generation++
+	w.Write([]byte(`{}`))
+}
+
+func TestGCSCounterRetriesLostRace(t *testing.T) {
+	fake := &fakeGCS{raceOnce: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	counter, err := newGCSCounter(context.Background(), "bkt", "obj",
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, inFamily, err := counter.Record(context.Background(), time.Now(), time.Hour, "e2-small/us-central1-a")
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if n != 2 || inFamily != 1 {
+		t.Errorf("count = %d (%d in family), want 2 (the racing write plus ours) and 1", n, inFamily)
+	}
+
+	// Outside the window, older entries no longer count
+	if n, inFamily, _ := counter.Record(context.Background(), time.Now().Add(2*time.Hour), time.Hour, "e2-small/us-central1-a"); n != 1 || inFamily != 1 {
+		t.Errorf("count after window = %d (%d in family), want 1", n, inFamily)
+	}
+}
+
+func TestGCSCounterCountsByFamily(t *testing.T) {
+	srv := httptest.NewServer(&fakeGCS{})
+	defer srv.Close()
+
+	counter, err := newGCSCounter(context.Background(), "bkt", "obj",
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, family := range []string{"e2-small/us-central1-a", "n2-standard-4/us-central1-a", "e2-small/us-central1-a"} {
+		if _, _, err := counter.Record(context.Background(), now, time.Hour, family); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	n, inFamily, _ := counter.Record(context.Background(), now, time.Hour, "e2-small/us-central1-a")
+	if n != 4 || inFamily != 3 {
+		t.Errorf("count = %d (%d in family), want 4 and 3", n, inFamily)
+	}
+}
+
+func TestGCSCounterRecentDoesNotRecord(t *testing.T) {
+	fake := &fakeGCS{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	counter, err := newGCSCounter(context.Background(), "bkt", "obj",
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	counter.Record(context.Background(), now.Add(-2*time.Hour), time.Hour, "e2-small/us-central1-a")
+	counter.Record(context.Background(), now, time.Hour, "e2-small/us-central1-a")
+	counter.Record(context.Background(), now, time.Hour, "n2-standard-4/us-central1-a")
+	generation := fake.generation
+
+	n, inFamily, err := counter.Recent(context.Background(), now, time.Hour, "e2-small/us-central1-a")
+	if err != nil || n != 2 || inFamily != 1 {
+		t.Errorf("Recent = %d, %d, %v; want 2, 1", n, inFamily, err)
+	}
+	if fake.generation != generation {
+		t.Error("Recent wrote to the counter")
+	}
+}
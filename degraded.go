@@ -0,0 +1,62 @@
+package main
+
+import "time"
+
+const (
+	defaultFailureRateWindow = 10 * time.Minute
+	// Fewer polls than this in the window say too little about the rate
+	failureRateMinSamples = 5
+)
+
+// failureRate is the share of failed metadata polls over a sliding window.
+// It trips once the rate goes over threshold and clears once it is down to
+// half of it, so a rate hovering around the threshold doesn't flap.
+type failureRate struct {
+	window    time.Duration
+	threshold float64 // 0-1
+
+	polls   []ratePoll // oldest first
+	tripped bool
+}
+
+type ratePoll struct {
+	at     time.Time
+	failed bool
+}
+
+// record adds a poll and reports whether that tripped or cleared the alarm.
+func (r *failureRate) record(now time.Time, failed bool) (changed bool) {
+	r.polls = append(r.polls, ratePoll{at: now, failed: failed})
+	cutoff := now.Add(-r.window)
+	drop := 0
+	for drop < len(r.polls) && !r.polls[drop].at.After(cutoff) {
+		drop++
+	}
+	r.polls = r.polls[drop:]
+
+	rate, n := r.rate()
+	switch {
+	case !r.tripped && n >= failureRateMinSamples && rate > r.threshold:
+		r.tripped = true
+		return true
+	case r.tripped && rate <= r.threshold/2:
+		r.tripped = false
+		return true
+	}
+	return false
+}
+
+// rate returns the failure rate over the window, and how many polls it
+// covers.
+func (r *failureRate) rate() (float64, int) {
+	if len(r.polls) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, p := range r.polls {
+		if p.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(r.polls)), len(r.polls)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// exitHookTimeout bounds the final webhook; nothing waits on us after it.
+const exitHookTimeout = 5 * time.Second
+
+// exitEvent is the body posted to EXIT_WEBHOOK_URL.
+type exitEvent struct {
+	Kind     string       `json:"kind"` // always "process-exiting"
+	Instance instanceInfo `json:"instance"`
+	// Reason is a TerminationReason, "signal" for a plain shutdown or
+	// "crash" for a panic, "max-lifetime" for MAX_PROCESS_LIFETIME
+	Reason string    `json:"reason"`
+	Uptime float64   `json:"uptimeSeconds"`
+	Time   time.Time `json:"time"`
+}
+
+// exitHook posts one exitEvent when the process exits, whatever the cause,
+// so tooling knows the notifier is gone even when the event notifications
+// were skipped or failed. log.Fatalf bypasses it: those are startup errors.
+type exitHook struct {
+	url      string // "" disables the hook
+	started  time.Time
+	instance instanceInfo
+	reason   string
+	once     sync.Once
+}
+
+// fire sends the event, once. It is meant to be the first deferred call in
+// main, so it runs last.
+func (h *exitHook) fire() {
+	if h.url == "" {
+		return
+	}
+	h.once.Do(h.send)
+}
+
+func (h *exitHook) send() {
+	event := exitEvent{
+		Kind:     "process-exiting",
+		Instance: h.instance,
+		Reason:   h.reason,
+		Uptime:   time.Since(h.started).Seconds(),
+		Time:     time.Now(),
+	}
+	log.Printf("Process exiting, reason=%s", h.reason)
+	if err := h.post(event); err != nil {
+		log.Printf("Exit webhook failed: %v", err)
+	}
+}
+
+func (h *exitHook) post(event exitEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exit event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exitHookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("exit webhook POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("exit webhook returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExitHookPostsReason(t *testing.T) {
+	var got exitEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	h := &exitHook{url: srv.URL, started: time.Now().Add(-time.Minute), instance: instanceInfo{Name: "vm"}, reason: "crash"}
+	h.fire()
+
+	if got.Kind != "process-exiting" || got.Reason != "crash" || got.Instance.Name != "vm" || got.Uptime < 60 {
+		t.Errorf("exit event = %+v", got)
+	}
+}
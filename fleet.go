@@ -0,0 +1,327 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	defaultFleetPollInterval = time.Minute
+	defaultFleetTTLLabel     = "terminate-after-hours"
+	fleetPollTimeout         = 2 * time.Minute
+	// preemptedOperation is the system operation GCP logs for a preemption
+	preemptedOperation = "compute.instances.preempted"
+)
+
+// fleetWatcher watches, from outside, every Spot or preemptible instance of
+// a project that matches filter, through the Compute API rather than each
+// VM's metadata server. It announces instances as they start, reports
+// preemptions from the system operations GCP logs for them, and enforces a
+// TTL taken from each instance's ttlLabel. Instances without the label are
+// only watched for preemption.
+type fleetWatcher struct {
+	clock        Clock
+	project      string
+	filter       string // a Compute API list filter, "" for every instance
+	ttlLabel     string
+	warnFraction float64
+	grace        time.Duration
+	interval     time.Duration
+	templates    messageTemplates
+	notifier     *dispatcher
+	terminator   *computeTerminator // deletes, whatever TERMINATE_ACTION says
+
+	polled    bool // the first poll adopts what is already running quietly
+	opsSince  time.Time
+	instances map[uint64]*fleetInstance
+}
+
+// fleetInstance is what the watcher knows about one instance.
+type fleetInstance struct {
+	data      messageData // Instance, Started and TerminateAfter are kept current
+	status    string
+	preempted bool      // reported, until the instance starts again
+	warned    bool      // TTL warning sent
+	deleteAt  time.Time // when the grace period after the TTL runs out
+	failed    bool      // termination failure reported
+	deleted   bool
+}
+
+// loadFleetWatcher reads the FLEET_* settings, along with the TTL warning,
+// grace period and Compute API settings the agent uses too.
+func loadFleetWatcher(clock Clock, notifier *dispatcher, live liveConfig, grace time.Duration) (*fleetWatcher, error) {
+	f := &fleetWatcher{
+		clock:        clock,
+		project:      os.Getenv("FLEET_PROJECT"),
+		filter:       os.Getenv("FLEET_FILTER"),
+		ttlLabel:     cmp.Or(os.Getenv("FLEET_TTL_LABEL"), defaultFleetTTLLabel),
+		warnFraction: live.warnFraction,
+		grace:        grace,
+		interval:     defaultFleetPollInterval,
+		notifier:     notifier,
+		instances:    map[uint64]*fleetInstance{},
+	}
+	if f.project == "" {
+		// Running on GCE, watch the project the watcher itself is in
+		project, err := getMetadata("project/project-id")
+		if err != nil {
+			return nil, fmt.Errorf("--mode=fleet needs FLEET_PROJECT off GCE: %w", err)
+		}
+		f.project = strings.TrimSpace(project)
+	}
+	if val := os.Getenv("FLEET_POLL_INTERVAL"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid FLEET_POLL_INTERVAL: %q", val)
+		}
+		f.interval = d
+	}
+
+	var opts []option.ClientOption
+	if val := os.Getenv("COMPUTE_ENDPOINT"); val != "" {
+		// A fleet spans regions, so there is no one region to fill in
+		if u, err := url.Parse(val); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Contains(val, "{region}") {
+			return nil, fmt.Errorf("invalid COMPUTE_ENDPOINT for --mode=fleet: %q", val)
+		}
+		opts = append(opts, option.WithEndpoint(val))
+	}
+	f.terminator = newComputeTerminator(opts...)
+	if val := os.Getenv("COMPUTE_MIN_CALL_INTERVAL"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid COMPUTE_MIN_CALL_INTERVAL: %q", val)
+		}
+		f.terminator.minCallInterval = d
+	}
+
+	var err error
+	if f.templates, err = loadTemplates(); err != nil {
+		return nil, fmt.Errorf("failed to load message templates: %w", err)
+	}
+	return f, nil
+}
+
+// run polls every interval until SIGTERM or SIGINT.
+func (f *fleetWatcher) run() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	matching := ""
+	if f.filter != "" {
+		matching = " matching " + f.filter
+	}
+	log.Printf("Watching Spot instances in project %s%s every %v, TTLs from their %s label", f.project, matching, f.interval, f.ttlLabel)
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, fleetPollTimeout)
+		if err := f.poll(pollCtx); err != nil && ctx.Err() == nil {
+			log.Printf("Fleet poll failed: %v", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping the fleet watcher")
+			return
+		case <-f.clock.After(f.interval):
+		}
+	}
+}
+
+// poll lists the watched instances and the preemptions since the last
+// poll, and acts on what changed.
+func (f *fleetWatcher) poll(ctx context.Context) error {
+	svc, err := f.terminator.service(ctx)
+	if err != nil {
+		return err
+	}
+	now := f.clock.Now()
+	if !f.polled {
+		f.opsSince = now
+	}
+
+	// Preemptions first: a VM whose instance termination action is DELETE
+	// may already be gone from the list
+	preempted, err := f.preemptions(ctx, svc)
+	if err != nil {
+		return err
+	}
+	for _, id := range preempted {
+		if w, ok := f.instances[id]; ok && !w.preempted {
+			w.preempted = true
+			log.Printf("Instance %s in %s was preempted", w.data.Instance.Name, w.data.Instance.Zone)
+			f.notify(w, ReasonPreemption, EventPreempted, msgPreempt)
+		}
+	}
+
+	seen := map[uint64]bool{}
+	err = svc.Instances.AggregatedList(f.project).Filter(f.filter).Context(ctx).Pages(ctx, func(page *compute.InstanceAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, inst := range scoped.Instances {
+				if inst.Scheduling == nil || !(inst.Scheduling.Preemptible || inst.Scheduling.ProvisioningModel == ProvisioningSpot) {
+					continue
+				}
+				seen[inst.Id] = true
+				f.observe(ctx, inst, now)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", explainScope(err))
+	}
+	for id, w := range f.instances {
+		if !seen[id] {
+			log.Printf("Instance %s in %s is gone", w.data.Instance.Name, w.data.Instance.Zone)
+			delete(f.instances, id)
+		}
+	}
+	if !f.polled {
+		log.Printf("Watching %d Spot instances", len(f.instances))
+		f.polled = true
+	}
+	return nil
+}
+
+// preemptions returns the instances GCP preempted since the last call.
+func (f *fleetWatcher) preemptions(ctx context.Context, svc *compute.Service) ([]uint64, error) {
+	var ids []uint64
+	latest := f.opsSince
+	err := svc.GlobalOperations.AggregatedList(f.project).Filter(fmt.Sprintf("operationType=%q", preemptedOperation)).Context(ctx).Pages(ctx, func(page *compute.OperationAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, op := range scoped.Operations {
+				at, err := time.Parse(time.RFC3339, op.InsertTime)
+				if err != nil || !at.After(f.opsSince) {
+					continue
+				}
+				ids = append(ids, op.TargetId)
+				if at.After(latest) {
+					latest = at
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list preemptions: %w", explainScope(err))
+	}
+	f.opsSince = latest
+	return ids, nil
+}
+
+// observe updates what is known about inst, announcing it once it starts
+// and enforcing its TTL while it runs.
+func (f *fleetWatcher) observe(ctx context.Context, inst *compute.Instance, now time.Time) {
+	w, known := f.instances[inst.Id]
+	started, err := time.Parse(time.RFC3339, cmp.Or(inst.LastStartTimestamp, inst.CreationTimestamp))
+	switch {
+	case err != nil && known:
+		started = w.data.Started
+	case err != nil:
+		started = now
+	}
+	info := instanceInfo{
+		Name:        inst.Name,
+		ID:          strconv.FormatUint(inst.Id, 10),
+		Zone:        path.Base(inst.Zone),
+		MachineType: path.Base(inst.MachineType),
+		Project:     f.project,
+		Labels:      inst.Labels,
+	}
+	var ttl time.Duration
+	if val, ok := inst.Labels[f.ttlLabel]; ok {
+		// Label values can't hold a dot, so 1_5 stands for 1.5
+		if ttl, err = parseTTL(f.ttlLabel+" label", strings.ReplaceAll(val, "_", ".")); err != nil {
+			log.Printf("Ignoring TTL of instance %s: %v", inst.Name, err)
+		}
+	}
+
+	if !known || !w.data.Started.Equal(started) {
+		// New, or started again since, say, a preemption stopped it
+		w = &fleetInstance{data: messageData{CanTerminate: true, GracePeriod: f.grace, PollInterval: f.interval}}
+		f.instances[inst.Id] = w
+	}
+	w.data.Instance, w.data.Started, w.data.TerminateAfter = info, started, ttl
+	w.data.ProvisioningModel = ProvisioningSpot
+	if inst.Scheduling.ProvisioningModel != ProvisioningSpot {
+		w.data.ProvisioningModel = ProvisioningPreemptible
+	}
+	wasRunning := w.status == "RUNNING"
+	w.status = inst.Status
+	if w.status != "RUNNING" {
+		return
+	}
+	if !wasRunning && f.polled {
+		log.Printf("Instance %s in %s started", inst.Name, info.Zone)
+		f.notify(w, ReasonNone, EventLaunched, msgLaunch)
+	}
+	f.enforceTTL(ctx, w, now)
+}
+
+// enforceTTL warns as the TTL nears, then terminates the instance once the
+// grace period after it has passed, in steps across polls.
+func (f *fleetWatcher) enforceTTL(ctx context.Context, w *fleetInstance, now time.Time) {
+	ttl := w.data.TerminateAfter
+	if ttl <= 0 || w.deleted {
+		return
+	}
+	uptime := now.Sub(w.data.Started)
+	name, zone := w.data.Instance.Name, w.data.Instance.Zone
+	if !w.warned && f.warnFraction > 0 && uptime >= time.Duration(f.warnFraction*float64(ttl)) && uptime < ttl {
+		w.warned = true
+		w.data.TimeLeft = ttl - uptime
+		f.notify(w, ReasonNone, EventTTLWarning, msgWarn)
+	}
+	if uptime < ttl {
+		return
+	}
+	if w.deleteAt.IsZero() {
+		log.Printf("Instance %s in %s crossed its TTL of %v. Stopping in %v", name, zone, ttl, f.grace)
+		w.deleteAt = now.Add(f.grace)
+		f.notify(w, ReasonTTLExpiry, EventTTLExpired, msgTerminate)
+	}
+	if now.Before(w.deleteAt) {
+		return
+	}
+
+	w.data.GraceElapsed = now.Sub(w.deleteAt.Add(-f.grace))
+	result, err := f.terminator.Terminate(ctx, f.project, zone, name)
+	if err != nil {
+		log.Printf("Failed to terminate instance %s in %s: %v", name, zone, err)
+		if !w.failed {
+			w.failed = true
+			f.notifier.notifyAbout(w.data.Instance, ReasonTTLExpiry, EventTerminationFailed, fmt.Sprintf("❌ Failed to terminate instance `%s` in `%s` after its TTL: %v. Retrying every %s",
+				name, zone, err, formatDuration(f.interval)))
+		}
+		return
+	}
+	w.deleted = true
+	switch result {
+	case ResultDryRun:
+		f.notifier.notifyAbout(w.data.Instance, ReasonTTLExpiry, EventDryRun, fmt.Sprintf("🧪 Dry run: would delete instance `%s` in `%s` now, left it running", name, zone))
+	case ResultAlreadyGone, ResultAlreadyStopping:
+		log.Printf("Instance %s in %s is already going away", name, zone)
+	default:
+		f.notify(w, ReasonTTLExpiry, EventTerminating, msgExecute)
+	}
+}
+
+func (f *fleetWatcher) notify(w *fleetInstance, reason TerminationReason, kind EventKind, name string) {
+	data := w.data
+	data.Reason = reason
+	if reason == ReasonPreemption {
+		data.DetectedVia = "Compute API operations"
+	}
+	f.notifier.notifyAbout(w.data.Instance, reason, kind, f.templates.render(name, data.at(f.clock.Now())))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// fakeFleetCompute serves instances and preemption operations for the
+// aggregated list calls, and records deletes.
+type fakeFleetCompute struct {
+	mu         sync.Mutex
+	instances  []map[string]any
+	operations []map[string]any
+	filters    []string
+	deleted    []string
+}
+
+func (f *fakeFleetCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/aggregated/instances"):
+		f.filters = append(f.filters, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(map[string]any{"items": map[string]any{"zones/z": map[string]any{"instances": f.instances}}})
+	case strings.HasSuffix(r.URL.Path, "/aggregated/operations"):
+		json.NewEncoder(w).Encode(map[string]any{"items": map[string]any{"zones/z": map[string]any{"operations": f.operations}}})
+	case r.Method == http.MethodDelete:
+		f.deleted = append(f.deleted, r.URL.Path)
+		w.Write([]byte(`{"name":"op","status":"DONE"}`))
+	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/instances/"):
+		w.Write([]byte(`{"status":"RUNNING"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func fleetVM(id int, name, status string, started time.Time, labels map[string]string) map[string]any {
+	return map[string]any{
+		"id": fmt.Sprint(id), "name": name, "zone": "projects/p/zones/z", "machineType": "zones/z/machineTypes/n2-standard-4",
+		"status": status, "lastStartTimestamp": started.Format(time.RFC3339), "labels": labels,
+		"scheduling": map[string]any{"provisioningModel": "SPOT"},
+	}
+}
+
+func newTestFleet(t *testing.T) (*fleetWatcher, *fakeClock, *fakeFleetCompute, *recordingNotifier) {
+	t.Helper()
+	_, clock, _, rec := newTestMonitor(t)
+	fake := &fakeFleetCompute{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.backoff, term.minCallInterval = 0, 0
+	f := &fleetWatcher{
+		clock: clock, project: "p", filter: `labels.team = "ml"`, ttlLabel: defaultFleetTTLLabel, warnFraction: 0.5,
+		grace: 10 * time.Minute, interval: time.Minute, templates: templates,
+		notifier: &dispatcher{clock: clock, backends: []Notifier{rec}}, terminator: term,
+		instances: map[uint64]*fleetInstance{},
+	}
+	return f, clock, fake, rec
+}
+
+func TestFleetEnforcesLabelTTL(t *testing.T) {
+	f, clock, fake, rec := newTestFleet(t)
+	start := clock.Now()
+	fake.instances = []map[string]any{
+		fleetVM(1, "worker", "RUNNING", start, map[string]string{"terminate-after-hours": "1"}),
+		fleetVM(2, "no-ttl", "RUNNING", start, nil),
+	}
+
+	for clock.Since(start) <= 80*time.Minute {
+		if err := f.poll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		clock.Sleep(time.Minute)
+	}
+
+	var kinds []EventKind
+	for _, e := range rec.events {
+		if e.Instance.Name != "worker" {
+			t.Errorf("%s event about %s, which has no TTL", e.Kind, e.Instance.Name)
+		}
+		kinds = append(kinds, e.Kind)
+	}
+	want := []EventKind{EventTTLWarning, EventTTLExpired, EventTerminating}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v (nothing for instances already running at startup)", kinds, want)
+	}
+	if len(fake.deleted) != 1 || !strings.HasSuffix(fake.deleted[0], "/zones/z/instances/worker") {
+		t.Errorf("deleted %v, want worker once", fake.deleted)
+	}
+	if fake.filters[0] != `labels.team = "ml"` {
+		t.Errorf("listed with filter %q", fake.filters[0])
+	}
+}
+
+func TestFleetReportsPreemptionsAndRestarts(t *testing.T) {
+	f, clock, fake, rec := newTestFleet(t)
+	start := clock.Now()
+	fake.instances = []map[string]any{fleetVM(1, "worker", "RUNNING", start, nil)}
+	poll := func() {
+		t.Helper()
+		clock.Sleep(time.Minute)
+		if err := f.poll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll()
+
+	fake.operations = []map[string]any{{"operationType": preemptedOperation, "targetId": "1", "insertTime": clock.Now().Add(30 * time.Second).Format(time.RFC3339)}}
+	fake.instances = []map[string]any{fleetVM(1, "worker", "TERMINATED", start, nil)}
+	poll()
+	poll() // the same operation is not reported twice
+
+	fake.instances = []map[string]any{fleetVM(1, "worker", "RUNNING", clock.Now(), nil)}
+	poll()
+
+	var kinds []EventKind
+	for _, e := range rec.events {
+		kinds = append(kinds, e.Kind)
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint([]EventKind{EventPreempted, EventLaunched}) {
+		t.Errorf("events = %v, want the preemption then the restart", kinds)
+	}
+	if len(rec.events) > 0 && (rec.events[0].Reason != ReasonPreemption || !strings.Contains(rec.events[0].Message, "`worker` (`n2-standard-4`)")) {
+		t.Errorf("preemption event = %+v", rec.events[0])
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// groupMember identifies one instance that shares the group label.
+type groupMember struct {
+	Zone string
+	Name string
+}
+
+// groupFilter turns a "key=value" label selector into a Compute list filter.
+func groupFilter(label string) (string, error) {
+	key, value, ok := strings.Cut(label, "=")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || key == "" || value == "" {
+		return "", fmt.Errorf("group label %q must be in key=value form", label)
+	}
+	return fmt.Sprintf("labels.%s = %q", key, value), nil
+}
+
+// regionOf returns the region a zone belongs to ("us-central1-a" -> "us-central1").
+func regionOf(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// resolveGroupZones expands TERMINATE_GROUP_ZONES into a list of zones.
+// Empty means only our own zone, "auto" means every zone in our region.
+func resolveGroupZones(ctx context.Context, svc *compute.Service, projectID, ownZone, spec string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return []string{ownZone}, nil
+	case "auto":
+		region, err := svc.Regions.Get(projectID, regionOf(ownZone)).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region %s: %w", regionOf(ownZone), err)
+		}
+		zones := make([]string, 0, len(region.Zones))
+		for _, z := range region.Zones {
+			zones = append(zones, path.Base(z)) // Zones are full URLs
+		}
+		return zones, nil
+	}
+
+	var zones []string
+	for _, z := range strings.Split(spec, ",") {
+		if z = strings.TrimSpace(z); z != "" {
+			zones = append(zones, z)
+		}
+	}
+	return zones, nil
+}
+
+// listGroup lists the labelled instances in every zone concurrently and
+// returns the aggregated result once all zones have answered.
+func listGroup(ctx context.Context, svc *compute.Service, projectID string, zones []string, filter string) ([]groupMember, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		members []groupMember
+		errs    []error
+	)
+
+	for _, zone := range zones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			var found []groupMember
+			err := svc.Instances.List(projectID, zone).Filter(filter).Pages(ctx, func(list *compute.InstanceList) error {
+				for _, inst := range list.Items {
+					found = append(found, groupMember{Zone: zone, Name: inst.Name})
+				}
+				return nil
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list instances in %s: %w", zone, err))
+				return
+			}
+			members = append(members, found...)
+		}(zone)
+	}
+	wg.Wait()
+
+	return members, errors.Join(errs...)
+}
+
+// defaultGroupConcurrency bounds concurrent sibling deletions so a large
+// group doesn't trip Compute API rate limits.
+const defaultGroupConcurrency = 4
+
+// groupResult counts how sibling termination went, with the outcome for
+// each sibling sorted by zone and name. DryRun means the terminator only
+// logged the deletes; those siblings count as neither deleted nor failed.
+type groupResult struct {
+	Deleted int
+	Failed  int
+	DryRun  bool
+	Members []memberResult
+}
+
+// memberResult is how deleting one sibling went; Err is nil on success.
+type memberResult struct {
+	groupMember
+	Err error
+}
+
+func (r groupResult) String() string {
+	return fmt.Sprintf("%d of %d siblings terminated, %d failed", r.Deleted, r.Deleted+r.Failed, r.Failed)
+}
+
+// findGroup lists every sibling carrying the group label, leaving out
+// ourselves so the caller can delete this VM last.
+func findGroup(ctx context.Context, t *computeTerminator, projectID, ownZone, ownName, label, zoneSpec string) ([]groupMember, error) {
+	filter, err := groupFilter(label)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := t.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := resolveGroupZones(ctx, svc, projectID, ownZone, zoneSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := listGroup(ctx, svc, projectID, zones, filter)
+	if err != nil {
+		// Refuse to delete a partial view of the group
+		return nil, err
+	}
+	siblings := members[:0]
+	for _, m := range members {
+		if m.Zone != ownZone || m.Name != ownName {
+			siblings = append(siblings, m)
+		}
+	}
+	return siblings, nil
+}
+
+// terminateGroup deletes the siblings found by findGroup. At most
+// concurrency deletions run at once. Siblings that fail to delete are
+// logged and reported but don't stop the rest. Whatever steps t runs on
+// this VM, siblings are only deleted.
+func terminateGroup(ctx context.Context, t *computeTerminator, projectID string, members []groupMember, concurrency int) (groupResult, error) {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result groupResult
+		errs   []error
+		sem    = make(chan struct{}, max(concurrency, 1))
+	)
+	for _, m := range members {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m groupMember) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			log.Printf("Deleting group member %s in %s", m.Name, m.Zone)
+			res, err := siblingTerminator(t).Terminate(ctx, projectID, m.Zone, m.Name)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Members = append(result.Members, memberResult{m, err})
+			switch {
+			case err != nil:
+				result.Failed++
+				errs = append(errs, fmt.Errorf("%s/%s: %w", m.Zone, m.Name, err))
+			case res == ResultDryRun:
+				result.DryRun = true
+			default:
+				result.Deleted++
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	slices.SortFunc(result.Members, func(a, b memberResult) int {
+		return cmp.Or(strings.Compare(a.Zone, b.Zone), strings.Compare(a.Name, b.Name))
+	})
+	return result, errors.Join(errs...)
+}
+
+// siblingTerminator returns a copy of t that only deletes, sharing its
+// client. Each sibling gets its own so their operation warnings don't
+// race, nor end up reported as this VM's.
+func siblingTerminator(t *computeTerminator) *computeTerminator {
+	c := *t
+	c.steps, c.self, c.warnings = []string{"delete"}, instanceInfo{}, nil
+	return &c
+}
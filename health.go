@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthFailures = 3
+	defaultHealthDuration = 5 * time.Minute
+	healthTimeout         = 2 * time.Second
+)
+
+// healthClient talks to a workload on the VM itself, so skip any proxy.
+var healthClient = &http.Client{
+	Timeout:   healthTimeout,
+	Transport: &http.Transport{Proxy: nil},
+}
+
+// healthChecker polls a workload's own health endpoint and reports the VM
+// unhealthy once it has failed threshold times in a row over at least
+// minDuration, so a single slow restart doesn't cost the VM.
+type healthChecker struct {
+	url         string
+	threshold   int
+	minDuration time.Duration
+
+	failures     int
+	firstFailure time.Time
+	lastErr      error
+}
+
+// check probes once at now and reports whether the VM should be retired.
+func (h *healthChecker) check(ctx context.Context, now time.Time) bool {
+	err := probeHealth(ctx, h.url)
+	if err == nil {
+		h.failures, h.firstFailure, h.lastErr = 0, time.Time{}, nil
+		return false
+	}
+
+	if h.failures == 0 {
+		h.firstFailure = now
+	}
+	h.failures++
+	h.lastErr = err
+	return h.failures >= h.threshold && now.Sub(h.firstFailure) >= h.minDuration
+}
+
+// probeHealth treats anything but a 2xx answer as unhealthy.
+func probeHealth(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// historyMaxEntries keeps a run of several days from growing without bound;
+// the oldest entries go first.
+const historyMaxEntries = 10000
+
+// historyEntry is one thing that happened during the run.
+type historyEntry struct {
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"` // notification, transition or error
+	Kind      EventKind         `json:"kind,omitempty"`
+	Reason    TerminationReason `json:"reason,omitempty"`
+	Severity  Severity          `json:"severity,omitempty"`
+	From      lifecycleState    `json:"from,omitempty"`
+	To        lifecycleState    `json:"to,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Delivered *bool             `json:"delivered,omitempty"`
+}
+
+// historyDump is what EVENT_HISTORY_ON_EXIT writes.
+type historyDump struct {
+	Kind     string         `json:"kind"` // always "event-history"
+	Instance instanceInfo   `json:"instance"`
+	Reason   string         `json:"reason"` // as in exitEvent
+	Dropped  int            `json:"dropped,omitempty"`
+	Entries  []historyEntry `json:"entries"`
+	Time     time.Time      `json:"time"`
+}
+
+// eventHistory keeps every notification, state transition and delivery
+// error of the run in memory, and writes them out as one JSON document when
+// the process exits. A nil history records nothing.
+type eventHistory struct {
+	clock Clock
+	sink  string // "stdout" or a file path
+
+	mu      sync.Mutex
+	entries []historyEntry
+	dropped int
+	once    sync.Once
+}
+
+func (h *eventHistory) add(e historyEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= historyMaxEntries {
+		copy(h.entries, h.entries[1:])
+		h.entries = h.entries[:len(h.entries)-1]
+		h.dropped++
+	}
+	h.entries = append(h.entries, e)
+}
+
+func (h *eventHistory) notification(event Event, delivered bool) {
+	h.add(historyEntry{Time: event.Time, Type: "notification", Kind: event.Kind, Reason: event.Reason,
+		Severity: event.Severity, Message: event.Message, Delivered: &delivered})
+}
+
+func (h *eventHistory) transition(t transitionEvent) {
+	h.add(historyEntry{Time: t.Time, Type: "transition", Reason: t.Reason, From: t.From, To: t.To})
+}
+
+func (h *eventHistory) failure(kind EventKind, err error) {
+	if h == nil {
+		return
+	}
+	h.add(historyEntry{Time: h.clock.Now(), Type: "error", Kind: kind, Message: err.Error()})
+}
+
+// export writes the history to the sink, once. Like exitHook.fire, it is
+// deferred in main so that it runs on the way out.
+func (h *eventHistory) export(instance instanceInfo, reason string) {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		if err := h.write(instance, reason); err != nil {
+			log.Printf("Failed to export the event history: %v", err)
+		}
+	})
+}
+
+func (h *eventHistory) write(instance instanceInfo, reason string) error {
+	h.mu.Lock()
+	dump := historyDump{
+		Kind:     "event-history",
+		Instance: instance,
+		Reason:   reason,
+		Dropped:  h.dropped,
+		Entries:  h.entries,
+		Time:     h.clock.Now(),
+	}
+	data, err := json.Marshal(dump)
+	h.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal event history: %w", err)
+	}
+	data = append(data, '\n')
+
+	if h.sink == "stdout" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(h.sink, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", h.sink, err)
+	}
+	log.Printf("Wrote %d history entries to %s", len(dump.Entries), h.sink)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEventHistoryExportsOnce(t *testing.T) {
+	clock := newFakeClock()
+	sink := filepath.Join(t.TempDir(), "history.json")
+	h := &eventHistory{clock: clock, sink: sink}
+
+	h.transition(transitionEvent{From: StateMonitoring, To: StateGracePeriod, Time: clock.Now()})
+	h.notification(Event{Kind: EventTTLExpired, Time: clock.Now()}, false)
+	h.failure(EventTTLExpired, errors.New("slack is down"))
+	h.export(instanceInfo{Name: "vm"}, "ttl-expiry")
+	h.notification(Event{Kind: EventTerminating}, true)
+	h.export(instanceInfo{Name: "vm"}, "ttl-expiry")
+
+	data, err := os.ReadFile(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump historyDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Instance.Name != "vm" || dump.Reason != "ttl-expiry" || len(dump.Entries) != 3 {
+		t.Fatalf("dump = %+v", dump)
+	}
+	if e := dump.Entries[1]; e.Type != "notification" || e.Delivered == nil || *e.Delivered {
+		t.Errorf("notification entry = %+v, want undelivered", e)
+	}
+	if e := dump.Entries[2]; e.Type != "error" || e.Message != "slack is down" {
+		t.Errorf("error entry = %+v", e)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// preemptionBudget is GCP's notice before it forces a preempted VM off.
+	// Nothing on the preemption path may wait longer, whatever the TTL
+	// grace period is set to.
+	preemptionBudget          = 30 * time.Second
+	defaultPreemptHookTimeout = 20 * time.Second
+	defaultDrainTimeout       = 20 * time.Second
+	maxPreemptHookDelay       = 10 * time.Second
+)
+
+// runHook runs command through the shell and kills it once timeout expires.
+// Its combined output is written to the log. env is added to ours.
+func runHook(command string, timeout time.Duration, env ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Kill whatever the shell started too, or a child still holding the
+	// output pipe keeps Run waiting past the timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	log.Printf("Running hook: %s", command)
+	err := cmd.Run()
+	if s := strings.TrimSpace(out.String()); s != "" {
+		log.Printf("Hook output:\n%s", s)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook timed out after %v", timeout)
+	}
+	return err
+}
+
+// shutdownHook is one entry of SHUTDOWN_HOOKS.
+type shutdownHook struct {
+	Name    string
+	Command string
+	// Timeout is the hook's own limit; without one it may use whatever is
+	// left of the deadline
+	Timeout time.Duration
+}
+
+// parseShutdownHooks parses SHUTDOWN_HOOKS, a JSON array of
+// {"name": ..., "command": ..., "timeout": "10s"} run in order. Only the
+// command is required.
+func parseShutdownHooks(spec string) ([]shutdownHook, error) {
+	var entries []struct {
+		Name    string `json:"name"`
+		Command string `json:"command"`
+		Timeout string `json:"timeout"`
+	}
+	if err := json.Unmarshal([]byte(spec), &entries); err != nil {
+		return nil, fmt.Errorf("SHUTDOWN_HOOKS must be a JSON array of hooks: %w", err)
+	}
+	hooks := make([]shutdownHook, 0, len(entries))
+	for i, e := range entries {
+		if strings.TrimSpace(e.Command) == "" {
+			return nil, fmt.Errorf("shutdown hook %d has no command", i+1)
+		}
+		h := shutdownHook{Name: cmp.Or(e.Name, fmt.Sprintf("hook %d", i+1)), Command: e.Command}
+		if e.Timeout != "" {
+			d, err := time.ParseDuration(e.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q for shutdown hook %s", e.Timeout, h.Name)
+			}
+			h.Timeout = d
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// runShutdownHooks runs hooks one after another within budget: each gets
+// its own timeout or what is left, whichever is shorter, and those that
+// find nothing left are skipped. Hooks see the reason and the deadline in
+// SPOT_NOTIFIER_REASON and SPOT_NOTIFIER_DEADLINE (RFC 3339). It returns
+// how each went, e.g. "drain: ok, upload: skipped".
+func runShutdownHooks(hooks []shutdownHook, budget time.Duration, reason TerminationReason) string {
+	start := time.Now()
+	deadline := start.Add(budget)
+	env := []string{"SPOT_NOTIFIER_REASON=" + string(reason), "SPOT_NOTIFIER_DEADLINE=" + deadline.UTC().Format(time.RFC3339)}
+	results := make([]string, 0, len(hooks))
+	for _, h := range hooks {
+		left := time.Until(deadline)
+		if left < time.Second {
+			log.Printf("No time left for shutdown hook %s, skipping it", h.Name)
+			results = append(results, h.Name+": skipped")
+			continue
+		}
+		timeout := left
+		if h.Timeout > 0 && h.Timeout < left {
+			timeout = h.Timeout
+		}
+		if err := runHook(h.Command, timeout, env...); err != nil {
+			log.Printf("Shutdown hook %s failed: %v", h.Name, err)
+			results = append(results, fmt.Sprintf("%s: %v", h.Name, err))
+			continue
+		}
+		results = append(results, h.Name+": ok")
+	}
+	log.Printf("Shutdown hooks finished in %v", time.Since(start).Truncate(time.Millisecond))
+	return strings.Join(results, ", ")
+}
+
+// notifyOnSIGTERM returns a channel that is closed on the first SIGTERM.
+func notifyOnSIGTERM() <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	fired := make(chan struct{})
+	go func() {
+		<-sig
+		close(fired)
+	}()
+	return fired
+}
+
+// waitForShutdown blocks until the OS tells us to stop, via SIGINT or the
+// shutdown channel from notifyOnSIGTERM. After a preemption we stay up
+// rather than exit, so the VM isn't left unmonitored if GCP's forced stop
+// is late.
+func waitForShutdown(shutdown <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT)
+	log.Printf("Waiting for GCP to stop the VM")
+	select {
+	case <-shutdown:
+		log.Printf("Received %v, exiting", syscall.SIGTERM)
+	case sig := <-sigs:
+		log.Printf("Received %v, exiting", sig)
+	}
+}
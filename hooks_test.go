@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShutdownHooks(t *testing.T) {
+	hooks, err := parseShutdownHooks(`[{"name": "drain", "command": "kubectl drain", "timeout": "10s"}, {"command": "sync"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0] != (shutdownHook{"drain", "kubectl drain", 10 * time.Second}) || hooks[1] != (shutdownHook{"hook 2", "sync", 0}) {
+		t.Errorf("hooks = %+v", hooks)
+	}
+	for _, spec := range []string{`{"command": "sync"}`, `[{"name": "x"}]`, `[{"command": "sync", "timeout": "soon"}]`} {
+		if _, err := parseShutdownHooks(spec); err == nil {
+			t.Errorf("parseShutdownHooks(%s) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestShutdownHooksStayWithinBudget(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "reason")
+	hooks := []shutdownHook{
+		{Name: "reason", Command: "echo $SPOT_NOTIFIER_REASON > " + out},
+		{Name: "slow", Command: "sleep 5", Timeout: 100 * time.Millisecond},
+		{Name: "greedy", Command: "sleep 5"},
+		{Name: "late", Command: "true"},
+	}
+
+	start := time.Now()
+	status := runShutdownHooks(hooks, 1500*time.Millisecond, ReasonPreemption)
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("hooks took %v, want them cut off at the budget", elapsed)
+	}
+	want := "reason: ok, slow: hook timed out after 100ms, greedy: hook timed out after"
+	if !strings.HasPrefix(status, want) || !strings.HasSuffix(status, ", late: skipped") {
+		t.Errorf("status = %q, want it to start %q and end with late skipped", status, want)
+	}
+	if data, _ := os.ReadFile(out); strings.TrimSpace(string(data)) != string(ReasonPreemption) {
+		t.Errorf("hook saw SPOT_NOTIFIER_REASON=%q", data)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// imageLookupTimeout bounds the boot image lookup, which holds up the
+// launch notification.
+const imageLookupTimeout = 5 * time.Second
+
+// bootImage is the image the VM's boot disk was created from.
+type bootImage struct {
+	Name    string
+	Family  string // empty if the image isn't in one
+	Created time.Time
+}
+
+// parseImagePath splits "projects/<project>/global/images/<name>", or a
+// full API URL ending in it.
+func parseImagePath(image string) (project, name string, ok bool) {
+	_, rest, found := strings.Cut(image, "projects/")
+	if !found {
+		return "", "", false
+	}
+	project, name, found = strings.Cut(rest, "/global/images/")
+	if !found || project == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	return project, name, true
+}
+
+// bootImage describes the boot disk's source image. image is what the
+// metadata server reported; if it's empty the boot disk is looked up.
+func (t *computeTerminator) bootImage(ctx context.Context, projectID, zone, instanceName, image string) (bootImage, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return bootImage{}, err
+	}
+	if image == "" {
+		inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+		if err != nil {
+			return bootImage{}, fmt.Errorf("failed to get instance: %w", explainScope(err))
+		}
+		for _, d := range inst.Disks {
+			if !d.Boot {
+				continue
+			}
+			disk, err := svc.Disks.Get(projectID, zone, path.Base(d.Source)).Context(ctx).Do()
+			if err != nil {
+				return bootImage{}, fmt.Errorf("failed to get boot disk: %w", explainScope(err))
+			}
+			image = disk.SourceImage
+		}
+		if image == "" {
+			return bootImage{}, fmt.Errorf("boot disk wasn't created from an image")
+		}
+	}
+
+	project, name, ok := parseImagePath(image)
+	if !ok {
+		return bootImage{}, fmt.Errorf("unexpected image path %q", image)
+	}
+	img, err := svc.Images.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		// The name alone is still worth reporting
+		return bootImage{Name: name}, fmt.Errorf("failed to get image %s: %w", name, explainScope(err))
+	}
+	created, _ := time.Parse(time.RFC3339, img.CreationTimestamp)
+	return bootImage{Name: img.Name, Family: img.Family, Created: created}, nil
+}
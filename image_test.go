@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func TestParseImagePath(t *testing.T) {
+	for _, tt := range []struct {
+		in            string
+		project, name string
+		ok            bool
+	}{
+		{"projects/debian-cloud/global/images/debian-12-v1", "debian-cloud", "debian-12-v1", true},
+		{"https://www.googleapis.com/compute/v1/projects/p/global/images/img", "p", "img", true},
+		{"projects/p/global/images/family/debian-12", "", "", false},
+		{"", "", "", false},
+	} {
+		project, name, ok := parseImagePath(tt.in)
+		if project != tt.project || name != tt.name || ok != tt.ok {
+			t.Errorf("parseImagePath(%q) = %q, %q, %t", tt.in, project, name, ok)
+		}
+	}
+}
+
+func TestBootImageFollowsBootDisk(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/p/zones/z/instances/vm":
+			json.NewEncoder(w).Encode(map[string]any{"disks": []map[string]any{
+				{"boot": false, "source": "projects/p/zones/z/disks/data"},
+				{"boot": true, "source": "https://compute.googleapis.com/compute/v1/projects/p/zones/z/disks/vm"},
+			}})
+		case "/projects/p/zones/z/disks/vm":
+			json.NewEncoder(w).Encode(map[string]any{"sourceImage": "projects/img-project/global/images/app-v7"})
+		case "/projects/img-project/global/images/app-v7":
+			json.NewEncoder(w).Encode(map[string]any{"name": "app-v7", "family": "app", "creationTimestamp": "2026-09-01T10:00:00.000-07:00"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.minCallInterval = 0
+
+	img, err := term.bootImage(context.Background(), "p", "z", "vm", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Name != "app-v7" || img.Family != "app" || img.Created.IsZero() {
+		t.Errorf("bootImage = %+v", img)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples = 1024
+	// slowMetadataRequest is logged as it happens: a slow metadata server
+	// delays preemption detection by as much
+	slowMetadataRequest       = time.Second
+	defaultLatencyReportEvery = time.Hour
+	metadataLatencyMetric     = "metadata_latency"
+)
+
+// metadataLatency times every request to the metadata server.
+var metadataLatency = &latencyTracker{}
+
+// latencyTracker keeps the most recent latencySamples durations.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int // where the next sample goes once samples is full
+}
+
+func (l *latencyTracker) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// percentiles returns the p50, p99 and max of the recent samples, and how
+// many there are.
+func (l *latencyTracker) percentiles() (p50, p99, maxD time.Duration, n int) {
+	l.mu.Lock()
+	sorted := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, 0, 0, 0
+	}
+	slices.Sort(sorted)
+	at := func(p float64) time.Duration { return sorted[int(p*float64(len(sorted)-1))] }
+	return at(0.5), at(0.99), sorted[len(sorted)-1], len(sorted)
+}
+
+// reportMetadataLatency logs the metadata latency percentiles every interval.
+func reportMetadataLatency(interval time.Duration) {
+	for range time.Tick(interval) {
+		p50, p99, maxD, n := metadataLatency.percentiles()
+		if n == 0 {
+			continue
+		}
+		log.Printf("Metadata latency over the last %d requests: p50 %v, p99 %v, max %v", n, p50, p99, maxD)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTrackerPercentiles(t *testing.T) {
+	l := &latencyTracker{}
+	if _, _, _, n := l.percentiles(); n != 0 {
+		t.Fatalf("empty tracker has %d samples", n)
+	}
+	// Overflow the buffer so only 1..latencySamples ms remain
+	for i := 0; i <= latencySamples; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+
+	p50, p99, maxD, n := l.percentiles()
+	if n != latencySamples {
+		t.Errorf("n = %d, want %d", n, latencySamples)
+	}
+	if p50 != 512*time.Millisecond || p99 != 1013*time.Millisecond || maxD != latencySamples*time.Millisecond {
+		t.Errorf("p50 %v, p99 %v, max %v", p50, p99, maxD)
+	}
+}
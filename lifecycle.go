@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lifecycleState is where the VM is in its life, as seen by the notifier.
+type lifecycleState string
+
+const (
+	StateLaunched          lifecycleState = "launched"
+	StateMonitoring        lifecycleState = "monitoring"
+	StateApproachingTTL    lifecycleState = "approaching-ttl"
+	StateGracePeriod       lifecycleState = "grace-period"
+	StateTerminating       lifecycleState = "terminating"
+	StateTerminated        lifecycleState = "terminated"
+	StateTerminationFailed lifecycleState = "termination-failed"
+	StatePreempted         lifecycleState = "preempted"
+)
+
+const (
+	transitionTimeout = 5 * time.Second
+	transitionQueue   = 32
+)
+
+// transitionEvent is the body posted to STATE_WEBHOOK_URL on every change.
+// Seq orders them, since they are posted in the background.
+type transitionEvent struct {
+	Kind     string            `json:"kind"` // always "state-transition"
+	Instance instanceInfo      `json:"instance"`
+	From     lifecycleState    `json:"from,omitempty"`
+	To       lifecycleState    `json:"to"`
+	Reason   TerminationReason `json:"reason,omitempty"`
+	Seq      int               `json:"seq"`
+	Time     time.Time         `json:"time"`
+}
+
+// lifecycle tracks the current state and reports each transition, saving
+// it so the next process can tell whether this run ended. A nil lifecycle
+// ignores them all.
+type lifecycle struct {
+	clock    Clock
+	instance instanceInfo
+	send     func(transitionEvent)
+	saved    *savedState
+
+	mu    sync.Mutex
+	state lifecycleState
+	seq   int
+}
+
+// current returns the state last entered.
+func (l *lifecycle) current() lifecycleState {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// enter moves to state, reporting the transition unless it is already there.
+func (l *lifecycle) enter(state lifecycleState, reason TerminationReason) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state == l.state {
+		return
+	}
+	l.seq++
+	event := transitionEvent{
+		Kind:     "state-transition",
+		Instance: l.instance,
+		From:     l.state,
+		To:       state,
+		Reason:   reason,
+		Seq:      l.seq,
+		Time:     l.clock.Now(),
+	}
+	l.state = state
+	l.send(event)
+	l.saved.update("The lifecycle state", func(saved *notifierState) { saved.Lifecycle = state })
+}
+
+// stateWebhook posts transitions to a URL in order, off the monitoring
+// path, so a slow endpoint never delays a preemption response.
+type stateWebhook struct {
+	url   string
+	queue chan transitionEvent
+	done  chan struct{}
+}
+
+func newStateWebhook(url string) *stateWebhook {
+	w := &stateWebhook{url: url, queue: make(chan transitionEvent, transitionQueue), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for event := range w.queue {
+			if err := w.post(event); err != nil {
+				log.Printf("State webhook failed for %s -> %s: %v", event.From, event.To, err)
+			}
+		}
+	}()
+	return w
+}
+
+// send queues the event, dropping it if the webhook has fallen far behind.
+func (w *stateWebhook) send(event transitionEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		log.Printf("State webhook is backed up, dropping %s -> %s", event.From, event.To)
+	}
+}
+
+// drain waits up to transitionTimeout for queued transitions to go out.
+func (w *stateWebhook) drain() {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-time.After(transitionTimeout):
+	}
+}
+
+func (w *stateWebhook) post(event transitionEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transition: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transitionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("state webhook POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("state webhook returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestMonitorReportsLifecycleTransitions(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	m.WarnFraction = 0.5
+	var got []lifecycleState
+	m.Lifecycle = &lifecycle{clock: clock, state: StateLaunched, send: func(e transitionEvent) { got = append(got, e.To) }}
+
+	m.Run()
+
+	want := []lifecycleState{StateMonitoring, StateApproachingTTL, StateGracePeriod, StateTerminating, StateTerminated}
+	if !slices.Equal(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestStateWebhookPostsInOrder(t *testing.T) {
+	var events []transitionEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e transitionEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events = append(events, e)
+	}))
+	defer srv.Close()
+
+	hook := newStateWebhook(srv.URL)
+	l := &lifecycle{clock: newFakeClock(), send: hook.send}
+	l.enter(StateLaunched, ReasonNone)
+	l.enter(StateMonitoring, ReasonNone)
+	l.enter(StateMonitoring, ReasonNone) // no change, no event
+	l.enter(StatePreempted, ReasonPreemption)
+	hook.drain()
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	last := events[2]
+	if last.From != StateMonitoring || last.To != StatePreempted || last.Reason != ReasonPreemption || last.Seq != 3 {
+		t.Errorf("last event = %+v", last)
+	}
+	if last.Time.IsZero() {
+		t.Error("event has no time")
+	}
+}
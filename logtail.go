@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+const defaultLogTailLines = 20
+
+// logTail is an io.Writer that keeps the last N lines written to it, so crash
+// reports can include recent context. Install it with io.MultiWriter
+// alongside stderr.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogTail(n int) *logTail {
+	return &logTail{lines: make([]string, n)}
+}
+
+// Write records p, which the log package always hands over as whole lines.
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.lines[t.next] = line
+		t.next = (t.next + 1) % len(t.lines)
+		if t.next == 0 {
+			t.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the buffered lines, oldest first.
+func (t *logTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ordered []string
+	if t.full {
+		ordered = append(ordered, t.lines[t.next:]...)
+	}
+	ordered = append(ordered, t.lines[:t.next]...)
+	return strings.Join(ordered, "\n")
+}
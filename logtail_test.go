@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLogTail(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"nothing logged", nil, ""},
+		{"shorter than the limit", []string{"a\n", "b\n"}, "a\nb"},
+		{"exactly the limit", []string{"a\n", "b\n", "c\n"}, "a\nb\nc"},
+		{"longer than the limit", []string{"a\n", "b\n", "c\n", "d\n", "e\n"}, "c\nd\ne"},
+		{"several lines in one write", []string{"a\nb\nc\nd\n"}, "b\nc\nd"},
+		{"no trailing newline", []string{"a\n", "b"}, "a\nb"},
+	} {
+		tail := newLogTail(3)
+		for _, w := range tc.writes {
+			if n, err := tail.Write([]byte(w)); err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v", tc.name, w, n, err)
+			}
+		}
+		if got := tail.String(); got != tc.want {
+			t.Errorf("%s: String() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
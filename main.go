@@ -1,207 +1,1332 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"maps"
 	"os"
 	"path"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 )
 
 const (
-	// GCP Metadata Server
-	metadataBase = "http://metadata.google.internal/computeMetadata/v1/"
-	slackURL     = "https://v7uagcoglkqlufu7bah6luxjta0dsfht.lambda-url.us-east-2.on.aws" // Keeping your original URL
-	gracePeriod  = 15 * time.Minute
-	checkInterval = 5 * time.Second
-	defaultTerminate = 24
+	defaultGracePeriod    = 15 * time.Minute
+	defaultMaxGracePeriod = 2 * time.Hour
+	defaultCheckInterval  = 5 * time.Second
+	defaultTerminate      = 24 * time.Hour
+
+	// maxCheckInterval leaves at least half the preemption notice to act in
+	maxCheckInterval = preemptionBudget / 2
+
+	// Live migrations are reported separately and never end the VM
+	defaultMaintenanceIgnore = `^NONE$`
+
+	defaultComputeInitAttempts   = 5
+	defaultComputeInitMaxBackoff = 30 * time.Second
 )
 
-// getMetadata fetches data from GCP metadata server.
-// GCP requires the "Metadata-Flavor: Google" header.
-func getMetadata(path string) (string, error) {
-	client := &http.Client{Timeout: 2 * time.Second}
-	req, err := http.NewRequest("GET", metadataBase+path, nil)
+// parseTTL accepts a Go duration ("90m", "1h30m") or, for backward
+// compatibility, a plain number of hours which may be fractional ("1.5").
+// "never" turns the TTL off; anything else must be positive. Errors name
+// the setting, so callers can log them as they are.
+func parseTTL(name, val string) (time.Duration, error) {
+	val = strings.TrimSpace(val)
+	if val == "never" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(val)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		hours, ferr := strconv.ParseFloat(val, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("%s: %q is neither a duration nor a number of hours", name, val)
+		}
+		d = time.Duration(hours * float64(time.Hour))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s: %q is not positive; use \"never\" to turn the TTL off", name, val)
 	}
-	req.Header.Add("Metadata-Flavor", "Google")
+	return d, nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
+// terminationDryRun reports whether terminations should only be logged and
+// notified: under --dry-run, and always with mock metadata, whose instance
+// isn't real.
+func terminationDryRun(flag bool) bool {
+	return mockMetadataFile != "" || flag
+}
+
+// parseDurations parses a comma-separated list of positive durations, such
+// as "1m,5m,15m". "off" or an empty list gives nil.
+func parseDurations(spec string) ([]time.Duration, error) {
+	if strings.TrimSpace(spec) == "off" {
+		return nil, nil
+	}
+	var ds []time.Duration
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q is not a positive duration", part)
+		}
+		ds = append(ds, d)
 	}
-	defer resp.Body.Close()
+	return ds, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("metadata %s returned %d", path, resp.StatusCode)
+// formatDuration prints d without trailing zero units ("24h", "1h30m").
+func formatDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
 	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
 
-	body, err := io.ReadAll(resp.Body)
+// checkMaintenanceEvent returns the pending host maintenance event, or ""
+// if there is none or its value matches the ignore pattern. migrating
+// reports that GCP will live-migrate the VM rather than stop it.
+func checkMaintenanceEvent(ignore *regexp.Regexp) (event string, migrating bool, err error) {
+	event, err = getMetadata("instance/maintenance-event")
 	if err != nil {
-		return "", fmt.Errorf("reading response failed: %w", err)
+		return "", false, err
 	}
 
-	return string(body), nil
+	event = strings.TrimSpace(event)
+	if strings.HasPrefix(event, "MIGRATE") {
+		return event, true, nil
+	}
+	if event == "" || ignore.MatchString(event) {
+		return "", false, nil
+	}
+	return event, false, nil
 }
 
-// terminateInstance deletes the VM using the Google Compute Engine API.
-func terminateInstance(projectID, zone, instanceName string) error {
-	ctx := context.Background()
-	
-	// Create Compute Service
-	// Ensure the VM's Service Account has "Compute Instance Admin" role
-	computeService, err := compute.NewService(ctx, option.WithScopes(compute.ComputeScope))
-	if err != nil {
-		return fmt.Errorf("failed to create compute service: %w", err)
+// addBackends adds the backends that go alongside whatever NOTIFIER_TYPE
+// picked. A bare PUBSUB_TOPIC is in projectID.
+func addBackends(notifier *dispatcher, projectID string) {
+	if topic := os.Getenv("PUBSUB_TOPIC"); topic != "" {
+		ps, err := newPubSubNotifier(context.Background(), topic, projectID)
+		if err != nil {
+			log.Printf("Pub/Sub notifications disabled: %v", err)
+		} else {
+			timed, err := newTimedNotifier("pubsub", ps)
+			if err != nil {
+				log.Fatalf("Invalid configuration: %v", err)
+			}
+			notifier.backends = append(notifier.backends, timed)
+			log.Printf("Publishing events to %s", ps.topic)
+		}
 	}
 
-	// Create the delete call
-	call := computeService.Instances.Delete(projectID, zone, instanceName)
-	
-	// Execute
-	_, err = call.Do()
-	if err != nil {
-		return fmt.Errorf("failed to delete instance: %w", err)
+	if key := os.Getenv("OPSGENIE_API_KEY"); key != "" {
+		timed, err := newTimedNotifier("opsgenie", &opsgenieNotifier{
+			apiURL: strings.TrimSuffix(cmp.Or(os.Getenv("OPSGENIE_API_URL"), defaultOpsgenieURL), "/"),
+			apiKey: key,
+		})
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		notifier.backends = append(notifier.backends, timed)
+		log.Printf("Sending alerts to Opsgenie")
+	}
+
+	if key := os.Getenv("PAGERDUTY_ROUTING_KEY"); key != "" {
+		timed, err := newTimedNotifier("pagerduty", &pagerdutyNotifier{
+			url:        cmp.Or(os.Getenv("PAGERDUTY_EVENTS_URL"), defaultPagerDutyURL),
+			routingKey: key,
+		})
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		notifier.backends = append(notifier.backends, timed)
+		log.Printf("Sending incidents to PagerDuty")
+	}
+
+	// Slack incoming webhooks and Google Chat webhooks both take {"text": ...},
+	// alongside whatever NOTIFIER_TYPE picked
+	for _, hook := range []struct{ name, env, label string }{
+		{"slack_webhook", "SLACK_WEBHOOK_URL", "Slack incoming webhook"},
+		{"google_chat", "GOOGLE_CHAT_WEBHOOK_URL", "Google Chat"},
+	} {
+		if url := os.Getenv(hook.env); url != "" {
+			timed, err := newTimedNotifier(hook.name, &relayNotifier{url: url, field: "text"})
+			if err != nil {
+				log.Fatalf("Invalid configuration: %v", err)
+			}
+			notifier.backends = append(notifier.backends, timed)
+			log.Printf("Posting to a %s", hook.label)
+		}
+	}
+
+	if token := os.Getenv("SLACK_BOT_TOKEN"); token != "" {
+		channel := os.Getenv("SLACK_CHANNEL")
+		if channel == "" {
+			log.Fatalf("SLACK_BOT_TOKEN needs SLACK_CHANNEL")
+		}
+		timed, err := newTimedNotifier("slack_api", &slackAPINotifier{
+			apiURL:  strings.TrimSuffix(cmp.Or(os.Getenv("SLACK_API_URL"), defaultSlackAPIURL), "/"),
+			token:   token,
+			channel: channel,
+			verify:  os.Getenv("SLACK_VERIFY_DELIVERY") == "true",
+		})
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		notifier.backends = append(notifier.backends, timed)
+		log.Printf("Posting to Slack channel %s through the Web API", channel)
+	}
+
+	if spec := os.Getenv("NOTIFY_ROUTES"); spec != "" {
+		routed, err := newRoutedNotifier(spec)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		timed, err := newTimedNotifier("routes", routed)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		notifier.backends = append(notifier.backends, timed)
+		log.Printf("Routing notifications to %d Slack webhooks", len(routed.routes))
+	}
+
+	if path := os.Getenv("EVENT_SOCKET"); path != "" {
+		timed, err := newTimedNotifier("event_socket", &socketNotifier{path: path})
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		notifier.backends = append(notifier.backends, timed)
+		log.Printf("Writing events to %s", path)
 	}
-	
-	return nil
 }
 
-func sendSlackMessage(message string) {
-	payload := map[string]string{"message": message}
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal Slack message: %v", err)
-		return
+const usage = `usage: spot-notifier [agent] [--dry-run]   watch this VM through its metadata server
+       spot-notifier fleet [--dry-run]     watch a project's Spot VMs through the Compute API
+       spot-notifier check                 check the configuration and what the agent needs from the VM
+       spot-notifier ctl status | extend <duration> | cancel
+       spot-notifier version`
+
+func main() {
+	// Flags alone, as before there were subcommands, run the agent
+	cmd, args := "agent", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
+	switch cmd {
+	case "agent", "fleet":
+		runNotifier(cmd, args)
+	case "check":
+		if !runCheck(os.Stdout) {
+			os.Exit(1)
+		}
+	case "ctl":
+		// ctl talks to the notifier already running on this VM
+		if err := runControlCommand(os.Getenv("CONTROL_ADDR"), args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "version":
+		fmt.Println("spot-notifier", versionString())
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
 
-	resp, err := http.Post(slackURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Slack POST failed: %v", err)
+// initMetadata points metadata reads at the mock or another server, then
+// reads the spot-notifier-config attribute. Its settings fill in whatever
+// the environment leaves unset, so this comes before anything else.
+func initMetadata() error {
+	mockMetadataFile = os.Getenv("MOCK_METADATA")
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		metadataBase = "http://" + host + "/computeMetadata/v1/"
+	}
+	return loadMetadataConfig()
+}
+
+// runNotifier runs the agent or fleet subcommand until the VM, or the
+// watcher, is done.
+func runNotifier(mode string, args []string) {
+	flags := flag.NewFlagSet(mode, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	showVersion := flags.Bool("version", false, "print version information and exit")
+	dryRun := flags.Bool("dry-run", false, "log and notify what termination would do instead of doing it")
+	flags.StringVar(&mode, "mode", mode, "agent or fleet, same as the subcommand")
+	flags.Parse(args)
+	if *showVersion {
+		fmt.Println("spot-notifier", versionString())
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		log.Printf("Slack API returned non-2xx status: %d", resp.StatusCode)
+	// Give slow-booting VMs time to bring up metadata and credentials
+	if val := os.Getenv("STARTUP_DELAY"); val != "" {
+		delay, err := time.ParseDuration(val)
+		if err != nil {
+			log.Fatalf("Invalid STARTUP_DELAY: %v", err)
+		}
+		log.Printf("Waiting %v before starting", delay)
+		time.Sleep(delay)
 	}
-}
 
-// checkSpotTermination checks if the GCP VM is being preempted.
-// GCP provides a 30-second warning window.
-func checkSpotTermination() (bool, error) {
-	// Method 1: Check "preempted" flag (Returns "TRUE" if preempted)
-	status, err := getMetadata("instance/preempted")
+	if err := initMetadata(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Keep the last few log lines around for crash reports
+	tailLines := defaultLogTailLines
+	if val, err := strconv.Atoi(os.Getenv("LOG_TAIL_LINES")); err == nil && val > 0 {
+		tailLines = val
+	}
+	tail := newLogTail(tailLines)
+	log.SetOutput(io.MultiWriter(os.Stderr, tail))
+
+	terminateAfter := defaultTerminate
+	if val := os.Getenv("TERMINATE_AFTER_HOURS"); val != "" {
+		ttl, err := parseTTL("TERMINATE_AFTER_HOURS", val)
+		if err != nil {
+			log.Printf("Ignoring %v", err)
+		} else {
+			terminateAfter = ttl
+		}
+	}
+
+	// Together, SOFT_TTL_HOURS reminds and HARD_TTL_HOURS enforces; either
+	// one alone is simply the TTL
+	var softTTL time.Duration
+	if soft, hard := os.Getenv("SOFT_TTL_HOURS"), os.Getenv("HARD_TTL_HOURS"); soft != "" || hard != "" {
+		var (
+			softD, hardD time.Duration
+			err          error
+		)
+		if soft != "" {
+			if softD, err = parseTTL("SOFT_TTL_HOURS", soft); err != nil {
+				log.Fatalf("Invalid %v", err)
+			}
+		}
+		if hard != "" {
+			if hardD, err = parseTTL("HARD_TTL_HOURS", hard); err != nil {
+				log.Fatalf("Invalid %v", err)
+			}
+		}
+		switch {
+		case soft != "" && hard != "":
+			if hardD > 0 && softD >= hardD {
+				log.Fatalf("SOFT_TTL_HOURS (%s) must be shorter than HARD_TTL_HOURS (%s)", soft, hard)
+			}
+			softTTL, terminateAfter = softD, hardD
+		case hard != "":
+			terminateAfter = hardD
+		default:
+			terminateAfter = softD
+		}
+	}
+	// GRACE_PERIOD applies to every VM; the grace-period attribute can
+	// lengthen it per VM, up to MAX_GRACE_PERIOD
+	gracePeriod, maxGracePeriod := defaultGracePeriod, defaultMaxGracePeriod
+	if val := os.Getenv("MAX_GRACE_PERIOD"); val != "" {
+		var err error
+		if maxGracePeriod, err = time.ParseDuration(val); err != nil || maxGracePeriod < 0 {
+			log.Fatalf("Invalid MAX_GRACE_PERIOD: %q", val)
+		}
+	}
+	if val := os.Getenv("GRACE_PERIOD"); val != "" {
+		var err error
+		if gracePeriod, err = time.ParseDuration(val); err != nil || gracePeriod < 0 {
+			log.Fatalf("Invalid GRACE_PERIOD: %q", val)
+		}
+	}
+	if maxGracePeriod > 0 && gracePeriod > maxGracePeriod {
+		log.Fatalf("GRACE_PERIOD (%v) must not exceed MAX_GRACE_PERIOD (%v)", gracePeriod, maxGracePeriod)
+	}
+	log.Printf("spot-notifier %s", versionString())
+	logResolvedConfig()
+	if softTTL > 0 {
+		log.Printf("Soft TTL: reminder after %s", formatDuration(softTTL))
+	}
+	switch {
+	case mode == "fleet":
+		// Each instance's TTL comes from its label
+	case terminateAfter > 0:
+		log.Printf("Instance will terminate in %s", formatDuration(terminateAfter))
+	default:
+		log.Printf("No TTL: monitoring for preemption only, the instance will never be terminated automatically")
+	}
+
+	maintenanceIgnore, err := regexp.Compile(cmp.Or(os.Getenv("MAINTENANCE_EVENT_IGNORE"), defaultMaintenanceIgnore))
 	if err != nil {
-		return false, err
+		log.Fatalf("Invalid MAINTENANCE_EVENT_IGNORE: %v", err)
 	}
 
-	if strings.TrimSpace(status) == "TRUE" {
-		return true, nil
+	// Optional: delete sibling instances sharing this label on TTL
+	group, err := loadGroupConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Method 2 (Optional but robust): Check maintenance-event
-	// event, _ := getMetadata("instance/maintenance-event")
-	// if event == "TERMINATE_ON_HOST_MAINTENANCE" { return true, nil }
+	// Intervals and notification settings can be changed with a SIGHUP
+	live, err := loadLiveConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	switch eventFormat = cmp.Or(os.Getenv("EVENT_FORMAT"), formatNative); eventFormat {
+	case formatNative, formatCloudEvents:
+	default:
+		log.Fatalf("Invalid EVENT_FORMAT: %q (want native or cloudevents)", eventFormat)
+	}
+	clock := realClock{}
+	slack := &breakerNotifier{name: "Slack", clock: clock}
+	notifier := &dispatcher{clock: clock}
+	primary, err := loadPrimaryNotifier(slack)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	notifier.backends = append(notifier.backends, primary)
+	live.apply(notifier, slack)
+	if notifier.onUndelivered, err = parseUndeliveredAction(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	return false, nil
-}
+	// A non-zero status set on the way out takes effect after every other
+	// deferred call has run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 
-func main() {
-	terminateAfterHours := defaultTerminate
-	if val, err := strconv.Atoi(os.Getenv("TERMINATE_AFTER_HOURS")); err == nil {
-		terminateAfterHours = val
+	// Whatever ends the process, EXIT_WEBHOOK_URL hears about it last
+	exit := &exitHook{url: os.Getenv("EXIT_WEBHOOK_URL"), started: time.Now(), reason: "signal"}
+	defer exit.fire()
+
+	// Just before that, the whole run in one document for the post-mortem
+	var history *eventHistory
+	if sink := os.Getenv("EVENT_HISTORY_ON_EXIT"); sink != "" {
+		history = &eventHistory{clock: clock, sink: sink}
+		notifier.history = history
+		defer func() { history.export(exit.instance, exit.reason) }()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			exit.reason = "crash"
+			log.Printf("Panic: %v", r)
+			host, _ := os.Hostname()
+			notifier.notify(EventCrashed, fmt.Sprintf("💥 Notifier on `%s` crashed: %v\n```\n%s\n```", host, r, tail))
+			panic(r)
+		}
+	}()
+
+	// Fleet mode runs off the watched VMs, so there is no metadata of our own
+	switch mode {
+	case "agent":
+	case "fleet":
+		fleet, err := loadFleetWatcher(clock, notifier, live, gracePeriod)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		fleet.terminator.dryRun = *dryRun
+		if *dryRun {
+			log.Printf("Dry run: instances will not be terminated")
+		}
+		addBackends(notifier, fleet.project)
+		fleet.run()
+		notifier.flush()
+		return
+	default:
+		log.Fatalf("Invalid --mode: %q (want agent or fleet)", mode)
 	}
-	log.Printf("Instance will terminate in %d hours", terminateAfterHours)
 
 	// Fetch basic info
-	instanceID, err := getMetadata("instance/id")
-	if err != nil {
+	if mockMetadataFile != "" {
+		log.Printf("MOCK_METADATA is set: using mock metadata and skipping Compute API calls")
+	}
+
+	prefetch := defaultMetadataPrefetch
+	if val, err := strconv.Atoi(os.Getenv("METADATA_PREFETCH_CONCURRENCY")); err == nil && val > 0 {
+		prefetch = val
+	}
+	meta, metaErrs := readMetadata([]string{
+		"instance/id", "instance/name", "instance/zone", "instance/machine-type", "instance/image", "project/project-id",
+		"instance/scheduling/on-host-maintenance", "instance/scheduling/preemptible", "instance/scheduling/provisioning-model",
+		"instance/service-accounts/default/email",
+	}, prefetch)
+
+	instanceID := meta["instance/id"]
+	if err := metaErrs["instance/id"]; err != nil {
+		if isNotOnGCP(err) {
+			log.Fatalf("Cannot reach the GCP metadata server (%v).\n"+
+				"spot-notifier must run on a GCP VM. For local development set "+
+				"MOCK_METADATA=true, or MOCK_METADATA=<file.json> to override values.", err)
+		}
 		log.Fatalf("Failed to get instance ID: %v", err)
 	}
 
 	// In GCP, instance/name is the Hostname/Resource Name
-	name, err := getMetadata("instance/name")
-	if err != nil {
+	name := meta["instance/name"]
+	if err := metaErrs["instance/name"]; err != nil {
 		log.Printf("Failed to get instance name: %v", err)
 		name = "unknown"
 	}
 
 	// Zone returns full path: "projects/123/zones/us-central1-a"
-	fullZone, err := getMetadata("instance/zone")
-	if err != nil {
+	if err := metaErrs["instance/zone"]; err != nil {
 		log.Fatalf("Failed to get zone: %v", err)
 	}
-	zone := path.Base(fullZone) // Extract just "us-central1-a"
+	zone := path.Base(meta["instance/zone"]) // Extract just "us-central1-a"
 
 	// Machine Type returns full path
-	fullType, err := getMetadata("instance/machine-type")
-	if err != nil {
+	if err := metaErrs["instance/machine-type"]; err != nil {
 		log.Fatalf("Failed to get machine type: %v", err)
 	}
-	machineType := path.Base(fullType)
+	fullType := meta["instance/machine-type"]
 
 	// Project ID is needed for the API call to delete itself
-	projectID, err := getMetadata("project/project-id")
-	if err != nil {
+	if err := metaErrs["project/project-id"]; err != nil {
 		log.Fatalf("Failed to get project ID: %v", err)
 	}
+	projectID := meta["project/project-id"]
+
+	inst := instanceInfo{
+		Name:        name,
+		ID:          instanceID,
+		Zone:        zone,
+		MachineType: path.Base(fullType),
+		Project:     projectID,
+	}
+	if id := resolveCorrelationID(os.Getenv("CORRELATION_ID")); id != "" {
+		inst.CorrelationID = id
+		log.SetPrefix("[" + id + "] ")
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+		log.Printf("Correlation ID %s", id)
+	}
+
+	notifier.instance = inst
+	exit.instance = inst
+
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		tags := []string{"instance:" + name, "zone:" + zone, "project:" + projectID}
+		if val := os.Getenv("STATSD_TAGS"); val != "" {
+			tags = append(tags, strings.Split(val, ",")...)
+		}
+		if stats, err = newStatsdClient(addr, cmp.Or(os.Getenv("STATSD_PREFIX"), defaultStatsdPrefix), tags); err != nil {
+			log.Printf("Metrics disabled: %v", err)
+		} else {
+			log.Printf("Sending metrics to StatsD at %s", addr)
+		}
+	}
+
+	addBackends(notifier, projectID)
+
+	var archive *eventArchive
+	if bucket := os.Getenv("EVENT_ARCHIVE_BUCKET"); bucket != "" {
+		prefix := cmp.Or(os.Getenv("EVENT_ARCHIVE_PREFIX"), defaultArchivePrefix)
+		if a, err := newGCSEventArchive(context.Background(), bucket, prefix, instanceID); err != nil {
+			log.Printf("Event archive disabled: %v", err)
+		} else {
+			if val := os.Getenv("EVENT_ARCHIVE_FLUSH_INTERVAL"); val != "" {
+				if a.interval, err = time.ParseDuration(val); err != nil || a.interval <= 0 {
+					log.Fatalf("Invalid EVENT_ARCHIVE_FLUSH_INTERVAL: %q", val)
+				}
+			}
+			if val := os.Getenv("EVENT_ARCHIVE_MAX_BYTES"); val != "" {
+				if a.maxBytes, err = strconv.Atoi(val); err != nil || a.maxBytes <= 0 {
+					log.Fatalf("Invalid EVENT_ARCHIVE_MAX_BYTES: %q", val)
+				}
+			}
+			archive = a
+			archive.start()
+			defer archive.close()
+			notifier.backends = append(notifier.backends, archive)
+			log.Printf("Archiving events to gs://%s/%s every %v or %d bytes", bucket, prefix, a.interval, a.maxBytes)
+		}
+	}
 
-	message := fmt.Sprintf("GCP Instance Started\n"+
-		"```\n"+
-		"Name: %s\n"+
-		"ID: %s\n"+
-		"Zone: %s\n"+
-		"Type: %s\n"+
-		"Project: %s\n"+
-		"Stop after: %d hours\n"+
-		"```\n",
-		name, instanceID, zone, machineType, projectID, terminateAfterHours)
+	templates, err := loadTemplates()
+	if err != nil {
+		log.Fatalf("Failed to load message templates: %v", err)
+	}
+	data := messageData{
+		Instance:       inst,
+		Version:        versionString(),
+		TerminateAfter: terminateAfter,
+		GracePeriod:    gracePeriod,
+		CanTerminate:   true,
+		PollInterval:   live.checkInterval,
+		Started:        clock.Now(),
+		SoftTTL:        softTTL,
+	}
+	if os.Getenv("INCLUDE_CONFIG_IN_LAUNCH") == "true" {
+		data.Config = resolvedConfig()
+	}
+	// What the notifier can delete depends on who it runs as
+	if err := metaErrs["instance/service-accounts/default/email"]; err != nil {
+		log.Printf("No default service account, the Compute API can't be used: %v", err)
+		data.ServiceAccount = "none"
+	} else {
+		data.ServiceAccount = strings.TrimSpace(meta["instance/service-accounts/default/email"])
+		log.Printf("Running as service account %s", data.ServiceAccount)
+	}
+	if err := metaErrs["instance/scheduling/preemptible"]; err != nil {
+		log.Printf("Failed to get scheduling, provisioning model unknown: %v", err)
+	} else if model := classifyProvisioning(meta["instance/scheduling/preemptible"], meta["instance/scheduling/provisioning-model"]); model != "" {
+		data.setProvisioning(model, clock.Now())
+	}
 
-	sendSlackMessage(message)
+	var computeOpts []option.ClientOption
+	endpoint, err := computeEndpoint(zone)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if endpoint != "" {
+		log.Printf("Using Compute API endpoint %s", endpoint)
+		computeOpts = append(computeOpts, option.WithEndpoint(endpoint))
+	}
+	terminator := newComputeTerminator(computeOpts...)
 
-	startTime := time.Now()
-	terminateAfter := time.Duration(terminateAfterHours) * time.Hour
+	// A restart keeps the original start time, so the TTL isn't reset, what
+	// was already announced, and when each event last went out, for
+	// EVENT_COOLDOWN
+	var saved *savedState
+	if store, err := newStateStore(context.Background(), instanceID); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		state, err := store.Load(ctx)
+		if err != nil {
+			log.Printf("Failed to load saved state, starting fresh: %v", err)
+		}
+		// A VM preempted or stopped and then started again keeps its ID, but
+		// this is a new run with its own TTL and launch
+		if state.InstanceID == instanceID && state.ended() {
+			log.Printf("The saved state is from a run that ended (%s), starting fresh", state.Lifecycle)
+			state = notifierState{}
+		}
+		// Without saved state, TTL_FROM_CREATION counts from when the VM was
+		// created rather than from this process
+		var created time.Time
+		if (state.InstanceID != instanceID || state.Started.IsZero()) && os.Getenv("TTL_FROM_CREATION") == "true" && mockMetadataFile == "" {
+			if created, err = terminator.instanceCreated(ctx, projectID, zone, name); err != nil {
+				log.Printf("Failed to get the instance creation time, the TTL counts from now: %v", err)
+			}
+		}
+		var source string
+		data.Started, source = startTime(state, instanceID, created, clock.Now())
+		if source != "" {
+			log.Printf("TTL counts from %s, the %s", data.Started.Format(time.RFC3339), source)
+		}
+		if state.InstanceID != instanceID {
+			state = notifierState{}
+		}
+		state.InstanceID, state.Started = instanceID, data.Started
+		if err := store.Save(ctx, state); err != nil {
+			log.Printf("A restart will reset the TTL: %v", err)
+		}
+		cancel()
+		saved = &savedState{store: store, state: state}
 
-	for {
-		uptime := time.Since(startTime)
+		// An extension or cancellation from before the restart still holds
+		if state.TerminateAfter != nil {
+			terminateAfter, data.TerminateAfter = *state.TerminateAfter, *state.TerminateAfter
+			log.Printf("Using the TTL of %s set through the control endpoint", formatDuration(terminateAfter))
+		}
 
-		// 1. Check TTL (Self-Termination)
-		if uptime > terminateAfter {
-			sendSlackMessage(fmt.Sprintf("Instance `%s` in `%s` crossed uptime threshold. Will stop in %v", name, zone, gracePeriod))
-			log.Printf("Crossed uptime threshold. Stopping in %v", gracePeriod)
-			time.Sleep(gracePeriod)
+		if val := os.Getenv("EVENT_COOLDOWN"); val != "" {
+			if notifier.cooldown, err = time.ParseDuration(val); err != nil || notifier.cooldown < 0 {
+				log.Fatalf("Invalid EVENT_COOLDOWN: %q", val)
+			}
+			notifier.lastSent = maps.Clone(state.LastSent)
+			if notifier.lastSent == nil {
+				notifier.lastSent = map[EventKind]time.Time{}
+			}
+			notifier.onSent = func(kind EventKind, at time.Time) {
+				saved.update("Event cooldowns", func(state *notifierState) {
+					if state.LastSent == nil {
+						state.LastSent = map[EventKind]time.Time{}
+					}
+					if at.After(state.LastSent[kind]) {
+						state.LastSent[kind] = at
+					}
+				})
+			}
+		}
+	}
 
-			if err := terminateInstance(projectID, zone, name); err != nil {
-				log.Printf("Stopping failed: %v", err)
+	// Spot VMs are cheap enough to forget about; put a rough price on them.
+	// Looked up once: the per-hour price of a running VM barely moves.
+	var costEvery time.Duration
+	if val := os.Getenv("COST_REPORT_INTERVAL"); val != "" {
+		if costEvery, err = time.ParseDuration(val); err != nil || costEvery <= 0 {
+			log.Fatalf("Invalid COST_REPORT_INTERVAL: %q", val)
+		}
+	}
+	if os.Getenv("COST_ESTIMATE") == "true" || costEvery > 0 {
+		shape, ok := parseMachineShape(inst.MachineType)
+		ctx, cancel := context.WithTimeout(context.Background(), costLookupTimeout)
+		if !ok && mockMetadataFile == "" {
+			if s, err := terminator.machineShape(ctx, projectID, zone, inst.MachineType); err != nil {
+				log.Printf("Failed to look up machine type %s: %v", inst.MachineType, err)
+			} else {
+				shape, ok = s, true
+			}
+		}
+		if !ok {
+			log.Printf("Can't estimate the cost of machine type %s", inst.MachineType)
+		} else {
+			data.HourlyCost, data.CostSource, err = estimateHourlyCost(ctx, shape, regionOf(zone))
+			switch {
+			case data.HourlyCost == 0:
+				log.Printf("No price for machine type %s, notifications won't estimate cost: %v", inst.MachineType, err)
+			case err != nil:
+				log.Printf("Using an approximate price for %s, the Billing Catalog failed: %v", inst.MachineType, err)
+				fallthrough
+			default:
+				log.Printf("Estimated Spot cost of %s: %s/h (%s)", inst.MachineType, formatUSD(data.HourlyCost), data.CostSource)
 			}
-			break
 		}
+		cancel()
+	}
 
-		// 2. Check Spot/Preemptible Interruption
-		// GCP provides a 30-second warning via metadata
-		isPreempted, err := checkSpotTermination()
+	// Looked up once: the hierarchy doesn't change under a running VM
+	if os.Getenv("INCLUDE_ORG_CONTEXT") == "true" && mockMetadataFile == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), orgContextTimeout)
+		if data.Org, err = lookupOrgContext(ctx, inst.Project); err != nil {
+			log.Printf("Notifications will lack org context: %v", err)
+		} else {
+			log.Printf("Project %s (%s) is under %s", inst.Project, data.Org.ProjectName, data.Org.Parent)
+		}
+		cancel()
+	}
+
+	stats.incr("starts")
+
+	latencyEvery := defaultLatencyReportEvery
+	if val := os.Getenv("METADATA_LATENCY_REPORT_INTERVAL"); val != "" {
+		if latencyEvery, err = time.ParseDuration(val); err != nil || latencyEvery <= 0 {
+			log.Fatalf("Invalid METADATA_LATENCY_REPORT_INTERVAL: %q", val)
+		}
+	}
+	go reportMetadataLatency(latencyEvery)
+	if val := os.Getenv("RESOURCE_REPORT_INTERVAL"); val != "" {
+		every, err := time.ParseDuration(val)
+		if err != nil || every <= 0 {
+			log.Fatalf("Invalid RESOURCE_REPORT_INTERVAL: %q", val)
+		}
+		log.Printf("Notifier resources at startup: %s", readResourceUsage())
+		go reportResourceUsage(every)
+	}
+
+	// Don't re-announce the same VM when the container is crashlooping
+	markerPath := cmp.Or(os.Getenv("LAUNCH_MARKER_FILE"), defaultLaunchMarker)
+	dedupWindow := defaultLaunchDedupWindow
+	if val := os.Getenv("LAUNCH_DEDUP_WINDOW"); val != "" {
+		if dedupWindow, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("Invalid LAUNCH_DEDUP_WINDOW: %v", err)
+		}
+	}
+	// Someone deployed the notifier on an on-demand VM; only the TTL applies
+	notSpot := data.ProvisioningModel == ProvisioningStandard
+	if notSpot {
+		log.Printf("WARNING: not a Spot or preemptible VM, preemption monitoring is disabled")
+	}
+	announce := true
+	switch {
+	case saved.get().Launched:
+		log.Printf("Launch already announced before this restart, skipping launch notification")
+		announce = false
+	case recentLaunch(markerPath, instanceID, clock.Now(), dedupWindow):
+		log.Printf("Launch already announced within %v, skipping launch notification", dedupWindow)
+		announce = false
+	}
+	if announce {
+		// Spot fleets often keep running stale images
+		image := strings.TrimSpace(meta["instance/image"])
+		if _, name, ok := parseImagePath(image); ok {
+			data.Image = name
+		}
+		if mockMetadataFile == "" && os.Getenv("TERMINATION_CONTROLLER_URL") == "" {
+			ctx, cancel := context.WithTimeout(context.Background(), imageLookupTimeout)
+			img, err := terminator.bootImage(ctx, projectID, zone, name, image)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to look up the boot image: %v", err)
+			}
+			if img.Name != "" {
+				data.Image, data.ImageFamily, data.ImageCreated = img.Name, img.Family, img.Created
+			}
+		}
+		notifier.notifyThen(EventLaunched, templates.render(msgLaunch, data.at(clock.Now())), func() {
+			saved.update("The launch notification", func(state *notifierState) { state.Launched = true })
+			if err := writeLaunchMarker(markerPath, instanceID, clock.Now()); err != nil {
+				log.Printf("Launch notifications may repeat on restart: %v", err)
+			}
+		})
+		if notSpot && os.Getenv("NOT_SPOT_WARNING") != "false" {
+			notifier.notify(EventNotSpot, templates.render(msgNotSpot, data.at(clock.Now())))
+		}
+	}
+
+	notifyOnly := false
+	action, err := loadActionConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if action.steps != nil {
+		terminator.steps = action.steps
+	}
+	if action.snapshotTimeout > 0 {
+		terminator.snapshotTimeout = action.snapshotTimeout
+	}
+	terminator.dryRun = terminationDryRun(*dryRun)
+	if *dryRun {
+		log.Printf("Dry run: termination (%s) will only be logged and notified", terminator.Action())
+	}
+	terminator.forceWhenStopping = os.Getenv("TERMINATE_WHEN_STOPPING") == "true"
+	if val := os.Getenv("TERMINATION_ALLOWED_REGIONS"); val != "" {
+		for _, r := range strings.Split(val, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				terminator.allowedRegions = append(terminator.allowedRegions, r)
+			}
+		}
+		if !terminator.zoneAllowed(zone) {
+			log.Printf("WARNING: %s is not in TERMINATION_ALLOWED_REGIONS (%s): this VM will not be terminated", zone, val)
+		}
+	}
+	// Guards against deleting some other VM on bad metadata or config
+	if os.Getenv("VERIFY_INSTANCE_IDENTITY") != "false" {
+		terminator.self = inst
+	}
+	if val := os.Getenv("COMPUTE_MIN_CALL_INTERVAL"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid COMPUTE_MIN_CALL_INTERVAL: %q", val)
+		}
+		terminator.minCallInterval = d
+	}
+
+	// A controller terminating on our behalf needs no Compute client here
+	controllerURL := os.Getenv("TERMINATION_CONTROLLER_URL")
+	delegated := controllerURL != "" && !terminator.dryRun
+
+	// Without a Compute client we can still notify, just not terminate
+	if !terminator.dryRun && !delegated {
+		attempts, maxBackoff := defaultComputeInitAttempts, defaultComputeInitMaxBackoff
+		if val, err := strconv.Atoi(os.Getenv("COMPUTE_INIT_ATTEMPTS")); err == nil && val > 0 {
+			attempts = val
+		}
+		if val, err := time.ParseDuration(os.Getenv("COMPUTE_INIT_MAX_BACKOFF")); err == nil && val > 0 {
+			maxBackoff = val
+		}
+		if err := terminator.connect(context.Background(), attempts, maxBackoff); err != nil {
+			log.Printf("WARNING: Compute client unavailable, running in notify-only mode: %v", err)
+			notifyOnly = true
+			data.CanTerminate, data.MissingPermission = false, "a working Compute API client"
+		}
+	}
+
+	// Labels only matter to severity rules and Pub/Sub subscribers, and
+	// only the API has them
+	if (usesLabels(notifier.severityRules) || os.Getenv("PUBSUB_TOPIC") != "") && !terminator.dryRun && !notifyOnly && !delegated {
+		if notifier.labels, err = terminator.instanceLabels(context.Background(), projectID, zone, name); err != nil {
+			log.Printf("Events will go out without the instance labels: %v", err)
+		} else {
+			inst.Labels = notifier.labels
+			notifier.instance.Labels, data.Instance.Labels, exit.instance.Labels = inst.Labels, inst.Labels, inst.Labels
+		}
+	}
+
+	// Metadata can't always tell Spot from legacy preemptible; the API can
+	preemptible := strings.TrimSpace(meta["instance/scheduling/preemptible"]) == "TRUE"
+	if data.ProvisioningModel == "" && preemptible && !terminator.dryRun && !notifyOnly && !delegated {
+		if model, err := terminator.provisioningModel(context.Background(), projectID, zone, name); err != nil {
+			log.Printf("Failed to get provisioning model: %v", err)
+		} else {
+			data.setProvisioning(model, clock.Now())
+		}
+	}
+
+	// A misconfigured fleet can put "Spot" VMs where they aren't reclaimed
+	// like Spot; worth a warning once per launch
+	spot := data.ProvisioningModel == ProvisioningSpot || data.ProvisioningModel == ProvisioningPreemptible
+	if announce && spot && os.Getenv("PLACEMENT_WARNING") != "false" && !terminator.dryRun && !notifyOnly && !delegated {
+		if issues, err := terminator.placementIssues(context.Background(), projectID, zone, name); err != nil {
+			log.Printf("Failed to check placement: %v", err)
+		} else if len(issues) > 0 {
+			log.Printf("WARNING: unusual placement for a %s VM: %s", data.ProvisioningModel, strings.Join(issues, "; "))
+			data.PlacementIssues = issues
+			notifier.notify(EventPlacement, templates.render(msgPlacement, data.at(clock.Now())))
+		}
+	}
+
+	// Unless TERMINATE_ACTION says otherwise, do what GCP itself would do
+	// when it reclaims the VM
+	if action.steps == nil && !terminator.dryRun && !notifyOnly && !delegated {
+		configured, err := terminator.configuredAction(context.Background(), projectID, zone, name)
+		if err != nil {
+			log.Printf("Failed to read instanceTerminationAction, using %s: %v", terminator.steps[0], err)
+		} else if configured != "" {
+			terminator.steps = []string{configured}
+		}
+	}
+	if action.snapshotFirst && !slices.Contains(terminator.steps, "snapshot") {
+		terminator.steps = append([]string{"snapshot"}, terminator.steps...)
+	}
+	snapshotOnTTL := action.snapshotOnTTL
+	if snapshotOnTTL && slices.Contains(terminator.steps, "snapshot") {
+		log.Printf("SNAPSHOT_DISKS_ON_TTL is redundant, every termination already snapshots the disks")
+		snapshotOnTTL = false
+	}
+	if delegated {
+		log.Printf("Termination delegated to the controller at %s", controllerURL)
+	} else {
+		log.Printf("Termination action: %s", strings.Join(terminator.steps, " -> "))
+	}
+
+	// Find out early whether we'll actually be able to stop ourselves,
+	// so the alerts can tell operators if manual cleanup is needed.
+	if os.Getenv("SKIP_PERMISSION_CHECK") != "true" && !terminator.dryRun && !notifyOnly && !delegated {
+		allowed, missing, err := terminator.canTerminate(context.Background(), projectID, zone, name)
+		if errors.Is(err, errInsufficientScope) {
+			log.Printf("Termination will not work: %v", err)
+			data.CanTerminate, data.MissingPermission = false, "the compute access scope"
+		} else if err != nil {
+			log.Printf("Permission check failed, assuming termination is allowed: %v", err)
+		} else if !allowed {
+			log.Printf("Missing %s permission: TTL termination will not work", missing)
+			data.CanTerminate, data.MissingPermission = false, missing
+		}
+	}
+
+	monitor := &Monitor{
+		Instance:           inst,
+		Clock:              clock,
+		Terminator:         terminator,
+		Notifier:           notifier,
+		Templates:          templates,
+		TerminateAfter:     terminateAfter,
+		State:              saved,
+		SoftTTL:            softTTL,
+		GracePeriod:        gracePeriod,
+		MaxGracePeriod:     maxGracePeriod,
+		CheckInterval:      live.checkInterval,
+		WarnFraction:       live.warnFraction,
+		CostReportInterval: costEvery,
+		MaintenanceIgnore:  maintenanceIgnore,
+		PreemptHook:        cmp.Or(os.Getenv("PREEMPT_HOOK"), os.Getenv("DRAIN_COMMAND")),
+		OnPreempt:          PreemptHook,
+		PreemptHookTimeout: defaultPreemptHookTimeout,
+		SnapshotOnTTL:      snapshotOnTTL,
+		NotSpot:            notSpot,
+		NotifyOnly:         notifyOnly,
+		Data:               data,
+	}
+	// Spot VMs must TERMINATE; standard VMs using only the TTL may MIGRATE
+	if err := metaErrs["instance/scheduling/on-host-maintenance"]; err != nil {
+		log.Printf("Failed to get host maintenance policy, assuming TERMINATE: %v", err)
+	} else if policy := strings.TrimSpace(meta["instance/scheduling/on-host-maintenance"]); policy == "MIGRATE" {
+		monitor.LiveMigrate = true
+		log.Printf("Host maintenance policy is MIGRATE: maintenance events won't end the VM")
+	}
+	if delegated {
+		monitor.Terminator = &controllerTerminator{url: controllerURL}
+	} else if last := terminator.steps[len(terminator.steps)-1]; last == "stop" || last == "suspend" {
+		monitor.CleanupAction = last
+	}
+
+	if spec := os.Getenv("FREEZE_WINDOW"); spec != "" {
+		loc, err := time.LoadLocation(os.Getenv("FREEZE_WINDOW_TZ")) // Empty means UTC
+		if err != nil {
+			log.Fatalf("Invalid FREEZE_WINDOW_TZ: %v", err)
+		}
+		if monitor.FreezeWindow, err = parseTimeWindow(spec, loc); err != nil {
+			log.Fatalf("Invalid FREEZE_WINDOW: %v", err)
+		}
+		log.Printf("Change freeze %s: TTL termination waits until it is over", monitor.FreezeWindow)
+	}
+
+	monitor.SchedulingCheckInterval = defaultSchedulingCheckInterval
+	if val := os.Getenv("SCHEDULING_CHECK_INTERVAL"); val != "" {
+		if monitor.SchedulingCheckInterval, err = time.ParseDuration(val); err != nil || monitor.SchedulingCheckInterval < 0 {
+			log.Fatalf("Invalid SCHEDULING_CHECK_INTERVAL: %q", val)
+		}
+	}
+	if val := os.Getenv("METADATA_FAILURE_RATE"); val != "" {
+		rate := &failureRate{window: defaultFailureRateWindow}
+		if rate.threshold, err = strconv.ParseFloat(val, 64); err != nil || rate.threshold <= 0 || rate.threshold >= 1 {
+			log.Fatalf("Invalid METADATA_FAILURE_RATE: %q (want a number between 0 and 1)", val)
+		}
+		if val := os.Getenv("METADATA_FAILURE_WINDOW"); val != "" {
+			if rate.window, err = time.ParseDuration(val); err != nil || rate.window <= 0 {
+				log.Fatalf("Invalid METADATA_FAILURE_WINDOW: %q", val)
+			}
+		}
+		monitor.MetadataFailures = rate
+		log.Printf("Alerting when over %g%% of metadata reads fail within %v", rate.threshold*100, rate.window)
+	}
+	monitor.DrainCheckURL = os.Getenv("DRAIN_CHECK_URL")
+	if monitor.CompletionMarker = os.Getenv("COMPLETION_MARKER"); monitor.CompletionMarker != "" {
+		log.Printf("Retiring the VM once %s appears", monitor.CompletionMarker)
+	}
+	monitor.TerminateRetryWindow = defaultTerminateRetryWindow
+	if val := os.Getenv("SELF_TERMINATE_RETRY_WINDOW"); val != "" {
+		if monitor.TerminateRetryWindow, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("Invalid SELF_TERMINATE_RETRY_WINDOW: %v", err)
+		}
+	}
+	if val := os.Getenv("TERMINATION_TIMEOUT"); val != "" {
+		if monitor.TerminationTimeout, err = time.ParseDuration(val); err != nil || monitor.TerminationTimeout < 0 {
+			log.Fatalf("Invalid TERMINATION_TIMEOUT: %q", val)
+		}
+		if monitor.TerminationTimeout > 0 && monitor.TerminationTimeout < monitor.TerminateRetryWindow {
+			log.Printf("WARNING: TERMINATION_TIMEOUT %v cuts SELF_TERMINATE_RETRY_WINDOW %v short", monitor.TerminationTimeout, monitor.TerminateRetryWindow)
+		}
+	}
+	monitor.EscalationIntervals = defaultEscalationIntervals
+	if val, ok := os.LookupEnv("ESCALATION_INTERVALS"); ok {
+		if monitor.EscalationIntervals, err = parseDurations(val); err != nil {
+			log.Fatalf("Invalid ESCALATION_INTERVALS: %v", err)
+		}
+	}
+	monitor.MaxEscalations = len(monitor.EscalationIntervals)
+	if val := os.Getenv("ESCALATION_MAX_ALERTS"); val != "" {
+		if monitor.MaxEscalations, err = strconv.Atoi(val); err != nil || monitor.MaxEscalations < 0 {
+			log.Fatalf("Invalid ESCALATION_MAX_ALERTS: %q", val)
+		}
+	}
+
+	if val := os.Getenv("PREEMPTION_SURVIVAL_WINDOW"); val != "" {
+		if monitor.SurvivalWindow, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("Invalid PREEMPTION_SURVIVAL_WINDOW: %v", err)
+		}
+	}
+	if val := os.Getenv("PREEMPTION_SURVIVAL_POLL_INTERVAL"); val != "" {
+		if monitor.SurvivalPollInterval, err = time.ParseDuration(val); err != nil || monitor.SurvivalPollInterval <= 0 {
+			log.Fatalf("Invalid PREEMPTION_SURVIVAL_POLL_INTERVAL: %q", val)
+		}
+	}
+
+	// GCP's ACPI soft-off reaches us as SIGTERM, often before the next poll
+	monitor.Shutdown = notifyOnSIGTERM()
+
+	// A shutdown script can signal preemption faster than the metadata flag
+	if path := os.Getenv("PREEMPT_SIGNAL_FILE"); path != "" {
+		monitor.PreemptSignal = watchSignalFile(path)
+		log.Printf("Watching %s for preemption signals", path)
+	}
+
+	// Hanging GETs catch a change within a second or so, whatever the
+	// CHECK_INTERVAL
+	if mockMetadataFile == "" && os.Getenv("METADATA_WATCH") != "false" {
+		paths := []string{"instance/maintenance-event"}
+		if !notSpot {
+			paths = append(paths, "instance/preempted")
+		}
+		monitor.MetadataChanged = watchMetadata(paths...)
+		log.Printf("Watching %s for changes", strings.Join(paths, " and "))
+	}
+
+	switch action := PreemptAction(os.Getenv("ON_PREEMPT_ACTION")); action {
+	case "":
+	case PreemptNotify, PreemptHook, PreemptDelete:
+		monitor.OnPreempt = action
+	default:
+		log.Fatalf("Invalid ON_PREEMPT_ACTION: %q (want notify, hook or delete)", action)
+	}
+	log.Printf("On preemption: %s", monitor.OnPreempt)
+
+	switch action := PreemptAction(os.Getenv("GRACE_PREEMPT_ACTION")); action {
+	case "":
+	case PreemptNotify, PreemptHook, PreemptDelete:
+		monitor.GracePreemptAction = action
+	default:
+		log.Fatalf("Invalid GRACE_PREEMPT_ACTION: %q (want notify, hook or delete)", action)
+	}
+
+	if val := os.Getenv("GRACE_WARNINGS"); val != "" {
+		for _, field := range strings.Split(val, ",") {
+			pct, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil || pct <= 0 || pct >= 100 || len(monitor.GraceWarnings) > 0 && pct <= monitor.GraceWarnings[len(monitor.GraceWarnings)-1] {
+				log.Fatalf("Invalid GRACE_WARNINGS: %q (want ascending percentages, e.g. 50,75,90,95,99)", val)
+			}
+			monitor.GraceWarnings = append(monitor.GraceWarnings, pct)
+		}
+	}
+
+	monitor.SIGTERMAction, monitor.SIGTERMCheckWindow = SIGTERMCheck, defaultSIGTERMCheckWindow
+	switch action := SIGTERMAction(os.Getenv("SIGTERM_ACTION")); action {
+	case "":
+	case SIGTERMCheck, SIGTERMPreemption, SIGTERMExit:
+		monitor.SIGTERMAction = action
+	default:
+		log.Fatalf("Invalid SIGTERM_ACTION: %q (want check, preemption or exit)", action)
+	}
+	if val := os.Getenv("SIGTERM_CHECK_WINDOW"); val != "" {
+		if monitor.SIGTERMCheckWindow, err = time.ParseDuration(val); err != nil || monitor.SIGTERMCheckWindow < 0 || monitor.SIGTERMCheckWindow > maxSIGTERMCheckWindow {
+			log.Fatalf("Invalid SIGTERM_CHECK_WINDOW: %q (want a duration up to %v)", val, maxSIGTERMCheckWindow)
+		}
+	}
+
+	if monitor.DrainCommand = os.Getenv("DRAIN_COMMAND"); monitor.DrainCommand != "" {
+		monitor.DrainTimeout = defaultDrainTimeout
+		if val := os.Getenv("DRAIN_TIMEOUT"); val != "" {
+			if monitor.DrainTimeout, err = time.ParseDuration(val); err != nil || monitor.DrainTimeout <= 0 {
+				log.Fatalf("Invalid DRAIN_TIMEOUT: %q", val)
+			}
+		}
+		if os.Getenv("PREEMPT_HOOK") == "" {
+			monitor.PreemptHookTimeout = monitor.DrainTimeout
+		}
+		log.Printf("Running the drain command for up to %v before terminating", monitor.DrainTimeout)
+	}
+	if spec := os.Getenv("SHUTDOWN_HOOKS"); spec != "" {
+		if monitor.ShutdownHooks, err = parseShutdownHooks(spec); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		log.Printf("Running %d shutdown hooks on preemption and at the start of the grace period", len(monitor.ShutdownHooks))
+	}
+	if val := os.Getenv("PREEMPT_HOOK_TIMEOUT"); val != "" {
+		if monitor.PreemptHookTimeout, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("Invalid PREEMPT_HOOK_TIMEOUT: %v", err)
+		}
+		if monitor.PreemptHookTimeout > preemptionBudget {
+			log.Printf("WARNING: PREEMPT_HOOK_TIMEOUT %v is longer than GCP's preemption notice, the hook will be cut off at %v", monitor.PreemptHookTimeout, preemptionBudget)
+		}
+	}
+	if val := os.Getenv("PREEMPT_HOOK_DELAY"); val != "" {
+		if monitor.PreemptHookDelay, err = time.ParseDuration(val); err != nil || monitor.PreemptHookDelay < 0 || monitor.PreemptHookDelay > maxPreemptHookDelay {
+			log.Fatalf("Invalid PREEMPT_HOOK_DELAY: %q (want a duration up to %v)", val, maxPreemptHookDelay)
+		}
+	}
+
+	if bucket := os.Getenv("PREEMPTION_COUNTER_BUCKET"); bucket != "" && !terminator.dryRun {
+		counter, err := newGCSCounter(context.Background(), bucket, cmp.Or(os.Getenv("PREEMPTION_COUNTER_OBJECT"), defaultCounterObject))
+		if err != nil {
+			log.Printf("Shared preemption counter disabled: %v", err)
+		} else {
+			monitor.Counter, monitor.PreemptionWindow = counter, defaultPreemptionWindow
+			if val := os.Getenv("PREEMPTION_COUNT_WINDOW"); val != "" {
+				if monitor.PreemptionWindow, err = time.ParseDuration(val); err != nil {
+					log.Fatalf("Invalid PREEMPTION_COUNT_WINDOW: %v", err)
+				}
+			}
+			monitor.FamilyThreshold = defaultFamilyThreshold
+			if val := os.Getenv("FAMILY_PREEMPTION_THRESHOLD"); val != "" {
+				if monitor.FamilyThreshold, err = strconv.Atoi(val); err != nil || monitor.FamilyThreshold < 0 {
+					log.Fatalf("Invalid FAMILY_PREEMPTION_THRESHOLD: %q", val)
+				}
+			}
+			monitor.CapacityCheckInterval = defaultCapacityCheckInterval
+			if val := os.Getenv("CAPACITY_CHECK_INTERVAL"); val != "" {
+				if monitor.CapacityCheckInterval, err = time.ParseDuration(val); err != nil || monitor.CapacityCheckInterval < 0 {
+					log.Fatalf("Invalid CAPACITY_CHECK_INTERVAL: %q", val)
+				}
+			}
+		}
+	}
+
+	if bucket := os.Getenv("AUDIT_BUCKET"); bucket != "" && !terminator.dryRun {
+		audit, err := newGCSAuditLog(context.Background(), bucket, cmp.Or(os.Getenv("AUDIT_PREFIX"), defaultAuditPrefix))
+		if err != nil {
+			log.Printf("Audit records disabled: %v", err)
+		} else {
+			monitor.Audit = audit
+			log.Printf("Writing audit records to gs://%s/%s", bucket, audit.prefix)
+		}
+	}
+
+	if url := os.Getenv("SELF_HEALTH_URL"); url != "" {
+		monitor.Health = &healthChecker{url: url, threshold: defaultHealthFailures, minDuration: defaultHealthDuration}
+		if val := os.Getenv("SELF_HEALTH_FAILURES"); val != "" {
+			if monitor.Health.threshold, err = strconv.Atoi(val); err != nil || monitor.Health.threshold < 1 {
+				log.Fatalf("Invalid SELF_HEALTH_FAILURES: %q", val)
+			}
+		}
+		if val := os.Getenv("SELF_HEALTH_DURATION"); val != "" {
+			if monitor.Health.minDuration, err = time.ParseDuration(val); err != nil {
+				log.Fatalf("Invalid SELF_HEALTH_DURATION: %v", err)
+			}
+		}
+		log.Printf("Retiring the VM if %s fails %d checks over %v", url, monitor.Health.threshold, monitor.Health.minDuration)
+	}
+
+	if val := os.Getenv("MAX_SPOT_PRICE"); val != "" {
+		limit, err := strconv.ParseFloat(val, 64)
+		if err != nil || limit <= 0 {
+			log.Fatalf("Invalid MAX_SPOT_PRICE: %q", val)
+		}
+		url := os.Getenv("SPOT_PRICE_URL")
+		if url == "" {
+			log.Fatalf("MAX_SPOT_PRICE needs SPOT_PRICE_URL")
+		}
+		monitor.Price = newPriceChecker(url, limit, inst)
+		if val := os.Getenv("SPOT_PRICE_CHECK_INTERVAL"); val != "" {
+			if monitor.Price.interval, err = time.ParseDuration(val); err != nil {
+				log.Fatalf("Invalid SPOT_PRICE_CHECK_INTERVAL: %v", err)
+			}
+		}
+		log.Printf("Retiring the VM if its Spot price goes over %v, checked every %v", limit, monitor.Price.interval)
+	}
+
+	// A dashboard or Prometheus can scrape the loop's state, and a load
+	// balancer drain the VM on /healthz
+	if addr := cmp.Or(os.Getenv("STATUS_ADDR"), defaultStatusAddr); addr != "off" {
+		status, err := startStatusServer(addr, clock, inst)
 		if err != nil {
-			log.Printf("Spot termination check failed: %v", err)
-		} else if isPreempted {
-			sendSlackMessage(fmt.Sprintf("🚨 Instance `%s` in `%s` is being PREEMPTED by GCP", name, zone))
-			// We break loop, but GCP will likely kill the VM forcefully in <30s
-			break
+			log.Printf("WARNING: status endpoint disabled: %v", err)
+		} else {
+			log.Printf("Serving status on http://%s/status and /metrics", status.addr)
+			// Under a trace, scrapes link the preemption to it
+			if tp := os.Getenv("TRACEPARENT"); tp != "" {
+				if status.traceID = traceID(tp); status.traceID == "" {
+					log.Printf("Ignoring TRACEPARENT: %q is not a W3C traceparent", tp)
+				}
+			}
+			monitor.Status = status
+			notifier.status = status
+		}
+	}
+
+	// Someone on the VM can postpone or cancel the TTL when work runs long
+	var control *controlServer
+	if addr := os.Getenv("CONTROL_ADDR"); addr != "" {
+		var err error
+		if control, err = startControlServer(addr); err != nil {
+			log.Printf("WARNING: control endpoint disabled: %v", err)
+		} else {
+			log.Printf("Taking control commands on %s", addr)
+			monitor.Control = control.commands
+		}
+	}
+
+	// A restart picks up where the last process was, not from launched
+	var hook *stateWebhook
+	if url := os.Getenv("STATE_WEBHOOK_URL"); url != "" {
+		hook = newStateWebhook(url)
+		defer hook.drain()
+	}
+	send := func(event transitionEvent) {
+		history.transition(event)
+		monitor.Status.transition(event)
+		if hook != nil {
+			hook.send(event)
+		}
+	}
+	monitor.Lifecycle = &lifecycle{clock: clock, instance: inst, send: send, saved: saved}
+	if saved.get().Lifecycle == "" {
+		monitor.Lifecycle.enter(StateLaunched, ReasonNone)
+	}
+
+	// Last resort for a wedged process: let the supervisor start a fresh one
+	if val := os.Getenv("MAX_PROCESS_LIFETIME"); val != "" {
+		lifetime, err := time.ParseDuration(val)
+		if err != nil || lifetime <= 0 {
+			log.Fatalf("Invalid MAX_PROCESS_LIFETIME: %q", val)
+		}
+		time.AfterFunc(lifetime, func() {
+			log.Printf("Reached MAX_PROCESS_LIFETIME of %v, exiting", lifetime)
+			notifier.notify(EventNotifierExiting, fmt.Sprintf("♻️ The notifier on `%s` in `%s` is exiting after %s (MAX_PROCESS_LIFETIME), whatever it was doing. Its supervisor should restart it",
+				name, zone, formatDuration(lifetime)))
+			exit.reason = "max-lifetime"
+			archive.close()
+			history.export(exit.instance, exit.reason)
+			exit.fire()
+			os.Exit(1)
+		})
+	}
+
+	monitor.TerminateNow = notifyOnSIGUSR1()
+	monitor.TerminateNowSkipGrace = os.Getenv("TERMINATE_NOW_SKIP_GRACE") == "true"
+
+	monitor.Reload = notifyOnSIGHUP()
+	monitor.OnReload = func() {
+		if err := reloadConfig(monitor, slack); err != nil {
+			log.Printf("Reload failed, keeping current settings: %v", err)
 		}
+	}
 
-		timeLeft := terminateAfter - uptime
-		log.Printf("Time left: %v", timeLeft.Truncate(time.Second))
-		time.Sleep(checkInterval)
+	if os.Getenv("INCLUDE_SERIAL_OUTPUT") == "true" && !terminator.dryRun && !notifyOnly {
+		serialBytes := defaultSerialOutputBytes
+		if val := os.Getenv("SERIAL_OUTPUT_BYTES"); val != "" {
+			if serialBytes, err = strconv.Atoi(val); err != nil || serialBytes < 1 {
+				log.Fatalf("Invalid SERIAL_OUTPUT_BYTES: %q", val)
+			}
+		}
+		monitor.SerialOutput = func(ctx context.Context) (string, error) {
+			svc, err := terminator.service(ctx)
+			if err != nil {
+				return "", err
+			}
+			return serialTail(ctx, svc, projectID, zone, name, serialBytes)
+		}
 	}
-}
\ No newline at end of file
+
+	// A dry run lists the group and reports it; mock metadata has no real
+	// project to list
+	if group.label != "" && mockMetadataFile == "" {
+		monitor.GroupLabel, monitor.GroupConfirmWindow = group.label, group.confirmWindow
+		monitor.FindGroup = func(ctx context.Context) ([]groupMember, error) {
+			return findGroup(ctx, terminator, projectID, zone, name, group.label, group.zones)
+		}
+		monitor.TerminateGroup = func(ctx context.Context, members []groupMember) (groupResult, error) {
+			return terminateGroup(ctx, terminator, projectID, members, group.concurrency)
+		}
+	}
+
+	// Under systemd, report readiness and let its watchdog restart a wedged loop
+	monitor.Watchdog = sdWatchdog(monitor.CheckInterval)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to report readiness: %v", err)
+	}
+
+	interrupted := monitor.Run()
+	for interrupted && monitor.survived() {
+		interrupted = monitor.Run()
+	}
+	monitor.Status.close()
+	control.close()
+	notifier.flush() // Don't lose a batch still inside the coalescing window
+	if monitor.groupFailed || monitor.timedOut {
+		exitCode = 1
+	}
+	exit.reason = cmp.Or(string(monitor.Data.Reason), exit.reason)
+	if monitor.Watchdog != nil {
+		// Nothing left to wedge; keep systemd happy until we're stopped
+		go func() {
+			for range time.Tick(monitor.CheckInterval) {
+				monitor.Watchdog()
+			}
+		}()
+	}
+	if interrupted {
+		trace := os.Getenv("PREEMPTION_TRACE") == "true"
+		if trace {
+			go monitor.tracePreemption()
+		}
+		waitForShutdown(monitor.Shutdown)
+		if trace {
+			// SIGTERM is only the OS going down; keep tracing until it kills us
+			history.export(exit.instance, exit.reason)
+			exit.fire()
+			log.Printf("Still tracing until the VM goes down")
+			select {}
+		}
+	}
+}
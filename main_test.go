@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	for _, tc := range []struct {
+		val  string
+		want time.Duration
+		ok   bool
+	}{
+		{"90m", 90 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"12", 12 * time.Hour, true},
+		{" 1.5 ", 90 * time.Minute, true},
+		{"never", 0, true},
+		{"soon", 0, false},
+		{"1.5.2", 0, false},
+		{"-1", 0, false},
+		{"-30m", 0, false},
+		{"0", 0, false},
+		{"0s", 0, false},
+	} {
+		got, err := parseTTL("TERMINATE_AFTER_HOURS", tc.val)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseTTL(%q) = %v, %v; want %v, ok %v", tc.val, got, err, tc.want, tc.ok)
+		}
+		if err != nil && !strings.Contains(err.Error(), "TERMINATE_AFTER_HOURS") {
+			t.Errorf("parseTTL(%q) error %q doesn't name the setting", tc.val, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultLaunchDedupWindow = time.Hour
+
+// defaultLaunchMarker survives a container restart (though not a new
+// container); point LAUNCH_MARKER_FILE at a volume for more.
+var defaultLaunchMarker = filepath.Join(os.TempDir(), "spot-notifier-launch.json")
+
+// launchMarker records the last launch notification, so a crashlooping
+// notifier doesn't announce the same VM on every restart.
+type launchMarker struct {
+	InstanceID string    `json:"instanceID"`
+	NotifiedAt time.Time `json:"notifiedAt"`
+}
+
+// recentLaunch reports whether the marker at path says this instance was
+// already announced within window. A missing or unreadable marker means no.
+func recentLaunch(path, instanceID string, now time.Time, window time.Duration) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var m launchMarker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false
+	}
+	return m.InstanceID == instanceID && now.Sub(m.NotifiedAt) < window
+}
+
+// writeLaunchMarker records that instanceID was announced at now.
+func writeLaunchMarker(path, instanceID string, now time.Time) error {
+	data, err := json.Marshal(launchMarker{InstanceID: instanceID, NotifiedAt: now})
+	if err != nil {
+		return fmt.Errorf("failed to marshal launch marker: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write launch marker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLaunchMarkerDedupWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "launch.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if recentLaunch(path, "123", now, time.Hour) {
+		t.Error("recentLaunch without a marker = true")
+	}
+	if err := writeLaunchMarker(path, "123", now); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		instanceID string
+		at         time.Time
+		want       bool
+	}{
+		{"fresh marker", "123", now.Add(59 * time.Minute), true},
+		{"expired marker", "123", now.Add(time.Hour), false},
+		{"another instance", "456", now.Add(time.Minute), false},
+	} {
+		if got := recentLaunch(path, tc.instanceID, tc.at, time.Hour); got != tc.want {
+			t.Errorf("%s: recentLaunch = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if recentLaunch(path, "123", now, time.Hour) {
+		t.Error("recentLaunch with a corrupt marker = true")
+	}
+}
+
+func TestWriteLaunchMarkerUnwritablePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing-dir", "launch.json")
+	if err := writeLaunchMarker(path, "123", time.Now()); err == nil {
+		t.Error("writeLaunchMarker into a missing directory succeeded")
+	}
+	if recentLaunch(path, "123", time.Now(), time.Hour) {
+		t.Error("recentLaunch after a failed write = true")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"spot-notifier-gcp/metadata"
+)
+
+// metadataBase is the GCP Metadata Server. GCE_METADATA_HOST, as honored by
+// Google's client libraries, points it elsewhere, e.g. at an emulator.
+var metadataBase = metadata.DefaultBase
+
+// mockMetadataFile is set from MOCK_METADATA. When non-empty, metadata reads
+// are answered locally instead of hitting the metadata server.
+var mockMetadataFile string
+
+// mockMetadataDefaults are the values served in mock mode unless overridden.
+var mockMetadataDefaults = map[string]string{
+	"instance/id":                             "1234567890",
+	"instance/name":                           "mock-instance",
+	"instance/zone":                           "projects/123/zones/us-central1-a",
+	"instance/machine-type":                   "projects/123/machineTypes/e2-small",
+	"instance/image":                          "projects/debian-cloud/global/images/debian-12-bookworm-v20260901",
+	"instance/preempted":                      "FALSE",
+	"instance/maintenance-event":              "NONE",
+	"instance/scheduling/on-host-maintenance": "TERMINATE",
+	"instance/scheduling/preemptible":         "TRUE",
+	"instance/scheduling/provisioning-model":  "SPOT",
+	"instance/service-accounts/default/email": "notifier@mock-project.iam.gserviceaccount.com",
+	"project/project-id":                      "mock-project",
+}
+
+// getMetadata fetches data from GCP metadata server, timing each request.
+func getMetadata(path string) (string, error) {
+	return pollMetadata().Get(context.Background(), path)
+}
+
+// pollMetadata is the client for the monitor's polls and the startup reads.
+// There are no retries: the next poll is one, and a startup read that fails
+// is reported per key.
+func pollMetadata() *metadata.Client {
+	return &metadata.Client{Base: metadataBase, HTTP: metadataPollClient}
+}
+
+// metadataPollClient times each request for the latency report, and answers
+// from the mock values under MOCK_METADATA.
+var metadataPollClient = &http.Client{
+	Timeout:   metadataTimeout,
+	Transport: metadataTransport{next: metadataClient.Transport},
+}
+
+type metadataTransport struct{ next http.RoundTripper }
+
+func (t metadataTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(r.URL.String(), metadataBase)
+	if mockMetadataFile != "" {
+		return mockMetadataResponse(r, path)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	elapsed := time.Since(start)
+	metadataLatency.record(elapsed)
+	stats.timing(metadataLatencyMetric, elapsed)
+	if elapsed >= slowMetadataRequest {
+		log.Printf("Slow metadata request: %s took %v", path, elapsed.Truncate(time.Millisecond))
+	}
+	return resp, err
+}
+
+// mockMetadataResponse answers r as the metadata server would, from
+// getMockMetadata.
+func mockMetadataResponse(r *http.Request, path string) (*http.Response, error) {
+	status := http.StatusOK
+	v, err := getMockMetadata(path)
+	var statusErr *metadata.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		status = statusErr.Code
+	case err != nil:
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Metadata-Flavor": {"Google"}},
+		Body:       io.NopCloser(strings.NewReader(v)),
+		Request:    r,
+	}, nil
+}
+
+// defaultMetadataPrefetch bounds how many metadata keys are fetched at once.
+const defaultMetadataPrefetch = 5
+
+// prefetchMetadata fetches keys concurrently, at most limit at a time. Each
+// key gets its own result, so callers decide which failures are fatal.
+func prefetchMetadata(keys []string, limit int) (values map[string]string, errs map[string]error) {
+	var (
+		mu sync.Mutex
+		g  errgroup.Group
+	)
+	values, errs = make(map[string]string, len(keys)), map[string]error{}
+	g.SetLimit(max(limit, 1))
+	for _, key := range keys {
+		g.Go(func() error {
+			v, err := getMetadata(key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[key] = err
+			} else {
+				values[key] = v
+			}
+			return nil // Keep fetching the rest
+		})
+	}
+	g.Wait()
+	return values, errs
+}
+
+// instanceMetadata is the instance/ tree as one JSON document, from
+// instance/?recursive=true.
+type instanceMetadata struct {
+	ID          json.Number `json:"id"`
+	Name        string      `json:"name"`
+	Hostname    string      `json:"hostname"`
+	Zone        string      `json:"zone"`
+	MachineType string      `json:"machineType"`
+	Image       string      `json:"image"`
+	Preempted   string      `json:"preempted"`
+	Scheduling  struct {
+		AutomaticRestart  string `json:"automaticRestart"`
+		OnHostMaintenance string `json:"onHostMaintenance"`
+		Preemptible       string `json:"preemptible"`
+		ProvisioningModel string `json:"provisioningModel"`
+	} `json:"scheduling"`
+	Disks []struct {
+		DeviceName string `json:"deviceName"`
+		Index      int    `json:"index"`
+		Mode       string `json:"mode"`
+		Type       string `json:"type"`
+	} `json:"disks"`
+	NetworkInterfaces []struct {
+		IP      string `json:"ip"`
+		Network string `json:"network"`
+	} `json:"networkInterfaces"`
+	ServiceAccounts map[string]struct {
+		Email string `json:"email"`
+	} `json:"serviceAccounts"`
+	Attributes map[string]string `json:"attributes"`
+	Tags       []string          `json:"tags"`
+}
+
+// startupMetadataRetries ride out a metadata server still coming up on a
+// freshly booted VM. Only the startup read retries; the polls don't.
+const (
+	startupMetadataRetries = 3
+	startupMetadataBackoff = 500 * time.Millisecond
+)
+
+// getInstanceMetadata reads the whole instance/ tree in one request.
+func getInstanceMetadata() (*instanceMetadata, error) {
+	const key = "instance/?recursive=true"
+	var (
+		body string
+		err  error
+	)
+	if mockMetadataFile != "" {
+		body, err = getMockMetadata(key)
+	} else {
+		client := &metadata.Client{Base: metadataBase, HTTP: metadataClient, Retries: startupMetadataRetries, Backoff: startupMetadataBackoff}
+		body, err = client.Get(context.Background(), key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var im instanceMetadata
+	if err := json.Unmarshal([]byte(body), &im); err != nil {
+		return nil, fmt.Errorf("failed to parse instance metadata: %w", err)
+	}
+	return &im, nil
+}
+
+// values returns the tree's fields keyed by their metadata paths, as
+// getMetadata would return them. Empty fields are left out.
+func (im *instanceMetadata) values() map[string]string {
+	values := map[string]string{}
+	for key, v := range map[string]string{
+		"instance/id":                             im.ID.String(),
+		"instance/name":                           im.Name,
+		"instance/hostname":                       im.Hostname,
+		"instance/zone":                           im.Zone,
+		"instance/machine-type":                   im.MachineType,
+		"instance/image":                          im.Image,
+		"instance/preempted":                      im.Preempted,
+		"instance/scheduling/automatic-restart":   im.Scheduling.AutomaticRestart,
+		"instance/scheduling/on-host-maintenance": im.Scheduling.OnHostMaintenance,
+		"instance/scheduling/preemptible":         im.Scheduling.Preemptible,
+		"instance/scheduling/provisioning-model":  im.Scheduling.ProvisioningModel,
+		"instance/service-accounts/default/email": im.ServiceAccounts["default"].Email,
+	} {
+		if v != "" {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// readMetadata is prefetchMetadata taking the instance/ keys from a single
+// recursive read where it can. Keys outside instance/, or missing from the
+// tree, are still fetched one by one.
+func readMetadata(keys []string, limit int) (values map[string]string, errs map[string]error) {
+	im, err := getInstanceMetadata()
+	if err != nil {
+		if mockMetadataFile == "" {
+			log.Printf("Recursive metadata read failed, fetching keys one by one: %v", err)
+		}
+		return prefetchMetadata(keys, limit)
+	}
+
+	tree := im.values()
+	values = map[string]string{}
+	var rest []string
+	for _, key := range keys {
+		if v, ok := tree[key]; ok {
+			values[key] = v
+		} else {
+			rest = append(rest, key)
+		}
+	}
+	more, errs := prefetchMetadata(rest, limit)
+	maps.Copy(values, more)
+	return values, errs
+}
+
+// getMockMetadata serves a key from the mock defaults, overridden by the JSON
+// object in the mock file if one is given. The file is re-read on every call,
+// so editing it (e.g. setting "instance/preempted" to "TRUE") takes effect live.
+func getMockMetadata(path string) (string, error) {
+	values := mockMetadataDefaults
+	if mockMetadataFile != "true" {
+		data, err := os.ReadFile(mockMetadataFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read mock metadata: %w", err)
+		}
+		overrides := map[string]string{}
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return "", fmt.Errorf("failed to parse mock metadata: %w", err)
+		}
+		if v, ok := overrides[path]; ok {
+			return v, nil
+		}
+	}
+
+	v, ok := values[path]
+	if !ok {
+		return "", &metadata.StatusError{Path: path, Code: http.StatusNotFound}
+	}
+	return v, nil
+}
+
+// isNotOnGCP reports whether a metadata error means there is no metadata
+// server at all, which is what happens when running off a GCP VM.
+func isNotOnGCP(err error) bool {
+	return metadata.IsNotOnGCP(err)
+}
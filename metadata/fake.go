@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake is a metadata server for tests. It serves the values set on it with
+// the header and ETags the real one sends, holds wait_for_change requests
+// until the value changes, and keeps what is PUT, like guest attributes.
+type Fake struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	values   map[string]string
+	versions map[string]int
+	changed  chan struct{} // closed and replaced on every change
+	failures []int         // status codes for the next requests
+}
+
+// NewFake starts a Fake serving values, keyed by path, e.g.
+// "instance/preempted". Close it when done.
+func NewFake(values map[string]string) *Fake {
+	f := &Fake{values: map[string]string{}, versions: map[string]int{}, changed: make(chan struct{})}
+	for path, v := range values {
+		f.values[path] = v
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Base is the URL to use as a Client's Base.
+func (f *Fake) Base() string {
+	return f.srv.URL + "/computeMetadata/v1/"
+}
+
+// Client returns a Client for the Fake, without retries.
+func (f *Fake) Client() *Client {
+	return &Client{Base: f.Base(), HTTP: f.srv.Client()}
+}
+
+// Set changes the value at path, waking anyone waiting for it.
+func (f *Fake) Set(path, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(path, value)
+}
+
+// Get returns the value at path, as last Set or PUT.
+func (f *Fake) Get(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[path]
+	return v, ok
+}
+
+// Fail answers the next requests with these status codes, in turn.
+func (f *Fake) Fail(codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, codes...)
+}
+
+func (f *Fake) Close() {
+	f.srv.Close()
+}
+
+func (f *Fake) set(path, value string) {
+	f.values[path] = value
+	f.versions[path]++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *Fake) etag(path string) string {
+	return strconv.Itoa(f.versions[path])
+}
+
+func (f *Fake) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Metadata-Flavor", "Google")
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")
+	if q := r.URL.RawQuery; q != "" && r.URL.Query().Get("wait_for_change") == "" {
+		path += "?" + q // e.g. instance/?recursive=true is a key of its own
+	}
+
+	f.mu.Lock()
+	if len(f.failures) > 0 {
+		code := f.failures[0]
+		f.failures = f.failures[1:]
+		f.mu.Unlock()
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	if r.Method == "PUT" {
+		body, _ := io.ReadAll(r.Body)
+		f.set(path, string(body))
+		f.mu.Unlock()
+		return
+	}
+
+	if q := r.URL.Query(); q.Get("wait_for_change") == "true" {
+		timeout, _ := strconv.Atoi(q.Get("timeout_sec"))
+		deadline := time.NewTimer(time.Duration(max(timeout, 1)) * time.Second)
+		defer deadline.Stop()
+		for waiting := true; waiting && f.etag(path) == q.Get("last_etag"); {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-deadline.C:
+				waiting = false
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+		}
+	}
+	v, ok := f.values[path]
+	etag := f.etag(path)
+	f.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s not found", path), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	io.WriteString(w, v)
+}
@@ -0,0 +1,183 @@
+// Package metadata reads the GCE metadata server: values, their ETags, and
+// hanging GETs that wait for a value to change. It is what the notifier
+// detects preemption and host maintenance with, and knows nothing else
+// about it, so other tools can do the same.
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultBase is the metadata server as seen from a GCE VM.
+const DefaultBase = "http://metadata.google.internal/computeMetadata/v1/"
+
+// ErrNotMetadataServer is something other than the metadata server
+// answering, like a proxy or a captive portal.
+var ErrNotMetadataServer = errors.New("not from the metadata server")
+
+// StatusError is a non-200 answer from the metadata server.
+type StatusError struct {
+	Path string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("metadata %s returned %d", e.Path, e.Code)
+}
+
+// Client reads metadata from Base, DefaultBase if empty, through HTTP,
+// http.DefaultClient if nil. A failure that may pass, a 5xx or a dropped
+// connection, is retried up to Retries times, Backoff apart and doubling;
+// a poll that must answer within its interval leaves Retries at zero.
+type Client struct {
+	Base    string
+	HTTP    *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+// Get returns the value at path, e.g. "instance/preempted".
+func (c *Client) Get(ctx context.Context, path string) (string, error) {
+	v, _, err := c.GetETag(ctx, path)
+	return v, err
+}
+
+// GetETag returns the value at path and its ETag.
+func (c *Client) GetETag(ctx context.Context, path string) (value, etag string, err error) {
+	var resp *http.Response
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err = c.do(ctx, "GET", path, nil)
+		if err == nil && resp.StatusCode < 500 || attempt >= c.Retries || !retryable(err) {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", &StatusError{Path: path, Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("reading response failed: %w", err)
+	}
+	return string(body), resp.Header.Get("ETag"), nil
+}
+
+// WaitForChange returns the value at path and its ETag once the ETag
+// differs from etag, or after timeout without a change. The server holds
+// the request open meanwhile, so ctx must allow for timeout. Without an
+// etag it returns the current value right away.
+func (c *Client) WaitForChange(ctx context.Context, path, etag string, timeout time.Duration) (value, next string, err error) {
+	if etag != "" {
+		query := url.Values{
+			"wait_for_change": {"true"},
+			"timeout_sec":     {fmt.Sprint(int(timeout.Seconds()))},
+			"last_etag":       {etag},
+		}
+		path += "?" + query.Encode()
+	}
+	if value, next, err = c.GetETag(ctx, path); err == nil && next == "" {
+		err = fmt.Errorf("metadata %s response has no ETag", path)
+	}
+	return value, next, err
+}
+
+// Put writes value at path, which only guest attributes accept.
+func (c *Client) Put(ctx context.Context, path, value string) error {
+	resp, err := c.do(ctx, "PUT", path, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Path: path, Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Preempted reports whether GCP is preempting the VM. It says so up to 30
+// seconds before the VM is stopped.
+func (c *Client) Preempted(ctx context.Context) (bool, error) {
+	v, err := c.Get(ctx, "instance/preempted")
+	return strings.TrimSpace(v) == "TRUE", err
+}
+
+// MaintenanceEvent returns the pending host maintenance event, "NONE" if
+// there is none.
+func (c *Client) MaintenanceEvent(ctx context.Context) (string, error) {
+	v, err := c.Get(ctx, "instance/maintenance-event")
+	return strings.TrimSpace(v), err
+}
+
+// do makes one request. GCP requires the "Metadata-Flavor: Google" header,
+// and sends it back, so its absence means something else answered.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	base := c.Base
+	if base == "" {
+		base = DefaultBase
+	}
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	// A proxy answering for metadata.google.internal won't send this back;
+	// don't mistake its page for metadata
+	if flavor := resp.Header.Get("Metadata-Flavor"); flavor != "Google" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("metadata %s response has Metadata-Flavor %q: %w", path, flavor, ErrNotMetadataServer)
+	}
+	return resp, nil
+}
+
+// retryable reports whether a request that failed with err, or without an
+// error on a 5xx, may work if tried again. Being off GCP never passes.
+func retryable(err error) bool {
+	if err == nil {
+		return true
+	}
+	return !IsNotOnGCP(err) && !errors.Is(err, ErrNotMetadataServer) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// IsNotOnGCP reports whether a metadata error means there is no metadata
+// server at all, which is what happens when running off a GCP VM.
+func IsNotOnGCP(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || errors.Is(err, syscall.ECONNREFUSED)
+}
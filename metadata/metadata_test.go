@@ -0,0 +1,112 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	f := NewFake(map[string]string{"instance/preempted": "TRUE"})
+	defer f.Close()
+	c := f.Client()
+	c.Retries, c.Backoff = 2, time.Millisecond
+
+	f.Fail(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	if preempted, err := c.Preempted(context.Background()); err != nil || !preempted {
+		t.Errorf("Preempted() after two 5xx = %v, %v; want true", preempted, err)
+	}
+
+	f.Fail(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	var status *StatusError
+	if _, err := c.Get(context.Background(), "instance/preempted"); !errors.As(err, &status) || status.Code != http.StatusServiceUnavailable {
+		t.Errorf("Get() with retries used up = %v, want the 503", err)
+	}
+
+	// A 404 won't go away by asking again
+	f.Fail(http.StatusNotFound, http.StatusInternalServerError)
+	if _, err := c.Get(context.Background(), "instance/preempted"); !errors.As(err, &status) || status.Code != http.StatusNotFound {
+		t.Errorf("Get() = %v, want the 404 without a retry", err)
+	}
+}
+
+func TestClientRejectsOtherServers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "TRUE") // no Metadata-Flavor header, e.g. a proxy
+	}))
+	defer srv.Close()
+	c := &Client{Base: srv.URL + "/", Retries: 3, Backoff: time.Hour}
+
+	if preempted, err := c.Preempted(context.Background()); !errors.Is(err, ErrNotMetadataServer) || preempted {
+		t.Errorf("Preempted() = %v, %v; want ErrNotMetadataServer at once", preempted, err)
+	}
+}
+
+func TestClientRejectsOtherServersWhateverTheStatus(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable) // a proxy's error page
+	}))
+	defer srv.Close()
+	c := &Client{Base: srv.URL + "/", Retries: 3, Backoff: time.Millisecond}
+
+	var status *StatusError
+	if _, err := c.Get(context.Background(), "instance/preempted"); !errors.Is(err, ErrNotMetadataServer) || errors.As(err, &status) {
+		t.Errorf("Get() = %v, want ErrNotMetadataServer rather than the 503", err)
+	}
+	if _, _, err := c.WaitForChange(context.Background(), "instance/preempted", "etag", time.Second); !errors.Is(err, ErrNotMetadataServer) {
+		t.Errorf("WaitForChange() = %v, want ErrNotMetadataServer", err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want one per call with no retries", requests)
+	}
+}
+
+func TestClientWaitsForChange(t *testing.T) {
+	f := NewFake(map[string]string{"instance/maintenance-event": "NONE"})
+	defer f.Close()
+	c := f.Client()
+	ctx := context.Background()
+
+	_, etag, err := c.WaitForChange(ctx, "instance/maintenance-event", "", time.Minute)
+	if err != nil || etag == "" {
+		t.Fatalf("first read = %q, %v; want an ETag", etag, err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { f.Set("instance/maintenance-event", "TERMINATE_ON_HOST_MAINTENANCE") })
+	start := time.Now()
+	v, next, err := c.WaitForChange(ctx, "instance/maintenance-event", etag, time.Minute)
+	if err != nil || v != "TERMINATE_ON_HOST_MAINTENANCE" || next == etag {
+		t.Fatalf("hanging GET = %q (%s), %v; want the new value", v, next, err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("hanging GET returned after %v, before the change", waited)
+	}
+
+	// Nothing changes: the server gives up after the timeout
+	if _, again, err := c.WaitForChange(ctx, "instance/maintenance-event", next, time.Second); err != nil || again != next {
+		t.Errorf("hanging GET without a change = %s, %v; want %s", again, err, next)
+	}
+}
+
+func TestClientPutsGuestAttributes(t *testing.T) {
+	f := NewFake(nil)
+	defer f.Close()
+	c := f.Client()
+	path := "instance/guest-attributes/tool/state"
+
+	var status *StatusError
+	if _, err := c.Get(context.Background(), path); !errors.As(err, &status) || status.Code != http.StatusNotFound {
+		t.Errorf("Get() before Put = %v, want a 404", err)
+	}
+	if err := c.Put(context.Background(), path, `{"ok":true}`); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(context.Background(), path); err != nil || v != `{"ok":true}` {
+		t.Errorf("Get() after Put = %q, %v", v, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"spot-notifier-gcp/metadata"
+)
+
+func TestReadMetadataUsesRecursiveTree(t *testing.T) {
+	tree := `{"id": 42, "name": "tree-vm", "zone": "projects/1/zones/europe-west1-b",
+		"scheduling": {"preemptible": "TRUE", "onHostMaintenance": "TERMINATE"},
+		"serviceAccounts": {"default": {"email": "sa@p.iam.gserviceaccount.com"}}}`
+	overrides, _ := json.Marshal(map[string]string{"instance/?recursive=true": tree})
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	t.Cleanup(func() { mockMetadataFile = "" })
+	if err := os.WriteFile(mockMetadataFile, overrides, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	values, errs := readMetadata([]string{"instance/id", "instance/name", "instance/scheduling/preemptible",
+		"instance/service-accounts/default/email", "project/project-id"}, 2)
+
+	want := map[string]string{
+		"instance/id":                             "42",
+		"instance/name":                           "tree-vm",
+		"instance/scheduling/preemptible":         "TRUE",
+		"instance/service-accounts/default/email": "sa@p.iam.gserviceaccount.com",
+		"project/project-id":                      "mock-project", // not in the tree, fetched on its own
+	}
+	for key, v := range want {
+		if values[key] != v {
+			t.Errorf("%s = %q, want %q", key, values[key], v)
+		}
+	}
+	if len(errs) != 0 {
+		t.Errorf("errs = %v", errs)
+	}
+}
+
+// fakeMetadataServer serves values as the metadata server would, and points
+// metadataBase at itself for the test.
+func fakeMetadataServer(t *testing.T, values map[string]string) {
+	f := metadata.NewFake(values)
+	t.Cleanup(f.Close)
+	base := metadataBase
+	metadataBase = f.Base()
+	t.Cleanup(func() { metadataBase = base })
+}
+
+func TestCheckEventsAgainstMetadataServer(t *testing.T) {
+	ignore := regexp.MustCompile(defaultMaintenanceIgnore)
+	for _, tc := range []struct {
+		preempted, maintenance string
+		wantPreempted          bool
+		wantEvent              string
+		wantMigrating          bool
+	}{
+		{preempted: "FALSE", maintenance: "NONE"},
+		{preempted: "TRUE", maintenance: "NONE", wantPreempted: true},
+		{preempted: "FALSE", maintenance: "MIGRATE_ON_HOST_MAINTENANCE", wantEvent: "MIGRATE_ON_HOST_MAINTENANCE", wantMigrating: true},
+		{preempted: "FALSE", maintenance: "TERMINATE_ON_HOST_MAINTENANCE", wantEvent: "TERMINATE_ON_HOST_MAINTENANCE"},
+	} {
+		fakeMetadataServer(t, map[string]string{"instance/preempted": tc.preempted, "instance/maintenance-event": tc.maintenance})
+
+		preempted, err := pollMetadata().Preempted(context.Background())
+		if err != nil || preempted != tc.wantPreempted {
+			t.Errorf("preempted=%s: Preempted() = %v, %v, want %v", tc.preempted, preempted, err, tc.wantPreempted)
+		}
+		event, migrating, err := checkMaintenanceEvent(ignore)
+		if err != nil || event != tc.wantEvent || migrating != tc.wantMigrating {
+			t.Errorf("maintenance-event=%s: checkMaintenanceEvent() = %q, %v, %v, want %q, %v",
+				tc.maintenance, event, migrating, err, tc.wantEvent, tc.wantMigrating)
+		}
+	}
+}
+
+func TestPollRejectsNonMetadataResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "TRUE") // no Metadata-Flavor header, e.g. a proxy
+	}))
+	t.Cleanup(srv.Close)
+	base := metadataBase
+	metadataBase = srv.URL + "/computeMetadata/v1/"
+	t.Cleanup(func() { metadataBase = base })
+
+	if preempted, err := pollMetadata().Preempted(context.Background()); err == nil || preempted {
+		t.Errorf("Preempted() = %v, %v, want an error", preempted, err)
+	}
+}
+
+func TestMockMetadataFileOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mock.json")
+	if err := os.WriteFile(path, []byte(`{"instance/preempted": "TRUE", "instance/name": "worker-7"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if terminationDryRun(false) {
+		t.Fatal("terminations are a dry run without mock metadata or --dry-run")
+	}
+	mockMetadataFile = path
+	t.Cleanup(func() { mockMetadataFile = "" })
+
+	for key, want := range map[string]string{
+		"instance/preempted": "TRUE",
+		"instance/name":      "worker-7",
+		"project/project-id": "mock-project", // not in the file, so the default
+	} {
+		if got, err := getMetadata(key); err != nil || got != want {
+			t.Errorf("getMetadata(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if _, err := getMetadata("instance/attributes/missing"); err == nil {
+		t.Error("getMetadata of a key in neither the file nor the defaults succeeded")
+	}
+	if !terminationDryRun(false) {
+		t.Error("terminations aren't a dry run with mock metadata")
+	}
+}
@@ -0,0 +1,1493 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// terminateNowAttribute triggers termination when set to "true", or to
+// "immediate" to also skip the grace period.
+const terminateNowAttribute = "instance/attributes/terminate-now"
+
+// groupCancelAttribute, set to "true" during GroupConfirmWindow, spares the
+// siblings that group termination was about to delete.
+const groupCancelAttribute = "instance/attributes/cancel-group-termination"
+
+// gracePeriodAttribute overrides GracePeriod for this VM, e.g. "45m". It is
+// read when termination starts, so it can be set at launch or any time after.
+const gracePeriodAttribute = "instance/attributes/grace-period"
+
+// freezeAttribute, set to "true", defers TTL termination like FreezeWindow
+// for as long as it stays set.
+const freezeAttribute = "instance/attributes/change-freeze"
+
+const (
+	defaultTerminateRetryWindow = 5 * time.Minute
+	terminateRetryBackoff       = 10 * time.Second
+	maxTerminateRetryBackoff    = time.Minute
+	// Per-minute quotas take a while to refill, so retrying sooner is wasted
+	quotaRetryBackoff = 30 * time.Second
+
+	escalationCheckTimeout = 30 * time.Second
+)
+
+// errTerminationTimedOut marks a termination sequence that was still
+// running when TerminationTimeout passed.
+var errTerminationTimedOut = errors.New("termination did not finish in time")
+
+// SIGTERMAction is what a SIGTERM outside a known preemption is taken for.
+type SIGTERMAction string
+
+const (
+	SIGTERMCheck      SIGTERMAction = "check"      // preemption if metadata says so (default)
+	SIGTERMPreemption SIGTERMAction = "preemption" // always a preemption
+	SIGTERMExit       SIGTERMAction = "exit"       // always a clean shutdown
+)
+
+const (
+	defaultSIGTERMCheckWindow = 3 * time.Second
+	maxSIGTERMCheckWindow     = 10 * time.Second // a third of the preemption notice
+	sigtermRecheckInterval    = 500 * time.Millisecond
+)
+
+// defaultSchedulingCheckInterval is how often the scheduling metadata is
+// re-read; SCHEDULING_CHECK_INTERVAL=0 turns it off.
+const defaultSchedulingCheckInterval = 10 * time.Minute
+
+const (
+	defaultSurvivalPollInterval = 5 * time.Second
+	maxSurvivalPollInterval     = time.Minute
+)
+
+// defaultEscalationIntervals space out the repeats of a failed
+// self-termination alert.
+var defaultEscalationIntervals = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// PreemptAction is how the monitor responds to preemption. GCP reclaims the
+// VM either way; the choice is what we do in the ~30s before it does.
+type PreemptAction string
+
+const (
+	PreemptNotify PreemptAction = "notify" // alert only, skip PREEMPT_HOOK
+	PreemptHook   PreemptAction = "hook"   // alert and run PREEMPT_HOOK (default)
+	PreemptDelete PreemptAction = "delete" // also run the termination action
+)
+
+// Monitor watches the VM for preemption and maintenance events and enforces
+// its TTL. main builds one from the environment; tests build one directly.
+type Monitor struct {
+	Instance   instanceInfo
+	Clock      Clock
+	Terminator Terminator
+	Notifier   *dispatcher
+	Templates  messageTemplates
+
+	TerminateAfter    time.Duration // zero for no TTL
+	GracePeriod       time.Duration
+	MaxGracePeriod    time.Duration // caps the grace-period attribute; zero for no cap
+	CheckInterval     time.Duration
+	MaintenanceIgnore *regexp.Regexp
+	// NotSpot skips polling for preemption on a standard VM, which GCP
+	// never preempts
+	NotSpot bool
+	// SchedulingCheckInterval, if set, is how often the scheduling metadata
+	// is re-read to catch a provisioning model changed mid-run.
+	SchedulingCheckInterval time.Duration
+
+	// FreezeWindow, if set, is a daily change freeze: a TTL that runs out
+	// inside it waits for the window to close. Preemption is handled as usual.
+	FreezeWindow *timeWindow
+
+	// SoftTTL, if set, sends one reminder that the VM has outlived its
+	// intended lifetime, well before TerminateAfter enforces it.
+	SoftTTL time.Duration
+
+	// WarnFraction, if set, sends one early warning once that fraction of
+	// the TTL has elapsed.
+	WarnFraction float64
+
+	// CostReportInterval, if set, reports the estimated spend so far that
+	// often, so a forgotten VM doesn't go unnoticed. It needs a HourlyCost.
+	CostReportInterval time.Duration
+
+	// PreemptSignal fires when a shutdown script reports preemption.
+	PreemptSignal <-chan struct{}
+	// MetadataChanged fires when a watched metadata value changes, to
+	// check it now rather than at the next poll.
+	MetadataChanged    <-chan struct{}
+	OnPreempt          PreemptAction
+	PreemptHook        string
+	PreemptHookTimeout time.Duration
+	// PreemptHookDelay holds the hook back so the alert goes out first
+	PreemptHookDelay time.Duration
+	// GraceWarnings are the points, in ascending percentages of the grace
+	// period, at which to warn how long is left, e.g. 50, 75, 90, 95, 99.
+	GraceWarnings []float64
+	// GracePreemptAction is the response to a preemption that cuts the
+	// grace period short; PreemptNotify leaves the VM to GCP.
+	GracePreemptAction PreemptAction
+
+	// Shutdown is closed when the process gets SIGTERM. GCP sends one through
+	// the guest on preemption, so it is cross-checked against metadata;
+	// without a preemption it's an ordinary stop and Run returns.
+	Shutdown <-chan struct{}
+
+	// FindGroup and TerminateGroup, if set, delete sibling instances before
+	// this one when the TTL expires. With GroupConfirmWindow, the siblings
+	// are announced first and deleted once the window passes without the
+	// cancel attribute.
+	FindGroup          func(ctx context.Context) ([]groupMember, error)
+	TerminateGroup     func(ctx context.Context, members []groupMember) (groupResult, error)
+	GroupLabel         string
+	GroupConfirmWindow time.Duration
+
+	// SerialOutput, if set, fetches recent console output for alerts.
+	SerialOutput func(ctx context.Context) (string, error)
+
+	// TerminateNow fires when an operator sends SIGUSR1; the terminate-now
+	// metadata attribute is checked on every poll as well.
+	TerminateNow          <-chan struct{}
+	TerminateNowSkipGrace bool
+
+	// Control carries commands from the control endpoint: extend or cancel
+	// the TTL, or report it. State, if set, keeps a changed TTL across
+	// restarts.
+	Control <-chan controlCommand
+	State   *savedState
+
+	// Watchdog, if set, is called on every poll to prove the loop is alive.
+	Watchdog func()
+
+	// Health, if set, retires the VM when its workload stays unhealthy.
+	Health *healthChecker
+
+	// CompletionMarker, if set, is a file the workload writes when it is
+	// done; the VM is retired as soon as it appears.
+	CompletionMarker string
+
+	// Price, if set, retires the VM once its Spot price is over the limit.
+	Price *priceChecker
+
+	// Audit, if set, gets a record of every termination.
+	Audit AuditLog
+
+	// Counter, if set, tracks preemptions across the project.
+	Counter          PreemptionCounter
+	PreemptionWindow time.Duration
+	// FamilyThreshold is how many preemptions of this machine type in this
+	// zone, within PreemptionWindow, call for a note in the follow-up.
+	FamilyThreshold int
+	// CapacityCheckInterval, if set, is how often the counter is read to
+	// warn early once other VMs like this one reach FamilyThreshold.
+	CapacityCheckInterval time.Duration
+
+	// MetadataFailures, if set, alerts once while too many metadata reads
+	// in the poll loop fail, and again once they recover.
+	MetadataFailures *failureRate
+
+	// Reload fires when the operator asks for a config reload; OnReload
+	// applies it between checks.
+	Reload   <-chan struct{}
+	OnReload func()
+
+	// DrainCommand, if set, runs for up to DrainTimeout at the start of the
+	// grace period of every termination we start. On preemption, main uses
+	// it as the PreemptHook when there is no other.
+	DrainCommand string
+	DrainTimeout time.Duration
+
+	// ShutdownHooks run in order after the PreemptHook on preemption, within
+	// GCP's notice, and after the DrainCommand at the start of the grace
+	// period, within what is left of it.
+	ShutdownHooks []shutdownHook
+
+	// DrainCheckURL, if set, ends the grace period early once it answers
+	// 2xx, so the workload decides when it's safe to go.
+	DrainCheckURL string
+
+	// TerminateRetryWindow bounds how long a failed self-termination is
+	// retried before alerting that manual cleanup is needed. CleanupAction
+	// is the gcloud verb that alert suggests, "delete" by default.
+	TerminateRetryWindow time.Duration
+	CleanupAction        string
+	// TerminationTimeout, if set, is a hard deadline on deleting the group
+	// and this VM, for Compute calls that hang instead of failing.
+	TerminationTimeout time.Duration
+
+	// EscalationIntervals are the waits between repeats of the failed
+	// self-termination alert, the last one reused until MaxEscalations
+	// repeats have gone out or the instance is gone. Nil disables them.
+	EscalationIntervals []time.Duration
+	MaxEscalations      int
+
+	// SnapshotOnTTL snapshots the disks before a TTL termination, when the
+	// Terminator can. A failed snapshot stops the termination.
+	SnapshotOnTTL bool
+
+	// NotifyOnly skips termination when there is no usable Compute client.
+	NotifyOnly bool
+
+	// Data is the template context, pre-filled with the startup checks.
+	Data messageData
+
+	// SurvivalWindow, if set, is how long to keep watching a preempted VM
+	// that hasn't been stopped, in case GCP called the preemption off. The
+	// preempted flag is re-checked every SurvivalPollInterval, doubling up
+	// to maxSurvivalPollInterval.
+	SurvivalWindow       time.Duration
+	SurvivalPollInterval time.Duration
+
+	// SIGTERMAction says whether a SIGTERM is a preemption; see
+	// sigtermIsPreemption.
+	SIGTERMAction      SIGTERMAction
+	SIGTERMCheckWindow time.Duration
+
+	// LiveMigrate is set when the VM's host maintenance policy is MIGRATE,
+	// so no maintenance event ends it.
+	LiveMigrate bool
+
+	// Lifecycle, if set, reports each state transition.
+	Lifecycle *lifecycle
+	// Status, if set, serves what each poll observed on STATUS_ADDR.
+	Status *statusServer
+
+	interrupted   bool      // preemption or maintenance already handled
+	interruptedAt time.Time // when it was detected
+	sigtermSpent  bool      // the SIGTERM was taken as the preemption
+	migration     string    // live migration event already reported
+	groupFailed   bool      // some sibling couldn't be deleted
+	timedOut      bool      // termination was abandoned at TerminationTimeout
+	frozen        bool      // TTL termination deferred by a change freeze
+
+	// counted gets the shared counter's answer for this preemption
+	counted <-chan preemptionCount
+
+	// The grace period under way, and how many GraceWarnings went out
+	graceStart  time.Time
+	graceLength time.Duration
+	graceWarned int
+
+	lastCapacityCheck   time.Time
+	capacityPressure    bool // already warned about
+	lastSchedulingCheck time.Time
+}
+
+// Run monitors until the TTL fires or GCP interrupts the VM. It reports
+// whether GCP is ending the VM, in which case the caller should wait for
+// the shutdown rather than exit.
+func (m *Monitor) Run() (interrupted bool) {
+	// The TTL counts from startup, not from a resumed Run
+	if m.Data.Started.IsZero() {
+		m.Data.Started = m.Clock.Now()
+	}
+	// A restart doesn't warn again about what the last process already did
+	resumed := m.State.get()
+	warned, softNotified := resumed.Warned, resumed.SoftTTLNotified
+	if warned {
+		m.Lifecycle.enter(StateApproachingTTL, ReasonNone)
+	} else {
+		m.Lifecycle.enter(StateMonitoring, ReasonNone)
+	}
+
+	// lastCheck is when metadata last said we were not preempted. The
+	// preemption flipped somewhere between then and when we noticed.
+	var lastCheck time.Time
+	// Reports fall due on multiples of the interval since the start; those
+	// already due went out before a restart
+	costReports := 0
+	if m.CostReportInterval > 0 {
+		costReports = int(m.Clock.Since(m.Data.Started) / m.CostReportInterval)
+	}
+
+	for {
+		if m.Watchdog != nil {
+			m.Watchdog()
+		}
+		// An extension sent just as the TTL runs out still wins
+		select {
+		case cmd := <-m.Control:
+			if m.control(cmd) {
+				warned = false
+			}
+		default:
+		}
+		uptime := m.Clock.Since(m.Data.Started)
+		stats.gauge("uptime_seconds", uptime.Seconds())
+
+		// 1. Check TTL (Self-Termination)
+		if m.TerminateAfter > 0 && uptime > m.TerminateAfter {
+			if freeze := m.changeFreeze(); freeze != "" {
+				if !m.frozen {
+					log.Printf("Crossed uptime threshold during %s, deferring termination", freeze)
+					m.Notifier.notify(EventTerminationDeferred, fmt.Sprintf("❄️ Instance `%s` in `%s` is past its TTL of %s, but termination is deferred during %s. "+
+						"It will be terminated once the freeze is over; preemption is still handled.", m.Instance.Name, m.Instance.Zone, formatDuration(m.TerminateAfter), freeze))
+					m.frozen = true
+				}
+			} else {
+				if m.frozen {
+					log.Printf("Change freeze is over after %v past the TTL", uptime-m.TerminateAfter)
+				}
+				m.setReason(ReasonTTLExpiry)
+				log.Printf("Crossed uptime threshold. Stopping in %v", m.GracePeriod)
+				return m.terminate(m.GracePeriod)
+			}
+		}
+
+		// An operator asked to retire the VM now
+		if skipGrace, requested := m.terminateRequested(); requested {
+			m.setReason(ReasonManual)
+			grace := m.GracePeriod
+			if skipGrace {
+				grace = 0
+			}
+			m.Data.GracePeriod = grace
+			log.Printf("Termination requested. Stopping in %v", grace)
+			return m.terminate(grace)
+		}
+
+		// The job is done, nothing is gained by waiting for the TTL
+		if m.CompletionMarker != "" {
+			if _, err := os.Stat(m.CompletionMarker); err == nil {
+				m.setReason(ReasonCompleted)
+				m.Data.CompletionMarker = m.CompletionMarker
+				log.Printf("Completion marker %s found. Stopping in %v", m.CompletionMarker, m.GracePeriod)
+				return m.terminate(m.GracePeriod)
+			}
+		}
+
+		if !softNotified && m.SoftTTL > 0 && uptime >= m.SoftTTL {
+			log.Printf("Soft TTL of %v reached", m.SoftTTL)
+			m.Notifier.notify(EventSoftTTL, m.render(msgSoftTTL))
+			softNotified = true
+			m.State.update("The soft TTL notification", func(state *notifierState) { state.SoftTTLNotified = true })
+		}
+
+		if m.CostReportInterval > 0 && m.Data.HourlyCost > 0 {
+			if due := int(uptime / m.CostReportInterval); due > costReports {
+				m.Notifier.notify(EventCostReport, m.render(msgCost))
+				costReports = due
+			}
+		}
+
+		if !warned && m.WarnFraction > 0 && m.TerminateAfter > 0 && uptime >= time.Duration(m.WarnFraction*float64(m.TerminateAfter)) {
+			m.Data.TimeLeft = m.TerminateAfter - uptime
+			m.Notifier.notify(EventTTLWarning, m.render(msgWarn))
+			m.Lifecycle.enter(StateApproachingTTL, ReasonNone)
+			warned = true
+			m.State.update("The TTL warning", func(state *notifierState) { state.Warned = true })
+		}
+
+		// A wedged workload is just burning money
+		if m.Health != nil && m.Health.check(context.Background(), m.Clock.Now()) {
+			m.setReason(ReasonUnhealthy)
+			m.Data.HealthFailures, m.Data.HealthError = m.Health.failures, m.Health.lastErr.Error()
+			log.Printf("Workload unhealthy (%d failed checks): %v. Stopping in %v", m.Health.failures, m.Health.lastErr, m.GracePeriod)
+			return m.terminate(m.GracePeriod)
+		} else if m.Health != nil && m.Health.lastErr != nil {
+			log.Printf("Health check %d failed: %v", m.Health.failures, m.Health.lastErr)
+		}
+
+		// Cheaper to give the capacity back than to keep paying premium rates
+		if m.Price != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), priceTimeout)
+			over := m.Price.check(ctx, m.Clock.Now())
+			cancel()
+			if over {
+				m.setReason(ReasonSpotPrice)
+				m.Data.SpotPrice, m.Data.MaxSpotPrice = m.Price.price, m.Price.max
+				log.Printf("Spot price %v is over MAX_SPOT_PRICE %v. Stopping in %v", m.Price.price, m.Price.max, m.GracePeriod)
+				return m.terminate(m.GracePeriod)
+			} else if m.Price.lastErr != nil {
+				log.Printf("Spot price check failed: %v", m.Price.lastErr)
+				m.Price.lastErr = nil
+			}
+		}
+
+		// Siblings being preempted is the earliest hint GCP gives
+		m.checkCapacity()
+		m.checkScheduling()
+
+		// 2. Check Spot/Preemptible Interruption
+		// GCP provides a 30-second warning via metadata
+		// A signal from the shutdown script wins over polling metadata
+		checkedAt := m.Clock.Now()
+		var (
+			isPreempted bool
+			err         error
+		)
+		source := "metadata"
+		select {
+		case <-m.PreemptSignal:
+			isPreempted, source = true, "shutdown script"
+		case <-m.shutdown():
+			if isPreempted, err = m.sigtermIsPreemption(); err != nil {
+				log.Printf("Received SIGTERM and could not check for preemption (%v), exiting", err)
+				return false
+			} else if !isPreempted {
+				log.Printf("Received SIGTERM without a preemption, exiting")
+				return false
+			}
+			source, m.sigtermSpent = "SIGTERM", true
+		default:
+			if !m.NotSpot {
+				isPreempted, err = pollMetadata().Preempted(context.Background())
+				m.recordMetadataRead(err)
+			}
+		}
+		if err == nil {
+			m.Status.observe(m.Data.Started, m.TerminateAfter, isPreempted)
+		}
+		if err != nil {
+			log.Printf("Spot termination check failed: %v", err)
+		} else if isPreempted {
+			var latency time.Duration
+			if !lastCheck.IsZero() {
+				latency = checkedAt.Sub(lastCheck).Truncate(time.Millisecond)
+			}
+			m.preempted(source, latency)
+			return true
+		}
+
+		if err == nil {
+			lastCheck = checkedAt
+		}
+
+		// 3. Check Host Maintenance
+		event, migrating, err := checkMaintenanceEvent(m.MaintenanceIgnore)
+		m.recordMetadataRead(err)
+		if err == nil {
+			m.Status.maintenanceEvent(event)
+		}
+		if err != nil {
+			log.Printf("Maintenance event check failed: %v", err)
+		} else if migrating || (event != "" && m.LiveMigrate) {
+			// The VM keeps running, and so do we
+			if event != m.migration {
+				log.Printf("Host maintenance event %s: live migration, not terminating", event)
+				m.Data.MaintenanceEvent = event
+				m.Notifier.notify(EventMigrating, m.render(msgMigrate))
+				m.migration = event
+			}
+		} else if event != "" {
+			if m.interrupted {
+				return true
+			}
+			m.interrupted, m.interruptedAt = true, m.Clock.Now()
+			stats.incr("maintenance_events")
+			log.Printf("Host maintenance event: %s", event)
+			m.Data.MaintenanceEvent = event
+			m.setReason(ReasonMaintenance)
+			m.Notifier.notify(EventMaintenance, m.render(msgMaintenance))
+			m.Lifecycle.enter(StatePreempted, ReasonMaintenance)
+			m.handleInterruption(PreemptHook)
+			return true
+		} else {
+			m.migration = ""
+		}
+
+		if m.TerminateAfter > 0 {
+			timeLeft := m.TerminateAfter - uptime
+			log.Printf("Time left: %v", timeLeft.Truncate(time.Second))
+		}
+		select {
+		case <-m.Clock.After(m.CheckInterval):
+		case <-m.MetadataChanged:
+		case <-m.PreemptSignal:
+		case <-m.shutdown():
+		case <-m.TerminateNow:
+		case <-m.Reload:
+			log.Printf("SIGHUP received, reloading configuration")
+			m.OnReload()
+		case cmd := <-m.Control:
+			if m.control(cmd) {
+				warned = false
+			}
+		}
+	}
+}
+
+// control applies a command from the control endpoint and answers it. It
+// reports whether an extension moved the TTL back far enough for the early
+// warning to go out again.
+func (m *Monitor) control(cmd controlCommand) (rewarn bool) {
+	uptime := m.Clock.Since(m.Data.Started)
+	var reply controlReply
+	switch cmd.action {
+	case "extend":
+		if m.TerminateAfter == 0 {
+			reply.err = fmt.Errorf("no TTL is set, there is nothing to extend")
+			break
+		}
+		m.TerminateAfter += cmd.by
+		m.Data.TerminateAfter = m.TerminateAfter
+		left := max(m.TerminateAfter-uptime, 0)
+		m.frozen = m.frozen && left == 0
+		log.Printf("TTL extended by %v to %v, %v left", cmd.by, m.TerminateAfter, left.Truncate(time.Second))
+		reply.Message = fmt.Sprintf("Extended the TTL by %s to %s, terminating in %s", formatDuration(cmd.by), formatDuration(m.TerminateAfter), formatDuration(left))
+		m.Notifier.notify(EventTTLChanged, fmt.Sprintf("⏩ The uptime limit of instance `%s` in `%s` was extended by %s to %s, it now stops in %s",
+			m.Instance.Name, m.Instance.Zone, formatDuration(cmd.by), formatDuration(m.TerminateAfter), formatDuration(left)))
+		m.saveTTL()
+		if m.WarnFraction > 0 && uptime < time.Duration(m.WarnFraction*float64(m.TerminateAfter)) {
+			m.leaveApproachingTTL()
+			m.State.update("The TTL warning", func(state *notifierState) { state.Warned = false })
+			rewarn = true
+		}
+	case "cancel":
+		if m.TerminateAfter == 0 {
+			reply.err = fmt.Errorf("no TTL is set, there is nothing to cancel")
+			break
+		}
+		log.Printf("TTL of %v cancelled", m.TerminateAfter)
+		m.TerminateAfter, m.Data.TerminateAfter, m.frozen = 0, 0, false
+		reply.Message = "Cancelled the TTL, the instance keeps running until it is stopped or preempted"
+		m.Notifier.notify(EventTTLChanged, fmt.Sprintf("🛑 The scheduled termination of instance `%s` in `%s` was cancelled, it keeps running with no uptime limit. Preemption is still handled.",
+			m.Instance.Name, m.Instance.Zone))
+		m.saveTTL()
+		m.leaveApproachingTTL()
+	default:
+		if m.TerminateAfter > 0 {
+			reply.Message = fmt.Sprintf("Up %s, TTL %s, terminating in %s", formatDuration(uptime), formatDuration(m.TerminateAfter), formatDuration(max(m.TerminateAfter-uptime, 0)))
+		} else {
+			reply.Message = fmt.Sprintf("Up %s, no TTL", formatDuration(uptime))
+		}
+	}
+
+	reply.TerminateAfterHours, reply.UptimeSeconds = m.TerminateAfter.Hours(), uptime.Seconds()
+	if m.TerminateAfter > 0 {
+		left := (m.TerminateAfter - uptime).Seconds()
+		reply.TimeLeftSeconds = &left
+	}
+	cmd.reply <- reply
+	return rewarn
+}
+
+// saveTTL keeps the TTL as the control endpoint left it for a restart.
+func (m *Monitor) saveTTL() {
+	ttl := m.TerminateAfter
+	m.State.update("The TTL change", func(state *notifierState) { state.TerminateAfter = &ttl })
+}
+
+// leaveApproachingTTL goes back to monitoring once the TTL is no longer
+// close. Any other state is left as it is.
+func (m *Monitor) leaveApproachingTTL() {
+	if m.Lifecycle.current() == StateApproachingTTL {
+		m.Lifecycle.enter(StateMonitoring, ReasonNone)
+	}
+}
+
+// sigtermIsPreemption decides what a SIGTERM means, as SIGTERMAction says.
+// To check, it reads instance/preempted until it says TRUE or
+// SIGTERMCheckWindow is up, since the signal can beat the metadata update.
+func (m *Monitor) sigtermIsPreemption() (bool, error) {
+	switch m.SIGTERMAction {
+	case SIGTERMPreemption:
+		return true, nil
+	case SIGTERMExit:
+		return false, nil
+	}
+	deadline := m.Clock.Now().Add(m.SIGTERMCheckWindow)
+	for {
+		preempted, err := pollMetadata().Preempted(context.Background())
+		if err != nil || preempted || !m.Clock.Now().Before(deadline) {
+			return preempted, err
+		}
+		m.Clock.Sleep(min(sigtermRecheckInterval, deadline.Sub(m.Clock.Now())))
+	}
+}
+
+// survived waits out SurvivalWindow after a preemption and reports whether
+// the VM is still here with metadata no longer saying it's preempted. If
+// so it corrects the earlier alert, and the caller can resume with Run.
+func (m *Monitor) survived() bool {
+	if m.SurvivalWindow <= 0 || m.Data.Reason != ReasonPreemption {
+		return false
+	}
+	log.Printf("Watching for %v in case the preemption is called off", m.SurvivalWindow)
+	deadline := m.Clock.Now().Add(m.SurvivalWindow)
+	interval := cmp.Or(m.SurvivalPollInterval, defaultSurvivalPollInterval)
+	for left := m.SurvivalWindow; left > 0; left = deadline.Sub(m.Clock.Now()) {
+		if !m.sleep(min(interval, left)) {
+			return false
+		}
+		since := m.Clock.Since(m.interruptedAt).Truncate(time.Second)
+		switch preempted, err := pollMetadata().Preempted(context.Background()); {
+		case err != nil:
+			log.Printf("Still up %v after the preemption alert, check failed: %v", since, err)
+		case preempted:
+			log.Printf("Still up %v after the preemption alert, metadata says preempted", since)
+		default:
+			log.Printf("Still up %v after the preemption alert, metadata no longer says preempted", since)
+		}
+		interval = min(2*interval, maxSurvivalPollInterval)
+	}
+	if preempted, err := pollMetadata().Preempted(context.Background()); err != nil {
+		log.Printf("Spot termination check failed: %v", err)
+		return false
+	} else if preempted {
+		log.Printf("Still preempted after %v, waiting for GCP", m.SurvivalWindow)
+		return false
+	}
+
+	log.Printf("Preemption was called off, resuming monitoring")
+	m.Notifier.notify(EventInterruptionCancelled, fmt.Sprintf("✅ Instance `%s` in `%s` survived: %v after the preemption alert it is still running and no longer marked preempted",
+		m.Instance.Name, m.Instance.Zone, m.SurvivalWindow))
+	m.interrupted = false
+	m.Data.Reason = ReasonNone
+	m.Notifier.setReason(ReasonNone)
+	m.Data.DetectedVia, m.Data.DetectionLatency = "", 0
+	return true
+}
+
+// shutdown is Shutdown until its SIGTERM has been taken as a preemption.
+// Shutdown stays closed, so from then on it is nil, which never fires:
+// otherwise survived would give up at once, and so would a resumed Run.
+func (m *Monitor) shutdown() <-chan struct{} {
+	if m.sigtermSpent {
+		return nil
+	}
+	return m.Shutdown
+}
+
+// render renders the named template with the time fields as of now.
+func (m *Monitor) render(name string) string {
+	return m.Templates.render(name, m.Data.at(m.Clock.Now()))
+}
+
+// waitForDrain polls DrainCheckURL every CheckInterval until it answers
+// 2xx or grace runs out. Like graceSleep, it reports false if SIGTERM or a
+// preemption cut it short.
+func (m *Monitor) waitForDrain(grace time.Duration) bool {
+	deadline := m.Clock.Now().Add(grace)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		err := probeHealth(ctx, m.DrainCheckURL)
+		cancel()
+		if err == nil {
+			log.Printf("Drain check passed, ending the grace period early")
+			return true
+		}
+		left := deadline.Sub(m.Clock.Now())
+		if left <= 0 {
+			log.Printf("Drain check still failing at the end of the grace period: %v", err)
+			return true
+		}
+		log.Printf("Workload not drained yet: %v", err)
+		if !m.graceSleep(min(m.CheckInterval, left)) {
+			return false
+		}
+	}
+}
+
+// sleep waits d, still feeding the watchdog if there is one. It reports
+// false if SIGTERM cut the wait short.
+func (m *Monitor) sleep(d time.Duration) bool {
+	if m.Watchdog == nil && m.Shutdown == nil {
+		m.Clock.Sleep(d)
+		return true
+	}
+	for d > 0 {
+		step := d
+		if m.Watchdog != nil {
+			step = min(d, m.CheckInterval)
+		}
+		select {
+		case <-m.Clock.After(step):
+		case <-m.shutdown():
+			return false
+		}
+		if m.Watchdog != nil {
+			m.Watchdog()
+		}
+		d -= step
+	}
+	return true
+}
+
+// graceSleep is sleep for the grace period: it also checks for preemption
+// every CheckInterval, and reports false with m.interrupted set if GCP took
+// the VM first.
+func (m *Monitor) graceSleep(d time.Duration) bool {
+	deadline := m.Clock.Now().Add(d)
+	for left := d; left > 0; left = deadline.Sub(m.Clock.Now()) {
+		step := min(left, m.graceWarning())
+		if !m.NotSpot {
+			step = min(step, m.CheckInterval)
+		}
+		if !m.sleep(step) {
+			return false
+		}
+		if m.NotSpot {
+			continue
+		}
+		source := "metadata"
+		select {
+		case <-m.PreemptSignal:
+			source = "shutdown script"
+		default:
+			if preempted, err := pollMetadata().Preempted(context.Background()); err != nil {
+				log.Printf("Spot termination check failed: %v", err)
+				continue
+			} else if !preempted {
+				continue
+			}
+		}
+		m.interrupted, m.interruptedAt = true, m.Clock.Now()
+		m.Data.DetectedVia = source
+		return false
+	}
+	return true
+}
+
+// graceWarning sends the latest of the GraceWarnings that have come due,
+// skipping any it slept through, and returns the wait until the next one.
+func (m *Monitor) graceWarning() time.Duration {
+	mark := func(i int) time.Duration {
+		return time.Duration(m.GraceWarnings[i] / 100 * float64(m.graceLength))
+	}
+	elapsed := m.Clock.Since(m.graceStart)
+	due := m.graceWarned
+	for due < len(m.GraceWarnings) && elapsed >= mark(due) {
+		due++
+	}
+	if due > m.graceWarned {
+		m.graceWarned = due
+		left := max(m.graceLength-elapsed, 0)
+		log.Printf("Grace period %g%% over, %v left", m.GraceWarnings[due-1], left)
+		m.Notifier.notify(EventGraceWarning, fmt.Sprintf("⏳ Instance `%s` in `%s` stops in %s, %g%% of its %s grace period has passed",
+			m.Instance.Name, m.Instance.Zone, formatDuration(left), m.GraceWarnings[due-1], formatDuration(m.graceLength)))
+	}
+	if due == len(m.GraceWarnings) {
+		return math.MaxInt64
+	}
+	return mark(due) - elapsed
+}
+
+// terminateRequested reports whether SIGUSR1 or the terminate-now attribute
+// asked for termination, and whether to skip the grace period.
+func (m *Monitor) terminateRequested() (skipGrace, requested bool) {
+	select {
+	case <-m.TerminateNow:
+		return m.TerminateNowSkipGrace, true
+	default:
+	}
+	val, err := getMetadata(terminateNowAttribute)
+	if err != nil {
+		return false, false // Normally just not set
+	}
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "", "false":
+		return false, false
+	case "immediate", "skip-grace":
+		return true, true
+	}
+	return false, true
+}
+
+// changeFreeze describes the change freeze holding back TTL termination,
+// or returns "" if there is none.
+func (m *Monitor) changeFreeze() string {
+	if val, err := getMetadata(freezeAttribute); err == nil && strings.EqualFold(strings.TrimSpace(val), "true") {
+		return "a change freeze (" + path.Base(freezeAttribute) + " is set)"
+	}
+	if m.FreezeWindow != nil && m.FreezeWindow.contains(m.Clock.Now()) {
+		return "the freeze window " + m.FreezeWindow.String()
+	}
+	return ""
+}
+
+// gracePeriodOverride returns the grace-period attribute if it is set and
+// valid, capped at MaxGracePeriod, and grace otherwise.
+func (m *Monitor) gracePeriodOverride(grace time.Duration) time.Duration {
+	val, err := getMetadata(gracePeriodAttribute)
+	if err != nil || strings.TrimSpace(val) == "" {
+		return grace // Normally just not set
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(val))
+	if err != nil || d < 0 {
+		log.Printf("Ignoring invalid grace-period attribute %q, using %v", val, grace)
+		return grace
+	}
+	if m.MaxGracePeriod > 0 && d > m.MaxGracePeriod {
+		log.Printf("The grace-period attribute %v is over the %v maximum, using %v", d, m.MaxGracePeriod, m.MaxGracePeriod)
+		d = m.MaxGracePeriod
+	}
+	log.Printf("Grace period set to %v by the grace-period attribute", d)
+	return d
+}
+
+// preempted alerts on a preemption and runs the configured response. It
+// acts only once per interruption, however many detections follow, and
+// never waits out GracePeriod: the whole response fits in preemptionBudget.
+func (m *Monitor) preempted(source string, latency time.Duration) {
+	if m.interrupted {
+		log.Printf("Preemption seen again via %s, already handled", source)
+		return
+	}
+	m.interrupted, m.interruptedAt = true, m.Clock.Now()
+
+	log.Printf("Preemption detected via %s", source)
+	stats.incr("preemptions", "source:"+strings.ReplaceAll(source, " ", "_"))
+	m.Data.DetectedVia = source
+	m.setReason(ReasonPreemption)
+	m.fetchSerialOutput(preemptSerialOutputTimeout)
+	m.countPreemption()
+	if latency > 0 {
+		m.Data.DetectionLatency = latency
+		stats.timing("detection_latency", latency)
+		log.Printf("Preemption detected at most %v after the previous check (poll interval %v)", latency, m.CheckInterval)
+	}
+	m.Notifier.notify(EventPreempted, m.render(msgPreempt))
+	m.Lifecycle.enter(StatePreempted, ReasonPreemption)
+	// GCP will likely kill the VM forcefully in <30s
+	m.handleInterruption(m.OnPreempt)
+}
+
+// preemptedDuringGrace alerts that GCP preempted the VM before the grace
+// period ran out, then responds as GracePreemptAction says.
+func (m *Monitor) preemptedDuringGrace() {
+	log.Printf("Preemption detected via %s after %v of the grace period", m.Data.DetectedVia, m.Data.GraceElapsed.Truncate(time.Second))
+	stats.incr("preemptions", "source:"+strings.ReplaceAll(m.Data.DetectedVia, " ", "_"), "during:grace")
+	m.Data.GraceReason = m.Data.Reason
+	m.setReason(ReasonPreemption)
+	m.countPreemption()
+	m.Notifier.notify(EventPreempted, m.render(msgGracePreempt))
+	m.Lifecycle.enter(StatePreempted, ReasonPreemption)
+	m.handleInterruption(cmp.Or(m.GracePreemptAction, PreemptNotify))
+}
+
+// setReason records why the VM is ending for templates and every
+// notification that follows.
+func (m *Monitor) setReason(reason TerminationReason) {
+	m.Data.Reason = reason
+	m.Notifier.setReason(reason)
+	log.Printf("Termination reason: %s", reason)
+}
+
+// terminate runs the termination sequence: warn, wait out the grace period,
+// then stop the group and this VM. It reports true, like Run, if GCP
+// preempted the VM during the grace period.
+func (m *Monitor) terminate(grace time.Duration) (interrupted bool) {
+	name, zone := m.Instance.Name, m.Instance.Zone
+
+	if grace > 0 {
+		grace = m.gracePeriodOverride(grace)
+		m.Data.GracePeriod = grace
+	}
+	m.fetchSerialOutput(serialOutputTimeout)
+	kind, msg := EventTTLExpired, msgTerminate
+	switch m.Data.Reason {
+	case ReasonManual:
+		kind, msg = EventTerminateRequested, msgManual
+	case ReasonUnhealthy:
+		kind, msg = EventUnhealthy, msgUnhealthy
+	case ReasonSpotPrice:
+		kind, msg = EventPriceExceeded, msgPrice
+	case ReasonCompleted:
+		kind, msg = EventJobCompleted, msgCompleted
+	}
+	if !m.Data.CanTerminate {
+		// Nothing else will remove this VM, so make sure this goes out
+		kind = EventTerminationFailed
+	}
+	stats.incr("terminations", "reason:"+string(m.Data.Reason))
+	m.Notifier.notify(kind, m.render(msg))
+	m.Lifecycle.enter(StateGracePeriod, m.Data.Reason)
+	graceStart := m.Clock.Now()
+	m.graceStart, m.graceLength, m.graceWarned = graceStart, grace, 0
+	if m.DrainCommand != "" && m.Data.CanTerminate && !m.NotifyOnly {
+		m.Data.DrainStatus = m.runDrainCommand()
+	}
+	if len(m.ShutdownHooks) > 0 && m.Data.CanTerminate && !m.NotifyOnly {
+		m.Data.HookStatus = runShutdownHooks(m.ShutdownHooks, max(grace-m.Clock.Since(graceStart), 0), m.Data.Reason)
+	}
+	// The drain command's and hooks' time comes out of the grace period
+	left := max(grace-m.Clock.Since(graceStart), 0)
+	var completed bool
+	if m.DrainCheckURL != "" {
+		completed = m.waitForDrain(left)
+	} else {
+		completed = m.graceSleep(left)
+	}
+	m.Data.GraceElapsed = m.Clock.Since(graceStart)
+	stats.timing("grace_elapsed", m.Data.GraceElapsed, "reason:"+string(m.Data.Reason))
+	if m.interrupted {
+		m.preemptedDuringGrace()
+		return true
+	}
+	if !completed {
+		// Same as before we caught SIGTERM: the process stops, the next
+		// start picks the TTL up again
+		log.Printf("Received SIGTERM after %v of the grace period, exiting without terminating", m.Data.GraceElapsed.Truncate(time.Second))
+		return false
+	}
+
+	// If this never arrives, the process died during the grace period
+	log.Printf("Grace period over after %v of %v, terminating now", m.Data.GraceElapsed.Truncate(time.Second), grace)
+	if !m.snapshotBeforeTTL() {
+		return false
+	}
+	m.Notifier.notify(EventTerminating, m.render(msgExecute))
+	m.Lifecycle.enter(StateTerminating, m.Data.Reason)
+
+	if m.NotifyOnly {
+		log.Printf("Notify-only mode, not terminating")
+		return false
+	}
+
+	result, err := m.runTermination()
+	switch result {
+	case ResultAlreadyStopping:
+		m.audit("already-stopping", "", err)
+	case ResultAlreadyGone:
+		m.audit("already-gone", "", err)
+	case ResultDryRun:
+		m.audit("dry-run", "", err)
+	default:
+		m.audit("terminated", "", err)
+	}
+	if err != nil {
+		m.Lifecycle.enter(StateTerminationFailed, m.Data.Reason)
+		stats.incr("termination_failures", "reason:"+string(m.Data.Reason))
+		log.Printf("Stopping failed: %v", err)
+		if errors.Is(err, errTerminationTimedOut) {
+			// Whatever hung may still go through, so don't escalate yet
+			m.timedOut = true
+			m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 Terminating instance `%s` in `%s` TIMED OUT after %s, the notifier is exiting. "+
+				"Check whether it is gone, manual cleanup may be required\nRun: `%s`", name, zone, formatDuration(m.TerminationTimeout), m.cleanupCommand()))
+		} else if errors.Is(err, errIdentityMismatch) {
+			// Deleting by name could take out the wrong VM, so a human has to look;
+			// no cleanup command, and no reminders suggesting one
+			m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 REFUSED TO SELF-TERMINATE instance `%s` in `%s`: metadata and the Compute API disagree on its identity (%v). "+
+				"Check the notifier's metadata and configuration before deleting anything", name, zone, err))
+		} else if errors.Is(err, errQuotaExceeded) {
+			// Not a permission problem: the same call works once the quota refills
+			m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 FAILED TO SELF-TERMINATE instance `%s` in `%s`: Compute API quota exceeded for %v, "+
+				"manual cleanup required once the quota allows: %v\nRun: `%s`", name, zone, m.TerminateRetryWindow, err, m.cleanupCommand()))
+		} else {
+			m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 FAILED TO SELF-TERMINATE instance `%s` in `%s`, manual cleanup required: %v\nRun: `%s`",
+				name, zone, err, m.cleanupCommand()))
+		}
+		if !errors.Is(err, errIdentityMismatch) && !errors.Is(err, errTerminationTimedOut) {
+			m.escalate()
+		}
+	} else {
+		m.Lifecycle.enter(StateTerminated, m.Data.Reason)
+		switch result {
+		case ResultAlreadyStopping:
+			m.Notifier.notify(EventAlreadyTerminating, fmt.Sprintf("Instance `%s` in `%s` is already terminating, nothing left to do", name, zone))
+		case ResultAlreadyGone:
+			m.Notifier.notify(EventAlreadyTerminating, fmt.Sprintf("Instance `%s` in `%s` is already gone, nothing left to do", name, zone))
+		case ResultDryRun:
+			m.Notifier.notify(EventDryRun, fmt.Sprintf("🧪 Dry run: would %s instance `%s` in `%s` now, left it running", m.terminationAction(), name, zone))
+		}
+	}
+	if m.timedOut {
+		return false // The abandoned call still owns the Terminator
+	}
+	m.reportOperationWarnings()
+	return false
+}
+
+// runTermination deletes the group, if there is one and the TTL ran out,
+// then this VM. With TerminationTimeout it runs on its own goroutine and
+// gives up on it at the deadline, so a call that never returns can't stop
+// the alert going out.
+func (m *Monitor) runTermination() (TerminationResult, error) {
+	ctx := context.Background()
+	if m.TerminationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.TerminationTimeout)
+		defer cancel()
+	}
+
+	type outcome struct {
+		result TerminationResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		// The group shares the TTL; a sick or preempted member goes alone
+		if m.TerminateGroup != nil && m.Data.Reason == ReasonTTLExpiry {
+			m.terminateGroup(ctx)
+		}
+		result, err := m.selfTerminate(ctx)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case out := <-done:
+		if out.err != nil && ctx.Err() != nil {
+			return out.result, fmt.Errorf("%w after %v: %w", errTerminationTimedOut, m.TerminationTimeout, out.err)
+		}
+		return out.result, out.err
+	case <-ctx.Done():
+		log.Printf("Termination still running after %v, giving up on it", m.TerminationTimeout)
+		return ResultTerminated, fmt.Errorf("%w after %v", errTerminationTimedOut, m.TerminationTimeout)
+	}
+}
+
+// terminateGroup deletes the siblings in the group, after announcing them
+// and waiting out GroupConfirmWindow if one is set.
+func (m *Monitor) terminateGroup(ctx context.Context) {
+	name := m.Instance.Name
+	members, err := m.FindGroup(ctx)
+	if err != nil {
+		log.Printf("Listing group %s failed: %v", m.GroupLabel, err)
+		m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("Instance `%s` failed to clean up group `%s`, no siblings were deleted: %v", name, m.GroupLabel, err))
+		return
+	}
+	if len(members) == 0 {
+		log.Printf("No other instances in group %s", m.GroupLabel)
+		return
+	}
+	if m.GroupConfirmWindow > 0 && !m.confirmGroup(members) {
+		return
+	}
+
+	result, err := m.TerminateGroup(ctx, members)
+	if result.DryRun && err == nil {
+		var list strings.Builder
+		for _, r := range result.Members {
+			fmt.Fprintf(&list, "\n- `%s` in `%s`", r.Name, r.Zone)
+		}
+		log.Printf("Dry run: would delete %d siblings in group %s", len(result.Members), m.GroupLabel)
+		m.Notifier.notify(EventDryRun, fmt.Sprintf("🧪 Dry run: would delete %d siblings in group `%s`, left them running:%s", len(result.Members), m.GroupLabel, list.String()))
+		return
+	}
+	var list strings.Builder
+	for _, r := range result.Members {
+		if r.Err != nil {
+			fmt.Fprintf(&list, "\n❌ `%s` in `%s`: %v", r.Name, r.Zone, r.Err)
+		} else {
+			fmt.Fprintf(&list, "\n✅ `%s` in `%s`", r.Name, r.Zone)
+		}
+	}
+	if err != nil {
+		// Half a cluster left running is easy to miss; make the run fail too
+		m.groupFailed = true
+		log.Printf("Group termination failed (%s): %v", result, err)
+		m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("Instance `%s` failed to clean up group `%s` (%s), manual cleanup required:%s",
+			name, m.GroupLabel, result, list.String()))
+	} else {
+		log.Printf("Group termination done: %s", result)
+		m.Notifier.notify(EventTerminating, fmt.Sprintf("Instance `%s` cleaned up group `%s`: %s%s", name, m.GroupLabel, result, list.String()))
+	}
+}
+
+// confirmGroup lists the siblings about to be deleted, then waits
+// GroupConfirmWindow, polling the cancel attribute every CheckInterval. It
+// reports whether to go ahead.
+func (m *Monitor) confirmGroup(members []groupMember) bool {
+	var list strings.Builder
+	for _, g := range members {
+		fmt.Fprintf(&list, "\n• `%s` in `%s`", g.Name, g.Zone)
+	}
+	log.Printf("Deleting %d siblings in group %s in %v unless %s is set", len(members), m.GroupLabel, m.GroupConfirmWindow, groupCancelAttribute)
+	m.Notifier.notify(EventTerminating, fmt.Sprintf("Instance `%s` will delete these %d instances in group `%s` in %s unless `%s` is set to true:%s",
+		m.Instance.Name, len(members), m.GroupLabel, formatDuration(m.GroupConfirmWindow), path.Base(groupCancelAttribute), list.String()))
+
+	deadline := m.Clock.Now().Add(m.GroupConfirmWindow)
+	for {
+		if val, err := getMetadata(groupCancelAttribute); err == nil && strings.TrimSpace(strings.ToLower(val)) == "true" {
+			log.Printf("Group termination cancelled by %s", groupCancelAttribute)
+			m.Notifier.notify(EventTerminating, fmt.Sprintf("Group termination for `%s` was cancelled, its %d siblings are left running", m.GroupLabel, len(members)))
+			return false
+		}
+		left := deadline.Sub(m.Clock.Now())
+		if left <= 0 {
+			return true
+		}
+		if !m.sleep(min(m.CheckInterval, left)) {
+			log.Printf("Received SIGTERM while confirming group termination, leaving the siblings running")
+			return false
+		}
+	}
+}
+
+// snapshotBeforeTTL snapshots the disks ahead of a TTL termination if
+// SnapshotOnTTL is set, and reports whether termination may go ahead.
+func (m *Monitor) snapshotBeforeTTL() bool {
+	if !m.SnapshotOnTTL || m.NotifyOnly || m.Data.Reason != ReasonTTLExpiry {
+		return true
+	}
+	snapshotter, ok := m.Terminator.(diskSnapshotter)
+	if !ok {
+		log.Printf("Termination is delegated, not snapshotting disks")
+		return true
+	}
+	snapshots, err := snapshotter.SnapshotDisks(context.Background(), m.Instance.Project, m.Instance.Zone, m.Instance.Name)
+	m.Data.Snapshots = snapshots
+	if err != nil {
+		log.Printf("Snapshotting disks failed: %v", err)
+		m.Lifecycle.enter(StateTerminationFailed, m.Data.Reason)
+		m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 Instance `%s` in `%s` was NOT terminated because snapshotting its disks failed: %v\nRun: `%s`",
+			m.Instance.Name, m.Instance.Zone, err, m.cleanupCommand()))
+		m.escalate()
+		return false
+	}
+	return true
+}
+
+// selfTerminate runs the Terminator, retrying with backoff for up to
+// TerminateRetryWindow: a VM that fails to delete itself lives on.
+func (m *Monitor) selfTerminate(ctx context.Context) (TerminationResult, error) {
+	deadline := m.Clock.Now().Add(m.TerminateRetryWindow)
+	backoff := terminateRetryBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := m.callTerminator(ctx)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errZoneNotAllowed) || errors.Is(err, errIdentityMismatch) || !m.Clock.Now().Add(backoff).Before(deadline) {
+			return result, err
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			backoff = max(backoff, quotaRetryBackoff)
+			if !m.Clock.Now().Add(backoff).Before(deadline) {
+				return result, err
+			}
+		}
+		log.Printf("Self-termination attempt %d failed, retrying in %v: %v", attempt, backoff, err)
+		if !m.sleep(backoff) {
+			return result, err
+		}
+		backoff = min(2*backoff, maxTerminateRetryBackoff)
+	}
+}
+
+// callTerminator asks the Terminator to terminate this VM, telling it why
+// when it can record that.
+func (m *Monitor) callTerminator(ctx context.Context) (TerminationResult, error) {
+	if t, ok := m.Terminator.(reasonTerminator); ok {
+		return t.TerminateFor(ctx, m.Data.Reason, m.Instance.Project, m.Instance.Zone, m.Instance.Name)
+	}
+	return m.Terminator.Terminate(ctx, m.Instance.Project, m.Instance.Zone, m.Instance.Name)
+}
+
+// escalate repeats the failed self-termination alert on the
+// EscalationIntervals schedule until the instance is confirmed gone, so one
+// missed alert doesn't leave a VM running unnoticed.
+func (m *Monitor) escalate() {
+	if len(m.EscalationIntervals) == 0 {
+		return
+	}
+	checker, _ := m.Terminator.(instanceChecker)
+	failedAt := m.Clock.Now()
+	for i := 0; i < m.MaxEscalations; i++ {
+		if !m.sleep(m.EscalationIntervals[min(i, len(m.EscalationIntervals)-1)]) {
+			return
+		}
+		if checker != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), escalationCheckTimeout)
+			exists, err := checker.InstanceExists(ctx, m.Instance.Project, m.Instance.Zone, m.Instance.Name)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to check whether the instance still exists: %v", err)
+			} else if !exists {
+				log.Printf("Instance is gone, no more escalation needed")
+				return
+			}
+		}
+		m.Notifier.notify(EventTerminationFailed, fmt.Sprintf("🚨 Instance `%s` in `%s` is STILL RUNNING %v after failing to self-terminate (reminder %d of %d)\nRun: `%s`",
+			m.Instance.Name, m.Instance.Zone, m.Clock.Since(failedAt).Truncate(time.Second), i+1, m.MaxEscalations, m.cleanupCommand()))
+	}
+}
+
+// reportOperationWarnings passes on side effects of the termination the
+// API warned about, like leaked disks or addresses.
+func (m *Monitor) reportOperationWarnings() {
+	w, ok := m.Terminator.(operationWarner)
+	if !ok || len(w.OperationWarnings()) == 0 {
+		return
+	}
+	m.Notifier.notify(EventTerminating, fmt.Sprintf("⚠️ Terminating instance `%s` in `%s` raised warnings:\n- %s",
+		m.Instance.Name, m.Instance.Zone, strings.Join(w.OperationWarnings(), "\n- ")))
+}
+
+// terminationAction is what the Terminator does, e.g. "stop".
+func (m *Monitor) terminationAction() string {
+	if d, ok := m.Terminator.(actionDescriber); ok {
+		return d.Action()
+	}
+	return "terminate"
+}
+
+// cleanupCommand is what an operator runs when self-termination failed.
+func (m *Monitor) cleanupCommand() string {
+	return fmt.Sprintf("gcloud compute instances %s %s --zone %s --project %s",
+		cmp.Or(m.CleanupAction, "delete"), m.Instance.Name, m.Instance.Zone, m.Instance.Project)
+}
+
+// fetchSerialOutput attaches the serial console tail to the template data,
+// giving up after timeout so the alert isn't held back. Failures only cost
+// the snippet, never the alert.
+func (m *Monitor) fetchSerialOutput(timeout time.Duration) {
+	if m.SerialOutput == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := m.SerialOutput(ctx)
+	if err != nil {
+		log.Printf("Serial output unavailable: %v", err)
+		return
+	}
+	m.Data.SerialOutput = out
+}
+
+// preemptionCount is the shared counter after recording a preemption.
+type preemptionCount struct {
+	project, inFamily int
+}
+
+// countPreemption records this preemption in the shared counter in the
+// background. The read-modify-write can take seconds the alert can't
+// spare, so how many others happened recently goes in the follow-up.
+func (m *Monitor) countPreemption() {
+	if m.Counter == nil {
+		return
+	}
+	counted := make(chan preemptionCount, 1)
+	m.counted = counted
+	now, family := m.Clock.Now(), instanceFamily(m.Data.Instance)
+	go func() {
+		defer close(counted)
+		ctx, cancel := context.WithTimeout(context.Background(), counterTimeout)
+		defer cancel()
+		n, inFamily, err := m.Counter.Record(ctx, now, m.PreemptionWindow, family)
+		if err != nil {
+			log.Printf("Failed to update preemption counter: %v", err)
+			return
+		}
+		log.Printf("Preemption %d in this project in the last %v, %d of %s", n, m.PreemptionWindow, inFamily, family)
+		counted <- preemptionCount{n, inFamily}
+	}()
+}
+
+// preemptionCounts waits for countPreemption and describes the counts for
+// the follow-up, "" without any.
+func (m *Monitor) preemptionCounts() string {
+	if m.counted == nil {
+		return ""
+	}
+	c, ok := <-m.counted
+	m.counted = nil
+	if !ok {
+		return ""
+	}
+	m.Data.ProjectPreemptions, m.Data.PreemptionWindow = c.project, m.PreemptionWindow
+	text := fmt.Sprintf("\n%s preemption in this project in the last %s", ordinal(c.project), formatDuration(m.PreemptionWindow))
+	if m.FamilyThreshold > 0 && c.inFamily >= m.FamilyThreshold {
+		m.Data.FamilyPreemptions = c.inFamily
+		text += fmt.Sprintf("\n⚠️ %d of them were `%s` in `%s`: consider another zone or machine type", c.inFamily, m.Data.Instance.MachineType, m.Data.Instance.Zone)
+	}
+	return text
+}
+
+// checkScheduling re-reads the scheduling metadata every
+// SchedulingCheckInterval and, if the provisioning model changed since
+// startup or the last check, says so and starts or stops preemption polling
+// to match.
+func (m *Monitor) checkScheduling() {
+	now := m.Clock.Now()
+	if m.SchedulingCheckInterval <= 0 || now.Sub(m.lastSchedulingCheck) < m.SchedulingCheckInterval {
+		return
+	}
+	m.lastSchedulingCheck = now
+
+	preemptible, err := getMetadata("instance/scheduling/preemptible")
+	if err != nil {
+		log.Printf("Scheduling check failed: %v", err)
+		return
+	}
+	// Only Spot VMs have this set; the rest report STANDARD or nothing
+	provisioning, _ := getMetadata("instance/scheduling/provisioning-model")
+	model, was := classifyProvisioning(preemptible, provisioning), m.Data.ProvisioningModel
+	if model == "" && was != ProvisioningStandard {
+		return // Still Spot or preemptible, which one metadata can't say
+	}
+	if model == was || was == "" && model != ProvisioningStandard {
+		return
+	}
+
+	label := func(model string) string { return cmp.Or(model, "Spot or preemptible") }
+	log.Printf("Provisioning model changed from %s to %s", label(was), label(model))
+	m.Data.ProvisioningModel = model
+	m.NotSpot = model == ProvisioningStandard
+	monitoring := "preemption monitoring continues"
+	if m.NotSpot {
+		monitoring = "preemption monitoring is now off"
+	}
+	m.Notifier.notify(EventSchedulingChanged, fmt.Sprintf("🔀 The scheduling of instance `%s` in `%s` changed while it was running: it was %s and is now %s, %s",
+		m.Instance.Name, m.Instance.Zone, label(was), label(model), monitoring))
+}
+
+// recordMetadataRead feeds MetadataFailures, alerting when it trips or
+// clears, and the /metrics error count.
+func (m *Monitor) recordMetadataRead(err error) {
+	m.Status.metadataRead(err)
+	if m.MetadataFailures == nil || !m.MetadataFailures.record(m.Clock.Now(), err != nil) {
+		return
+	}
+	rate, n := m.MetadataFailures.rate()
+	window := formatDuration(m.MetadataFailures.window)
+	if m.MetadataFailures.tripped {
+		log.Printf("Metadata failure rate is %.0f%% over the last %s", rate*100, window)
+		m.Notifier.notify(EventMonitoringDegraded, fmt.Sprintf("📉 Monitoring of instance `%s` in `%s` is degraded: %.0f%% of the last %d metadata reads within %s failed, "+
+			"so a preemption may be noticed late or not at all. Last error: %v", m.Instance.Name, m.Instance.Zone, rate*100, n, window, err))
+		return
+	}
+	log.Printf("Metadata failure rate is back down to %.0f%%", rate*100)
+	m.Notifier.notify(EventMonitoringRecovered, fmt.Sprintf("📈 Monitoring of instance `%s` in `%s` has recovered: %.0f%% of metadata reads within the last %s failed",
+		m.Instance.Name, m.Instance.Zone, rate*100, window))
+}
+
+// checkCapacity warns once other VMs of this machine type in this zone
+// reach FamilyThreshold preemptions within PreemptionWindow while this one
+// is still up, so the workload can drain before its own 30s notice. It
+// warns again only once the pressure has eased in between.
+func (m *Monitor) checkCapacity() {
+	reader, ok := m.Counter.(preemptionReader)
+	now := m.Clock.Now()
+	if !ok || m.CapacityCheckInterval <= 0 || m.FamilyThreshold <= 0 || now.Sub(m.lastCapacityCheck) < m.CapacityCheckInterval {
+		return
+	}
+	m.lastCapacityCheck = now
+
+	ctx, cancel := context.WithTimeout(context.Background(), counterTimeout)
+	defer cancel()
+	family := instanceFamily(m.Data.Instance)
+	_, inFamily, err := reader.Recent(ctx, now, m.PreemptionWindow, family)
+	if err != nil {
+		log.Printf("Capacity check failed: %v", err)
+		return
+	}
+	pressure := inFamily >= m.FamilyThreshold
+	if pressure == m.capacityPressure {
+		return
+	}
+	m.capacityPressure = pressure
+	if !pressure {
+		log.Printf("Capacity pressure on %s has eased", family)
+		return
+	}
+	log.Printf("Capacity pressure: %d preemptions of %s in the last %v", inFamily, family, m.PreemptionWindow)
+	m.Notifier.notify(EventCapacityPressure, fmt.Sprintf("⚠️ Capacity pressure in `%s`: %d `%s` VMs were preempted in the last %s. "+
+		"Instance `%s` may be next, consider draining it now", m.Instance.Zone, inFamily, m.Instance.MachineType, formatDuration(m.PreemptionWindow), m.Instance.Name))
+}
+
+// runDrainCommand runs DrainCommand and describes how it went.
+func (m *Monitor) runDrainCommand() string {
+	err := runHook(m.DrainCommand, cmp.Or(m.DrainTimeout, defaultDrainTimeout))
+	if err != nil {
+		log.Printf("Drain command failed: %v", err)
+		return err.Error()
+	}
+	log.Printf("Drain command completed")
+	return "exit status 0"
+}
+
+// handleInterruption responds to GCP ending the VM as action says, then
+// confirms we're done.
+func (m *Monitor) handleInterruption(action PreemptAction) {
+	status := "no shutdown hook configured"
+	switch {
+	case action == PreemptNotify:
+		status = "notify only"
+	case m.PreemptHook != "":
+		if m.PreemptHookDelay > 0 {
+			log.Printf("Waiting %v before running the hook", m.PreemptHookDelay)
+			m.Clock.Sleep(m.PreemptHookDelay)
+		}
+		// GCP's notice started when we detected the interruption; the alert
+		// and the delay have already used some of it
+		timeout, limit := m.PreemptHookTimeout, preemptionBudget-m.Clock.Since(m.interruptedAt)
+		if timeout <= 0 || timeout > limit {
+			log.Printf("Capping the hook at %v, GCP won't wait any longer", max(limit, 0))
+			timeout = limit
+		}
+		if timeout <= 0 {
+			log.Printf("No time left in the preemption notice, skipping the hook")
+			status = "shutdown hook skipped, no time left"
+		} else if err := runHook(m.PreemptHook, timeout); err != nil {
+			log.Printf("Preemption hook failed: %v", err)
+			status = fmt.Sprintf("shutdown hook failed: %v", err)
+		} else {
+			status = "shutdown hook completed"
+		}
+	}
+	if action != PreemptNotify && len(m.ShutdownHooks) > 0 {
+		// GCP's notice started when we detected the interruption
+		hooks := runShutdownHooks(m.ShutdownHooks, preemptionBudget-m.Clock.Since(m.interruptedAt), m.Data.Reason)
+		if m.PreemptHook == "" {
+			status = "shutdown hooks " + hooks
+		} else {
+			status += ", shutdown hooks " + hooks
+		}
+	}
+
+	if action == PreemptDelete && !m.NotifyOnly {
+		// Within what is left of GCP's notice, so slow steps like snapshots
+		// are skipped; the delete itself still gets a few seconds
+		ctx, cancel := context.WithTimeout(context.Background(), max(preemptionBudget-m.Clock.Since(m.interruptedAt), 5*time.Second))
+		defer cancel()
+		result, err := m.callTerminator(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Stopping after preemption failed: %v", err)
+			status += fmt.Sprintf(", termination failed: %v", err)
+		case result == ResultAlreadyStopping:
+			status += ", GCP is already stopping it"
+		case result == ResultAlreadyGone:
+			status += ", it is already gone"
+		case result == ResultDryRun:
+			status += ", dry run: termination skipped"
+		default:
+			status += ", termination requested"
+			if w, ok := m.Terminator.(operationWarner); ok && len(w.OperationWarnings()) > 0 {
+				status += fmt.Sprintf(" with warnings: %s", strings.Join(w.OperationWarnings(), "; "))
+			}
+		}
+	}
+
+	m.Notifier.notify(EventShutdownPending, fmt.Sprintf("Instance `%s` in `%s` finished preemption handling (%s), waiting for GCP to stop it%s",
+		m.Instance.Name, m.Instance.Zone, status, m.preemptionCounts()))
+	m.audit("interrupted", status, nil)
+}
+
+// audit writes the outcome of a termination to the audit log, if there is
+// one; err, if set, makes it "failed". A failed write is only logged.
+func (m *Monitor) audit(outcome, detail string, err error) {
+	if m.Audit == nil {
+		return
+	}
+	rec := auditRecord{
+		Instance:         m.Instance,
+		Reason:           m.Data.Reason,
+		DetectedVia:      m.Data.DetectedVia,
+		MaintenanceEvent: m.Data.MaintenanceEvent,
+		Outcome:          outcome,
+		Detail:           detail,
+		Snapshots:        m.Data.Snapshots,
+		Started:          m.Data.Started,
+		Time:             m.Clock.Now(),
+	}
+	if err != nil {
+		rec.Outcome, rec.Error = "failed", err.Error()
+	}
+	if w, ok := m.Terminator.(operationWarner); ok {
+		rec.Warnings = w.OperationWarnings()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	if err := m.Audit.Write(ctx, rec); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
@@ -0,0 +1,1554 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// fakeClock advances instantly: Sleep and After move time forward by the
+// requested duration instead of blocking. Tests can also move it explicitly
+// with Advance.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+// fakeTerminator records when it was asked to terminate.
+type fakeTerminator struct {
+	clock Clock
+	calls []time.Time
+}
+
+func (f *fakeTerminator) Terminate(ctx context.Context, projectID, zone, instanceName string) (TerminationResult, error) {
+	f.calls = append(f.calls, f.clock.Now())
+	return ResultTerminated, nil
+}
+
+// recordingNotifier keeps every event it is sent.
+type recordingNotifier struct {
+	events []Event
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, event Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func newTestMonitor(t *testing.T) (*Monitor, *fakeClock, *fakeTerminator, *recordingNotifier) {
+	t.Helper()
+
+	// Serve metadata from the built-in mock values
+	mockMetadataFile = "true"
+	t.Cleanup(func() { mockMetadataFile = "" })
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	term := &fakeTerminator{clock: clock}
+	rec := &recordingNotifier{}
+	inst := instanceInfo{Name: "vm", Zone: "us-central1-a", Project: "p"}
+
+	m := &Monitor{
+		Instance:          inst,
+		Clock:             clock,
+		Terminator:        term,
+		Notifier:          &dispatcher{clock: clock, backends: []Notifier{rec}, instance: inst},
+		Templates:         templates,
+		TerminateAfter:    time.Hour,
+		GracePeriod:       15 * time.Minute,
+		CheckInterval:     time.Minute,
+		MaintenanceIgnore: regexp.MustCompile(defaultMaintenanceIgnore),
+		Data:              messageData{Instance: inst, CanTerminate: true},
+	}
+	return m, clock, term, rec
+}
+
+func TestMonitorTerminatesAfterTTLAndGracePeriod(t *testing.T) {
+	m, clock, term, rec := newTestMonitor(t)
+	start := clock.Now()
+
+	if interrupted := m.Run(); interrupted {
+		t.Fatal("Run reported an interruption, want TTL termination")
+	}
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want exactly once", len(term.calls))
+	}
+	if earliest := start.Add(m.TerminateAfter + m.GracePeriod); term.calls[0].Before(earliest) {
+		t.Errorf("Terminate called at %v, before TTL plus grace period (%v)", term.calls[0].Sub(start), earliest.Sub(start))
+	}
+	// One poll interval of slack for the check that noticed the TTL
+	if latest := start.Add(m.TerminateAfter + m.CheckInterval + m.GracePeriod); term.calls[0].After(latest) {
+		t.Errorf("Terminate called at %v, later than expected (%v)", term.calls[0].Sub(start), latest.Sub(start))
+	}
+
+	if m.Data.GraceElapsed != m.GracePeriod {
+		t.Errorf("GraceElapsed = %v, want %v", m.Data.GraceElapsed, m.GracePeriod)
+	}
+
+	var kinds []EventKind
+	for _, e := range rec.events {
+		kinds = append(kinds, e.Kind)
+		if e.Reason != ReasonTTLExpiry {
+			t.Errorf("%s event has reason %q, want %q", e.Kind, e.Reason, ReasonTTLExpiry)
+		}
+	}
+	want := []EventKind{EventTTLExpired, EventTerminating}
+	if len(kinds) != len(want) || kinds[0] != want[0] || kinds[1] != want[1] {
+		t.Errorf("events = %v, want %v", kinds, want)
+	}
+}
+
+func TestMonitorDefersTTLDuringFreezeWindow(t *testing.T) {
+	m, clock, term, rec := newTestMonitor(t)
+	// The TTL runs out at 01:00, inside the freeze
+	window, err := parseTimeWindow("00:30-03:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.FreezeWindow = window
+	start := clock.Now()
+
+	m.Run()
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want once", len(term.calls))
+	}
+	if earliest := start.Add(3*time.Hour + m.GracePeriod); term.calls[0].Before(earliest) {
+		t.Errorf("Terminate called at %v, before the freeze ended plus grace (%v)", term.calls[0].Sub(start), earliest.Sub(start))
+	}
+	var deferred int
+	for _, e := range rec.events {
+		if e.Kind == EventTerminationDeferred {
+			deferred++
+		}
+	}
+	if deferred != 1 {
+		t.Errorf("got %d %s events, want 1", deferred, EventTerminationDeferred)
+	}
+}
+
+func TestMonitorWarnsOnGraceSchedule(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.GraceWarnings = []float64{50, 90}
+
+	m.Run()
+
+	var graceStart time.Time
+	var offsets []time.Duration
+	for _, e := range rec.events {
+		switch e.Kind {
+		case EventTTLExpired:
+			graceStart = e.Time
+		case EventGraceWarning:
+			offsets = append(offsets, e.Time.Sub(graceStart))
+		}
+	}
+	// Warnings land on their marks, not on the next poll
+	if want := []time.Duration{450 * time.Second, 810 * time.Second}; !slices.Equal(offsets, want) {
+		t.Errorf("grace warnings at %v into the grace period, want %v", offsets, want)
+	}
+}
+
+func TestMonitorRunsDrainCommandAndReportsStatus(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	m.DrainCommand, m.DrainTimeout = "echo draining; exit 3", 5*time.Second
+
+	m.Run()
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want once despite the failed drain", len(term.calls))
+	}
+	last := rec.events[len(rec.events)-1]
+	if last.Kind != EventTerminating || !strings.Contains(last.Message, "Drain command: exit status 3") {
+		t.Errorf("last event = %s %q, want the drain status in the %s message", last.Kind, last.Message, EventTerminating)
+	}
+}
+
+func TestMonitorRunsShutdownHooksAtGraceStart(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	m.ShutdownHooks = []shutdownHook{{Name: "flush", Command: "true"}, {Name: "upload", Command: "exit 2"}}
+
+	m.Run()
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want once despite the failed hook", len(term.calls))
+	}
+	last := rec.events[len(rec.events)-1]
+	if !strings.Contains(last.Message, "Shutdown hooks: flush: ok, upload: exit status 2") {
+		t.Errorf("%s message %q lacks the hooks' status", last.Kind, last.Message)
+	}
+}
+
+func TestMonitorReportsDryRun(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	term := newComputeTerminator()
+	term.steps, term.dryRun = []string{"suspend"}, true
+	m.Terminator = term
+
+	m.Run()
+
+	last := rec.events[len(rec.events)-1]
+	if last.Kind != EventDryRun || !strings.Contains(last.Message, "would suspend instance") {
+		t.Errorf("last event = %s %q, want a %s saying it would suspend", last.Kind, last.Message, EventDryRun)
+	}
+}
+
+func TestMonitorDoesNotTerminateInNotifyOnlyMode(t *testing.T) {
+	m, _, term, _ := newTestMonitor(t)
+	m.NotifyOnly = true
+
+	m.Run()
+
+	if len(term.calls) != 0 {
+		t.Errorf("Terminate called %d times in notify-only mode, want 0", len(term.calls))
+	}
+}
+
+func TestMonitorTerminatesOnRequestWithoutGrace(t *testing.T) {
+	m, clock, term, rec := newTestMonitor(t)
+	now := make(chan struct{})
+	close(now)
+	m.TerminateNow, m.TerminateNowSkipGrace = now, true
+	start := clock.Now()
+
+	m.Run()
+
+	if len(term.calls) != 1 || !term.calls[0].Equal(start) {
+		t.Fatalf("Terminate calls = %v, want one immediately at %v", term.calls, start)
+	}
+	if rec.events[0].Kind != EventTerminateRequested || rec.events[0].Reason != ReasonManual {
+		t.Errorf("first event = %s (%s), want %s (%s)", rec.events[0].Kind, rec.events[0].Reason, EventTerminateRequested, ReasonManual)
+	}
+}
+
+func TestMonitorRetiresVMOnCompletionMarker(t *testing.T) {
+	m, clock, term, rec := newTestMonitor(t)
+	m.CompletionMarker = filepath.Join(t.TempDir(), "done")
+	start := clock.Now()
+	m.Watchdog = func() {
+		if clock.Since(start) >= 10*time.Minute {
+			os.WriteFile(m.CompletionMarker, nil, 0o644)
+		}
+	}
+
+	m.Run()
+
+	if len(term.calls) != 1 || m.Data.Reason != ReasonCompleted {
+		t.Fatalf("got %d terminations with reason %q, want 1 for %s", len(term.calls), m.Data.Reason, ReasonCompleted)
+	}
+	if elapsed := term.calls[0].Sub(start); elapsed >= m.TerminateAfter {
+		t.Errorf("terminated %v in, want well before the %v TTL", elapsed, m.TerminateAfter)
+	}
+	if rec.events[0].Kind != EventJobCompleted || !strings.Contains(rec.events[0].Message, m.CompletionMarker) {
+		t.Errorf("first event = %s %q", rec.events[0].Kind, rec.events[0].Message)
+	}
+}
+
+func TestMonitorRetiresUnhealthyWorkload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	m, clock, term, _ := newTestMonitor(t)
+	m.Health = &healthChecker{url: srv.URL, threshold: 3, minDuration: 5 * time.Minute}
+	start := clock.Now()
+
+	m.Run()
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want 1", len(term.calls))
+	}
+	if m.Data.Reason != ReasonUnhealthy {
+		t.Errorf("reason = %q, want %q", m.Data.Reason, ReasonUnhealthy)
+	}
+	if got := term.calls[0].Sub(start); got != 5*time.Minute+m.GracePeriod {
+		t.Errorf("terminated %v after start, want %v", got, 5*time.Minute+m.GracePeriod)
+	}
+}
+
+func TestMonitorAlertsOncePerPreemption(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Detection may run again if the process stays up after preemption
+	if !m.Run() || !m.Run() {
+		t.Fatal("Run did not report the interruption")
+	}
+
+	var alerts int
+	for _, e := range rec.events {
+		if e.Kind == EventPreempted {
+			alerts++
+		}
+	}
+	if alerts != 1 {
+		t.Errorf("got %d preemption alerts, want 1", alerts)
+	}
+}
+
+func TestMonitorSendsTTLWarningOnce(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.WarnFraction = 0.9
+
+	m.Run()
+
+	var warnings []Event
+	for _, e := range rec.events {
+		if e.Kind == EventTTLWarning {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("got %d TTL warnings, want 1", len(warnings))
+	}
+	if rec.events[0].Kind != EventTTLWarning {
+		t.Errorf("first event is %s, want the warning before %s", rec.events[0].Kind, EventTTLExpired)
+	}
+}
+
+func TestMonitorReportsEstimatedCost(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.WarnFraction, m.CostReportInterval = 0.9, 20*time.Minute
+	m.Data.HourlyCost, m.Data.CostSource = 0.5, "Billing Catalog"
+
+	m.Run()
+
+	var reports []string
+	for _, e := range rec.events {
+		switch e.Kind {
+		case EventCostReport:
+			reports = append(reports, e.Message)
+		case EventTTLWarning:
+			if !strings.Contains(e.Message, "Estimated cost so far: $0.450 at $0.500/h (Billing Catalog)") {
+				t.Errorf("warning %q lacks the cost so far", e.Message)
+			}
+		}
+	}
+	// At 20m, 40m and 1h; the TTL only fires once past 1h
+	if len(reports) != 3 || !strings.Contains(reports[0], "up for 20m, costing an estimated $0.167 so far") {
+		t.Errorf("cost reports = %q, want 3 starting at 20m", reports)
+	}
+}
+
+func TestMonitorResumesWithoutRepeatingWarnings(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.WarnFraction, m.SoftTTL = 0.9, 30*time.Minute
+	store := &memoryStore{}
+	m.State = &savedState{store: store, state: notifierState{Lifecycle: StateApproachingTTL, Warned: true, SoftTTLNotified: true}}
+	var transitions []transitionEvent
+	m.Lifecycle = &lifecycle{clock: m.Clock, send: func(e transitionEvent) { transitions = append(transitions, e) }, saved: m.State}
+
+	m.Run()
+
+	for _, e := range rec.events {
+		if e.Kind == EventTTLWarning || e.Kind == EventSoftTTL {
+			t.Errorf("got %s again after the restart", e.Kind)
+		}
+	}
+	if len(transitions) == 0 || transitions[0].To != StateApproachingTTL {
+		t.Errorf("transitions = %+v, want to resume in %s", transitions, StateApproachingTTL)
+	}
+	if saved, _ := store.Load(context.Background()); saved.Lifecycle != StateTerminated {
+		t.Errorf("saved lifecycle state = %q, want %q", saved.Lifecycle, StateTerminated)
+	}
+}
+
+func TestDispatcherQuietHoursFollowClock(t *testing.T) {
+	clock := newFakeClock() // midnight UTC
+	rec := &recordingNotifier{}
+	window, err := parseTimeWindow("22:00-07:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dispatcher{clock: clock, backends: []Notifier{rec}, quietHours: window}
+
+	d.notify(EventLaunched, "suppressed")
+	d.notify(EventPreempted, "critical always goes out")
+	clock.Advance(8 * time.Hour)
+	d.notify(EventLaunched, "after quiet hours")
+
+	if len(rec.events) != 2 || rec.events[0].Kind != EventPreempted || rec.events[1].Message != "after quiet hours" {
+		t.Errorf("unexpected events: %+v", rec.events)
+	}
+}
+
+func TestDispatcherCooldownCarriesOverFromLastProcess(t *testing.T) {
+	clock := newFakeClock()
+	rec := &recordingNotifier{}
+	saved := make(chan EventKind, 2)
+	d := &dispatcher{
+		clock: clock, backends: []Notifier{rec}, cooldown: 10 * time.Minute,
+		lastSent: map[EventKind]time.Time{EventPreempted: clock.Now().Add(-time.Minute)}, // from before the restart
+		onSent:   func(kind EventKind, _ time.Time) { saved <- kind },
+	}
+
+	d.notify(EventPreempted, "repeat within the cooldown")
+	d.notify(EventLaunched, "other kinds are unaffected")
+	clock.Advance(10 * time.Minute)
+	d.notify(EventPreempted, "cooldown over")
+
+	if len(rec.events) != 2 || rec.events[0].Kind != EventLaunched || rec.events[1].Message != "cooldown over" {
+		t.Errorf("unexpected events: %+v", rec.events)
+	}
+	for range 2 {
+		<-saved
+	}
+}
+
+func TestDispatcherCooldownCountsOnlyDeliveredEvents(t *testing.T) {
+	clock := newFakeClock()
+	failing := &failingNotifier{}
+	d := &dispatcher{clock: clock, backends: []Notifier{failing}, cooldown: 10 * time.Minute, lastSent: map[EventKind]time.Time{}}
+
+	d.notify(EventPreempted, "lost")
+	d.notify(EventPreempted, "tried again")
+	d.notify(EventTerminationFailed, "still running")
+	d.notify(EventTerminationFailed, "reminder")
+	if failing.calls != 4 {
+		t.Errorf("got %d delivery attempts, want 4: failed sends don't start the cooldown", failing.calls)
+	}
+
+	rec := &recordingNotifier{}
+	d.backends = []Notifier{rec}
+	d.notify(EventTerminationFailed, "still running")
+	d.notify(EventTerminationFailed, "reminder")
+	if len(rec.events) != 2 {
+		t.Errorf("got %d termination failures, want every one despite the cooldown", len(rec.events))
+	}
+}
+
+func TestDispatcherRedactsInstanceFields(t *testing.T) {
+	rec := &recordingNotifier{}
+	labels := map[string]string{"owner": "acme-secret"}
+	d := &dispatcher{
+		clock: newFakeClock(), backends: []Notifier{rec}, labels: labels,
+		instance: instanceInfo{Name: "vm", Project: "acme-secret-prod"},
+		redact:   []*regexp.Regexp{regexp.MustCompile(`acme-secret`)},
+	}
+
+	d.notify(EventLaunched, "started in acme-secret-prod")
+
+	e := rec.events[0]
+	if e.Message != "started in ***-prod" || e.Instance.Project != "***-prod" || e.Instance.Labels["owner"] != "***" {
+		t.Errorf("event = %q with %+v, want every acme-secret masked", e.Message, e.Instance)
+	}
+	if labels["owner"] != "acme-secret" {
+		t.Errorf("the dispatcher's labels were changed to %v", labels)
+	}
+}
+
+func TestDispatcherBudgetHoldsUnderConcurrentNotify(t *testing.T) {
+	rec := &recordingNotifier{}
+	d := &dispatcher{clock: newFakeClock(), backends: []Notifier{rec}, budget: 5}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.notify(EventTTLWarning, fmt.Sprintf("warning %d", i))
+		}()
+	}
+	wg.Wait()
+
+	if len(rec.events) != 5 {
+		t.Errorf("got %d events, want the budget of 5", len(rec.events))
+	}
+}
+
+func TestDispatcherReasonSetWhileNotifying(t *testing.T) {
+	rec := &recordingNotifier{}
+	d := &dispatcher{clock: newFakeClock(), backends: []Notifier{rec}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.notify(EventNotifierExiting, "max lifetime reached") // as from MAX_PROCESS_LIFETIME's timer
+	}()
+	d.setReason(ReasonTTLExpiry)
+	<-done
+	d.notify(EventTTLExpired, "terminating")
+
+	if last := rec.events[len(rec.events)-1]; last.Reason != ReasonTTLExpiry {
+		t.Errorf("reason = %q, want %q", last.Reason, ReasonTTLExpiry)
+	}
+}
+
+func TestDispatcherCoalescedEventIsNotDeliveredUntilFlushed(t *testing.T) {
+	failing := &failingNotifier{}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{failing}, coalesce: time.Hour}
+
+	var recorded int
+	if d.notifyThen(EventLaunched, "started", func() { recorded++ }) {
+		t.Error("notifyThen reported a queued event as delivered")
+	}
+	if d.flush() || recorded != 0 {
+		t.Errorf("flush to a failing backend recorded the delivery %d times", recorded)
+	}
+
+	d.backends = []Notifier{&recordingNotifier{}}
+	d.notifyThen(EventLaunched, "started", func() { recorded++ })
+	if recorded != 0 {
+		t.Error("delivery recorded before the batch went out")
+	}
+	if !d.flush() || recorded != 1 {
+		t.Errorf("flush delivered, recorded %d times; want once", recorded)
+	}
+}
+
+func TestDispatcherTagsEventsWithCorrelationID(t *testing.T) {
+	rec := &recordingNotifier{}
+	d := &dispatcher{clock: newFakeClock(), backends: []Notifier{rec}, instance: instanceInfo{Name: "vm", CorrelationID: "run-42"}}
+
+	d.notify(EventLaunched, "started")
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(rec.events))
+	}
+	if e := rec.events[0]; e.Instance.CorrelationID != "run-42" || e.Message != "started\nCorrelation ID: run-42" {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestDispatcherSkipsDisabledBackends(t *testing.T) {
+	t.Setenv("PUBSUB_ENABLED", "false")
+	live, err := loadLiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slack, pubsub := &recordingNotifier{}, &recordingNotifier{}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{
+		&timedNotifier{name: "slack", timeout: time.Second, Notifier: slack},
+		&timedNotifier{name: "pubsub", timeout: time.Second, Notifier: pubsub},
+	}}
+	live.apply(d, &breakerNotifier{})
+
+	d.notify(EventLaunched, "hello")
+
+	if len(slack.events) != 1 || len(pubsub.events) != 0 {
+		t.Errorf("slack got %d events, pubsub %d; want 1 and 0", len(slack.events), len(pubsub.events))
+	}
+}
+
+func TestDispatcherAppliesBackendMinSeverity(t *testing.T) {
+	t.Setenv("OPSGENIE_MIN_SEVERITY", "critical")
+	slack, opsgenie := &recordingNotifier{}, &recordingNotifier{}
+	timed, err := newTimedNotifier("opsgenie", opsgenie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{
+		&timedNotifier{name: "slack", timeout: time.Second, Notifier: slack}, timed,
+	}}
+
+	d.notify(EventLaunched, "hello")
+	d.notify(EventPreempted, "going")
+
+	if len(slack.events) != 2 || len(opsgenie.events) != 1 || opsgenie.events[0].Kind != EventPreempted {
+		t.Errorf("slack got %d events, opsgenie %v; want 2 and only the preemption", len(slack.events), opsgenie.events)
+	}
+
+	t.Setenv("OPSGENIE_MIN_SEVERITY", "urgent")
+	if _, err := newTimedNotifier("opsgenie", opsgenie); err == nil {
+		t.Error("accepted an unknown severity")
+	}
+}
+
+func TestDispatcherAppliesBackendEvents(t *testing.T) {
+	t.Setenv("PUBSUB_EVENTS", "launched, preempted")
+	pubsub := &recordingNotifier{}
+	timed, err := newTimedNotifier("pubsub", pubsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{timed}}
+
+	d.notify(EventLaunched, "hello")
+	d.notify(EventTTLWarning, "soon")
+	d.notify(EventPreempted, "going")
+
+	if len(pubsub.events) != 2 || pubsub.events[1].Kind != EventPreempted {
+		t.Errorf("pubsub got %v, want the launch and the preemption only", pubsub.events)
+	}
+
+	t.Setenv("PUBSUB_EVENTS", "launched,exploded")
+	if _, err := newTimedNotifier("pubsub", pubsub); err == nil {
+		t.Error("accepted an unknown event kind")
+	}
+}
+
+func TestDispatcherCoalescesUntilCriticalMessage(t *testing.T) {
+	rec := &recordingNotifier{}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{rec}, coalesce: time.Hour}
+
+	d.notify(EventTTLWarning, "warning")
+	if len(rec.events) != 0 {
+		t.Fatalf("non-critical message sent before the window closed")
+	}
+	d.notify(EventPreempted, "preempted")
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d sends, want 1 combined", len(rec.events))
+	}
+	if e := rec.events[0]; e.Kind != EventPreempted || e.Message != "warning\n\npreempted" {
+		t.Errorf("combined event = %s %q", e.Kind, e.Message)
+	}
+}
+
+// blockingNotifier never answers before its context ends.
+type blockingNotifier struct{}
+
+func (blockingNotifier) Notify(ctx context.Context, _ Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDispatcherSlowBackendDoesNotBlockOthers(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	rec := &recordingNotifier{}
+	slow := &timedNotifier{name: "slow", timeout: 10 * time.Millisecond, Notifier: blockingNotifier{}}
+	d := &dispatcher{clock: realClock{}, backends: []Notifier{slow, rec}}
+
+	start := time.Now()
+	if !d.notify(EventPreempted, "preempted") {
+		t.Error("notify reported no delivery")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fan-out took %v, the slow backend's timeout is 10ms", elapsed)
+	}
+	if len(rec.events) != 1 {
+		t.Errorf("fast backend got %d events, want 1", len(rec.events))
+	}
+	if err := slow.Notify(context.Background(), Event{}); !isTimeout(err) {
+		t.Errorf("slow backend error %v is not reported as a timeout", err)
+	}
+}
+
+func TestMonitorCrossChecksSIGTERM(t *testing.T) {
+	for _, tc := range []struct {
+		action      SIGTERMAction
+		metadata    string
+		interrupted bool
+	}{
+		{SIGTERMCheck, `{"instance/preempted": "TRUE"}`, true},
+		{SIGTERMCheck, `{}`, false},
+		{SIGTERMExit, `{"instance/preempted": "TRUE"}`, false},
+		{SIGTERMPreemption, `{}`, true},
+	} {
+		m, _, term, rec := newTestMonitor(t)
+		mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+		if err := os.WriteFile(mockMetadataFile, []byte(tc.metadata), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		shutdown := make(chan struct{})
+		close(shutdown)
+		m.Shutdown, m.SIGTERMAction, m.SIGTERMCheckWindow = shutdown, tc.action, 2*time.Second
+
+		if got := m.Run(); got != tc.interrupted {
+			t.Errorf("%s, metadata %s: Run() = %v, want %v", tc.action, tc.metadata, got, tc.interrupted)
+		}
+		if len(term.calls) != 0 {
+			t.Errorf("%s, metadata %s: Terminate called after SIGTERM", tc.action, tc.metadata)
+		}
+		if tc.interrupted && (len(rec.events) == 0 || rec.events[0].Kind != EventPreempted || m.Data.DetectedVia != "SIGTERM") {
+			t.Errorf("%s, metadata %s: events %+v, want a preemption detected via SIGTERM", tc.action, tc.metadata, rec.events)
+		}
+	}
+}
+
+func TestMonitorPreemptionSkipsGracePeriod(t *testing.T) {
+	m, clock, term, _ := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.GracePeriod = 24 * time.Hour
+	m.OnPreempt = PreemptDelete
+	m.PreemptHook, m.PreemptHookTimeout, m.PreemptHookDelay = "true", time.Hour, 5*time.Second
+	start, wallStart := clock.Now(), time.Now()
+
+	if !m.Run() {
+		t.Fatal("Run did not report the preemption")
+	}
+
+	if elapsed := clock.Since(start); elapsed > preemptionBudget {
+		t.Errorf("preemption handling slept %v, budget is %v", elapsed, preemptionBudget)
+	}
+	if elapsed := time.Since(wallStart); elapsed > preemptionBudget {
+		t.Errorf("preemption handling took %v, budget is %v", elapsed, preemptionBudget)
+	}
+	if len(term.calls) != 1 || term.calls[0].Sub(start) > preemptionBudget {
+		t.Errorf("Terminate calls = %v, want one within %v of %v", term.calls, preemptionBudget, start)
+	}
+}
+
+// slowNotifier records events like recordingNotifier, each taking delay on
+// clock, as a backend near its deadline would.
+type slowNotifier struct {
+	recordingNotifier
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (n *slowNotifier) Notify(ctx context.Context, event Event) error {
+	n.clock.Advance(n.delay)
+	return n.recordingNotifier.Notify(ctx, event)
+}
+
+func TestMonitorPreemptHookGetsWhatIsLeftOfTheNotice(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowNotifier{clock: clock, delay: 27 * time.Second}
+	m.Notifier.backends = []Notifier{slow}
+	m.PreemptHook, m.PreemptHookTimeout, m.PreemptHookDelay = "sleep 5", 30*time.Second, 2*time.Second
+
+	start := time.Now()
+	if !m.Run() {
+		t.Fatal("Run did not report the preemption")
+	}
+
+	// The alert took 27s and the delay 2s, leaving 1s of the 30s notice
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("hook ran for %v, want it cut off at what was left of the notice", elapsed)
+	}
+	last := slow.events[len(slow.events)-1]
+	if !strings.Contains(last.Message, "hook timed out after 1s") {
+		t.Errorf("last event = %q, want the hook timed out after 1s", last.Message)
+	}
+}
+
+func TestMonitorPreemptionAlertDoesNotWaitForSerialOutput(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.SerialOutput = func(ctx context.Context) (string, error) {
+		<-ctx.Done() // an API call that hangs
+		return "", ctx.Err()
+	}
+
+	start := time.Now()
+	m.Run()
+
+	if elapsed := time.Since(start); elapsed > 2*preemptSerialOutputTimeout {
+		t.Errorf("preemption handling took %v, want the serial output given up after %v", elapsed, preemptSerialOutputTimeout)
+	}
+	if rec.events[0].Kind != EventPreempted || strings.Contains(rec.events[0].Message, "serial console") {
+		t.Errorf("first event = %s %q, want the alert without serial output", rec.events[0].Kind, rec.events[0].Message)
+	}
+}
+
+func TestMonitorReportsSurvivedPreemption(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.SurvivalWindow = 5 * time.Minute
+
+	if !m.Run() {
+		t.Fatal("Run did not report the preemption")
+	}
+	start := clock.Now()
+	if m.survived() {
+		t.Fatal("survived() with metadata still saying preempted")
+	}
+	if got := clock.Since(start); got != m.SurvivalWindow {
+		t.Errorf("watched for %v, want exactly %v", got, m.SurvivalWindow)
+	}
+	if err := os.WriteFile(mockMetadataFile, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !m.survived() {
+		t.Fatal("survived() = false after metadata flipped back")
+	}
+	if last := rec.events[len(rec.events)-1]; last.Kind != EventInterruptionCancelled || last.Reason != ReasonPreemption {
+		t.Errorf("last event = %s (%q), want %s", last.Kind, last.Reason, EventInterruptionCancelled)
+	}
+}
+
+func TestMonitorSurvivesSIGTERMPreemption(t *testing.T) {
+	m, _, term, _ := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan struct{})
+	close(shutdown)
+	m.Shutdown, m.SIGTERMAction, m.SurvivalWindow = shutdown, SIGTERMCheck, 5*time.Minute
+
+	if !m.Run() || m.Data.DetectedVia != "SIGTERM" {
+		t.Fatalf("Run did not report the preemption via SIGTERM (%q)", m.Data.DetectedVia)
+	}
+	if err := os.WriteFile(mockMetadataFile, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !m.survived() {
+		t.Fatal("survived() = false: the spent SIGTERM cut the watch short")
+	}
+	if m.Run() || len(term.calls) != 1 {
+		t.Errorf("resumed Run made %d terminations, want it to run to the TTL", len(term.calls))
+	}
+}
+
+func TestMonitorTemplatesSeeComputedTimes(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.TerminateAfter, m.WarnFraction = 10*time.Hour, 0.7
+	m.Data.TerminateAfter = m.TerminateAfter
+	m.Templates[msgWarn] = template.Must(template.New(msgWarn).Funcs(templateFuncs).Parse(
+		"{{.PercentUsed}}% through its {{duration .TerminateAfter}} lifetime, {{duration .Remaining}} remaining"))
+
+	m.Run()
+
+	if got, want := rec.events[0].Message, "70% through its 10h lifetime, 3h remaining"; got != want {
+		t.Errorf("warning = %q, want %q", got, want)
+	}
+}
+
+func TestDispatcherSavesUndeliveredCriticalEvent(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	path := filepath.Join(t.TempDir(), "undelivered.jsonl")
+	d := &dispatcher{clock: newFakeClock(), backends: []Notifier{&failingNotifier{}},
+		onUndelivered: undeliveredAction{mode: "file", path: path}}
+
+	d.notify(EventTTLWarning, "not critical")
+	if d.notify(EventPreempted, "preempted") {
+		t.Error("notify reported delivery with every backend failing")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"kind":"preempted"`) || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("undelivered file = %q, want only the preemption", data)
+	}
+}
+
+// flakyTerminator fails the first failures calls.
+type flakyTerminator struct {
+	failures, calls int
+}
+
+func (f *flakyTerminator) Terminate(context.Context, string, string, string) (TerminationResult, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return ResultTerminated, io.ErrUnexpectedEOF
+	}
+	return ResultTerminated, nil
+}
+
+func TestMonitorRetriesSelfTermination(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	term := &flakyTerminator{failures: 2}
+	m.Terminator, m.TerminateRetryWindow = term, 5*time.Minute
+
+	m.Run()
+
+	if term.calls != 3 {
+		t.Errorf("Terminate called %d times, want 3", term.calls)
+	}
+	for _, e := range rec.events {
+		if e.Kind == EventTerminationFailed {
+			t.Errorf("got %s after a retry succeeded", e.Kind)
+		}
+	}
+}
+
+func TestMonitorAlertsWithCleanupCommandWhenSelfTerminationFails(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	term := &flakyTerminator{failures: 1000}
+	m.Terminator, m.TerminateRetryWindow = term, 5*time.Minute
+
+	m.Run()
+
+	if term.calls < 2 || clock.Since(m.Data.Started) > m.TerminateAfter+m.CheckInterval+m.GracePeriod+m.TerminateRetryWindow {
+		t.Errorf("%d attempts ending at %v, want retries bounded by the window", term.calls, clock.Since(m.Data.Started))
+	}
+	last := rec.events[len(rec.events)-1]
+	if want := "`gcloud compute instances delete vm --zone us-central1-a --project p`"; last.Kind != EventTerminationFailed || !strings.Contains(last.Message, want) {
+		t.Errorf("last event = %s %q, want %s with %s", last.Kind, last.Message, EventTerminationFailed, want)
+	}
+}
+
+// lingeringTerminator never manages to terminate, and the instance goes
+// away after gone existence checks.
+type lingeringTerminator struct {
+	flakyTerminator
+	gone, checks int
+}
+
+func (l *lingeringTerminator) InstanceExists(context.Context, string, string, string) (bool, error) {
+	l.checks++
+	return l.checks < l.gone, nil
+}
+
+func TestMonitorEscalatesUntilInstanceIsGone(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	term := &lingeringTerminator{flakyTerminator: flakyTerminator{failures: 1000}, gone: 3}
+	m.Terminator, m.TerminateRetryWindow = term, time.Minute
+	m.EscalationIntervals, m.MaxEscalations = []time.Duration{time.Minute, 5 * time.Minute}, 10
+
+	m.Run()
+
+	var reminders []string
+	for _, e := range rec.events {
+		if e.Kind == EventTerminationFailed && strings.Contains(e.Message, "STILL RUNNING") {
+			reminders = append(reminders, e.Message)
+		}
+	}
+	if len(reminders) != 2 || !strings.Contains(reminders[1], "STILL RUNNING 6m0s") {
+		t.Errorf("reminders = %q, want two, 1m and 6m after the failure", reminders)
+	}
+}
+
+// snapshottingTerminator is a fakeTerminator that can snapshot disks.
+type snapshottingTerminator struct {
+	fakeTerminator
+	snapshotted []time.Time
+}
+
+func (s *snapshottingTerminator) SnapshotDisks(context.Context, string, string, string) ([]string, error) {
+	s.snapshotted = append(s.snapshotted, s.clock.Now())
+	return []string{"projects/p/global/snapshots/vm-20240101-010000"}, nil
+}
+
+func TestMonitorSnapshotsDisksBeforeTTLTermination(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	term := &snapshottingTerminator{fakeTerminator: fakeTerminator{clock: clock}}
+	m.Terminator, m.SnapshotOnTTL = term, true
+
+	m.Run()
+
+	if len(term.snapshotted) != 1 || len(term.calls) != 1 || term.calls[0].Before(term.snapshotted[0]) {
+		t.Fatalf("snapshots at %v, terminate at %v, want one snapshot before terminating", term.snapshotted, term.calls)
+	}
+	var execute string
+	for _, e := range rec.events {
+		if e.Kind == EventTerminating {
+			execute = e.Message
+		}
+	}
+	if !strings.Contains(execute, "projects/p/global/snapshots/vm-20240101-010000") {
+		t.Errorf("termination message %q lacks the snapshot", execute)
+	}
+}
+
+func TestMonitorKeepsRunningThroughLiveMigration(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/maintenance-event": "MIGRATE_ON_HOST_MAINTENANCE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Run() {
+		t.Fatal("Run reported an interruption for a live migration")
+	}
+
+	if len(term.calls) != 1 {
+		t.Errorf("Terminate called %d times, want the TTL to still apply", len(term.calls))
+	}
+	if rec.events[0].Kind != EventMigrating || rec.events[1].Kind != EventTTLExpired {
+		t.Errorf("events start with %s, %s; want one %s note, then the TTL", rec.events[0].Kind, rec.events[1].Kind, EventMigrating)
+	}
+}
+
+func TestMonitorRemindsAtSoftTTL(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	m.SoftTTL, m.TerminateAfter = 30*time.Minute, time.Hour
+	m.Data.SoftTTL, m.Data.TerminateAfter = m.SoftTTL, m.TerminateAfter
+
+	m.Run()
+
+	var reminders int
+	for _, e := range rec.events {
+		if e.Kind == EventSoftTTL {
+			reminders++
+		}
+	}
+	if reminders != 1 || rec.events[0].Kind != EventSoftTTL {
+		t.Errorf("got %d soft TTL reminders (first event %s), want exactly one first", reminders, rec.events[0].Kind)
+	}
+	if !strings.Contains(rec.events[0].Message, "in 30m") {
+		t.Errorf("reminder %q doesn't say how long until the hard limit", rec.events[0].Message)
+	}
+	if len(term.calls) != 1 {
+		t.Errorf("Terminate called %d times, want once at the hard TTL", len(term.calls))
+	}
+}
+
+func TestDispatcherAddsRunbookToCriticalOnly(t *testing.T) {
+	rec := &recordingNotifier{}
+	d := &dispatcher{clock: newFakeClock(), backends: []Notifier{rec}, runbook: "https://wiki/spot"}
+
+	d.notify(EventLaunched, "launched")
+	d.notify(EventPreempted, "preempted")
+
+	if rec.events[0].Message != "launched" || rec.events[1].Message != "preempted\nRunbook: https://wiki/spot" {
+		t.Errorf("messages = %q, %q", rec.events[0].Message, rec.events[1].Message)
+	}
+}
+
+func TestMonitorEndsGraceOnceDrained(t *testing.T) {
+	var probes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probes++; probes < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	m, clock, term, _ := newTestMonitor(t)
+	m.DrainCheckURL = srv.URL
+	start := clock.Now()
+
+	m.Run()
+
+	if len(term.calls) != 1 {
+		t.Fatalf("Terminate called %d times, want 1", len(term.calls))
+	}
+	// The TTL is noticed one poll late, then two failed drain checks
+	if got, want := term.calls[0].Sub(start), m.TerminateAfter+3*m.CheckInterval; got != want {
+		t.Errorf("terminated %v after start, want %v (grace period is %v)", got, want, m.GracePeriod)
+	}
+}
+
+func TestLaunchMessageSaysWhenThereIsNoTTL(t *testing.T) {
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := templates.render(msgLaunch, messageData{TerminateAfter: 0}.at(time.Now()))
+	if !strings.Contains(msg, "no automatic termination configured") {
+		t.Errorf("launch message without a TTL doesn't say so:\n%s", msg)
+	}
+}
+
+func TestCheckIntervalIsClampedToPreemptionNotice(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	t.Setenv("CHECK_INTERVAL", "45s")
+	c, err := loadLiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.checkInterval != maxCheckInterval {
+		t.Errorf("checkInterval = %v, want it clamped to %v", c.checkInterval, maxCheckInterval)
+	}
+
+	t.Setenv("CHECK_INTERVAL", "0s")
+	if _, err := loadLiveConfig(); err == nil {
+		t.Error("CHECK_INTERVAL=0s accepted")
+	}
+}
+
+func TestMonitorGracePeriodAttribute(t *testing.T) {
+	for _, tt := range []struct {
+		attr string
+		want time.Duration
+	}{
+		{"45m", 45 * time.Minute},
+		{"5h", time.Hour}, // Capped at MaxGracePeriod
+		{"soon", 15 * time.Minute},
+	} {
+		m, clock, term, _ := newTestMonitor(t)
+		m.MaxGracePeriod = time.Hour
+		mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+		if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/attributes/grace-period": "`+tt.attr+`"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		start := clock.Now()
+
+		m.Run()
+
+		if len(term.calls) != 1 {
+			t.Fatalf("%s: got %d terminations, want 1", tt.attr, len(term.calls))
+		}
+		if got := term.calls[0].Sub(start) - m.TerminateAfter; got < tt.want || got > tt.want+m.CheckInterval {
+			t.Errorf("%s: grace period lasted %v, want %v", tt.attr, got, tt.want)
+		}
+		if m.Data.GracePeriod != tt.want {
+			t.Errorf("%s: reported grace period %v, want %v", tt.attr, m.Data.GracePeriod, tt.want)
+		}
+	}
+}
+
+func TestMonitorGroupConfirmWindow(t *testing.T) {
+	for _, cancel := range []bool{false, true} {
+		m, _, _, rec := newTestMonitor(t)
+		mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+		if err := os.WriteFile(mockMetadataFile, []byte(fmt.Sprintf(`{"instance/attributes/cancel-group-termination": "%t"}`, cancel)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		siblings := []groupMember{{Zone: "us-central1-a", Name: "vm-2"}, {Zone: "us-central1-b", Name: "vm-3"}}
+		var deleted []groupMember
+		m.GroupLabel, m.GroupConfirmWindow = "team=ml", 10*time.Minute
+		m.FindGroup = func(ctx context.Context) ([]groupMember, error) { return siblings, nil }
+		m.TerminateGroup = func(ctx context.Context, members []groupMember) (groupResult, error) {
+			deleted = members
+			return groupResult{Deleted: len(members)}, nil
+		}
+
+		m.Run()
+
+		if cancel != (deleted == nil) {
+			t.Errorf("cancel=%t: deleted %v", cancel, deleted)
+		}
+		if !cancel && !slices.Equal(deleted, siblings) {
+			t.Errorf("deleted %v, want the announced %v", deleted, siblings)
+		}
+		var preview bool
+		for _, e := range rec.events {
+			preview = preview || strings.Contains(e.Message, "`vm-3` in `us-central1-b`")
+		}
+		if !preview {
+			t.Errorf("cancel=%t: siblings were never announced", cancel)
+		}
+	}
+}
+
+func TestMonitorUnhealthyLeavesGroupRunning(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	m, _, term, _ := newTestMonitor(t)
+	m.Health = &healthChecker{url: srv.URL, threshold: 3, minDuration: 5 * time.Minute}
+	m.GroupLabel = "team=ml"
+	m.FindGroup = func(ctx context.Context) ([]groupMember, error) {
+		return []groupMember{{Zone: "us-central1-a", Name: "vm-2"}}, nil
+	}
+	var deleted []groupMember
+	m.TerminateGroup = func(ctx context.Context, members []groupMember) (groupResult, error) {
+		deleted = members
+		return groupResult{Deleted: len(members)}, nil
+	}
+
+	m.Run()
+
+	if len(term.calls) != 1 || m.Data.Reason != ReasonUnhealthy {
+		t.Fatalf("got %d terminations with reason %q, want 1 for %s", len(term.calls), m.Data.Reason, ReasonUnhealthy)
+	}
+	if deleted != nil {
+		t.Errorf("deleted siblings %v for an unhealthy member", deleted)
+	}
+}
+
+func TestMonitorNotSpotSkipsPreemptionCheck(t *testing.T) {
+	m, _, term, _ := newTestMonitor(t)
+	m.NotSpot = true
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Run() {
+		t.Fatal("Run reported a preemption on a standard VM")
+	}
+	if len(term.calls) != 1 {
+		t.Errorf("got %d terminations, want the TTL to still apply", len(term.calls))
+	}
+}
+
+func TestLoadTemplatesFromDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "preempt.tmpl"), []byte("{{.Instance.Name}} preempted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEMPLATE_DIR", dir)
+	t.Setenv("LAUNCH_TEMPLATE", "inline wins")
+	if err := os.WriteFile(filepath.Join(dir, "launch.tmpl"), []byte("from dir"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := messageData{Instance: instanceInfo{Name: "vm"}}
+	for name, want := range map[string]string{msgPreempt: "vm preempted", msgLaunch: "inline wins"} {
+		if got := templates.render(name, data); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := templates.render(msgMigrate, data); !strings.Contains(got, "live-migrated") {
+		t.Errorf("migrate = %q, want the built-in template", got)
+	}
+}
+
+func TestLoadTemplatesFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "preempt.txt")
+	if err := os.WriteFile(path, []byte("file: {{.Instance.Name}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PREEMPT_TEMPLATE_FILE", path)
+	t.Setenv("LAUNCH_TEMPLATE", "{{.NoSuchField}}")
+
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := messageData{Instance: instanceInfo{Name: "vm"}}
+	if got := templates.render(msgPreempt, data); got != "file: vm" {
+		t.Errorf("preempt = %q, want the file's template", got)
+	}
+	// Fails only when executed, so the built-in one goes out instead
+	if got := templates.render(msgLaunch, data); !strings.Contains(got, "vm") || strings.Contains(got, "NoSuchField") {
+		t.Errorf("launch = %q, want the built-in template", got)
+	}
+}
+
+func TestLoadTemplatesRejectsBadOverrides(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"unparsable inline": {"LAUNCH_TEMPLATE": "{{.Instance.Name"},
+		"missing file":      {"LAUNCH_TEMPLATE_FILE": filepath.Join(t.TempDir(), "gone.tmpl")},
+		"missing dir":       {"TEMPLATE_DIR": filepath.Join(t.TempDir(), "gone")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := loadTemplates(); err == nil {
+				t.Errorf("loadTemplates() accepted %v", env)
+			}
+		})
+	}
+}
+
+func TestMonitorTerminatesOverSpotPrice(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	m.TerminateAfter = 0
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"price": 0.05}`))
+	}))
+	defer srv.Close()
+	m.Instance.MachineType = "e2-small"
+	m.Price = newPriceChecker(srv.URL+"/{region}/{machineType}", 0.02, m.Instance)
+
+	m.Run()
+
+	if path != "/us-central1/e2-small" {
+		t.Errorf("price requested for %s", path)
+	}
+	if len(term.calls) != 1 || m.Data.Reason != ReasonSpotPrice {
+		t.Fatalf("got %d terminations with reason %q, want 1 for %s", len(term.calls), m.Data.Reason, ReasonSpotPrice)
+	}
+	if rec.events[0].Kind != EventPriceExceeded || !strings.Contains(rec.events[0].Message, "0.05") {
+		t.Errorf("first event = %s %q", rec.events[0].Kind, rec.events[0].Message)
+	}
+}
+
+func TestMonitorPreemptionCutsGracePeriodShort(t *testing.T) {
+	for _, action := range []PreemptAction{"", PreemptDelete} {
+		m, clock, term, rec := newTestMonitor(t)
+		mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+		if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m.Data.Started = clock.Now().Add(-2 * m.TerminateAfter)
+		m.GracePreemptAction = action
+
+		if !m.Run() {
+			t.Fatalf("%q: Run did not report the preemption", action)
+		}
+		if m.Data.GraceElapsed != m.CheckInterval {
+			t.Errorf("%q: grace period lasted %v, want one check interval", action, m.Data.GraceElapsed)
+		}
+		if want := map[PreemptAction]int{PreemptDelete: 1}[action]; len(term.calls) != want {
+			t.Errorf("%q: got %d terminations, want %d", action, len(term.calls), want)
+		}
+		var kinds []EventKind
+		for _, e := range rec.events {
+			kinds = append(kinds, e.Kind)
+		}
+		if want := []EventKind{EventTTLExpired, EventPreempted, EventShutdownPending}; !slices.Equal(kinds, want) {
+			t.Errorf("%q: events = %v, want %v", action, kinds, want)
+		}
+		if msg := rec.events[1].Message; !strings.Contains(msg, "grace period") || m.Data.Reason != ReasonPreemption {
+			t.Errorf("%q: alert %q, reason %q", action, msg, m.Data.Reason)
+		}
+	}
+}
+
+// fakeCounter reports a fixed count for this VM's family.
+type fakeCounter struct{ inFamily int }
+
+func (c *fakeCounter) Record(ctx context.Context, t time.Time, window time.Duration, family string) (int, int, error) {
+	c.inFamily++
+	return c.inFamily, c.inFamily, nil
+}
+
+func (c *fakeCounter) Recent(ctx context.Context, t time.Time, window time.Duration, family string) (int, int, error) {
+	return c.inFamily, c.inFamily, nil
+}
+
+// alertGatedCounter answers only once the preemption alert is out, or
+// fails at the deadline if the alert waits for it.
+type alertGatedCounter struct{ alerted chan struct{} }
+
+func (c *alertGatedCounter) Record(ctx context.Context, t time.Time, window time.Duration, family string) (int, int, error) {
+	select {
+	case <-c.alerted:
+		return 4, 3, nil
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+}
+
+type alertSignallingNotifier struct {
+	recordingNotifier
+	alerted chan struct{}
+}
+
+func (n *alertSignallingNotifier) Notify(ctx context.Context, event Event) error {
+	if event.Kind == EventPreempted {
+		close(n.alerted)
+	}
+	return n.recordingNotifier.Notify(ctx, event)
+}
+
+func TestMonitorPreemptionAlertDoesNotWaitForCounter(t *testing.T) {
+	m, _, _, _ := newTestMonitor(t)
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(mockMetadataFile, []byte(`{"instance/preempted": "TRUE"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	alerted := make(chan struct{})
+	rec := &alertSignallingNotifier{alerted: alerted}
+	m.Notifier.backends = []Notifier{rec}
+	m.Counter, m.PreemptionWindow, m.FamilyThreshold = &alertGatedCounter{alerted}, time.Hour, 2
+
+	m.Run()
+
+	last := rec.events[len(rec.events)-1]
+	if last.Kind != EventShutdownPending || !strings.Contains(last.Message, "4th preemption in this project in the last 1h") ||
+		!strings.Contains(last.Message, "3 of them were") {
+		t.Errorf("follow-up = %s %q, want the counts the counter gave after the alert", last.Kind, last.Message)
+	}
+}
+
+func TestMonitorWarnsOnCapacityPressureOnce(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	counter := &fakeCounter{inFamily: 3}
+	m.Counter, m.PreemptionWindow, m.FamilyThreshold = counter, time.Hour, 2
+	m.CapacityCheckInterval = 5 * time.Minute
+
+	for _, inFamily := range []int{3, 3, 1, 2} {
+		counter.inFamily = inFamily
+		m.checkCapacity()
+		m.checkCapacity() // Within the interval, skipped
+		clock.Advance(m.CapacityCheckInterval)
+	}
+
+	var warnings int
+	for _, e := range rec.events {
+		if e.Kind == EventCapacityPressure {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("got %d capacity warnings, want one per episode (2)", warnings)
+	}
+}
+
+func TestMonitorDryRunReportsGroup(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	m.GroupLabel = "team=ml"
+	m.FindGroup = func(ctx context.Context) ([]groupMember, error) {
+		return []groupMember{{Zone: "us-central1-a", Name: "vm-2"}, {Zone: "us-central1-b", Name: "vm-3"}}, nil
+	}
+	m.TerminateGroup = func(ctx context.Context, members []groupMember) (groupResult, error) {
+		return groupResult{DryRun: true, Members: []memberResult{{members[0], nil}, {members[1], nil}}}, nil
+	}
+
+	m.Run()
+
+	var report *Event
+	for i, e := range rec.events {
+		if strings.Contains(e.Message, "group `team=ml`") {
+			report = &rec.events[i]
+		}
+	}
+	if report == nil || report.Kind != EventDryRun || !strings.Contains(report.Message, "would delete 2 siblings") ||
+		!strings.Contains(report.Message, "`vm-3` in `us-central1-b`") {
+		t.Fatalf("group report = %+v, want a dry run listing both siblings", report)
+	}
+	if m.groupFailed {
+		t.Error("dry run marked the group as failed")
+	}
+}
+
+func TestMonitorReportsPartialGroupFailure(t *testing.T) {
+	m, _, term, rec := newTestMonitor(t)
+	m.GroupLabel = "team=ml"
+	m.FindGroup = func(ctx context.Context) ([]groupMember, error) {
+		return []groupMember{{Zone: "us-central1-a", Name: "vm-2"}, {Zone: "us-central1-a", Name: "vm-3"}}, nil
+	}
+	m.TerminateGroup = func(ctx context.Context, members []groupMember) (groupResult, error) {
+		err := fmt.Errorf("403 Forbidden")
+		return groupResult{Deleted: 1, Failed: 1, Members: []memberResult{{members[0], nil}, {members[1], err}}}, err
+	}
+
+	m.Run()
+
+	var report *Event
+	for i, e := range rec.events {
+		if strings.Contains(e.Message, "group `team=ml`") {
+			report = &rec.events[i]
+		}
+	}
+	if report == nil || report.Kind != EventTerminationFailed ||
+		!strings.Contains(report.Message, "✅ `vm-2`") || !strings.Contains(report.Message, "❌ `vm-3` in `us-central1-a`: 403 Forbidden") {
+		t.Fatalf("group report = %+v", report)
+	}
+	if !m.groupFailed {
+		t.Error("partial failure not recorded for the exit status")
+	}
+	if len(term.calls) != 1 {
+		t.Errorf("self-termination ran %d times after the group report, want 1", len(term.calls))
+	}
+}
+
+// hangingTerminator never returns, like a Compute call stuck on a dead
+// connection, until the test ends.
+type hangingTerminator struct{ release chan struct{} }
+
+func (h *hangingTerminator) Terminate(ctx context.Context, projectID, zone, instanceName string) (TerminationResult, error) {
+	<-h.release
+	return ResultTerminated, nil
+}
+
+func TestMonitorGivesUpOnHangingTermination(t *testing.T) {
+	m, _, _, rec := newTestMonitor(t)
+	hang := &hangingTerminator{release: make(chan struct{})}
+	t.Cleanup(func() { close(hang.release) })
+	m.Terminator, m.TerminationTimeout = hang, 50*time.Millisecond
+
+	m.Run()
+
+	if !m.timedOut {
+		t.Fatal("termination not reported as timed out")
+	}
+	last := rec.events[len(rec.events)-1]
+	if last.Kind != EventTerminationFailed || !strings.Contains(last.Message, "TIMED OUT") {
+		t.Errorf("last event = %s: %s", last.Kind, last.Message)
+	}
+}
+
+func TestMonitorAlertsOnMetadataFailureRate(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	m.MetadataFailures = &failureRate{window: 10 * time.Minute, threshold: 0.5}
+	// Every read fails until the mock file shows up half an hour in
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	start := clock.Now()
+	m.Watchdog = func() {
+		if clock.Since(start) >= 30*time.Minute {
+			os.WriteFile(mockMetadataFile, []byte("{}"), 0o644)
+		}
+	}
+
+	m.Run()
+
+	var kinds []EventKind
+	for _, e := range rec.events {
+		if e.Kind == EventMonitoringDegraded || e.Kind == EventMonitoringRecovered {
+			kinds = append(kinds, e.Kind)
+		}
+	}
+	if want := []EventKind{EventMonitoringDegraded, EventMonitoringRecovered}; !slices.Equal(kinds, want) {
+		t.Errorf("events = %v, want %v", kinds, want)
+	}
+}
+
+func TestMonitorNoticesSchedulingChange(t *testing.T) {
+	m, clock, _, rec := newTestMonitor(t)
+	m.Data.ProvisioningModel = ProvisioningSpot
+	m.SchedulingCheckInterval = 10 * time.Minute
+	mockMetadataFile = filepath.Join(t.TempDir(), "metadata.json")
+	write := func(content string) {
+		if err := os.WriteFile(mockMetadataFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"instance/scheduling/provisioning-model": "SPOT"}`)
+	m.checkScheduling()
+	clock.Advance(m.SchedulingCheckInterval)
+	write(`{"instance/scheduling/preemptible": "FALSE", "instance/scheduling/provisioning-model": "STANDARD"}`)
+	m.checkScheduling()
+	m.checkScheduling() // Within the interval, skipped
+
+	if len(rec.events) != 1 || rec.events[0].Kind != EventSchedulingChanged || !strings.Contains(rec.events[0].Message, "was SPOT and is now STANDARD") {
+		t.Fatalf("events = %+v", rec.events)
+	}
+	if !m.NotSpot || m.Data.ProvisioningModel != ProvisioningStandard {
+		t.Errorf("NotSpot = %t, model %q after the switch to standard", m.NotSpot, m.Data.ProvisioningModel)
+	}
+}
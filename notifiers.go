@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+)
+
+const slackURL = "https://v7uagcoglkqlufu7bah6luxjta0dsfht.lambda-url.us-east-2.on.aws" // Keeping your original URL
+
+const defaultRelayField = "message"
+
+// relayNotifier posts {"message": ...} to the Lambda relay that forwards to
+// Slack. The field name and any extra static fields are configurable for
+// relays that expect a different shape.
+type relayNotifier struct {
+	url   string
+	field string         // defaults to "message"
+	extra map[string]any // merged into every payload
+
+	// headers are sent with every request, e.g. an API gateway key
+	headers map[string]string
+}
+
+// newRelayNotifier reads RELAY_URL (or NOTIFIER_URL), RELAY_MESSAGE_FIELD,
+// RELAY_EXTRA_FIELDS and RELAY_HEADERS (both JSON objects), falling back to
+// the original relay and {"message": ...}.
+func newRelayNotifier() (*relayNotifier, error) {
+	n := &relayNotifier{
+		url:   cmp.Or(os.Getenv("RELAY_URL"), os.Getenv("NOTIFIER_URL"), slackURL),
+		field: cmp.Or(os.Getenv("RELAY_MESSAGE_FIELD"), defaultRelayField),
+	}
+	if val := os.Getenv("RELAY_EXTRA_FIELDS"); val != "" {
+		if err := json.Unmarshal([]byte(val), &n.extra); err != nil {
+			return nil, fmt.Errorf("invalid RELAY_EXTRA_FIELDS: %w", err)
+		}
+	}
+	if val := os.Getenv("RELAY_HEADERS"); val != "" {
+		if err := json.Unmarshal([]byte(val), &n.headers); err != nil {
+			return nil, fmt.Errorf("invalid RELAY_HEADERS: %w", err)
+		}
+	}
+	return n, nil
+}
+
+func (n *relayNotifier) Notify(ctx context.Context, event Event) error {
+	payload := make(map[string]any, len(n.extra)+1)
+	for k, v := range n.extra {
+		payload[k] = v
+	}
+	payload[cmp.Or(n.field, defaultRelayField)] = event.Message
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Slack message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Drain so the connection can be reused
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack API returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pubsubNotifier publishes each event as JSON to a Cloud Pub/Sub topic so
+// downstream subscribers, from alerting to job reschedulers, can act on it.
+// The attributes carry enough for subscription filters.
+type pubsubNotifier struct {
+	topic string // projects/<project>/topics/<name>
+	svc   *pubsub.Service
+}
+
+// newPubSubNotifier accepts either a full topic path or a bare topic name
+// in the instance's own project.
+func newPubSubNotifier(ctx context.Context, topic, projectID string) (*pubsubNotifier, error) {
+	if !strings.HasPrefix(topic, "projects/") {
+		topic = fmt.Sprintf("projects/%s/topics/%s", projectID, topic)
+	}
+	svc, err := pubsub.NewService(ctx, option.WithScopes(pubsub.PubsubScope))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub service: %w", err)
+	}
+	return &pubsubNotifier{topic: topic, svc: svc}, nil
+}
+
+func (n *pubsubNotifier) Notify(ctx context.Context, event Event) error {
+	data, err := json.Marshal(eventPayload(event))
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	msg := &pubsub.PubsubMessage{
+		Data: base64.StdEncoding.EncodeToString(data),
+		Attributes: map[string]string{
+			"kind":        string(event.Kind),
+			"instance":    event.Instance.Name,
+			"instance-id": event.Instance.ID,
+			"zone":        event.Instance.Zone,
+			"project":     event.Instance.Project,
+			"reason":      string(event.Reason),
+		},
+	}
+	if eventFormat == formatCloudEvents {
+		msg.Attributes["content-type"] = cloudEventsContentType
+	}
+	req := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{msg}}
+	if _, err := n.svc.Projects.Topics.Publish(n.topic, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", n.topic, err)
+	}
+	return nil
+}
+
+const defaultOpsgenieURL = "https://api.opsgenie.com"
+
+// opsgeniePriorities maps the events worth paging on to an alert priority.
+// Everything else is ignored, except launches which close the alert.
+var opsgeniePriorities = map[EventKind]string{
+	EventTerminationFailed: "P1",
+	EventCrashed:           "P1",
+	EventPreempted:         "P2",
+	EventMaintenance:       "P2",
+}
+
+// opsgenieNotifier creates Opsgenie alerts through the Alert API. Alerts use
+// the instance identity as alias, so repeats dedupe into one alert and the
+// alert closes once the same VM launches again.
+type opsgenieNotifier struct {
+	apiURL string // https://api.opsgenie.com, or api.eu.opsgenie.com
+	apiKey string
+}
+
+func (n *opsgenieNotifier) Notify(ctx context.Context, event Event) error {
+	alias := fmt.Sprintf("spot-notifier/%s/%s/%s", event.Instance.Project, event.Instance.Zone, event.Instance.Name)
+
+	if event.Kind == EventLaunched || event.Kind == EventInterruptionCancelled {
+		note := "Instance launched again"
+		if event.Kind == EventInterruptionCancelled {
+			note = "Preemption was called off"
+		}
+		body := map[string]string{"source": "spot-notifier", "note": note}
+		return n.post(ctx, "/v2/alerts/"+url.PathEscape(alias)+"/close?identifierType=alias", body)
+	}
+
+	priority, ok := opsgeniePriorities[event.Kind]
+	if !ok {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s: %s in %s", event.Kind, event.Instance.Name, event.Instance.Zone)
+	body := map[string]any{
+		"message":     message,
+		"alias":       alias,
+		"description": event.Message,
+		"priority":    priority,
+		"entity":      event.Instance.Name,
+		"source":      "spot-notifier",
+		"tags":        []string{"spot-notifier", string(event.Kind)},
+		"details": map[string]string{
+			"project":     event.Instance.Project,
+			"zone":        event.Instance.Zone,
+			"instanceID":  event.Instance.ID,
+			"machineType": event.Instance.MachineType,
+			"reason":      string(event.Reason),
+		},
+	}
+	return n.post(ctx, "/v2/alerts", body)
+}
+
+func (n *opsgenieNotifier) post(ctx context.Context, path string, body any) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Opsgenie request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.apiURL+path, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+n.apiKey)
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("opsgenie POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	// Requests are processed asynchronously and answered with 202
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("opsgenie API returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerdutySeverities maps the events worth paging on to a PagerDuty
+// severity, like opsgeniePriorities.
+var pagerdutySeverities = map[EventKind]string{
+	EventTerminationFailed: "critical",
+	EventCrashed:           "critical",
+	EventPreempted:         "error",
+	EventMaintenance:       "error",
+}
+
+// pagerdutyNotifier triggers PagerDuty incidents through the Events API v2.
+// The dedup key is the instance identity, so repeats join one incident and
+// it resolves once the same VM launches again.
+type pagerdutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+func (n *pagerdutyNotifier) Notify(ctx context.Context, event Event) error {
+	dedupKey := fmt.Sprintf("spot-notifier/%s/%s/%s", event.Instance.Project, event.Instance.Zone, event.Instance.Name)
+
+	if event.Kind == EventLaunched || event.Kind == EventInterruptionCancelled {
+		return n.post(ctx, map[string]any{"routing_key": n.routingKey, "event_action": "resolve", "dedup_key": dedupKey})
+	}
+
+	severity, ok := pagerdutySeverities[event.Kind]
+	if !ok {
+		return nil
+	}
+	return n.post(ctx, map[string]any{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    dedupKey,
+		"payload": map[string]any{
+			"summary":   fmt.Sprintf("%s: %s in %s", event.Kind, event.Instance.Name, event.Instance.Zone),
+			"source":    event.Instance.Name,
+			"severity":  severity,
+			"timestamp": event.Time,
+			"component": event.Instance.MachineType,
+			"group":     event.Instance.Project,
+			"class":     string(event.Kind),
+			"custom_details": map[string]string{
+				"message":    event.Message,
+				"zone":       event.Instance.Zone,
+				"instanceID": event.Instance.ID,
+				"reason":     string(event.Reason),
+			},
+		},
+	})
+}
+
+func (n *pagerdutyNotifier) post(ctx context.Context, body any) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal PagerDuty event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pagerduty POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	// Accepted events are answered with 202
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pagerduty API returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+const defaultSlackAPIURL = "https://slack.com/api"
+
+// slackAPINotifier posts through the Slack Web API with a bot token. Unlike
+// a webhook it gets the message's timestamp back, so with verify set it
+// reads critical messages back from the channel as proof they landed.
+type slackAPINotifier struct {
+	apiURL  string
+	token   string
+	channel string
+	verify  bool // needs the channels:history (or groups:history) scope
+}
+
+// slackResponse is the part of a Web API answer we look at. Errors come
+// back as 200 with ok false.
+type slackResponse struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error"`
+	TS       string `json:"ts"`
+	Messages []struct {
+		TS   string `json:"ts"`
+		Text string `json:"text"`
+	} `json:"messages"`
+}
+
+func (n *slackAPINotifier) Notify(ctx context.Context, event Event) error {
+	var posted slackResponse
+	if err := n.call(ctx, "chat.postMessage", map[string]string{"channel": n.channel, "text": event.Message}, &posted); err != nil {
+		return err
+	}
+	if !n.verify || event.Severity != SeverityCritical {
+		return nil
+	}
+
+	// Read back exactly the message we posted
+	var history slackResponse
+	query := map[string]string{"channel": n.channel, "latest": posted.TS, "oldest": posted.TS, "inclusive": "true", "limit": "1"}
+	if err := n.call(ctx, "conversations.history", query, &history); err != nil {
+		return fmt.Errorf("posted %s but could not read it back: %w", posted.TS, err)
+	}
+	if len(history.Messages) == 0 || history.Messages[0].TS != posted.TS {
+		return fmt.Errorf("posted %s but it is not in the channel", posted.TS)
+	}
+	log.Printf("Delivery of %s confirmed by read-back: message %s in %s", event.Kind, posted.TS, n.channel)
+	return nil
+}
+
+// call invokes a Web API method with a form-encoded body.
+func (n *slackAPINotifier) call(ctx context.Context, method string, params map[string]string, out *slackResponse) error {
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.apiURL+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+n.token)
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("slack %s returned non-2xx status: %d", method, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode slack %s response: %w", method, err)
+	}
+	if !out.OK {
+		return fmt.Errorf("slack %s failed: %s", method, out.Error)
+	}
+	return nil
+}
+
+// discordNotifier posts the message to a Discord webhook.
+type discordNotifier struct {
+	url string
+}
+
+func (n *discordNotifier) Notify(ctx context.Context, event Event) error {
+	jsonData, err := json.Marshal(map[string]string{"content": event.Message})
+	if err != nil {
+		return fmt.Errorf("failed to marshal Discord message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("discord POST failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	// Discord answers 204 without ?wait=true
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discord webhook returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// stdoutNotifier writes each event as one JSON line to stdout, for piping
+// into other tooling. Logs go to stderr, so the stream stays clean.
+type stdoutNotifier struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (n *stdoutNotifier) Notify(ctx context.Context, event Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := json.NewEncoder(n.out).Encode(eventPayload(event)); err != nil {
+		return fmt.Errorf("failed to write event to stdout: %w", err)
+	}
+	return nil
+}
+
+// socketNotifier writes each event as a JSON line to a Unix domain socket,
+// for a sidecar on the same VM. Every event gets its own connection, so the
+// sidecar can restart between them.
+type socketNotifier struct {
+	path string
+}
+
+func (n *socketNotifier) Notify(ctx context.Context, event Event) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", n.path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to event socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(eventPayload(event)); err != nil {
+		return fmt.Errorf("failed to write event to socket: %w", err)
+	}
+	return nil
+}
+
+// routedNotifier sends each event to the Slack webhook routed for its
+// kind, else for its termination reason, else for its severity, else for
+// "*". Events with no route are skipped.
+type routedNotifier struct {
+	routes map[string]Notifier
+}
+
+// newRoutedNotifier parses NOTIFY_ROUTES, a JSON object mapping event
+// kinds ("launched", "preempted", ...), termination reasons ("ttl-expiry",
+// ...), severities ("critical", ...) or "*" to Slack incoming webhook URLs.
+func newRoutedNotifier(spec string) (*routedNotifier, error) {
+	var urls map[string]string
+	if err := json.Unmarshal([]byte(spec), &urls); err != nil {
+		return nil, fmt.Errorf("NOTIFY_ROUTES must be a JSON object of webhook URLs: %w", err)
+	}
+	n := &routedNotifier{routes: make(map[string]Notifier, len(urls))}
+	for key, u := range urls {
+		if key != "*" && !slices.Contains(eventKinds, EventKind(key)) && !slices.Contains(terminationReasons, TerminationReason(key)) &&
+			!slices.Contains(severities, Severity(key)) {
+			return nil, fmt.Errorf("unknown NOTIFY_ROUTES key %q (want an event kind, a termination reason, a severity or *)", key)
+		}
+		// Slack incoming webhooks take {"text": ...}
+		n.routes[key] = &relayNotifier{url: u, field: "text"}
+	}
+	return n, nil
+}
+
+func (n *routedNotifier) Notify(ctx context.Context, event Event) error {
+	for _, key := range []string{string(event.Kind), string(event.Reason), string(event.Severity), "*"} {
+		if route, ok := n.routes[key]; ok && key != "" {
+			if err := route.Notify(ctx, event); err != nil {
+				return fmt.Errorf("route %s: %w", key, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
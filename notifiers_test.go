@@ -0,0 +1,457 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+)
+
+func TestOpsgenieMapsPriorityAndClosesOnLaunch(t *testing.T) {
+	type request struct {
+		path string
+		body map[string]any
+	}
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "GenieKey k" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = append(got, request{r.URL.RequestURI(), body})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	n := &opsgenieNotifier{apiURL: srv.URL, apiKey: "k"}
+	inst := instanceInfo{Name: "vm", Zone: "z", Project: "p"}
+	ctx := context.Background()
+	for _, kind := range []EventKind{EventPreempted, EventTerminationFailed, EventTTLExpired, EventLaunched} {
+		if err := n.Notify(ctx, Event{Kind: kind, Instance: inst}); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d requests, want 3 (ttl-expired should be ignored)", len(got))
+	}
+	if got[0].body["priority"] != "P2" || got[1].body["priority"] != "P1" {
+		t.Errorf("priorities = %v, %v, want P2, P1", got[0].body["priority"], got[1].body["priority"])
+	}
+	if got[0].body["alias"] != got[1].body["alias"] {
+		t.Errorf("aliases differ: %v vs %v", got[0].body["alias"], got[1].body["alias"])
+	}
+	if want := "/v2/alerts/spot-notifier%2Fp%2Fz%2Fvm/close?identifierType=alias"; got[2].path != want {
+		t.Errorf("close path = %s, want %s", got[2].path, want)
+	}
+}
+
+func TestWebhookGzipsNDJSON(t *testing.T) {
+	var contentType, encoding string
+	var line []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType, encoding = r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not gzip: %v", err)
+			return
+		}
+		line, _ = io.ReadAll(zr)
+	}))
+	defer srv.Close()
+
+	n := &webhookNotifier{url: srv.URL, contentType: "application/x-ndjson", gzip: true}
+	if err := n.Notify(context.Background(), Event{Kind: EventPreempted}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/x-ndjson" || encoding != "gzip" {
+		t.Errorf("headers = %q, %q", contentType, encoding)
+	}
+	var got Event
+	if err := json.Unmarshal(line, &got); err != nil || got.Kind != EventPreempted || line[len(line)-1] != '\n' {
+		t.Errorf("body %q is not one NDJSON event (%v)", line, err)
+	}
+}
+
+func TestDiscordPostsContent(t *testing.T) {
+	var contentType string
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if err := (&discordNotifier{url: srv.URL}).Notify(context.Background(), Event{Kind: EventPreempted, Message: "preempted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" || len(got) != 1 || got["content"] != "preempted" {
+		t.Errorf("got %q body %v, want application/json {\"content\": \"preempted\"}", contentType, got)
+	}
+}
+
+func TestWebhookSendsCloudEvents(t *testing.T) {
+	eventFormat = formatCloudEvents
+	t.Cleanup(func() { eventFormat = formatNative })
+
+	var contentType string
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	event := Event{Kind: EventPreempted, Instance: instanceInfo{Name: "vm", ID: "42", Zone: "us-central1-a", Project: "p"}, Time: time.Unix(1, 0)}
+	if err := (&webhookNotifier{url: srv.URL}).Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != cloudEventsContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, cloudEventsContentType)
+	}
+	want := map[string]string{
+		"specversion": "1.0",
+		"type":        "com.gcp.spot.preempted",
+		"source":      "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a/instances/vm",
+		"subject":     "vm",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %q", k, got[k], v)
+		}
+	}
+	if data, _ := got["data"].(map[string]any); data["kind"] != "preempted" {
+		t.Errorf("data = %v, want the event", got["data"])
+	}
+}
+
+func TestSlackAPIReadsBackCriticalMessages(t *testing.T) {
+	var methods []string
+	inChannel := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, strings.TrimPrefix(r.URL.Path, "/"))
+		if r.Header.Get("Authorization") != "Bearer xoxb-1" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			w.Write([]byte(`{"ok": true, "ts": "1700000000.000100"}`))
+		case "/conversations.history":
+			if !inChannel {
+				w.Write([]byte(`{"ok": true, "messages": []}`))
+				return
+			}
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "1700000000.000100"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	n := &slackAPINotifier{apiURL: srv.URL, token: "xoxb-1", channel: "C1", verify: true}
+	if err := n.Notify(context.Background(), Event{Kind: EventLaunched, Severity: SeverityInfo}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Event{Kind: EventPreempted, Severity: SeverityCritical}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"chat.postMessage", "chat.postMessage", "conversations.history"}; !slices.Equal(methods, want) {
+		t.Errorf("calls = %v, want %v", methods, want)
+	}
+
+	inChannel = false
+	if err := n.Notify(context.Background(), Event{Kind: EventPreempted, Severity: SeverityCritical}); err == nil {
+		t.Error("Notify succeeded although the message could not be read back")
+	}
+}
+
+func TestNotifyClientTrustsCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newNotifyClient(time.Second, nil).Get(srv.URL); err == nil {
+		t.Fatal("system trust store accepted the test CA")
+	}
+	roots, err := loadCertPool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newNotifyClient(time.Second, roots).Get(srv.URL); err != nil {
+		t.Errorf("request with NOTIFY_CA_CERT failed: %v", err)
+	}
+}
+
+func TestRelaySendsCustomHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	t.Setenv("RELAY_URL", srv.URL)
+	t.Setenv("RELAY_HEADERS", `{"x-api-key": "secret", "Authorization": "Bearer t"}`)
+	n, err := newRelayNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Event{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("X-Api-Key") != "secret" || got.Get("Authorization") != "Bearer t" || got.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v", got)
+	}
+}
+
+func TestRelayShapesPayload(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	t.Setenv("RELAY_URL", srv.URL)
+	t.Setenv("RELAY_MESSAGE_FIELD", "text")
+	t.Setenv("RELAY_EXTRA_FIELDS", `{"channel": "#spot", "text": "overwritten"}`)
+	n, err := newRelayNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Event{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["text"] != "hi" || got["channel"] != "#spot" {
+		t.Errorf("payload = %v, want the message in text next to the extra fields", got)
+	}
+}
+
+func TestRelayURLFallsBack(t *testing.T) {
+	for _, tc := range []struct {
+		relay, notifier, want string
+	}{
+		{"https://relay", "https://notifier", "https://relay"},
+		{"", "https://notifier", "https://notifier"},
+		{"", "", slackURL},
+	} {
+		t.Setenv("RELAY_URL", tc.relay)
+		t.Setenv("NOTIFIER_URL", tc.notifier)
+		n, err := newRelayNotifier()
+		if err != nil || n.url != tc.want || n.field != defaultRelayField {
+			t.Errorf("RELAY_URL=%q NOTIFIER_URL=%q: relay = %+v, %v, want %s", tc.relay, tc.notifier, n, err, tc.want)
+		}
+	}
+}
+
+func TestRelayRejectsBadJSON(t *testing.T) {
+	for _, key := range []string{"RELAY_EXTRA_FIELDS", "RELAY_HEADERS"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, `{"channel":`)
+			if _, err := newRelayNotifier(); err == nil {
+				t.Errorf("newRelayNotifier() accepted a truncated %s", key)
+			}
+		})
+	}
+}
+
+func TestSocketNotifierWritesJSONLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		got <- data
+	}()
+
+	n := &socketNotifier{path: path}
+	if err := n.Notify(context.Background(), Event{Kind: EventPreempted, Message: "m"}); err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	data := <-got
+	if err := json.Unmarshal(data, &event); err != nil || event.Kind != EventPreempted || data[len(data)-1] != '\n' {
+		t.Errorf("socket received %q (%v)", data, err)
+	}
+}
+
+func TestRoutedNotifierPicksRouteByKindThenReason(t *testing.T) {
+	got := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		got[r.URL.Path] = append(got[r.URL.Path], body["text"])
+	}))
+	defer srv.Close()
+
+	n, err := newRoutedNotifier(`{"launched": "` + srv.URL + `/deploys", "preemption": "` + srv.URL + `/oncall"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, e := range []Event{
+		{Kind: EventLaunched, Message: "up"},
+		{Kind: EventPreempted, Reason: ReasonPreemption, Message: "preempted"},
+		{Kind: EventTTLExpired, Reason: ReasonTTLExpiry, Message: "unrouted"},
+	} {
+		if err := n.Notify(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(got) != 2 || got["/deploys"][0] != "up" || got["/oncall"][0] != "preempted" {
+		t.Errorf("routed messages = %v", got)
+	}
+	if _, err := newRoutedNotifier(`{"preempt": "x"}`); err == nil {
+		t.Error("unknown route key accepted")
+	}
+}
+
+func TestTimedNotifierTruncatesOversizedMessages(t *testing.T) {
+	t.Setenv("SLACK_MAX_MESSAGE_SIZE", "40")
+	rec := &recordingNotifier{}
+	n, err := newTimedNotifier("slack", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "🚨 preempted " + strings.Repeat("x", 100) + " last line"
+	if err := n.Notify(context.Background(), Event{Message: msg}); err != nil {
+		t.Fatal(err)
+	}
+	got := rec.events[0].Message
+	if len(got) > 40 || !utf8.ValidString(got) || !strings.HasPrefix(got, "🚨") ||
+		!strings.HasSuffix(got, "line") || !strings.Contains(got, "[truncated]") {
+		t.Errorf("truncated message = %q (%d bytes)", got, len(got))
+	}
+	if short := truncateMessage("fits", 40); short != "fits" {
+		t.Errorf("short message changed to %q", short)
+	}
+}
+
+func TestPagerDutyTriggersAndResolvesOnLaunch(t *testing.T) {
+	var got []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = append(got, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	n := &pagerdutyNotifier{url: srv.URL, routingKey: "k"}
+	inst := instanceInfo{Name: "vm", Zone: "z", Project: "p"}
+	for _, kind := range []EventKind{EventTerminationFailed, EventTTLExpired, EventLaunched} {
+		if err := n.Notify(context.Background(), Event{Kind: kind, Instance: inst}); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2 (ttl-expired should be ignored)", len(got))
+	}
+	payload, _ := got[0]["payload"].(map[string]any)
+	if got[0]["event_action"] != "trigger" || payload["severity"] != "critical" || got[0]["routing_key"] != "k" {
+		t.Errorf("trigger = %v", got[0])
+	}
+	if got[1]["event_action"] != "resolve" || got[1]["dedup_key"] != got[0]["dedup_key"] {
+		t.Errorf("resolve = %v, want the trigger's dedup key %v", got[1], got[0]["dedup_key"])
+	}
+}
+
+func TestWebhookRendersPayloadTemplate(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	payload, err := parseWebhookPayload(`{"summary": {{json .Message}}, "vm": {{json .Instance.Name}}, "kind": "{{.Kind}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &webhookNotifier{url: srv.URL, payload: payload}
+	event := Event{Kind: EventPreempted, Instance: instanceInfo{Name: "vm"}, Message: "said \"bye\""}
+	if err := n.Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if got["summary"] != `said "bye"` || got["vm"] != "vm" || got["kind"] != "preempted" {
+		t.Errorf("body = %v", got)
+	}
+
+	// Unquoted strings break the JSON, which is caught before sending
+	n.payload, _ = parseWebhookPayload(`{"summary": {{.Message}}}`)
+	if err := n.Notify(context.Background(), event); err == nil {
+		t.Error("Notify sent an invalid JSON payload")
+	}
+}
+
+func TestPubSubPublishesStructuredEvent(t *testing.T) {
+	var body struct {
+		Messages []struct {
+			Data       []byte            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer srv.Close()
+	svc, err := pubsub.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &pubsubNotifier{topic: "projects/p/topics/spot", svc: svc}
+
+	inst := instanceInfo{Name: "vm", ID: "42", Zone: "z", MachineType: "n2-standard-4", Project: "p", Labels: map[string]string{"team": "ml"}}
+	if err := n.Notify(context.Background(), Event{Kind: EventPreempted, Instance: inst, Reason: ReasonPreemption, Message: "going", Time: time.Unix(0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/projects/p/topics/spot:publish" || len(body.Messages) != 1 {
+		t.Fatalf("published to %s: %+v", path, body)
+	}
+	msg := body.Messages[0]
+	var event Event
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != EventPreempted || event.Instance.MachineType != "n2-standard-4" || event.Instance.Labels["team"] != "ml" || event.Time.IsZero() {
+		t.Errorf("payload = %+v", event)
+	}
+	if msg.Attributes["kind"] != "preempted" || msg.Attributes["instance-id"] != "42" || msg.Attributes["project"] != "p" {
+		t.Errorf("attributes = %v", msg.Attributes)
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EventKind identifies what a notification is about.
+type EventKind string
+
+const (
+	EventLaunched           EventKind = "launched"
+	EventTTLWarning         EventKind = "ttl-warning"
+	EventSoftTTL            EventKind = "soft-ttl"
+	EventTTLExpired         EventKind = "ttl-expired"
+	EventTerminateRequested EventKind = "terminate-requested"
+	EventUnhealthy          EventKind = "unhealthy"
+	EventPriceExceeded      EventKind = "price-exceeded"
+	EventCostReport         EventKind = "cost-report"
+	EventJobCompleted       EventKind = "job-completed"
+	EventTerminating        EventKind = "terminating"
+	EventPreempted          EventKind = "preempted"
+	EventMaintenance        EventKind = "maintenance"
+	EventShutdownPending    EventKind = "shutdown-pending"
+	EventTerminationFailed  EventKind = "termination-failed"
+	EventCrashed            EventKind = "crashed"
+	EventAlreadyTerminating EventKind = "already-terminating"
+	EventMigrating          EventKind = "migrating"
+	EventNotSpot            EventKind = "not-spot"
+	EventNotifierExiting    EventKind = "notifier-exiting"
+	EventPlacement          EventKind = "unexpected-placement"
+	EventCapacityPressure   EventKind = "capacity-pressure"
+	EventSchedulingChanged  EventKind = "scheduling-changed"
+	// EventTerminationDeferred is a TTL termination held back by a change
+	// freeze.
+	EventTerminationDeferred EventKind = "termination-deferred"
+	EventGraceWarning        EventKind = "grace-warning"
+	EventMonitoringDegraded  EventKind = "monitoring-degraded"
+	EventMonitoringRecovered EventKind = "monitoring-recovered"
+	// EventInterruptionCancelled corrects a preemption alert for a VM that
+	// survived it.
+	EventInterruptionCancelled EventKind = "interruption-cancelled"
+	// EventDryRun says what a termination would have done under --dry-run.
+	EventDryRun EventKind = "dry-run"
+	// EventTTLChanged is the TTL extended or cancelled through the control
+	// endpoint.
+	EventTTLChanged EventKind = "ttl-changed"
+)
+
+// eventKinds lists every EventKind, for validating configuration.
+var eventKinds = []EventKind{
+	EventLaunched, EventTTLWarning, EventSoftTTL, EventTTLExpired, EventTerminateRequested, EventUnhealthy, EventPriceExceeded, EventJobCompleted,
+	EventTerminating, EventPreempted, EventMaintenance, EventShutdownPending, EventTerminationFailed,
+	EventCrashed, EventAlreadyTerminating, EventMigrating, EventNotSpot, EventPlacement, EventCapacityPressure, EventSchedulingChanged, EventNotifierExiting, EventInterruptionCancelled,
+	EventTerminationDeferred, EventGraceWarning, EventMonitoringDegraded, EventMonitoringRecovered, EventDryRun, EventTTLChanged,
+	EventCostReport,
+}
+
+// TerminationReason is why the VM is going away, carried as a structured
+// field so downstream consumers don't have to parse message text.
+type TerminationReason string
+
+const (
+	ReasonNone        TerminationReason = ""
+	ReasonPreemption  TerminationReason = "preemption"
+	ReasonTTLExpiry   TerminationReason = "ttl-expiry"
+	ReasonMaintenance TerminationReason = "maintenance-event"
+	ReasonManual      TerminationReason = "manual"
+	ReasonUnhealthy   TerminationReason = "unhealthy"
+	ReasonSpotPrice   TerminationReason = "spot-price"
+	ReasonCompleted   TerminationReason = "job-completed"
+)
+
+// terminationReasons lists every non-empty TerminationReason.
+var terminationReasons = []TerminationReason{
+	ReasonPreemption, ReasonTTLExpiry, ReasonMaintenance, ReasonManual, ReasonUnhealthy, ReasonSpotPrice, ReasonCompleted,
+}
+
+// critical reports whether the event must always be delivered.
+func (k EventKind) critical() bool {
+	switch k {
+	case EventPreempted, EventMaintenance, EventShutdownPending, EventTerminationFailed, EventCrashed, EventNotifierExiting:
+		return true
+	}
+	return false
+}
+
+// Event is a notification along with the structured context backends need
+// to format their own payloads.
+type Event struct {
+	Kind     EventKind         `json:"kind"`
+	Instance instanceInfo      `json:"instance"`
+	Reason   TerminationReason `json:"reason,omitempty"`
+	Severity Severity          `json:"severity,omitempty"`
+	Message  string            `json:"message"`
+	Time     time.Time         `json:"time"`
+}
+
+// Notifier delivers events to one backend.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// dispatcher decides whether a notification goes out and fans it out to
+// every configured backend.
+type dispatcher struct {
+	clock    Clock
+	backends []Notifier
+	disabled map[string]bool   // backend names turned off with <NAME>_ENABLED
+	instance instanceInfo      // filled in once metadata has been read
+	reason   TerminationReason // set once the VM is on its way out, under mu
+
+	quietHours *timeWindow // nil when quiet hours are off
+	// severityRules override each kind's fixed severity, matching on the
+	// instance's labels among other things
+	severityRules []severityRule
+	labels        map[string]string
+	budget        int    // max notifications per run, 0 for unlimited
+	mention       string // e.g. "<!here>", prepended to critical messages
+	runbook       string // URL appended to critical messages
+	redact        []*regexp.Regexp
+
+	// coalesce, if set, batches messages arriving within this window into
+	// one send. Critical messages flush the batch immediately.
+	coalesce time.Duration
+	// mu guards pending, the budget and reason: the flush timer and
+	// MAX_PROCESS_LIFETIME notify from their own goroutines
+	mu          sync.Mutex
+	pending     []Event
+	pendingThen []func()   // from notifyThen, for when pending is delivered
+	sendMu      sync.Mutex // the flush timer sends from its own goroutine
+
+	sent      int
+	exhausted bool
+
+	// history, if set, keeps every event sent and every delivery error
+	history *eventHistory
+	// status, if set, counts delivery errors for /metrics
+	status *statusServer
+
+	// onUndelivered is what happens to a critical event no backend took
+	onUndelivered undeliveredAction
+
+	// cooldown, if set, drops an event of a kind already delivered that
+	// recently. lastSent may come from a previous process; onSent persists
+	// it. Timers, such as MAX_PROCESS_LIFETIME's, notify from their own
+	// goroutines, hence cooldownMu.
+	cooldown   time.Duration
+	cooldownMu sync.Mutex
+	lastSent   map[EventKind]time.Time
+	onSent     func(kind EventKind, at time.Time)
+}
+
+// cooldownExempt are the kinds that must repeat however soon: a failed
+// termination and the escalation reminders that follow it.
+var cooldownExempt = map[EventKind]bool{EventTerminationFailed: true}
+
+// notify sends message unless its severity lets quiet hours or the spent
+// notification budget hold it back. Critical events always go out.
+// It reports whether at least one backend accepted the message; one held
+// for the coalescing window hasn't been yet.
+func (d *dispatcher) notify(kind EventKind, message string) (delivered bool) {
+	return d.notifyThen(kind, message, nil)
+}
+
+// notifyThen is notify, calling then once the message is delivered, which
+// with coalescing is when the batch goes out. Anything that records the
+// delivery, so as not to repeat it, belongs in then.
+func (d *dispatcher) notifyThen(kind EventKind, message string, then func()) (delivered bool) {
+	inst := d.instance
+	if inst.Labels == nil {
+		inst.Labels = d.labels
+	}
+	d.mu.Lock()
+	reason := d.reason
+	d.mu.Unlock()
+	return d.dispatch(inst, reason, kind, message, then)
+}
+
+// setReason tags every notification that follows with reason.
+func (d *dispatcher) setReason(reason TerminationReason) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reason = reason
+}
+
+// notifyAbout is notify for any instance, not just this one, as fleet mode
+// needs.
+func (d *dispatcher) notifyAbout(inst instanceInfo, reason TerminationReason, kind EventKind, message string) (delivered bool) {
+	return d.dispatch(inst, reason, kind, message, nil)
+}
+
+// dispatch does the work of notifyThen and notifyAbout.
+func (d *dispatcher) dispatch(inst instanceInfo, reason TerminationReason, kind EventKind, message string, then func()) (delivered bool) {
+	severity := severityOf(d.severityRules, kind, inst.Labels, d.clock.Now())
+	critical := severity == SeverityCritical
+	if severity == SeverityInfo && d.quietHours != nil && d.quietHours.contains(d.clock.Now()) {
+		log.Printf("Quiet hours: suppressing %s notification", kind)
+		return false
+	}
+
+	// Across restarts too, so a crashloop can't repeat the same alert
+	now := d.clock.Now()
+	if d.coolingDown(kind, now) {
+		return false
+	}
+	if !d.spend(critical) {
+		return false
+	}
+
+	if critical && d.mention != "" {
+		message = d.mention + " " + message
+	}
+	if critical && d.runbook != "" {
+		message += "\nRunbook: " + d.runbook
+	}
+
+	for _, re := range d.redact {
+		message = re.ReplaceAllString(message, "***")
+	}
+	if len(d.redact) > 0 {
+		inst = redactInstance(inst, d.redact)
+	}
+
+	event := Event{Kind: kind, Instance: inst, Reason: reason, Severity: severity, Message: message, Time: now}
+	if d.coalesce <= 0 {
+		delivered = d.send(event)
+		if delivered {
+			d.markSent(kind, now)
+			if then != nil {
+				then()
+			}
+		}
+		return delivered
+	}
+
+	d.mu.Lock()
+	d.pending = append(d.pending, event)
+	if then != nil {
+		d.pendingThen = append(d.pendingThen, then)
+	}
+	first := len(d.pending) == 1
+	d.mu.Unlock()
+
+	if critical {
+		// Time-sensitive, so take whatever is queued along right away
+		return d.flush()
+	}
+	if first {
+		window := d.coalesce
+		go func() {
+			<-d.clock.After(window)
+			d.flush()
+		}()
+	}
+	return false // Queued; flush logs failures and calls then on delivery
+}
+
+// spend counts a notification against the budget, reporting false if the
+// budget is spent. Critical events always go out, and count too.
+func (d *dispatcher) spend(critical bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !critical && d.budget > 0 && d.sent >= d.budget {
+		if !d.exhausted {
+			log.Printf("Notification budget exhausted (%d sent), dropping non-critical notifications", d.sent)
+			d.exhausted = true
+		}
+		return false
+	}
+	d.sent++
+	return true
+}
+
+// flush sends everything queued by the coalescing window as one message.
+// It is a no-op when nothing is pending.
+func (d *dispatcher) flush() bool {
+	d.mu.Lock()
+	pending, then := d.pending, d.pendingThen
+	d.pending, d.pendingThen = nil, nil
+	d.mu.Unlock()
+
+	if len(pending) == 0 {
+		return false
+	}
+
+	// The combined event takes its kind from the most urgent message
+	event := pending[len(pending)-1]
+	messages := make([]string, len(pending))
+	for i, e := range pending {
+		messages[i] = e.Message
+		if e.Severity == SeverityCritical {
+			event.Kind, event.Severity = e.Kind, e.Severity
+		}
+	}
+	event.Message = strings.Join(messages, "\n\n")
+	if !d.send(event) {
+		return false
+	}
+	for _, e := range pending {
+		d.markSent(e.Kind, e.Time)
+	}
+	for _, f := range then {
+		f()
+	}
+	return true
+}
+
+// coolingDown reports whether an event of kind was delivered less than the
+// cooldown before now, logging that it is suppressed.
+func (d *dispatcher) coolingDown(kind EventKind, now time.Time) bool {
+	if d.cooldown <= 0 || cooldownExempt[kind] {
+		return false
+	}
+	d.cooldownMu.Lock()
+	defer d.cooldownMu.Unlock()
+	last, ok := d.lastSent[kind]
+	if ok && now.Sub(last) < d.cooldown {
+		log.Printf("Cooldown: %s already sent %v ago, suppressing", kind, now.Sub(last).Truncate(time.Second))
+		return true
+	}
+	return false
+}
+
+// markSent starts the cooldown for kind, delivered at at. Only delivered
+// events count, so a failed send is tried again next time.
+func (d *dispatcher) markSent(kind EventKind, at time.Time) {
+	if d.cooldown <= 0 || cooldownExempt[kind] {
+		return
+	}
+	d.cooldownMu.Lock()
+	defer d.cooldownMu.Unlock()
+	d.lastSent[kind] = at
+	if d.onSent != nil {
+		go d.onSent(kind, at)
+	}
+}
+
+// send delivers event to every backend in parallel, all within
+// notifyDeadline, and reports whether any accepted it. A slow backend can't
+// hold up the others.
+func (d *dispatcher) send(event Event) bool {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	if id := event.Instance.CorrelationID; id != "" {
+		event.Message += "\nCorrelation ID: " + id
+	}
+	delivered := d.fanOut(event)
+	if !delivered && event.Severity == SeverityCritical {
+		delivered = d.undelivered(event)
+	}
+	d.history.notification(event, delivered)
+	return delivered
+}
+
+// fanOut makes one delivery attempt to every backend.
+func (d *dispatcher) fanOut(event Event) (delivered bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyDeadline)
+	defer cancel()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, b := range d.backends {
+		if t, ok := b.(*timedNotifier); ok && (d.disabled[t.name] || !t.accepts(event)) {
+			continue
+		}
+		wg.Add(1)
+		go func(b Notifier) {
+			defer wg.Done()
+			// Failures are logged but never stop the notifier
+			err := b.Notify(ctx, event)
+			switch {
+			case isTimeout(err):
+				stats.incr("notify_failures", "kind:"+string(event.Kind), "cause:timeout")
+				log.Printf("Notification timed out: %v", err)
+				d.history.failure(event.Kind, err)
+				d.status.notifyFailed(event.Kind, "timeout")
+			case err != nil:
+				stats.incr("notify_failures", "kind:"+string(event.Kind), "cause:error")
+				log.Printf("Notification failed: %v", err)
+				d.history.failure(event.Kind, err)
+				d.status.notifyFailed(event.Kind, "error")
+			default:
+				mu.Lock()
+				delivered = true
+				mu.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+	return delivered
+}
+
+// undeliveredAction is what CRITICAL_NOTIFY_FAILURE_ACTION asks for when
+// every backend failed to take a critical event.
+type undeliveredAction struct {
+	mode    string        // log (default), block or file
+	timeout time.Duration // how long block keeps retrying
+	path    string        // where file appends the event
+}
+
+const (
+	defaultUndeliveredTimeout = time.Minute
+	defaultUndeliveredFile    = "/var/log/spot-notifier-undelivered.jsonl"
+	undeliveredRetryInterval  = 5 * time.Second
+)
+
+// parseUndeliveredAction reads the CRITICAL_NOTIFY_FAILURE_* settings.
+func parseUndeliveredAction() (undeliveredAction, error) {
+	a := undeliveredAction{
+		mode:    cmp.Or(os.Getenv("CRITICAL_NOTIFY_FAILURE_ACTION"), "log"),
+		timeout: defaultUndeliveredTimeout,
+		path:    cmp.Or(os.Getenv("CRITICAL_NOTIFY_FAILURE_FILE"), defaultUndeliveredFile),
+	}
+	switch a.mode {
+	case "log", "block", "file":
+	default:
+		return a, fmt.Errorf("invalid CRITICAL_NOTIFY_FAILURE_ACTION: %q (want log, block or file)", a.mode)
+	}
+	if val := os.Getenv("CRITICAL_NOTIFY_FAILURE_TIMEOUT"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return a, fmt.Errorf("invalid CRITICAL_NOTIFY_FAILURE_TIMEOUT: %w", err)
+		}
+		a.timeout = d
+	}
+	return a, nil
+}
+
+// undelivered handles a critical event that no backend accepted, and
+// reports whether a later retry got it through.
+func (d *dispatcher) undelivered(event Event) bool {
+	switch d.onUndelivered.mode {
+	case "block":
+		deadline := d.clock.Now().Add(d.onUndelivered.timeout)
+		for d.clock.Now().Before(deadline) {
+			log.Printf("Critical %s notification undelivered, retrying in %v", event.Kind, undeliveredRetryInterval)
+			d.clock.Sleep(undeliveredRetryInterval)
+			if d.fanOut(event) {
+				return true
+			}
+		}
+		log.Printf("ERROR: Critical %s notification still undelivered after %v: %s", event.Kind, d.onUndelivered.timeout, event.Message)
+	case "file":
+		// A log shipper watching the file still gets it out
+		if err := appendEvent(d.onUndelivered.path, event); err != nil {
+			log.Printf("ERROR: Critical %s notification undelivered and not saved: %v: %s", event.Kind, err, event.Message)
+		} else {
+			log.Printf("ERROR: Critical %s notification undelivered, saved to %s", event.Kind, d.onUndelivered.path)
+		}
+	default:
+		log.Printf("ERROR: Critical %s notification undelivered: %s", event.Kind, event.Message)
+	}
+	return false
+}
+
+// appendEvent adds event to path as one JSON line.
+func appendEvent(path string, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// notifyDeadline bounds a whole fan-out, leaving part of the ~30s
+// preemption notice for the shutdown hook.
+const notifyDeadline = 20 * time.Second
+
+// timedNotifier gives one backend its own deadline, from <NAME>_TIMEOUT,
+// its own message size limit, from <NAME>_MAX_MESSAGE_SIZE, and the least
+// severe events it gets, from <NAME>_MIN_SEVERITY.
+type timedNotifier struct {
+	name        string
+	timeout     time.Duration
+	maxSize     int         // in bytes, 0 for no limit
+	minSeverity Severity    // "" for every event
+	kinds       []EventKind // nil for every event
+	Notifier
+}
+
+// backendNames are the names timedNotifier is created with, each of which
+// can be switched off with <NAME>_ENABLED=false.
+var backendNames = []string{"slack", "webhook", "discord", "slack_api", "slack_webhook", "google_chat", "pubsub", "opsgenie", "pagerduty", "routes", "event_socket"}
+
+// maxMessageSizes are the platforms' own caps, so an oversized message is
+// cut down instead of rejected. Backends not listed have no limit.
+var maxMessageSizes = map[string]int{
+	"slack":         40000,
+	"routes":        40000, // Slack too
+	"slack_api":     40000,
+	"slack_webhook": 40000,
+	"google_chat":   4096,
+	"opsgenie":      15000, // the alert description
+	"discord":       2000,
+}
+
+// truncatedMarker replaces the middle of an oversized message.
+const truncatedMarker = "\n…[truncated]…\n"
+
+// newTimedNotifier wraps n with the timeout from <NAME>_TIMEOUT, defaulting
+// to defaultNotifyTimeout, the size limit from <NAME>_MAX_MESSAGE_SIZE,
+// defaulting to maxMessageSizes, and the filters from <NAME>_MIN_SEVERITY
+// and <NAME>_EVENTS, a comma-separated list of event kinds.
+func newTimedNotifier(name string, n Notifier) (*timedNotifier, error) {
+	t := &timedNotifier{name: name, timeout: defaultNotifyTimeout, maxSize: maxMessageSizes[name], Notifier: n}
+	env := strings.ToUpper(name) + "_TIMEOUT"
+	if val := os.Getenv(env); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", env, err)
+		}
+		t.timeout = d
+	}
+	env = strings.ToUpper(name) + "_MAX_MESSAGE_SIZE"
+	if val := os.Getenv(env); val != "" {
+		size, err := strconv.Atoi(val)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", env, val)
+		}
+		t.maxSize = size
+	}
+	env = strings.ToUpper(name) + "_MIN_SEVERITY"
+	if val := Severity(os.Getenv(env)); val != "" {
+		if !slices.Contains(severities, val) {
+			return nil, fmt.Errorf("invalid %s: %q (want info, warning or critical)", env, val)
+		}
+		t.minSeverity = val
+	}
+	env = strings.ToUpper(name) + "_EVENTS"
+	if val := os.Getenv(env); val != "" {
+		for _, k := range strings.Split(val, ",") {
+			kind := EventKind(strings.TrimSpace(k))
+			if !slices.Contains(eventKinds, kind) {
+				return nil, fmt.Errorf("invalid %s: unknown event kind %q", env, kind)
+			}
+			t.kinds = append(t.kinds, kind)
+		}
+	}
+	return t, nil
+}
+
+// accepts reports whether event reaches the backend.
+func (t *timedNotifier) accepts(event Event) bool {
+	if t.kinds != nil && !slices.Contains(t.kinds, event.Kind) {
+		return false
+	}
+	return t.minSeverity == "" || slices.Index(severities, event.Severity) >= slices.Index(severities, t.minSeverity)
+}
+
+func (t *timedNotifier) Notify(ctx context.Context, event Event) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	if t.maxSize > 0 && len(event.Message) > t.maxSize {
+		log.Printf("Truncating %d byte message to %d bytes for %s", len(event.Message), t.maxSize, t.name)
+		event.Message = truncateMessage(event.Message, t.maxSize)
+	}
+	if err := t.Notifier.Notify(ctx, event); err != nil {
+		if isTimeout(err) {
+			return fmt.Errorf("%s: no answer within %v: %w", t.name, t.timeout, err)
+		}
+		return fmt.Errorf("%s: %w", t.name, err)
+	}
+	return nil
+}
+
+// truncateMessage cuts s down to max bytes by dropping its middle: the head
+// says what happened, the tail holds the latest output. Runes are never split.
+func truncateMessage(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	keep := max - len(truncatedMarker)
+	if keep <= 0 {
+		return strings.ToValidUTF8(s[:max], "")
+	}
+	head, tail := keep-keep/2, len(s)-keep/2
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+	return s[:head] + truncatedMarker + s[tail:]
+}
+
+// isTimeout tells deadline and client timeouts apart from other failures.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// redactInstance masks the matches of res in inst's fields, which the JSON
+// payloads carry alongside the message. Labels are copied, not changed in
+// place.
+func redactInstance(inst instanceInfo, res []*regexp.Regexp) instanceInfo {
+	redact := func(s string) string {
+		for _, re := range res {
+			s = re.ReplaceAllString(s, "***")
+		}
+		return s
+	}
+	for _, field := range []*string{&inst.Name, &inst.ID, &inst.Zone, &inst.MachineType, &inst.Project, &inst.CorrelationID} {
+		*field = redact(*field)
+	}
+	if inst.Labels != nil {
+		labels := make(map[string]string, len(inst.Labels))
+		for k, v := range inst.Labels {
+			labels[k] = redact(v)
+		}
+		inst.Labels = labels
+	}
+	return inst
+}
+
+// parseRedactPatterns reads REDACT_PATTERNS, a JSON array of regular
+// expressions whose matches are masked in every notification.
+func parseRedactPatterns(spec string) ([]*regexp.Regexp, error) {
+	var patterns []string
+	if err := json.Unmarshal([]byte(spec), &patterns); err != nil {
+		return nil, fmt.Errorf("REDACT_PATTERNS must be a JSON array of strings: %w", err)
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
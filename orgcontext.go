@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	crm "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/option"
+)
+
+const orgContextTimeout = 10 * time.Second
+
+// orgContext places the project in the resource hierarchy, so alerts from
+// a large org can be routed by business unit.
+type orgContext struct {
+	ProjectName string // display name
+	Parent      string // e.g. folders/123 or organizations/456
+	ParentName  string // display name of the parent, if readable
+}
+
+// lookupOrgContext resolves the project's display name and parent through
+// Cloud Resource Manager. It needs resourcemanager.projects.get, plus
+// folders.get or organizations.get for the parent's name.
+func lookupOrgContext(ctx context.Context, projectID string, opts ...option.ClientOption) (orgContext, error) {
+	opts = append([]option.ClientOption{option.WithScopes(crm.CloudPlatformReadOnlyScope)}, opts...)
+	svc, err := crm.NewService(ctx, opts...)
+	if err != nil {
+		return orgContext{}, fmt.Errorf("failed to create resource manager client: %w", err)
+	}
+
+	project, err := svc.Projects.Get("projects/" + projectID).Context(ctx).Do()
+	if err != nil {
+		return orgContext{}, fmt.Errorf("failed to get project: %w", err)
+	}
+	oc := orgContext{ProjectName: project.DisplayName, Parent: project.Parent}
+
+	// The parent's name is a nicety; the ID alone still routes
+	switch {
+	case strings.HasPrefix(oc.Parent, "folders/"):
+		if folder, err := svc.Folders.Get(oc.Parent).Context(ctx).Do(); err != nil {
+			log.Printf("Failed to get parent folder name: %v", err)
+		} else {
+			oc.ParentName = folder.DisplayName
+		}
+	case strings.HasPrefix(oc.Parent, "organizations/"):
+		if org, err := svc.Organizations.Get(oc.Parent).Context(ctx).Do(); err != nil {
+			log.Printf("Failed to get parent organization name: %v", err)
+		} else {
+			oc.ParentName = org.DisplayName
+		}
+	}
+	return oc, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPriceCheckInterval = 10 * time.Minute
+	priceTimeout              = 10 * time.Second
+)
+
+// priceChecker polls a configured price source for this VM's current Spot
+// price and reports when it is above max. The URL may contain {machineType},
+// {zone} and {region}; the answer is a bare number or {"price": <number>},
+// in the same unit as max (e.g. USD per hour).
+type priceChecker struct {
+	url      string
+	max      float64
+	interval time.Duration
+
+	lastCheck time.Time
+	price     float64 // last price seen
+	lastErr   error
+}
+
+// newPriceChecker fills the placeholders in url for inst.
+func newPriceChecker(url string, max float64, inst instanceInfo) *priceChecker {
+	url = strings.NewReplacer("{machineType}", inst.MachineType, "{zone}", inst.Zone, "{region}", regionOf(inst.Zone)).Replace(url)
+	return &priceChecker{url: url, max: max, interval: defaultPriceCheckInterval}
+}
+
+// check fetches the price if interval has passed since the last fetch, and
+// reports whether it is over max. A failed fetch never triggers termination.
+func (p *priceChecker) check(ctx context.Context, now time.Time) bool {
+	if !p.lastCheck.IsZero() && now.Sub(p.lastCheck) < p.interval {
+		return false
+	}
+	p.lastCheck = now
+	price, err := fetchPrice(ctx, p.url)
+	p.lastErr = err
+	if err != nil {
+		return false
+	}
+	p.price = price
+	return price > p.max
+}
+
+// fetchPrice reads a price from url.
+func fetchPrice(ctx context.Context, url string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("price request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read price: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("price source returned non-2xx status: %d", resp.StatusCode)
+	}
+
+	text := strings.TrimSpace(string(body))
+	if price, err := strconv.ParseFloat(text, 64); err == nil {
+		return price, nil
+	}
+	var v struct {
+		Price *float64 `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(text), &v); err != nil || v.Price == nil {
+		return 0, fmt.Errorf("price source answered %q, want a number or {\"price\": <number>}", truncateMessage(text, 100))
+	}
+	return *v.Price, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Provisioning models, as the Compute API names them. Legacy preemptible
+// VMs are STANDARD with scheduling.preemptible set; we call them PREEMPTIBLE.
+const (
+	ProvisioningSpot        = "SPOT"
+	ProvisioningPreemptible = "PREEMPTIBLE"
+	ProvisioningStandard    = "STANDARD"
+)
+
+// preemptibleMaxRuntime is how long GCP lets a legacy preemptible VM run
+// before stopping it, whatever our TTL says. Spot VMs have no such limit.
+const preemptibleMaxRuntime = 24 * time.Hour
+
+// classifyProvisioning names the provisioning model from the metadata
+// server's scheduling values; "" means they can't tell Spot from legacy
+// preemptible, since both report preemptible=TRUE.
+func classifyProvisioning(preemptible, model string) string {
+	switch model = strings.ToUpper(strings.TrimSpace(model)); {
+	case model == ProvisioningSpot:
+		return ProvisioningSpot
+	case strings.TrimSpace(preemptible) != "TRUE":
+		return ProvisioningStandard
+	case model == ProvisioningStandard:
+		return ProvisioningPreemptible
+	}
+	return ""
+}
+
+// provisioningModel asks the Compute API what classifyProvisioning couldn't
+// work out from metadata.
+func (t *computeTerminator) provisioningModel(ctx context.Context, projectID, zone, instanceName string) (string, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return "", err
+	}
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	switch {
+	case inst.Scheduling == nil:
+		return ProvisioningStandard, nil
+	case inst.Scheduling.ProvisioningModel == ProvisioningSpot:
+		return ProvisioningSpot, nil
+	case inst.Scheduling.Preemptible:
+		return ProvisioningPreemptible, nil
+	}
+	return ProvisioningStandard, nil
+}
+
+// placementIssues asks the Compute API how the VM is placed and lists what
+// doesn't fit Spot semantics: sole-tenant node affinity or a specific
+// reservation, either of which changes how and whether it gets reclaimed.
+func (t *computeTerminator) placementIssues(ctx context.Context, projectID, zone, instanceName string) ([]string, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	return checkPlacement(inst.Scheduling, inst.ReservationAffinity), nil
+}
+
+// checkPlacement is placementIssues for the API's scheduling and
+// reservation settings, either of which may be nil.
+func checkPlacement(scheduling *compute.Scheduling, reservation *compute.ReservationAffinity) []string {
+	var issues []string
+	if scheduling != nil {
+		for _, a := range scheduling.NodeAffinities {
+			if a.Operator == "IN" {
+				issues = append(issues, fmt.Sprintf("it runs on sole-tenant nodes (node affinity %s in %s)", a.Key, strings.Join(a.Values, ", ")))
+			}
+		}
+	}
+	if reservation != nil && reservation.ConsumeReservationType == "SPECIFIC_RESERVATION" {
+		issues = append(issues, fmt.Sprintf("it consumes a specific reservation (%s)", strings.Join(reservation.Values, ", ")))
+	}
+	return issues
+}
+
+// bootTime is when the VM last started, from /proc/uptime. GCP's 24h limit
+// on preemptible VMs counts from there.
+func bootTime(now time.Time) (time.Time, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read uptime: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("empty /proc/uptime")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse uptime: %w", err)
+	}
+	return now.Add(-time.Duration(secs * float64(time.Second))), nil
+}
+
+// setProvisioning records the provisioning model and, for a preemptible VM,
+// when GCP will stop it, warning if that comes before the TTL.
+func (d *messageData) setProvisioning(model string, now time.Time) {
+	d.ProvisioningModel = model
+	log.Printf("Provisioning model: %s", model)
+	if model != ProvisioningPreemptible {
+		return
+	}
+	boot, err := bootTime(now)
+	if err != nil {
+		log.Printf("Can't tell when GCP will stop this preemptible VM: %v", err)
+		return
+	}
+	d.ForcedStopAt = boot.Add(preemptibleMaxRuntime)
+	if d.TerminateAfter == 0 || d.Started.Add(d.TerminateAfter).After(d.ForcedStopAt) {
+		log.Printf("WARNING: GCP will stop this preemptible VM at %s, before the TTL runs out", d.ForcedStopAt.Format(time.RFC3339))
+	}
+}
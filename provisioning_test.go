@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestClassifyProvisioning(t *testing.T) {
+	for _, tc := range []struct{ preemptible, model, want string }{
+		{"TRUE", "SPOT", ProvisioningSpot},
+		{"TRUE", "STANDARD", ProvisioningPreemptible},
+		{"FALSE", "STANDARD", ProvisioningStandard},
+		{"FALSE", "", ProvisioningStandard},
+		{"TRUE", "", ""}, // Spot or legacy, metadata can't say
+	} {
+		if got := classifyProvisioning(tc.preemptible, tc.model); got != tc.want {
+			t.Errorf("classifyProvisioning(%q, %q) = %q, want %q", tc.preemptible, tc.model, got, tc.want)
+		}
+	}
+}
+
+func TestLaunchMessageWarnsAboutPreemptibleLimit(t *testing.T) {
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := messageData{
+		ProvisioningModel: ProvisioningPreemptible,
+		ForcedStopAt:      time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC),
+	}
+	msg := templates.render(msgLaunch, data)
+	if !strings.Contains(msg, "force-stop this preemptible VM within 24h of starting (by 2024-01-02 03:04 UTC)") {
+		t.Errorf("launch message lacks the 24h note:\n%s", msg)
+	}
+	data.ProvisioningModel = ProvisioningSpot
+	if msg := templates.render(msgLaunch, data); strings.Contains(msg, "24h") {
+		t.Errorf("Spot launch message mentions the 24h limit:\n%s", msg)
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	if issues := checkPlacement(&compute.Scheduling{ProvisioningModel: "SPOT"}, &compute.ReservationAffinity{ConsumeReservationType: "ANY_RESERVATION"}); len(issues) != 0 {
+		t.Errorf("plain Spot VM: issues = %q", issues)
+	}
+	if issues := checkPlacement(nil, nil); len(issues) != 0 {
+		t.Errorf("no settings: issues = %q", issues)
+	}
+
+	issues := checkPlacement(
+		&compute.Scheduling{NodeAffinities: []*compute.SchedulingNodeAffinity{
+			{Key: "compute.googleapis.com/node-group-name", Operator: "IN", Values: []string{"ml-nodes"}},
+			{Key: "env", Operator: "NOT_IN", Values: []string{"prod"}},
+		}},
+		&compute.ReservationAffinity{ConsumeReservationType: "SPECIFIC_RESERVATION", Key: "compute.googleapis.com/reservation-name", Values: []string{"res-1"}},
+	)
+	if len(issues) != 2 || !strings.Contains(issues[0], "ml-nodes") || !strings.Contains(issues[1], "res-1") {
+		t.Errorf("issues = %q", issues)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// liveSettings are re-read on SIGHUP and take effect immediately.
+var liveSettings = []string{
+	"CHECK_INTERVAL", "TTL_WARN_FRACTION", "NOTIFY_TIMEOUT", "NOTIFY_CA_CERT",
+	"RELAY_URL", "RELAY_MESSAGE_FIELD", "RELAY_EXTRA_FIELDS", "RELAY_HEADERS", "FALLBACK_WEBHOOK_URL",
+	"WEBHOOK_CONTENT_TYPE", "WEBHOOK_GZIP",
+	"NOTIFY_FAILURE_THRESHOLD", "NOTIFY_FAILURE_COOLDOWN",
+	"SLACK_MENTION", "RUNBOOK_URL", "MAX_NOTIFICATIONS", "NOTIFY_COALESCE_WINDOW", "QUIET_HOURS", "QUIET_HOURS_TZ", "SEVERITY_RULES", "REDACT_PATTERNS",
+	"SLACK_ENABLED", "WEBHOOK_ENABLED", "DISCORD_ENABLED", "SLACK_API_ENABLED", "PUBSUB_ENABLED", "OPSGENIE_ENABLED", "PAGERDUTY_ENABLED", "SLACK_WEBHOOK_ENABLED", "GOOGLE_CHAT_ENABLED", "ROUTES_ENABLED", "EVENT_SOCKET_ENABLED",
+}
+
+// restartSettings are only read at startup. A SIGHUP that changes one of
+// them just says so.
+var restartSettings = []string{
+	"NOTIFIER_TYPE", "NOTIFIER_URL", "EVENT_FORMAT", "TERMINATE_AFTER_HOURS", "SOFT_TTL_HOURS", "HARD_TTL_HOURS", "GRACE_PERIOD", "MAX_GRACE_PERIOD", "TERMINATE_ACTION", "SNAPSHOT_BEFORE_DELETE", "SNAPSHOT_DISKS_ON_TTL", "SNAPSHOT_TIMEOUT", "TERMINATE_WHEN_STOPPING", "TERMINATION_ALLOWED_REGIONS", "VERIFY_INSTANCE_IDENTITY", "CORRELATION_ID", "METADATA_FAILURE_RATE", "METADATA_FAILURE_WINDOW", "COMPUTE_ENDPOINT", "FREEZE_WINDOW", "FREEZE_WINDOW_TZ",
+	"COMPUTE_MIN_CALL_INTERVAL", "TERMINATION_CONTROLLER_URL", "SELF_TERMINATE_RETRY_WINDOW", "TERMINATION_TIMEOUT", "ESCALATION_INTERVALS", "ESCALATION_MAX_ALERTS", "DRAIN_COMMAND", "DRAIN_TIMEOUT", "SHUTDOWN_HOOKS", "DRAIN_CHECK_URL", "COMPLETION_MARKER", "TERMINATE_GROUP_LABEL", "TERMINATE_GROUP_ZONES", "TERMINATE_GROUP_CONFIRM_WINDOW", "TERMINATE_CONCURRENCY",
+	"MAINTENANCE_EVENT_IGNORE", "GCE_METADATA_HOST", "METADATA_WATCH", "PUBSUB_TOPIC", "OPSGENIE_API_KEY", "PAGERDUTY_ROUTING_KEY", "PAGERDUTY_EVENTS_URL", "SLACK_WEBHOOK_URL", "GOOGLE_CHAT_WEBHOOK_URL", "WEBHOOK_PAYLOAD_TEMPLATE",
+	"PREEMPT_HOOK", "PREEMPT_SIGNAL_FILE", "ON_PREEMPT_ACTION", "GRACE_PREEMPT_ACTION", "GRACE_WARNINGS", "SIGTERM_ACTION", "SIGTERM_CHECK_WINDOW", "PREEMPT_HOOK_DELAY", "PREEMPTION_SURVIVAL_WINDOW", "PREEMPTION_SURVIVAL_POLL_INTERVAL", "PREEMPTION_TRACE", "INCLUDE_SERIAL_OUTPUT", "LAUNCH_MARKER_FILE", "INCLUDE_ORG_CONTEXT",
+	"AUDIT_BUCKET", "AUDIT_PREFIX", "PREEMPTION_COUNTER_BUCKET", "PREEMPTION_COUNTER_OBJECT", "PREEMPTION_COUNT_WINDOW", "FAMILY_PREEMPTION_THRESHOLD", "CAPACITY_CHECK_INTERVAL", "SCHEDULING_CHECK_INTERVAL",
+	"SELF_HEALTH_URL", "SELF_HEALTH_FAILURES", "SELF_HEALTH_DURATION", "MAX_SPOT_PRICE", "SPOT_PRICE_URL", "SPOT_PRICE_CHECK_INTERVAL",
+	"NOTIFY_ROUTES", "ROUTES_TIMEOUT", "SLACK_BOT_TOKEN", "SLACK_CHANNEL", "SLACK_API_URL", "SLACK_VERIFY_DELIVERY", "SLACK_API_TIMEOUT", "SLACK_API_MAX_MESSAGE_SIZE", "EVENT_SOCKET", "EXIT_WEBHOOK_URL", "EVENT_HISTORY_ON_EXIT", "STATE_WEBHOOK_URL", "EVENT_ARCHIVE_BUCKET", "EVENT_ARCHIVE_PREFIX", "EVENT_ARCHIVE_FLUSH_INTERVAL", "EVENT_ARCHIVE_MAX_BYTES", "MAX_PROCESS_LIFETIME", "SLACK_TIMEOUT", "WEBHOOK_TIMEOUT", "DISCORD_TIMEOUT", "PUBSUB_TIMEOUT", "OPSGENIE_TIMEOUT", "PAGERDUTY_TIMEOUT", "SLACK_WEBHOOK_TIMEOUT", "GOOGLE_CHAT_TIMEOUT", "EVENT_SOCKET_TIMEOUT",
+	"SLACK_MAX_MESSAGE_SIZE", "WEBHOOK_MAX_MESSAGE_SIZE", "DISCORD_MAX_MESSAGE_SIZE", "ROUTES_MAX_MESSAGE_SIZE", "PUBSUB_MAX_MESSAGE_SIZE", "OPSGENIE_MAX_MESSAGE_SIZE", "EVENT_SOCKET_MAX_MESSAGE_SIZE", "SLACK_MIN_SEVERITY", "WEBHOOK_MIN_SEVERITY", "DISCORD_MIN_SEVERITY", "SLACK_API_MIN_SEVERITY", "PUBSUB_MIN_SEVERITY", "OPSGENIE_MIN_SEVERITY", "ROUTES_MIN_SEVERITY", "EVENT_SOCKET_MIN_SEVERITY",
+	"SLACK_EVENTS", "WEBHOOK_EVENTS", "DISCORD_EVENTS", "SLACK_API_EVENTS", "SLACK_WEBHOOK_EVENTS", "GOOGLE_CHAT_EVENTS", "PUBSUB_EVENTS", "OPSGENIE_EVENTS", "PAGERDUTY_EVENTS", "ROUTES_EVENTS", "EVENT_SOCKET_EVENTS",
+	"STATSD_ADDR", "STATUS_ADDR", "CONTROL_ADDR", "FLEET_PROJECT", "FLEET_FILTER", "FLEET_TTL_LABEL", "FLEET_POLL_INTERVAL", "STATSD_PREFIX", "STATSD_TAGS",
+	"METADATA_LATENCY_REPORT_INTERVAL", "RESOURCE_REPORT_INTERVAL", "STATE_STORE", "TTL_FROM_CREATION", "STATE_FILE", "STATE_BUCKET", "STATE_OBJECT", "EVENT_COOLDOWN", "COST_ESTIMATE", "COST_REPORT_INTERVAL", "TRACEPARENT",
+	"CRITICAL_NOTIFY_FAILURE_ACTION", "CRITICAL_NOTIFY_FAILURE_TIMEOUT", "CRITICAL_NOTIFY_FAILURE_FILE",
+	"COMPUTE_INIT_ATTEMPTS", "COMPUTE_INIT_MAX_BACKOFF", "LAUNCH_DEDUP_WINDOW", "LOG_TAIL_LINES", "METADATA_PREFETCH_CONCURRENCY", "MOCK_METADATA",
+	"OPSGENIE_API_URL", "PREEMPT_HOOK_TIMEOUT", "SERIAL_OUTPUT_BYTES", "SKIP_PERMISSION_CHECK", "STARTUP_DELAY", "TERMINATE_NOW_SKIP_GRACE", "INCLUDE_CONFIG_IN_LAUNCH", "NOT_SPOT_WARNING", "PLACEMENT_WARNING", "TEMPLATE_DIR",
+}
+
+// liveConfig holds the settings that can change at runtime.
+type liveConfig struct {
+	checkInterval time.Duration
+	warnFraction  float64
+	notifyTimeout time.Duration
+	notifyRoots   *x509.CertPool // nil for the system trust store
+
+	relay            *relayNotifier
+	fallback         Notifier // nil without FALLBACK_WEBHOOK_URL
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	mention    string
+	runbook    string
+	budget     int
+	coalesce   time.Duration
+	quietHours *timeWindow
+	redact     []*regexp.Regexp
+	severity   []severityRule
+	disabled   map[string]bool
+}
+
+// loadLiveConfig reads the live settings from the environment. Nothing is
+// applied unless all of them parse.
+func loadLiveConfig() (liveConfig, error) {
+	c := liveConfig{
+		checkInterval:    defaultCheckInterval,
+		notifyTimeout:    defaultNotifyTimeout,
+		breakerThreshold: defaultBreakerThreshold,
+		breakerCooldown:  defaultBreakerCooldown,
+		mention:          os.Getenv("SLACK_MENTION"),
+		runbook:          os.Getenv("RUNBOOK_URL"),
+	}
+
+	var err error
+	if val := os.Getenv("CHECK_INTERVAL"); val != "" {
+		if c.checkInterval, err = time.ParseDuration(val); err != nil || c.checkInterval <= 0 {
+			return c, fmt.Errorf("invalid CHECK_INTERVAL: %q (want a positive duration)", val)
+		}
+	}
+	// Every second between polls comes out of GCP's ~30s preemption notice
+	switch {
+	case c.checkInterval >= preemptionBudget:
+		log.Printf("WARNING: CHECK_INTERVAL %v would miss most of GCP's %v preemption notice, using %v", c.checkInterval, preemptionBudget, maxCheckInterval)
+		c.checkInterval = maxCheckInterval
+	case c.checkInterval > maxCheckInterval:
+		log.Printf("WARNING: CHECK_INTERVAL %v can leave under %v of GCP's preemption notice once it's detected", c.checkInterval, preemptionBudget-c.checkInterval)
+	}
+	if val := os.Getenv("TTL_WARN_FRACTION"); val != "" {
+		if c.warnFraction, err = strconv.ParseFloat(val, 64); err != nil || c.warnFraction <= 0 || c.warnFraction >= 1 {
+			return c, fmt.Errorf("invalid TTL_WARN_FRACTION: %q (want a number between 0 and 1)", val)
+		}
+	}
+	if val := os.Getenv("NOTIFY_TIMEOUT"); val != "" {
+		if c.notifyTimeout, err = time.ParseDuration(val); err != nil {
+			return c, fmt.Errorf("invalid NOTIFY_TIMEOUT: %w", err)
+		}
+	}
+
+	if path := os.Getenv("NOTIFY_CA_CERT"); path != "" {
+		if c.notifyRoots, err = loadCertPool(path); err != nil {
+			return c, fmt.Errorf("invalid NOTIFY_CA_CERT: %w", err)
+		}
+	}
+
+	if c.relay, err = newRelayNotifier(); err != nil {
+		return c, err
+	}
+	if url := os.Getenv("FALLBACK_WEBHOOK_URL"); url != "" {
+		c.fallback = &webhookNotifier{
+			url:         url,
+			contentType: os.Getenv("WEBHOOK_CONTENT_TYPE"),
+			gzip:        os.Getenv("WEBHOOK_GZIP") == "true",
+		}
+	}
+	if val := os.Getenv("NOTIFY_FAILURE_THRESHOLD"); val != "" {
+		if c.breakerThreshold, err = strconv.Atoi(val); err != nil || c.breakerThreshold < 1 {
+			return c, fmt.Errorf("invalid NOTIFY_FAILURE_THRESHOLD: %q", val)
+		}
+	}
+	if val := os.Getenv("NOTIFY_FAILURE_COOLDOWN"); val != "" {
+		if c.breakerCooldown, err = time.ParseDuration(val); err != nil {
+			return c, fmt.Errorf("invalid NOTIFY_FAILURE_COOLDOWN: %w", err)
+		}
+	}
+
+	if val := os.Getenv("REDACT_PATTERNS"); val != "" {
+		if c.redact, err = parseRedactPatterns(val); err != nil {
+			return c, err
+		}
+	}
+	if val := os.Getenv("NOTIFY_COALESCE_WINDOW"); val != "" {
+		if c.coalesce, err = time.ParseDuration(val); err != nil {
+			return c, fmt.Errorf("invalid NOTIFY_COALESCE_WINDOW: %w", err)
+		}
+	}
+	if val := os.Getenv("MAX_NOTIFICATIONS"); val != "" {
+		if c.budget, err = strconv.Atoi(val); err != nil || c.budget < 0 {
+			return c, fmt.Errorf("invalid MAX_NOTIFICATIONS: %q", val)
+		}
+	}
+	if spec := os.Getenv("QUIET_HOURS"); spec != "" {
+		loc, err := time.LoadLocation(os.Getenv("QUIET_HOURS_TZ")) // Empty means UTC
+		if err != nil {
+			return c, fmt.Errorf("invalid QUIET_HOURS_TZ: %w", err)
+		}
+		if c.quietHours, err = parseTimeWindow(spec, loc); err != nil {
+			return c, fmt.Errorf("invalid QUIET_HOURS: %w", err)
+		}
+	}
+	if spec := os.Getenv("SEVERITY_RULES"); spec != "" {
+		if c.severity, err = parseSeverityRules(spec); err != nil {
+			return c, err
+		}
+	}
+	for _, name := range backendNames {
+		env := strings.ToUpper(name) + "_ENABLED"
+		if val := os.Getenv(env); val != "" {
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return c, fmt.Errorf("invalid %s: %q", env, val)
+			}
+			if !enabled {
+				if c.disabled == nil {
+					c.disabled = map[string]bool{}
+				}
+				c.disabled[name] = true
+			}
+		}
+	}
+	return c, nil
+}
+
+// apply installs the notification settings on the dispatcher and on the
+// breaker guarding the relay. The breaker starts over, since the relay it
+// was tracking may just have been replaced.
+func (c liveConfig) apply(d *dispatcher, slack *breakerNotifier) {
+	notifyClient = newNotifyClient(c.notifyTimeout, c.notifyRoots)
+
+	slack.mu.Lock()
+	slack.primary, slack.fallback = c.relay, c.fallback
+	slack.threshold, slack.cooldown = c.breakerThreshold, c.breakerCooldown
+	slack.failures, slack.openUntil = 0, time.Time{}
+	slack.mu.Unlock()
+
+	d.mu.Lock()
+	d.budget = c.budget
+	d.mu.Unlock()
+	d.mention, d.runbook, d.quietHours, d.redact = c.mention, c.runbook, c.quietHours, c.redact
+	d.coalesce, d.severityRules, d.disabled = c.coalesce, c.severity, c.disabled
+	for name := range c.disabled {
+		log.Printf("Notifications to %s are disabled by %s_ENABLED", name, strings.ToUpper(name))
+	}
+	if d.quietHours != nil {
+		log.Printf("Quiet hours %s (%s): only critical notifications will be sent", os.Getenv("QUIET_HOURS"), d.quietHours.loc)
+	}
+}
+
+// reloadConfig re-reads the spot-notifier-config attribute, the live
+// settings and the message templates, and applies them to m and its
+// notifiers. If any of them fails to load, nothing changes.
+func reloadConfig(m *Monitor, slack *breakerNotifier) error {
+	before := envSnapshot(append(liveSettings, restartSettings...))
+	if err := loadMetadataConfig(); err != nil {
+		return err
+	}
+	cfg, err := loadLiveConfig()
+	if err != nil {
+		return err
+	}
+	tmpls, err := loadTemplates()
+	if err != nil {
+		return err
+	}
+	cfg.apply(m.Notifier, slack)
+	m.Templates = tmpls
+	m.CheckInterval, m.Data.PollInterval = cfg.checkInterval, cfg.checkInterval
+	m.WarnFraction = cfg.warnFraction
+	logConfigChanges(before)
+	return nil
+}
+
+// notifyOnSIGHUP returns a channel that receives once per SIGHUP. Signals
+// that arrive while a reload is still pending are merged into it.
+func notifyOnSIGHUP() <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	reload := make(chan struct{}, 1)
+	go func() {
+		for range sig {
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return reload
+}
+
+// notifyOnSIGUSR1 returns a channel that is closed on the first SIGUSR1.
+func notifyOnSIGUSR1() <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	fired := make(chan struct{})
+	go func() {
+		<-sig
+		close(fired)
+	}()
+	return fired
+}
+
+// envSnapshot captures the current value of each key.
+func envSnapshot(keys []string) map[string]string {
+	snap := make(map[string]string, len(keys))
+	for _, k := range keys {
+		snap[k] = os.Getenv(k)
+	}
+	return snap
+}
+
+// logConfigChanges reports which settings differ from before. Values are
+// left out since some of them (URLs, keys) are secrets.
+func logConfigChanges(before map[string]string) {
+	var applied, ignored []string
+	for _, k := range liveSettings {
+		if os.Getenv(k) != before[k] {
+			applied = append(applied, k)
+		}
+	}
+	for _, k := range restartSettings {
+		if os.Getenv(k) != before[k] {
+			ignored = append(ignored, k)
+		}
+	}
+	if len(applied) > 0 {
+		log.Printf("Reload applied changes to %s", strings.Join(applied, ", "))
+	}
+	if len(ignored) > 0 {
+		log.Printf("Reload found changes to %s, which need a restart to take effect", strings.Join(ignored, ", "))
+	}
+	if len(applied)+len(ignored) == 0 {
+		log.Printf("Reload found no setting changes")
+	}
+}
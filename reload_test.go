@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// relayServer counts the notifications posted to it.
+func relayServer(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	posts := new(int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*posts++
+	}))
+	t.Cleanup(srv.Close)
+	return srv, posts
+}
+
+func TestReloadConfigAppliesLiveSettings(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	client := notifyClient
+	t.Cleanup(func() { notifyClient = client })
+	slack := &breakerNotifier{name: "Slack", clock: clock}
+	oldRelay, oldPosts := relayServer(t)
+	newRelay, newPosts := relayServer(t)
+
+	t.Setenv("RELAY_URL", oldRelay.URL)
+	if err := reloadConfig(m, slack); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_URL", newRelay.URL)
+	t.Setenv("CHECK_INTERVAL", "10s")
+	t.Setenv("MAX_NOTIFICATIONS", "3")
+	if err := reloadConfig(m, slack); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.CheckInterval != 10*time.Second || m.Data.PollInterval != 10*time.Second {
+		t.Errorf("check interval = %v, poll interval in messages = %v, want 10s", m.CheckInterval, m.Data.PollInterval)
+	}
+	if m.Notifier.budget != 3 {
+		t.Errorf("notification budget = %d, want 3", m.Notifier.budget)
+	}
+	if err := slack.Notify(context.Background(), Event{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if *oldPosts != 0 || *newPosts != 1 {
+		t.Errorf("old relay got %d posts, new one %d, want only the new one", *oldPosts, *newPosts)
+	}
+}
+
+func TestReloadConfigKeepsSettingsOnError(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	client := notifyClient
+	t.Cleanup(func() { notifyClient = client })
+	slack := &breakerNotifier{name: "Slack", clock: clock}
+	relay, posts := relayServer(t)
+
+	t.Setenv("RELAY_URL", relay.URL)
+	t.Setenv("CHECK_INTERVAL", "10s")
+	if err := reloadConfig(m, slack); err != nil {
+		t.Fatal(err)
+	}
+	other, otherPosts := relayServer(t)
+	t.Setenv("RELAY_URL", other.URL)
+	t.Setenv("CHECK_INTERVAL", "often")
+	if err := reloadConfig(m, slack); err == nil {
+		t.Fatal("reload with CHECK_INTERVAL=often succeeded")
+	}
+
+	if m.CheckInterval != 10*time.Second {
+		t.Errorf("check interval = %v, want the 10s from before the failed reload", m.CheckInterval)
+	}
+	if err := slack.Notify(context.Background(), Event{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if *posts != 1 || *otherPosts != 0 {
+		t.Errorf("old relay got %d posts, new one %d, want the old relay kept", *posts, *otherPosts)
+	}
+}
+
+func TestLoadLiveConfigQuietHours(t *testing.T) {
+	t.Setenv("QUIET_HOURS", "22:00-07:00")
+	t.Setenv("QUIET_HOURS_TZ", "Europe/Paris")
+	c, err := loadLiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.quietHours.String(); got != "22:00-07:00 Europe/Paris" {
+		t.Errorf("quiet hours = %s, want 22:00-07:00 Europe/Paris", got)
+	}
+
+	t.Setenv("QUIET_HOURS_TZ", "Mars/Olympus")
+	if _, err := loadLiveConfig(); err == nil {
+		t.Error("loadLiveConfig accepted QUIET_HOURS_TZ=Mars/Olympus")
+	}
+	t.Setenv("QUIET_HOURS_TZ", "")
+	t.Setenv("QUIET_HOURS", "overnight")
+	if _, err := loadLiveConfig(); err == nil {
+		t.Error("loadLiveConfig accepted QUIET_HOURS=overnight")
+	}
+}
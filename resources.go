@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+// resourceUsage is a snapshot of the notifier's own footprint, to catch a
+// slow leak over a multi-day run.
+type resourceUsage struct {
+	Goroutines int
+	HeapAlloc  uint64 // bytes
+	Sys        uint64 // bytes obtained from the OS
+	NumGC      uint32
+	PauseTotal time.Duration
+}
+
+func readResourceUsage() resourceUsage {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return resourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		Sys:        ms.Sys,
+		NumGC:      ms.NumGC,
+		PauseTotal: time.Duration(ms.PauseTotalNs),
+	}
+}
+
+func (u resourceUsage) String() string {
+	return fmt.Sprintf("%d goroutines, heap %.1f MiB, sys %.1f MiB, %d GCs (%v paused)",
+		u.Goroutines, float64(u.HeapAlloc)/(1<<20), float64(u.Sys)/(1<<20), u.NumGC, u.PauseTotal.Round(time.Microsecond))
+}
+
+// reportResourceUsage logs the notifier's resource usage every interval,
+// and sends it as gauges when StatsD is set up.
+func reportResourceUsage(interval time.Duration) {
+	for range time.Tick(interval) {
+		u := readResourceUsage()
+		log.Printf("Notifier resources: %s", u)
+		stats.gauge("goroutines", float64(u.Goroutines))
+		stats.gauge("heap_bytes", float64(u.HeapAlloc))
+		stats.gauge("sys_bytes", float64(u.Sys))
+		stats.gauge("gc_cycles", float64(u.NumGC))
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResourceUsage(t *testing.T) {
+	u := readResourceUsage()
+	if u.Goroutines < 1 || u.HeapAlloc == 0 || u.Sys < u.HeapAlloc {
+		t.Errorf("implausible usage: %+v", u)
+	}
+	if s := u.String(); !strings.Contains(s, "goroutines, heap ") {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state line such as "READY=1" to systemd. It's a no-op
+// outside a Type=notify unit, where NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Abstract socket namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns the WatchdogSec systemd configured for us, or
+// zero when the watchdog is off or meant for another process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdWatchdog returns the function that pings the systemd watchdog, or nil
+// when there is no watchdog. Pings come once per poll, so checkInterval has
+// to leave room inside WatchdogSec.
+func sdWatchdog(checkInterval time.Duration) func() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+	if checkInterval >= interval/2 {
+		log.Printf("WARNING: CHECK_INTERVAL %v is too long for the %v systemd watchdog", checkInterval, interval)
+	}
+	return func() {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Watchdog ping failed: %v", err)
+		}
+	}
+}
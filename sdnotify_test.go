@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeSystemd listens where NOTIFY_SOCKET points and returns what it gets.
+func fakeSystemd(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	got := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+	return got
+}
+
+func TestSDNotifySendsState(t *testing.T) {
+	got := fakeSystemd(t)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-got:
+		if state != "READY=1" {
+			t.Errorf("systemd got %q, want READY=1", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("systemd got nothing")
+	}
+}
+
+func TestSDNotifyOutsideSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v, want a no-op", err)
+	}
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone.sock"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify() to a missing socket succeeded")
+	}
+}
+
+func TestSDWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	for _, tc := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"30000000", "", 30 * time.Second},
+		{"30000000", self, 30 * time.Second},
+		{"30000000", "1", 0}, // another process's watchdog
+		{"", "", 0},
+		{"0", "", 0},
+		{"soon", "", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+		if got := sdWatchdogInterval(); got != tc.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: interval = %v, want %v", tc.usec, tc.pid, got, tc.want)
+		}
+	}
+}
+
+func TestSDWatchdogPings(t *testing.T) {
+	got := fakeSystemd(t)
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if sdWatchdog(time.Second) != nil {
+		t.Error("sdWatchdog() without WATCHDOG_USEC returned a ping")
+	}
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	ping := sdWatchdog(time.Second)
+	if ping == nil {
+		t.Fatal("sdWatchdog() with WATCHDOG_USEC returned no ping")
+	}
+	ping()
+	select {
+	case state := <-got:
+		if state != "WATCHDOG=1" {
+			t.Errorf("systemd got %q, want WATCHDOG=1", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("systemd got nothing")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	defaultSerialOutputBytes = 2000
+	serialOutputTimeout      = 5 * time.Second
+	// Preemption leaves ~30s and the alert waits on this, so don't spend
+	// much of it on debug output
+	preemptSerialOutputTimeout = time.Second
+)
+
+// serialTail returns roughly the last n bytes of serial port 1, starting at
+// a line boundary. It needs compute.instances.getSerialPortOutput.
+func serialTail(ctx context.Context, svc *compute.Service, projectID, zone, name string, n int) (string, error) {
+	out, err := svc.Instances.GetSerialPortOutput(projectID, zone, name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get serial port output: %w", err)
+	}
+
+	contents := out.Contents
+	if len(contents) > n {
+		contents = contents[len(contents)-n:]
+		if i := strings.IndexByte(contents, '\n'); i >= 0 {
+			contents = contents[i+1:]
+		}
+	}
+	return strings.TrimSpace(contents), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Severity decides how hard a notification pushes through: critical ones
+// are always delivered and carry the mention and runbook, warnings still go
+// out during quiet hours, and info is held back by both quiet hours and
+// the notification budget.
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+var severities = []Severity{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// severityRule sets the severity of the events it matches. Every field
+// left empty matches anything.
+type severityRule struct {
+	Kinds    []EventKind       `json:"kinds"`
+	Labels   map[string]string `json:"labels"` // all must be on the instance
+	Hours    string            `json:"hours"`  // HH:MM-HH:MM
+	TZ       string            `json:"tz"`     // for hours, UTC by default
+	Severity Severity          `json:"severity"`
+
+	window *timeWindow
+}
+
+// parseSeverityRules parses SEVERITY_RULES, a JSON array of rules tried in
+// order, e.g. [{"kinds": ["preempted"], "labels": {"env": "dev"}, "severity": "info"}].
+func parseSeverityRules(spec string) ([]severityRule, error) {
+	var rules []severityRule
+	if err := json.Unmarshal([]byte(spec), &rules); err != nil {
+		return nil, fmt.Errorf("invalid SEVERITY_RULES: %w", err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if !slices.Contains(severities, r.Severity) {
+			return nil, fmt.Errorf("invalid SEVERITY_RULES: rule %d has severity %q (want info, warning or critical)", i+1, r.Severity)
+		}
+		for _, k := range r.Kinds {
+			if !slices.Contains(eventKinds, k) {
+				return nil, fmt.Errorf("invalid SEVERITY_RULES: rule %d has unknown event kind %q", i+1, k)
+			}
+		}
+		if r.Hours != "" {
+			loc, err := time.LoadLocation(r.TZ)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SEVERITY_RULES: rule %d: %w", i+1, err)
+			}
+			if r.window, err = parseTimeWindow(r.Hours, loc); err != nil {
+				return nil, fmt.Errorf("invalid SEVERITY_RULES: rule %d: %w", i+1, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// usesLabels reports whether any rule needs the instance's labels.
+func usesLabels(rules []severityRule) bool {
+	return slices.ContainsFunc(rules, func(r severityRule) bool { return len(r.Labels) > 0 })
+}
+
+// matches reports whether the rule applies to kind at now on an instance
+// with labels.
+func (r severityRule) matches(kind EventKind, labels map[string]string, now time.Time) bool {
+	if len(r.Kinds) > 0 && !slices.Contains(r.Kinds, kind) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return r.window == nil || r.window.contains(now)
+}
+
+// severityOf returns the severity of the first matching rule. Without one,
+// it is the kind's fixed severity: critical or info.
+func severityOf(rules []severityRule, kind EventKind, labels map[string]string, now time.Time) Severity {
+	for _, r := range rules {
+		if r.matches(kind, labels, now) {
+			return r.Severity
+		}
+	}
+	if kind.critical() {
+		return SeverityCritical
+	}
+	return SeverityInfo
+}
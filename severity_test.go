@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeverityRulesOverrideFixedSeverity(t *testing.T) {
+	rules, err := parseSeverityRules(`[
+		{"kinds": ["preempted"], "labels": {"env": "prod"}, "hours": "09:00-18:00", "severity": "critical"},
+		{"kinds": ["preempted"], "severity": "info"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock() // midnight UTC
+	rec := &recordingNotifier{}
+	window, _ := parseTimeWindow("22:00-07:00", time.UTC)
+	d := &dispatcher{clock: clock, backends: []Notifier{rec}, severityRules: rules, quietHours: window,
+		mention: "<!here>", labels: map[string]string{"env": "prod"}}
+
+	d.notify(EventPreempted, "overnight, info, held back by quiet hours")
+	clock.Advance(10 * time.Hour)
+	d.notify(EventPreempted, "business hours on prod")
+	d.labels = map[string]string{"env": "dev"}
+	d.notify(EventPreempted, "business hours on dev")
+	d.notify(EventTerminationFailed, "no rule, still critical")
+
+	var got []string
+	for _, e := range rec.events {
+		got = append(got, string(e.Severity)+": "+e.Message)
+	}
+	want := []string{
+		"critical: <!here> business hours on prod",
+		"info: business hours on dev",
+		"critical: <!here> no rule, still critical",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := parseSeverityRules(`[{"kinds": ["preempt"], "severity": "info"}]`); err == nil {
+		t.Error("unknown event kind accepted")
+	}
+}
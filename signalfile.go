@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const signalFilePoll = 250 * time.Millisecond
+
+// watchSignalFile returns a channel that is closed once an external shutdown
+// script signals preemption through path. A named pipe fires as soon as
+// something writes to it; a regular file fires when it appears or, if it
+// already existed at startup, when it is modified.
+func watchSignalFile(path string) <-chan struct{} {
+	fired := make(chan struct{})
+
+	info, err := os.Stat(path)
+	if err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		go func() {
+			// Opening a FIFO for reading blocks until a writer shows up
+			f, err := os.Open(path)
+			if err != nil {
+				log.Printf("Failed to open preemption signal pipe: %v", err)
+				return
+			}
+			defer f.Close()
+			io.ReadAll(f) // Returns once the writer closes its end
+			close(fired)
+		}()
+		return fired
+	}
+
+	var startMod time.Time
+	if err == nil {
+		log.Printf("Preemption signal file %s already exists, waiting for it to change", path)
+		startMod = info.ModTime()
+	}
+
+	go func() {
+		for {
+			if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(startMod) {
+				close(fired)
+				return
+			}
+			time.Sleep(signalFilePoll)
+		}
+	}()
+	return fired
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+
+	"spot-notifier-gcp/metadata"
+)
+
+const stateTimeout = 10 * time.Second
+
+// notifierState is what a restarted notifier needs to carry on where the
+// previous process left off.
+type notifierState struct {
+	InstanceID string    `json:"instanceID"`
+	Started    time.Time `json:"started"` // when the TTL clock started
+	// LastSent is when each kind of event last went out, for EVENT_COOLDOWN
+	LastSent map[EventKind]time.Time `json:"lastSent,omitempty"`
+	// TerminateAfter is the TTL as the control endpoint last left it, 0
+	// once cancelled. It wins over the configured TTL.
+	TerminateAfter *time.Duration `json:"terminateAfter,omitempty"`
+	// Lifecycle is the state last entered, and the rest what has already
+	// been announced for this run, so a restart doesn't say it again
+	Lifecycle       lifecycleState `json:"lifecycle,omitempty"`
+	Launched        bool           `json:"launched,omitempty"`
+	Warned          bool           `json:"warned,omitempty"`
+	SoftTTLNotified bool           `json:"softTTLNotified,omitempty"`
+}
+
+// ended reports whether the state is from a run that is over: the VM was
+// preempted or the TTL ended it, and whatever runs now is a new run even if
+// the instance ID is the same.
+func (s notifierState) ended() bool {
+	return s.Lifecycle == StatePreempted || s.Lifecycle == StateTerminated
+}
+
+// savedState holds the state and writes it back to its store on every
+// change. Changes come from the loop and from notification goroutines,
+// hence the mutex. A nil savedState saves nothing.
+type savedState struct {
+	store StateStore
+
+	mu    sync.Mutex
+	state notifierState
+}
+
+// update applies change and saves the result. what names the change for
+// the warning logged if the save fails.
+func (s *savedState) update(what string, change func(*notifierState)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(&s.state)
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	if err := s.store.Save(ctx, s.state); err != nil {
+		log.Printf("%s won't survive a restart: %v", what, err)
+	}
+}
+
+// get returns a copy of the state, the zero state for a nil savedState.
+func (s *savedState) get() notifierState {
+	if s == nil {
+		return notifierState{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// startTime picks when the TTL clock started: the saved start time if the
+// state is this instance's, else created if it is known, else now. It also
+// says which one it picked, "" for now.
+func startTime(state notifierState, instanceID string, created, now time.Time) (time.Time, string) {
+	switch {
+	case state.InstanceID == instanceID && !state.Started.IsZero() && !state.Started.After(now):
+		return state.Started, "start time in the saved state"
+	case !created.IsZero() && !created.After(now):
+		return created, "instance creation time"
+	}
+	return now, ""
+}
+
+// StateStore persists notifierState across restarts. Containers lose their
+// filesystem, so besides a local file the state can live in the instance's
+// guest attributes or in GCS.
+type StateStore interface {
+	// Load returns the saved state, or the zero state if none was saved.
+	Load(ctx context.Context) (notifierState, error)
+	Save(ctx context.Context, state notifierState) error
+}
+
+// defaultStateDir survives a reboot, unlike the temp dir; a non-root
+// notifier that can't create it falls back to the temp dir.
+const defaultStateDir = "/var/lib/spot-notifier"
+
+// newStateStore builds the store STATE_STORE asks for: file (the default,
+// STATE_FILE), guest-attributes (needs enable-guest-attributes on the
+// instance), gcs (STATE_BUCKET and STATE_OBJECT) or memory (nothing
+// survives a restart). Locations default to names keyed by the instance ID.
+func newStateStore(ctx context.Context, instanceID string) (StateStore, error) {
+	switch kind := cmp.Or(os.Getenv("STATE_STORE"), "file"); kind {
+	case "memory":
+		return &memoryStore{}, nil
+	case "file":
+		path := os.Getenv("STATE_FILE")
+		if path == "" {
+			dir := defaultStateDir
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				log.Printf("Can't use %s for state, falling back to the temp dir, which a reboot may clear: %v", dir, err)
+				dir = os.TempDir()
+			}
+			path = filepath.Join(dir, "state-"+instanceID+".json")
+		}
+		return &fileStore{path: path}, nil
+	case "guest-attributes":
+		return &guestAttributeStore{client: &metadata.Client{Base: metadataBase, HTTP: metadataClient}, path: guestAttributeState}, nil
+	case "gcs":
+		bucket := os.Getenv("STATE_BUCKET")
+		if bucket == "" {
+			return nil, fmt.Errorf("STATE_STORE=gcs needs STATE_BUCKET")
+		}
+		return newGCSStore(ctx, bucket, cmp.Or(os.Getenv("STATE_OBJECT"), "spot-notifier/state/"+instanceID+".json"))
+	default:
+		return nil, fmt.Errorf("invalid STATE_STORE: %q (want file, guest-attributes, gcs or memory)", kind)
+	}
+}
+
+// memoryStore keeps state for the life of the process only.
+type memoryStore struct {
+	mu    sync.Mutex
+	state notifierState
+}
+
+func (s *memoryStore) Load(context.Context) (notifierState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+func (s *memoryStore) Save(_ context.Context, state notifierState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+// fileStore keeps state in a local JSON file.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) Load(context.Context) (notifierState, error) {
+	var state notifierState
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse state %s: %w", s.path, err)
+	}
+	return state, nil
+}
+
+func (s *fileStore) Save(_ context.Context, state notifierState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create the state directory: %w", err)
+	}
+	// Write then rename, so a crash never leaves half a file behind
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	return nil
+}
+
+// guestAttributeState is where guestAttributeStore keeps the state, under
+// the metadata server's base URL.
+const guestAttributeState = "instance/guest-attributes/spot-notifier/state"
+
+// guestAttributeStore keeps state in a guest attribute of the instance,
+// which outlives both the container and a reboot and needs no bucket.
+type guestAttributeStore struct {
+	client *metadata.Client
+	path   string
+}
+
+func (s *guestAttributeStore) Load(ctx context.Context) (notifierState, error) {
+	var state notifierState
+	data, err := s.client.Get(ctx, s.path)
+	var status *metadata.StatusError
+	if errors.As(err, &status) && status.Code == http.StatusNotFound {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read guest attribute: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return state, fmt.Errorf("failed to parse guest attribute: %w", err)
+	}
+	return state, nil
+}
+
+func (s *guestAttributeStore) Save(ctx context.Context, state notifierState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	// Without enable-guest-attributes the metadata server refuses the write
+	if err := s.client.Put(ctx, s.path, string(data)); err != nil {
+		return fmt.Errorf("failed to write guest attribute, is enable-guest-attributes set? %w", err)
+	}
+	return nil
+}
+
+// gcsStore keeps state in a GCS object.
+type gcsStore struct {
+	bucket string
+	object string
+	svc    *storage.Service
+}
+
+func newGCSStore(ctx context.Context, bucket, object string, opts ...option.ClientOption) (*gcsStore, error) {
+	opts = append([]option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}, opts...)
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage service: %w", err)
+	}
+	return &gcsStore{bucket: bucket, object: object, svc: svc}, nil
+}
+
+func (s *gcsStore) Load(ctx context.Context) (notifierState, error) {
+	var state notifierState
+	resp, err := s.svc.Objects.Get(s.bucket, s.object).Context(ctx).Download()
+	if isNotFound(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read gs://%s/%s: %w", s.bucket, s.object, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return state, fmt.Errorf("failed to read gs://%s/%s: %w", s.bucket, s.object, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse gs://%s/%s: %w", s.bucket, s.object, err)
+	}
+	return state, nil
+}
+
+func (s *gcsStore) Save(ctx context.Context, state notifierState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	obj := &storage.Object{Name: s.object, ContentType: "application/json"}
+	if _, err := s.svc.Objects.Insert(s.bucket, obj).Media(bytes.NewReader(data)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", s.bucket, s.object, err)
+	}
+	return nil
+}
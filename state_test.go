@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+
+	"spot-notifier-gcp/metadata"
+)
+
+func TestStateStoresRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(&fakeGCS{})
+	defer srv.Close()
+	gcs, err := newGCSStore(context.Background(), "bkt", "obj",
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := metadata.NewFake(nil)
+	defer meta.Close()
+
+	stores := map[string]StateStore{
+		"memory":           &memoryStore{},
+		"file":             &fileStore{path: filepath.Join(t.TempDir(), "state", "state.json")},
+		"guest-attributes": &guestAttributeStore{client: meta.Client(), path: guestAttributeState},
+		"gcs":              gcs,
+	}
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := notifierState{InstanceID: "123", Started: started, LastSent: map[EventKind]time.Time{EventPreempted: started}}
+	for name, store := range stores {
+		ctx := context.Background()
+		if got, err := store.Load(ctx); err != nil || got.InstanceID != "" || !got.Started.IsZero() || got.LastSent != nil {
+			t.Errorf("%s: Load before Save = %+v, %v; want the zero state", name, got, err)
+		}
+		if err := store.Save(ctx, want); err != nil {
+			t.Fatalf("%s: Save: %v", name, err)
+		}
+		if got, err := store.Load(ctx); err != nil || !got.Started.Equal(want.Started) || got.InstanceID != want.InstanceID || !got.LastSent[EventPreempted].Equal(started) {
+			t.Errorf("%s: Load = %+v, %v; want %+v", name, got, err, want)
+		}
+	}
+}
+
+func TestStartTimeFromSavedState(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	saved, created := now.Add(-5*time.Hour), now.Add(-8*time.Hour)
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		created time.Time
+		want    time.Time
+	}{
+		{"saved", write("saved.json", `{"instanceID":"123","started":"2024-01-01T19:00:00Z"}`), created, saved},
+		{"missing", filepath.Join(dir, "missing.json"), time.Time{}, now},
+		{"missing with creation time", filepath.Join(dir, "missing.json"), created, created},
+		{"stale", write("stale.json", `{"instanceID":"999","started":"2024-01-01T19:00:00Z"}`), time.Time{}, now},
+		{"corrupt", write("corrupt.json", `{"instanceID":`), created, created},
+		{"from the future", write("future.json", `{"instanceID":"123","started":"2030-01-01T00:00:00Z"}`), time.Time{}, now},
+	} {
+		state, _ := (&fileStore{path: tc.path}).Load(context.Background())
+		if got, _ := startTime(state, "123", tc.created, now); !got.Equal(tc.want) {
+			t.Errorf("%s: start time = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEndedRunStartsFresh(t *testing.T) {
+	for state, want := range map[lifecycleState]bool{
+		"":                  false,
+		StateMonitoring:     false,
+		StateApproachingTTL: false,
+		StateGracePeriod:    false,
+		StatePreempted:      true,
+		StateTerminated:     true,
+	} {
+		if got := (notifierState{Lifecycle: state}).ended(); got != want {
+			t.Errorf("ended() with lifecycle %q = %v, want %v", state, got, want)
+		}
+	}
+}
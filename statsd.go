@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStatsdPrefix = "spot_notifier"
+
+// stats is the StatsD emitter, nil unless STATSD_ADDR is set. Its methods
+// are no-ops on nil, so callers don't check.
+var stats *statsdClient
+
+// statsdClient sends metrics over UDP, fire-and-forget: a lost or
+// unreachable StatsD host never holds up the monitor.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   []string // DogStatsD tags for every metric; none for plain StatsD
+
+	warnOnce sync.Once
+}
+
+// newStatsdClient dials addr. With tags set (from STATSD_TAGS, e.g.
+// "env:prod,team:ml") metrics use the DogStatsD tag extension, which plain
+// StatsD servers don't understand.
+func newStatsdClient(addr, prefix string, tags []string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial StatsD: %w", err)
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: tags}, nil
+}
+
+// incr counts one occurrence of name.
+func (s *statsdClient) incr(name string, tags ...string) {
+	s.send(name, "1|c", tags)
+}
+
+// gauge records the current value of name.
+func (s *statsdClient) gauge(name string, value float64, tags ...string) {
+	s.send(name, fmt.Sprintf("%g|g", value), tags)
+}
+
+// timing records a duration in milliseconds.
+func (s *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()), tags)
+}
+
+func (s *statsdClient) send(name, value string, tags []string) {
+	if s == nil {
+		return
+	}
+	line := s.prefix + "." + name + ":" + value
+	if len(s.tags) > 0 {
+		line += "|#" + strings.Join(append(s.tags[:len(s.tags):len(s.tags)], tags...), ",")
+	}
+	// UDP writes don't wait on the receiver; one that fails is just lost
+	s.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		s.warnOnce.Do(func() { log.Printf("StatsD write failed, metrics may be missing: %v", err) })
+	}
+}
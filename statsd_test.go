@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdFormatsMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	read := func() string {
+		buf := make([]byte, 512)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	plain, err := newStatsdClient(pc.LocalAddr().String(), "sn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.incr("preemptions", "source:metadata")
+	if got := read(); got != "sn.preemptions:1|c" {
+		t.Errorf("plain StatsD line = %q", got)
+	}
+
+	dog, err := newStatsdClient(pc.LocalAddr().String(), "sn", []string{"env:prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dog.timing("grace_elapsed", 1500*time.Millisecond, "reason:ttl-expiry")
+	if got := read(); got != "sn.grace_elapsed:1500|ms|#env:prod,reason:ttl-expiry" {
+		t.Errorf("DogStatsD line = %q", got)
+	}
+
+	var off *statsdClient
+	off.gauge("uptime_seconds", 1) // must not panic
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatusAddr = "127.0.0.1:9000"
+	// statusShutdownTimeout bounds how long close waits for open requests
+	statusShutdownTimeout = 2 * time.Second
+)
+
+// statusReport is the /status document.
+type statusReport struct {
+	Instance            instanceInfo   `json:"instance"`
+	State               lifecycleState `json:"state,omitempty"`
+	Healthy             bool           `json:"healthy"`
+	UptimeSeconds       float64        `json:"uptimeSeconds"`
+	TerminateAfterHours float64        `json:"terminateAfterHours,omitempty"`
+	TimeLeftSeconds     *float64       `json:"timeLeftSeconds,omitempty"` // negative while a freeze defers the TTL
+	Preempted           bool           `json:"preempted"`
+	MaintenanceEvent    string         `json:"maintenanceEvent,omitempty"`
+	LastCheck           time.Time      `json:"lastCheck,omitzero"`
+	Time                time.Time      `json:"time"`
+}
+
+// statusServer serves the monitoring loop's state on STATUS_ADDR: /status
+// for dashboards, /metrics for Prometheus, and /healthz, which fails once
+// the VM is going away so a load balancer can drain it. The loop updates
+// it every poll while the handlers read it, hence the mutex. A nil server
+// ignores every update.
+type statusServer struct {
+	clock    Clock
+	instance instanceInfo
+	srv      *http.Server
+	addr     string // as bound, for STATUS_ADDR ports of 0
+	// traceID, if set, is the exemplar on the preemption counter, so a
+	// scrape leads to the trace the VM ran under
+	traceID string
+
+	mu             sync.Mutex
+	running        bool
+	state          lifecycleState
+	started        time.Time
+	terminateAfter time.Duration
+	preempted      bool
+	maintenance    string
+	lastCheck      time.Time
+	metadataErrors int
+	notifyFailures map[[2]string]int // by event kind and cause
+	preemptions    int
+	preemptedAt    time.Time // of the last one, for its exemplar
+}
+
+// startStatusServer listens on addr and serves in the background until
+// close.
+func startStatusServer(addr string, clock Clock, instance instanceInfo) (*statusServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s := &statusServer{clock: clock, instance: instance, addr: ln.Addr().String()}
+	s.srv = &http.Server{Handler: s.handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Status endpoint failed: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *statusServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.report())
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.report().Healthy {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		s.writeMetrics(w, openMetrics)
+	})
+	return mux
+}
+
+// observe records one poll of the loop. started and terminateAfter come
+// along since a reload or an extension can move the TTL.
+func (s *statusServer) observe(started time.Time, terminateAfter time.Duration, preempted bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	s.started, s.terminateAfter = started, terminateAfter
+	s.preempted = s.preempted || preempted
+	s.lastCheck = s.clock.Now()
+}
+
+// maintenanceEvent records the last maintenance event metadata reported.
+func (s *statusServer) maintenanceEvent(event string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maintenance = event
+}
+
+// metadataRead counts the metadata reads that failed.
+func (s *statusServer) metadataRead(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadataErrors++
+}
+
+// notifyFailed counts a backend failing to deliver an event, cause being
+// "timeout" or "error" as in the StatsD metric.
+func (s *statusServer) notifyFailed(kind EventKind, cause string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.notifyFailures == nil {
+		s.notifyFailures = map[[2]string]int{}
+	}
+	s.notifyFailures[[2]string{string(kind), cause}]++
+}
+
+// transition follows the lifecycle, to know when the VM starts going away.
+func (s *statusServer) transition(t transitionEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = t.To
+	if t.To == StatePreempted {
+		s.preemptions++
+		s.preemptedAt = t.Time
+	}
+}
+
+func (s *statusServer) report() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	r := statusReport{
+		Instance:         s.instance,
+		State:            s.state,
+		Preempted:        s.preempted,
+		MaintenanceEvent: s.maintenance,
+		LastCheck:        s.lastCheck,
+		Time:             now,
+	}
+	switch s.state {
+	case "", StateLaunched, StateMonitoring, StateApproachingTTL:
+		r.Healthy = s.running && !s.preempted
+	}
+	if !s.started.IsZero() {
+		uptime := now.Sub(s.started)
+		r.UptimeSeconds = uptime.Seconds()
+		if s.terminateAfter > 0 {
+			left := (s.terminateAfter - uptime).Seconds()
+			r.TerminateAfterHours, r.TimeLeftSeconds = s.terminateAfter.Hours(), &left
+		}
+	}
+	return r
+}
+
+// writeMetrics writes the report and counters in the Prometheus text
+// format, named like the StatsD metrics, or in OpenMetrics, which also
+// carries the preemption's exemplar.
+func (s *statusServer) writeMetrics(w io.Writer, openMetrics bool) {
+	r := s.report()
+	s.mu.Lock()
+	metadataErrors, preemptions, preemptedAt := s.metadataErrors, s.preemptions, s.preemptedAt
+	failures := make(map[[2]string]int, len(s.notifyFailures))
+	for k, n := range s.notifyFailures {
+		failures[k] = n
+	}
+	s.mu.Unlock()
+
+	metric := func(name, kind, help string) {
+		// OpenMetrics names a counter's family without the _total
+		if openMetrics && kind == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", defaultStatsdPrefix, name, help, defaultStatsdPrefix, name, kind)
+	}
+	value := func(name string, v float64, labels ...string) {
+		fmt.Fprintf(w, "%s_%s%s %g\n", defaultStatsdPrefix, name, promLabels(labels...), v)
+	}
+	bool01 := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	metric("info", "gauge", "The instance being watched.")
+	value("info", 1, "name", r.Instance.Name, "zone", r.Instance.Zone, "project", r.Instance.Project)
+	metric("uptime_seconds", "gauge", "Time since the instance started.")
+	value("uptime_seconds", r.UptimeSeconds)
+	if r.TimeLeftSeconds != nil {
+		metric("ttl_remaining_seconds", "gauge", "Time left before the TTL terminates the instance.")
+		value("ttl_remaining_seconds", *r.TimeLeftSeconds)
+	}
+	metric("preempted", "gauge", "Whether the instance has been preempted.")
+	value("preempted", bool01(r.Preempted))
+	metric("healthy", "gauge", "Whether /healthz passes.")
+	value("healthy", bool01(r.Healthy))
+	if !r.LastCheck.IsZero() {
+		metric("last_check_timestamp_seconds", "gauge", "When metadata was last checked.")
+		value("last_check_timestamp_seconds", float64(r.LastCheck.Unix()))
+	}
+	metric("preemptions_total", "counter", "Preemptions the notifier saw.")
+	if openMetrics && preemptions > 0 && s.traceID != "" {
+		fmt.Fprintf(w, "%s_preemptions_total %d %s\n", defaultStatsdPrefix, preemptions, exemplar(s.traceID, preemptedAt))
+	} else {
+		value("preemptions_total", float64(preemptions))
+	}
+	metric("metadata_errors_total", "counter", "Metadata reads that failed.")
+	value("metadata_errors_total", float64(metadataErrors))
+	metric("notify_failures_total", "counter", "Notifications a backend failed to deliver.")
+	for _, k := range slices.SortedFunc(maps.Keys(failures), func(a, b [2]string) int {
+		return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1])
+	}) {
+		value("notify_failures_total", float64(failures[k]), "kind", k[0], "cause", k[1])
+	}
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+// promLabels formats name, value pairs as a Prometheus label set.
+func promLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, pairs[i]+`="`+v+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// close fails /healthz from here on, then shuts the server down. It is
+// safe on a nil server.
+func (s *statusServer) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.running = false
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the status endpoint: %v", err)
+	}
+}
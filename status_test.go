@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusServerFollowsMonitor(t *testing.T) {
+	m, clock, _, _ := newTestMonitor(t)
+	status, err := startStatusServer("127.0.0.1:0", clock, instanceInfo{Name: "vm", Zone: "z", Project: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Status = status
+	m.Lifecycle = &lifecycle{clock: clock, send: status.transition}
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get("http://" + status.addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	var healthz []int
+	var midRun statusReport
+	m.Watchdog = func() {
+		healthz = append(healthz, get("/healthz").StatusCode)
+		if len(healthz) == 3 {
+			if err := json.NewDecoder(get("/status").Body).Decode(&midRun); err != nil {
+				t.Errorf("decoding /status: %v", err)
+			}
+		}
+	}
+
+	m.Run()
+
+	if midRun.Instance.Name != "vm" || midRun.State != StateMonitoring || !midRun.Healthy ||
+		midRun.TerminateAfterHours != 1 || midRun.TimeLeftSeconds == nil || *midRun.TimeLeftSeconds >= 3600 {
+		t.Errorf("/status mid-run = %+v", midRun)
+	}
+	if len(healthz) < 3 || healthz[2] != http.StatusOK || healthz[len(healthz)-1] != http.StatusServiceUnavailable {
+		t.Errorf("/healthz answered %v, want 200 while monitoring and 503 by the grace period", healthz)
+	}
+
+	status.close()
+	if _, err := http.Get("http://" + status.addr + "/healthz"); err == nil {
+		t.Error("status endpoint still up after close")
+	}
+}
+
+func TestStatusServerMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := &statusServer{clock: clock, instance: instanceInfo{Name: "vm", Zone: "z", Project: "p"}}
+	s.observe(clock.now.Add(-30*time.Minute), time.Hour, false)
+	s.metadataRead(errors.New("boom"))
+	s.metadataRead(nil)
+	s.notifyFailed(EventPreempted, "timeout")
+	s.notifyFailed(EventPreempted, "timeout")
+	s.notifyFailed(EventLaunched, "error")
+
+	var b strings.Builder
+	s.writeMetrics(&b, false)
+	for _, want := range []string{
+		`spot_notifier_info{name="vm",zone="z",project="p"} 1`,
+		"spot_notifier_uptime_seconds 1800\n",
+		"spot_notifier_ttl_remaining_seconds 1800\n",
+		"spot_notifier_preempted 0\n",
+		"spot_notifier_healthy 1\n",
+		"# TYPE spot_notifier_metadata_errors_total counter\nspot_notifier_metadata_errors_total 1\n",
+		"spot_notifier_preemptions_total 0\n",
+		`spot_notifier_notify_failures_total{kind="launched",cause="error"} 1`,
+		`spot_notifier_notify_failures_total{kind="preempted",cause="timeout"} 2`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestStatusServerOpenMetricsExemplar(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := &statusServer{clock: clock, traceID: traceID("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")}
+	s.observe(clock.now.Add(-time.Hour), 0, true)
+	s.transition(transitionEvent{To: StatePreempted, Time: clock.now})
+
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	get := func(accept string) (string, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	contentType, body := get("application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	if !strings.HasPrefix(contentType, "application/openmetrics-text") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("OpenMetrics scrape = %s:\n%s", contentType, body)
+	}
+	for _, want := range []string{
+		"# TYPE spot_notifier_preemptions counter\n",
+		`spot_notifier_preemptions_total 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 1 1735732800.000` + "\n",
+		"# TYPE spot_notifier_metadata_errors counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("OpenMetrics scrape missing %q:\n%s", want, body)
+		}
+	}
+
+	// Prometheus text has no exemplars
+	contentType, body = get("text/plain")
+	if !strings.HasPrefix(contentType, "text/plain") || strings.Contains(body, "trace_id") || strings.Contains(body, "# EOF") {
+		t.Errorf("text scrape = %s:\n%s", contentType, body)
+	}
+	if traceID("not-a-traceparent") != "" {
+		t.Error("traceID accepted a malformed traceparent")
+	}
+}
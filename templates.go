@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// instanceInfo is what we know about the VM we're running on.
+type instanceInfo struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	Zone        string `json:"zone"`
+	MachineType string `json:"machineType"`
+	Project     string `json:"project"`
+	// Labels come from the Compute API, when severity rules or Pub/Sub
+	// subscribers need them
+	Labels map[string]string `json:"labels,omitempty"`
+	// CorrelationID, with CORRELATION_ID, joins these events with other
+	// systems' records of the VM
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// messageData is the context every message template is rendered with.
+type messageData struct {
+	Instance          instanceInfo
+	Version           string
+	Config            []string // from resolvedConfig, with INCLUDE_CONFIG_IN_LAUNCH
+	Image             string   // boot disk image name
+	ImageFamily       string
+	ImageCreated      time.Time
+	TerminateAfter    time.Duration // zero for no TTL
+	SoftTTL           time.Duration // reminder only, zero when not set
+	TimeLeft          time.Duration // until the TTL, set for the early warning
+	GracePeriod       time.Duration
+	GraceElapsed      time.Duration     // how long the grace period actually lasted
+	GraceReason       TerminationReason // what the grace period was for, if a preemption cut it short
+	CanTerminate      bool
+	Reason            TerminationReason
+	MissingPermission string
+	DetectedVia       string
+	MaintenanceEvent  string
+	HealthFailures    int
+	HealthError       string
+	SpotPrice         float64 // last price seen, with MAX_SPOT_PRICE
+	MaxSpotPrice      float64
+	CompletionMarker  string        // the file that retired the VM
+	DrainStatus       string        // how DRAIN_COMMAND went, e.g. "exit status 0"
+	HookStatus        string        // how SHUTDOWN_HOOKS went, e.g. "drain: ok"
+	DetectionLatency  time.Duration // zero when there was no earlier check
+	PollInterval      time.Duration
+	SerialOutput      string   // tail of the serial console, when enabled
+	Snapshots         []string // taken before a TTL delete, with SNAPSHOT_DISKS_ON_TTL
+	// ProjectPreemptions counts preemptions across the project in the last
+	// PreemptionWindow, this one included; zero without a shared counter.
+	// The counter answers after the preemption alert has gone out.
+	ProjectPreemptions int
+	PreemptionWindow   time.Duration
+	// FamilyPreemptions is the same count for this machine type and zone,
+	// set only once it reaches FAMILY_PREEMPTION_THRESHOLD.
+	FamilyPreemptions int
+	// Org is where the project sits in the hierarchy, with INCLUDE_ORG_CONTEXT
+	Org orgContext
+	// ProvisioningModel is SPOT, PREEMPTIBLE or STANDARD, "" if unknown.
+	// ForcedStopAt is when GCP stops a PREEMPTIBLE VM regardless of TTL.
+	ProvisioningModel string
+	ForcedStopAt      time.Time
+	// ServiceAccount is the VM's default service account, "none" without one
+	ServiceAccount string
+	// PlacementIssues are what makes this Spot VM's placement unusual
+	PlacementIssues []string
+	// HourlyCost is the estimated Spot price in USD, with COST_ESTIMATE;
+	// CostSource says where it came from.
+	HourlyCost float64
+	CostSource string
+
+	// Started is when the TTL clock started. The fields after it are
+	// derived from it when a message is rendered; see at.
+	Started     time.Time
+	Now         time.Time
+	Elapsed     time.Duration
+	Remaining   time.Duration // zero once the TTL has passed, or without one
+	PercentUsed int           // of the TTL, capped at 100
+	TerminateAt time.Time     // when the TTL runs out, zero without one
+	AccruedCost float64       // HourlyCost over Elapsed
+}
+
+// at fills in the time-derived fields as of now.
+func (d messageData) at(now time.Time) messageData {
+	if d.Started.IsZero() {
+		return d
+	}
+	d.Now = now
+	d.Elapsed = now.Sub(d.Started)
+	d.AccruedCost = d.HourlyCost * d.Elapsed.Hours()
+	if d.TerminateAfter > 0 {
+		d.Remaining = max(d.TerminateAfter-d.Elapsed, 0)
+		d.TerminateAt = d.Started.Add(d.TerminateAfter)
+		d.PercentUsed = min(int(100*d.Elapsed/d.TerminateAfter), 100)
+	}
+	return d
+}
+
+// Message names double as the environment variable prefix for overrides,
+// e.g. LAUNCH_TEMPLATE or LAUNCH_TEMPLATE_FILE.
+const (
+	msgLaunch       = "launch"
+	msgPreempt      = "preempt"
+	msgWarn         = "warn"
+	msgSoftTTL      = "soft_ttl"
+	msgTerminate    = "terminate"
+	msgExecute      = "execute"
+	msgManual       = "manual"
+	msgUnhealthy    = "unhealthy"
+	msgPrice        = "price"
+	msgCompleted    = "completed"
+	msgMaintenance  = "maintenance"
+	msgMigrate      = "migrate"
+	msgNotSpot      = "not_spot"
+	msgGracePreempt = "grace_preempt"
+	msgPlacement    = "placement"
+	msgCost         = "cost"
+)
+
+// costSnippet appends the estimated spend so far, with COST_ESTIMATE.
+const costSnippet = "{{if .HourlyCost}}\nEstimated cost so far: {{usd .AccruedCost}} at {{usd .HourlyCost}}/h ({{.CostSource}}){{end}}"
+
+// serialSnippet appends the serial console tail when one was fetched.
+const serialSnippet = "{{if .SerialOutput}}\nRecent serial console output:\n```\n{{.SerialOutput}}\n```{{end}}"
+
+var defaultTemplates = map[string]string{
+	msgLaunch: "GCP Instance Started\n" +
+		"```\n" +
+		"Name: {{.Instance.Name}}\n" +
+		"ID: {{.Instance.ID}}\n" +
+		"Zone: {{.Instance.Zone}}\n" +
+		"Type: {{.Instance.MachineType}}\n" +
+		"Project: {{.Instance.Project}}{{with .Org.ProjectName}} ({{.}}){{end}}\n" +
+		"{{with .Org.Parent}}Parent: {{.}}{{with $.Org.ParentName}} ({{.}}){{end}}\n{{end}}" +
+		"{{with .ProvisioningModel}}Provisioning: {{.}}\n{{end}}" +
+		"{{with .ServiceAccount}}Service account: {{.}}\n{{end}}" +
+		"{{with .Image}}Image: {{.}}{{with $.ImageFamily}} (family {{.}}){{end}}{{if not $.ImageCreated.IsZero}}, created {{$.ImageCreated.Format \"2006-01-02\"}}{{end}}\n{{end}}" +
+		"Stop after: {{if .TerminateAfter}}{{duration .TerminateAfter}}{{else}}never (no automatic termination configured, preemption monitoring only){{end}}\n" +
+		"{{if eq .ProvisioningModel \"PREEMPTIBLE\"}}Note: GCP will force-stop this preemptible VM within 24h of starting{{with .ForcedStopAt}} (by {{.Format \"2006-01-02 15:04 MST\"}}){{end}}, regardless of TTL\n{{end}}" +
+		"Notifier: {{.Version}}\n" +
+		"{{with .Config}}Config:\n{{range .}}  {{.}}\n{{end}}{{end}}" +
+		"```\n",
+
+	msgPreempt: "🚨 Instance `{{.Instance.Name}}` (`{{.Instance.MachineType}}`) in `{{.Instance.Zone}}` is being PREEMPTED by GCP (detected via {{.DetectedVia}})" +
+		"{{if eq .ProvisioningModel \"PREEMPTIBLE\"}}\nLegacy preemptible VMs are also stopped once they have run for 24h{{end}}" +
+		"{{if .DetectionLatency}}\nDetected within {{.DetectionLatency}} of the previous check (poll interval {{.PollInterval}}){{end}}" +
+		"{{if not .CanTerminate}}\nThe notifier lacks `{{.MissingPermission}}`, but no manual cleanup is needed: GCP reclaims the VM itself{{end}}" +
+		serialSnippet,
+
+	msgWarn: "⏳ Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` reaches its uptime limit of {{duration .TerminateAfter}} in {{duration .TimeLeft}}" +
+		costSnippet,
+
+	msgSoftTTL: "⏰ Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` has been up for {{duration .SoftTTL}}, its intended lifetime. " +
+		"{{if .TerminateAfter}}It will be terminated at the hard limit of {{duration .TerminateAfter}}, in {{duration .Remaining}}" +
+		"{{else}}Nothing will terminate it automatically{{end}}",
+
+	msgTerminate: "{{if .CanTerminate}}" +
+		"Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` crossed uptime threshold. Will stop in {{.GracePeriod}}" +
+		"{{else}}" +
+		"⚠️ Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` crossed uptime threshold but the notifier lacks `{{.MissingPermission}}`. " +
+		"It will NOT stop by itself, manual cleanup required" +
+		"{{end}}" +
+		costSnippet +
+		serialSnippet,
+
+	msgManual: "🛑 Termination of instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` was requested. " +
+		"{{if .GracePeriod}}Will stop in {{.GracePeriod}}{{else}}Stopping now{{end}}" +
+		"{{if not .CanTerminate}}, but the notifier lacks `{{.MissingPermission}}` so manual cleanup is required{{end}}",
+
+	msgUnhealthy: "🩺 Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` failed {{.HealthFailures}} health checks in a row ({{.HealthError}}). " +
+		"{{if .CanTerminate}}Will stop in {{.GracePeriod}}{{else}}The notifier lacks `{{.MissingPermission}}`, manual cleanup required{{end}}",
+
+	msgPrice: "💸 The Spot price of `{{.Instance.MachineType}}` in `{{.Instance.Zone}}` is {{.SpotPrice}}, over the {{.MaxSpotPrice}} limit. " +
+		"{{if .CanTerminate}}Instance `{{.Instance.Name}}` will stop in {{.GracePeriod}}{{else}}The notifier lacks `{{.MissingPermission}}`, manual cleanup required{{end}}",
+
+	msgCompleted: "✅ The workload on instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` finished ({{.CompletionMarker}} appeared) after {{duration .Elapsed}}. " +
+		"{{if .CanTerminate}}Will stop in {{.GracePeriod}}{{else}}The notifier lacks `{{.MissingPermission}}`, manual cleanup required{{end}}",
+
+	msgGracePreempt: "🚨 Instance `{{.Instance.Name}}` (`{{.Instance.MachineType}}`) in `{{.Instance.Zone}}` was PREEMPTED by GCP {{duration .GraceElapsed}} into " +
+		"its {{duration .GracePeriod}} grace period (detected via {{.DetectedVia}}), cutting the {{.GraceReason}} termination short",
+
+	msgMaintenance: "🚨 Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` will be terminated for host maintenance (`{{.MaintenanceEvent}}`)",
+
+	msgMigrate: "🔄 Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` is being live-migrated for host maintenance (`{{.MaintenanceEvent}}`), it keeps running",
+
+	msgNotSpot: "⚠️ Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` is not a Spot or preemptible VM, so preemption monitoring is disabled" +
+		"{{if .TerminateAfter}}. It will still stop after {{duration .TerminateAfter}}{{end}}",
+
+	msgPlacement: "⚠️ Instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` is a {{.ProvisioningModel}} VM but may not be interrupted like one:" +
+		"{{range .PlacementIssues}}\n- {{.}}{{end}}",
+
+	msgExecute: "Grace period is over after {{duration .GraceElapsed}}, terminating instance `{{.Instance.Name}}` in `{{.Instance.Zone}}` now" +
+		"{{with .Snapshots}}\nDisks were snapshotted first, restore from:{{range .}}\n- `{{.}}`{{end}}{{end}}" +
+		"{{with .DrainStatus}}\nDrain command: {{.}}{{end}}" +
+		"{{with .HookStatus}}\nShutdown hooks: {{.}}{{end}}" +
+		costSnippet,
+
+	msgCost: "💰 Instance `{{.Instance.Name}}` (`{{.Instance.MachineType}}`) in `{{.Instance.Zone}}` has been up for {{duration .Elapsed}}, " +
+		"costing an estimated {{usd .AccruedCost}} so far at {{usd .HourlyCost}}/h ({{.CostSource}})" +
+		"{{if .TerminateAfter}}. It stops in {{duration .Remaining}}{{else}}. Nothing will stop it automatically{{end}}",
+}
+
+// templateFuncs are available to every message template.
+var templateFuncs = template.FuncMap{
+	"duration": formatDuration,
+	"ordinal":  ordinal,
+	"usd":      formatUSD,
+}
+
+// ordinal formats n as "1st", "2nd", "3rd", "4th", ...
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// messageTemplates holds the parsed template for each message.
+type messageTemplates map[string]*template.Template
+
+// loadTemplates parses the built-in templates, replacing any that are
+// overridden by <NAME>_TEMPLATE (inline), <NAME>_TEMPLATE_FILE (path) or
+// <name>.tmpl in TEMPLATE_DIR, in that order.
+func loadTemplates() (messageTemplates, error) {
+	dir := os.Getenv("TEMPLATE_DIR")
+	if dir != "" {
+		if err := checkTemplateDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpls := messageTemplates{}
+	for name, text := range defaultTemplates {
+		env := strings.ToUpper(name) + "_TEMPLATE"
+		source := env
+		if inline := os.Getenv(env); inline != "" {
+			text = inline
+		} else if file := os.Getenv(env + "_FILE"); file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s_FILE: %w", env, err)
+			}
+			text = string(data)
+		} else if dir != "" {
+			path := filepath.Join(dir, name+".tmpl")
+			data, err := os.ReadFile(path)
+			if err == nil {
+				text, source = string(data), path
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read template: %w", err)
+			}
+		}
+
+		t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", source, err)
+		}
+		tmpls[name] = t
+	}
+	return tmpls, nil
+}
+
+// checkTemplateDir makes sure TEMPLATE_DIR can be read and warns about
+// .tmpl files that don't match any message, which are most likely typos.
+func checkTemplateDir(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("invalid TEMPLATE_DIR: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return fmt.Errorf("invalid TEMPLATE_DIR: %w", err)
+	}
+	for _, f := range files {
+		if _, ok := defaultTemplates[strings.TrimSuffix(filepath.Base(f), ".tmpl")]; !ok {
+			log.Printf("WARNING: ignoring %s, which doesn't match any message", f)
+		}
+	}
+	log.Printf("Loading message templates from %s (%d files)", dir, len(files))
+	return nil
+}
+
+// render executes the named template. A template that fails at runtime
+// falls back to the built-in one so the notification still goes out.
+func (m messageTemplates) render(name string, data messageData) string {
+	var buf bytes.Buffer
+	err := m[name].Execute(&buf, data)
+	if err == nil {
+		return buf.String()
+	}
+	log.Printf("Failed to render %s template, using default: %v", name, err)
+
+	buf.Reset()
+	template.Must(template.New(name).Funcs(templateFuncs).Parse(defaultTemplates[name])).Execute(&buf, data)
+	return buf.String()
+}
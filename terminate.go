@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	deleteAttempts = 3
+	deleteBackoff  = 2 * time.Second
+	// deleteRetryBudget caps the total time one step spends backing off
+	deleteRetryBudget = time.Minute
+
+	deletePermission = "compute.instances.delete"
+)
+
+// errInsufficientScope marks Compute calls refused because of the VM's
+// access scopes, which no IAM grant can fix.
+var errInsufficientScope = errors.New("the VM's access scopes don't allow Compute Engine API calls: " +
+	"recreate the VM with the compute scope (--scopes=compute-rw or cloud-platform), " +
+	"or run the notifier as a service account whose credentials aren't scope-limited")
+
+// errZoneNotAllowed marks a termination refused by TERMINATION_ALLOWED_REGIONS.
+var errZoneNotAllowed = errors.New("zone is not in TERMINATION_ALLOWED_REGIONS, refusing to terminate")
+
+// errIdentityMismatch marks a self-termination refused because the API's
+// instance ID doesn't match metadata's, so the delete could hit another VM.
+var errIdentityMismatch = errors.New("instance ID does not match metadata, refusing to terminate")
+
+// errQuotaExceeded marks Compute calls refused by a project quota or rate
+// limit, which waiting or a quota increase fixes, not IAM.
+var errQuotaExceeded = errors.New("the project is over a Compute Engine API quota: " +
+	"wait for the per-minute limit to reset, or request more at https://console.cloud.google.com/iam-admin/quotas")
+
+// TerminationResult says what Terminate actually did.
+type TerminationResult int
+
+const (
+	// ResultTerminated means the termination steps ran.
+	ResultTerminated TerminationResult = iota
+	// ResultAlreadyStopping means the instance was already going away
+	// (e.g. being preempted, or another delete in progress), so the steps
+	// were skipped.
+	ResultAlreadyStopping
+	// ResultAlreadyGone means the instance no longer existed.
+	ResultAlreadyGone
+	// ResultGaveUp means a step kept failing with transient errors until the
+	// retries ran out; the error says which.
+	ResultGaveUp
+	// ResultDryRun means nothing was done because of --dry-run.
+	ResultDryRun
+)
+
+// stoppingStatuses are instance states in which deleting again is pointless.
+var stoppingStatuses = map[string]bool{
+	"STOPPING":   true,
+	"SUSPENDING": true,
+	"SUSPENDED":  true,
+	"TERMINATED": true,
+}
+
+// Terminator removes the VM once the notifier decides it has to go.
+// It is an interface so the termination path can be exercised without GCP.
+type Terminator interface {
+	Terminate(ctx context.Context, projectID, zone, instanceName string) (TerminationResult, error)
+}
+
+// reasonTerminator is a Terminator that can record why it terminates, as
+// the labels on a stopped or suspended VM do.
+type reasonTerminator interface {
+	TerminateFor(ctx context.Context, reason TerminationReason, projectID, zone, instanceName string) (TerminationResult, error)
+}
+
+// operationWarner is a Terminator whose API operations can succeed with
+// warnings worth passing on, such as resources it didn't clean up.
+type operationWarner interface {
+	OperationWarnings() []string
+}
+
+// actionDescriber is a Terminator that can say what terminating does.
+type actionDescriber interface {
+	Action() string
+}
+
+// instanceChecker is a Terminator that can tell whether the instance is
+// gone, to stop escalating a failed termination once it is.
+type instanceChecker interface {
+	InstanceExists(ctx context.Context, projectID, zone, instanceName string) (bool, error)
+}
+
+// diskSnapshotter is a Terminator that can snapshot the instance's disks
+// ahead of terminating it.
+type diskSnapshotter interface {
+	SnapshotDisks(ctx context.Context, projectID, zone, instanceName string) ([]string, error)
+}
+
+// computeTerminator deletes the VM using the Google Compute Engine API.
+type computeTerminator struct {
+	opts     []option.ClientOption
+	svc      *compute.Service
+	steps    []string // names from terminationSteps, run in order
+	attempts int
+	backoff  time.Duration
+	// minCallInterval spaces out identical API calls; zero disables it
+	minCallInterval time.Duration
+
+	// dryRun logs the steps instead of calling the API
+	dryRun bool
+	// forceWhenStopping runs the steps even if the instance is already stopping
+	forceWhenStopping bool
+	// allowedRegions, if set, are the only regions or zones it will touch
+	allowedRegions []string
+	// self, if its ID is set, is this VM: terminating it first checks that
+	// the API agrees on the ID
+	self instanceInfo
+	// snapshotTimeout bounds snapshotting the disks, whether as a step or
+	// through SnapshotDisks
+	snapshotTimeout time.Duration
+
+	warnings []string // from the last Terminate's operations
+}
+
+// OperationWarnings returns the warnings raised by the operations of the
+// last Terminate call.
+func (t *computeTerminator) OperationWarnings() []string {
+	return t.warnings
+}
+
+// newComputeTerminator returns a Terminator backed by the Compute API.
+// Extra client options are appended to the defaults, which lets tests
+// point the client at a fake endpoint.
+func newComputeTerminator(opts ...option.ClientOption) *computeTerminator {
+	return &computeTerminator{
+		opts:     append([]option.ClientOption{option.WithScopes(compute.ComputeScope)}, opts...),
+		steps:    []string{"delete"},
+		attempts: deleteAttempts,
+		backoff:  deleteBackoff,
+
+		minCallInterval: defaultMinCallInterval,
+		snapshotTimeout: defaultSnapshotTimeout,
+	}
+}
+
+// service returns the Compute client, creating it on first use.
+func (t *computeTerminator) service(ctx context.Context) (*compute.Service, error) {
+	if t.svc != nil {
+		return t.svc, nil
+	}
+
+	// Create Compute Service
+	// Ensure the VM's Service Account has "Compute Instance Admin" role
+	opts := t.opts
+	if t.minCallInterval > 0 {
+		// Throttle underneath the auth layer, so credentials still apply
+		base := newThrottleTransport(http.DefaultTransport, t.minCallInterval)
+		rt, err := htransport.NewTransport(ctx, base, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compute transport: %w", err)
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: rt}))
+	}
+	computeService, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute service: %w", err)
+	}
+	t.svc = computeService
+	return computeService, nil
+}
+
+// connect creates the Compute client up front, retrying with exponential
+// backoff capped at maxBackoff. Right after boot the metadata-based
+// credentials may not be ready yet, so a single failure isn't final.
+func (t *computeTerminator) connect(ctx context.Context, attempts int, maxBackoff time.Duration) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		_, err := t.service(ctx)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+
+		log.Printf("Compute client attempt %d failed, retrying in %v: %v", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// Terminate terminates the instance for its TTL, which is what the fleet
+// watcher deletes for.
+func (t *computeTerminator) Terminate(ctx context.Context, projectID, zone, instanceName string) (TerminationResult, error) {
+	return t.TerminateFor(ctx, ReasonTTLExpiry, projectID, zone, instanceName)
+}
+
+// TerminateFor runs the configured termination steps (by default a plain
+// delete), retrying transient server errors. An instance that no longer
+// exists is treated as successfully stopped or deleted, and one that is
+// already stopping is left alone unless forceWhenStopping is set.
+func (t *computeTerminator) TerminateFor(ctx context.Context, reason TerminationReason, projectID, zone, instanceName string) (TerminationResult, error) {
+	if !t.zoneAllowed(zone) {
+		return ResultTerminated, fmt.Errorf("%s: %w", zone, errZoneNotAllowed)
+	}
+	if t.dryRun {
+		log.Printf("Dry run: would %s instance %s in %s", t.Action(), instanceName, zone)
+		return ResultDryRun, nil
+	}
+
+	computeService, err := t.service(ctx)
+	if err != nil {
+		return ResultTerminated, err
+	}
+
+	// A TTL deadline can race a preemption; don't pile a delete onto it
+	verify := t.self.ID != "" && zone == t.self.Zone && instanceName == t.self.Name
+	if !t.forceWhenStopping || verify {
+		inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+		switch {
+		case isNotFound(err):
+			return ResultAlreadyGone, nil
+		case err != nil && verify:
+			return ResultTerminated, fmt.Errorf("failed to verify instance identity: %w", explainQuota(explainScope(err)))
+		case err != nil:
+			log.Printf("Failed to get instance status, proceeding anyway: %v", err)
+		case verify && strconv.FormatUint(inst.Id, 10) != t.self.ID:
+			return ResultTerminated, fmt.Errorf("%s in %s has ID %d, metadata says %s: %w", instanceName, zone, inst.Id, t.self.ID, errIdentityMismatch)
+		case t.forceWhenStopping:
+		case stoppingStatuses[inst.Status]:
+			log.Printf("Instance %s is already %s, skipping termination", instanceName, inst.Status)
+			return ResultAlreadyStopping, nil
+		}
+	}
+
+	t.warnings = nil
+	for _, name := range t.steps {
+		step := terminationSteps[name]
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < step.minTime {
+			log.Printf("Only %v left, skipping the %s step", time.Until(deadline).Truncate(time.Second), name)
+			continue
+		}
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if name == "snapshot" {
+			stepCtx, cancel = context.WithTimeout(ctx, t.snapshotTimeout)
+		}
+		err := t.retry(stepCtx, name, func() error {
+			warnings, err := step.run(stepCtx, computeService, projectID, zone, instanceName, reason)
+			for _, w := range warnings {
+				log.Printf("%s operation warning: %s", name, w)
+			}
+			t.warnings = append(t.warnings, warnings...)
+			return err
+		})
+		cancel()
+		switch {
+		case step.goneOK && isNotFound(err):
+			return ResultAlreadyGone, nil
+		case step.goneOK && isNotReady(err):
+			log.Printf("Instance %s is busy with another operation, assuming it is already being deleted", instanceName)
+			return ResultAlreadyStopping, nil
+		case isRetryable(err):
+			return ResultGaveUp, fmt.Errorf("failed to %s instance: %w", name, explainQuota(err))
+		case err != nil:
+			return ResultTerminated, fmt.Errorf("failed to %s instance: %w", name, explainQuota(explainScope(err)))
+		}
+	}
+	return ResultTerminated, nil
+}
+
+// Action says what Terminate does, e.g. "snapshot then delete".
+func (t *computeTerminator) Action() string {
+	return strings.Join(t.steps, " then ")
+}
+
+// zoneAllowed reports whether zone, or its region, is in allowedRegions.
+// Without an allowlist every zone is.
+func (t *computeTerminator) zoneAllowed(zone string) bool {
+	return len(t.allowedRegions) == 0 || slices.Contains(t.allowedRegions, zone) || slices.Contains(t.allowedRegions, regionOf(zone))
+}
+
+// InstanceExists reports whether the instance is still there; only a 404
+// counts as gone.
+func (t *computeTerminator) InstanceExists(ctx context.Context, projectID, zone, instanceName string) (bool, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, err = svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	return true, nil
+}
+
+// SnapshotDisks snapshots the instance's persistent disks, waits for the
+// snapshots to finish and returns their paths.
+func (t *computeTerminator) SnapshotDisks(ctx context.Context, projectID, zone, instanceName string) ([]string, error) {
+	if t.dryRun {
+		log.Printf("Dry run: would snapshot the disks of instance %s in %s", instanceName, zone)
+		return nil, nil
+	}
+	svc, err := t.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.snapshotTimeout)
+	defer cancel()
+	snapshots, warnings, err := createSnapshots(ctx, svc, projectID, zone, instanceName)
+	for _, w := range warnings {
+		log.Printf("snapshot operation warning: %s", w)
+	}
+	return snapshots, err
+}
+
+// instanceLabels returns the labels set on the instance.
+func (t *computeTerminator) instanceLabels(ctx context.Context, projectID, zone, instanceName string) (map[string]string, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	return inst.Labels, nil
+}
+
+// instanceCreated returns when the instance was created.
+func (t *computeTerminator) instanceCreated(ctx context.Context, projectID, zone, instanceName string) (time.Time, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	created, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid creation timestamp %q: %w", inst.CreationTimestamp, err)
+	}
+	return created, nil
+}
+
+// machineShape looks up the vCPUs and memory of a machine type whose name
+// doesn't say.
+func (t *computeTerminator) machineShape(ctx context.Context, projectID, zone, machineType string) (machineShape, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return machineShape{}, err
+	}
+	mt, err := svc.MachineTypes.Get(projectID, zone, machineType).Context(ctx).Do()
+	if err != nil {
+		return machineShape{}, fmt.Errorf("failed to get machine type: %w", explainScope(err))
+	}
+	family, _, _ := strings.Cut(machineType, "-")
+	return machineShape{family: family, cpus: float64(mt.GuestCpus), memory: float64(mt.MemoryMb) / 1024}, nil
+}
+
+// configuredAction returns the termination step matching the instance's own
+// scheduling.instanceTerminationAction ("stop" or "delete"), or "" when the
+// instance doesn't set one.
+func (t *computeTerminator) configuredAction(ctx context.Context, projectID, zone, instanceName string) (string, error) {
+	svc, err := t.service(ctx)
+	if err != nil {
+		return "", err
+	}
+	inst, err := svc.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get instance: %w", explainScope(err))
+	}
+	if inst.Scheduling == nil {
+		return "", nil
+	}
+	switch inst.Scheduling.InstanceTerminationAction {
+	case "STOP":
+		return "stop", nil
+	case "DELETE":
+		return "delete", nil
+	}
+	return "", nil
+}
+
+// retry calls fn until it succeeds, fails permanently, or runs out of
+// attempts or of deleteRetryBudget.
+func (t *computeTerminator) retry(ctx context.Context, what string, fn func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		// Back off exponentially so rate-limited callers actually slow down,
+		// with jitter so a fleet preempted together doesn't retry in lockstep
+		wait := t.backoff << (attempt - 1)
+		if wait > 0 {
+			wait += rand.N(wait / 2)
+		}
+		if attempt >= t.attempts || time.Since(start)+wait > deleteRetryBudget {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("%s attempt %d failed, retrying in %v: %v", what, attempt, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// canTerminate asks IAM whether our credentials hold the instance-level
+// permissions the termination steps need. It returns the first one missing.
+func (t *computeTerminator) canTerminate(ctx context.Context, projectID, zone, instanceName string) (bool, string, error) {
+	computeService, err := t.service(ctx)
+	if err != nil {
+		return false, "", err
+	}
+
+	var wanted []string
+	for _, name := range t.steps {
+		if p := terminationSteps[name].permission; p != "" {
+			wanted = append(wanted, p)
+		}
+	}
+	if len(wanted) == 0 {
+		return true, "", nil
+	}
+
+	req := &compute.TestPermissionsRequest{Permissions: wanted}
+	resp, err := computeService.Instances.TestIamPermissions(projectID, zone, instanceName, req).Context(ctx).Do()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to test permissions: %w", explainScope(err))
+	}
+	granted := make(map[string]bool, len(resp.Permissions))
+	for _, p := range resp.Permissions {
+		granted[p] = true
+	}
+	for _, p := range wanted {
+		if !granted[p] {
+			return false, p, nil
+		}
+	}
+	return true, "", nil
+}
+
+// isNotFound reports whether err is a 404 from a Google API.
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// isNotReady reports whether Compute refused the call because another
+// operation, such as a delete already under way, holds the instance.
+func isNotReady(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "resourceNotReady" {
+			return true
+		}
+	}
+	return false
+}
+
+// isScopeError reports whether err is a 403 caused by the access token's
+// scopes rather than by missing IAM permissions.
+func isScopeError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	if strings.Contains(apiErr.Body, "ACCESS_TOKEN_SCOPE_INSUFFICIENT") ||
+		strings.Contains(apiErr.Message, "insufficient authentication scopes") {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "insufficientPermissions" {
+			return true
+		}
+	}
+	return false
+}
+
+// explainScope wraps a scope error with errInsufficientScope, which says
+// how to fix it; other errors are returned as they are.
+func explainScope(err error) error {
+	if isScopeError(err) {
+		return fmt.Errorf("%w: %w", errInsufficientScope, err)
+	}
+	return err
+}
+
+// isQuotaError reports whether err is a Google API quota or rate limit
+// failure. Compute reports per-minute limits as 403s with a reason.
+func isQuotaError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests || strings.Contains(apiErr.Body, "RATE_LIMIT_EXCEEDED") {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		switch e.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// explainQuota wraps a quota error with errQuotaExceeded; other errors are
+// returned as they are.
+func explainQuota(err error) error {
+	if isQuotaError(err) {
+		return fmt.Errorf("%w: %w", errQuotaExceeded, err)
+	}
+	return err
+}
+
+// isRetryable reports whether err is a transient server-side failure or a
+// rate limit.
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code >= http.StatusInternalServerError || apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	// Compute reports quota-per-minute limits as 403 with a rate limit reason
+	for _, e := range apiErr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
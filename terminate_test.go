@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// fakeCompute is a stand-in for the Compute API. Instance reads report
+// instanceStatus; every other request is recorded and answered with the
+// next status code from a scripted sequence.
+type fakeCompute struct {
+	mu             sync.Mutex
+	instanceStatus string
+	statuses       []int
+	requests       []*http.Request
+	opWarning      string // returned on every operation, if set
+	instanceID     uint64
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodGet {
+		status := f.instanceStatus
+		if status == "" {
+			status = "RUNNING"
+		}
+		fmt.Fprintf(w, `{"name":"vm","id":"%d","status":%q}`, f.instanceID, status)
+		return
+	}
+
+	f.requests = append(f.requests, r)
+	status := http.StatusOK
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		if f.opWarning != "" {
+			fmt.Fprintf(w, `{"name":"operation-1","status":"RUNNING","warnings":[{"code":"WARN","message":%q}]}`, f.opWarning)
+			return
+		}
+		w.Write([]byte(`{"name":"operation-1","status":"RUNNING"}`))
+		return
+	}
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, http.StatusText(status))
+}
+
+func newFakeTerminator(t *testing.T, statuses ...int) (*computeTerminator, *fakeCompute) {
+	t.Helper()
+	fake := &fakeCompute{statuses: statuses}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.backoff, term.minCallInterval = 0, 0
+	return term, fake
+}
+
+func TestTerminateDeletesInstance(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-a", "my-vm"); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(fake.requests))
+	}
+	req := fake.requests[0]
+	if req.Method != http.MethodDelete {
+		t.Errorf("method = %s, want DELETE", req.Method)
+	}
+	if want := "/projects/my-project/zones/us-central1-a/instances/my-vm"; req.URL.Path != want {
+		t.Errorf("path = %s, want %s", req.URL.Path, want)
+	}
+}
+
+func TestTerminateRetriesOnServiceUnavailable(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+
+	if _, err := term.Terminate(context.Background(), "p", "z", "vm"); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if len(fake.requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(fake.requests))
+	}
+}
+
+func TestTerminateRetriesOnRateLimit(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusTooManyRequests, http.StatusOK)
+
+	if _, err := term.Terminate(context.Background(), "p", "z", "vm"); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Errorf("got %d requests, want 2", len(fake.requests))
+	}
+}
+
+func TestTerminateGivesUpAfterMaxAttempts(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+
+	result, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if err == nil {
+		t.Fatal("Terminate succeeded, want error after exhausting retries")
+	}
+	if result != ResultGaveUp {
+		t.Errorf("result = %v, want ResultGaveUp", result)
+	}
+	if len(fake.requests) != deleteAttempts {
+		t.Errorf("got %d requests, want %d", len(fake.requests), deleteAttempts)
+	}
+}
+
+func TestTerminateGivesUpPastRetryBudget(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusServiceUnavailable, http.StatusOK)
+	term.backoff = deleteRetryBudget + time.Second
+
+	result, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if err == nil || result != ResultGaveUp {
+		t.Fatalf("Terminate = %v, %v, want ResultGaveUp with an error", result, err)
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("got %d requests, want 1: waiting would overrun the budget", len(fake.requests))
+	}
+}
+
+func TestTerminateTreatsNotFoundAsSuccess(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusNotFound)
+
+	result, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if err != nil {
+		t.Fatalf("Terminate returned error for 404: %v", err)
+	}
+	if result != ResultAlreadyGone {
+		t.Errorf("result = %v, want ResultAlreadyGone", result)
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(fake.requests))
+	}
+}
+
+func TestTerminateDoesNotRetryClientErrors(t *testing.T) {
+	term, fake := newFakeTerminator(t, http.StatusForbidden)
+
+	if _, err := term.Terminate(context.Background(), "p", "z", "vm"); err == nil {
+		t.Fatal("Terminate succeeded, want error for 403")
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(fake.requests))
+	}
+}
+
+func TestTerminateExplainsInsufficientScope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":{"code":403,"message":"Request had insufficient authentication scopes.",` +
+			`"errors":[{"message":"Insufficient Permission","reason":"insufficientPermissions"}]}}`))
+	}))
+	defer srv.Close()
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.backoff, term.minCallInterval, term.forceWhenStopping = 0, 0, true
+
+	_, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if !errors.Is(err, errInsufficientScope) {
+		t.Errorf("err = %v, want errInsufficientScope", err)
+	}
+
+	// A plain IAM denial is not a scope problem
+	plain, _ := newFakeTerminator(t, http.StatusForbidden)
+	if _, err := plain.Terminate(context.Background(), "p", "z", "vm"); errors.Is(err, errInsufficientScope) {
+		t.Errorf("IAM denial reported as a scope error: %v", err)
+	}
+}
+
+func TestTerminateExplainsQuotaExceeded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":{"code":403,"message":"Quota exceeded for quota metric 'Queries'.",` +
+			`"errors":[{"message":"Quota exceeded","reason":"rateLimitExceeded"}]}}`))
+	}))
+	defer srv.Close()
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.backoff, term.minCallInterval, term.forceWhenStopping = 0, 0, true
+
+	_, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if !errors.Is(err, errQuotaExceeded) || errors.Is(err, errInsufficientScope) {
+		t.Errorf("err = %v, want errQuotaExceeded", err)
+	}
+	if !strings.Contains(err.Error(), "failed to delete instance") {
+		t.Errorf("err = %v, want the failed operation named", err)
+	}
+}
+
+func TestTerminateRefusesZonesOutsideAllowedRegions(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.allowedRegions = []string{"europe-west1", "us-central1-a"}
+
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-b", "my-vm"); !errors.Is(err, errZoneNotAllowed) {
+		t.Fatalf("err = %v, want errZoneNotAllowed", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("made %d requests for a refused zone", len(fake.requests))
+	}
+	for _, zone := range []string{"us-central1-a", "europe-west1-c"} {
+		if _, err := term.Terminate(context.Background(), "my-project", zone, "my-vm"); err != nil {
+			t.Errorf("%s: %v", zone, err)
+		}
+	}
+}
+
+func TestTerminateVerifiesOwnIdentity(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.forceWhenStopping = true
+	term.self = instanceInfo{Name: "my-vm", Zone: "us-central1-a", ID: "1234"}
+	fake.instanceID = 5678
+
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-a", "my-vm"); !errors.Is(err, errIdentityMismatch) {
+		t.Fatalf("err = %v, want errIdentityMismatch", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("made %d requests despite the mismatch", len(fake.requests))
+	}
+	// Only this VM is checked, not the group siblings deleted by name
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-a", "my-vm-2"); err != nil {
+		t.Errorf("sibling: %v", err)
+	}
+	fake.instanceID = 1234
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-a", "my-vm"); err != nil {
+		t.Errorf("matching ID: %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Errorf("got %d delete requests, want 2", len(fake.requests))
+	}
+}
+
+func TestTerminateDryRunMakesNoCalls(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.dryRun = true
+
+	result, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if err != nil || result != ResultDryRun {
+		t.Fatalf("Terminate = %v, %v, want ResultDryRun", result, err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("got %d requests in a dry run, want none", len(fake.requests))
+	}
+}
+
+func TestParseTerminationStepsAcceptsSuspend(t *testing.T) {
+	steps, err := parseTerminationSteps("snapshot, Suspend")
+	if err != nil || strings.Join(steps, ",") != "snapshot,suspend" {
+		t.Errorf("parseTerminationSteps = %v, %v", steps, err)
+	}
+	if p := terminationSteps["suspend"].permission; p != "compute.instances.suspend" {
+		t.Errorf("suspend needs %q", p)
+	}
+}
+
+func TestTerminateSkipsInstanceAlreadyStopping(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	fake.instanceStatus = "STOPPING"
+
+	result, err := term.Terminate(context.Background(), "p", "z", "vm")
+	if err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if result != ResultAlreadyStopping {
+		t.Errorf("result = %v, want ResultAlreadyStopping", result)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("got %d delete requests, want none", len(fake.requests))
+	}
+}
+
+func TestControllerTerminatorPostsRequest(t *testing.T) {
+	mockMetadataFile = "true" // no identity token in mock mode
+	t.Cleanup(func() { mockMetadataFile = "" })
+
+	var got terminationRequest
+	status := http.StatusAccepted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := &controllerTerminator{url: srv.URL}
+	if res, err := c.Terminate(context.Background(), "p", "z", "vm"); err != nil || res != ResultTerminated {
+		t.Fatalf("Terminate = %v, %v", res, err)
+	}
+	if got != (terminationRequest{Project: "p", Zone: "z", Instance: "vm"}) {
+		t.Errorf("request = %+v", got)
+	}
+
+	status = http.StatusConflict
+	if res, err := c.Terminate(context.Background(), "p", "z", "vm"); err != nil || res != ResultAlreadyStopping {
+		t.Errorf("on 409: Terminate = %v, %v, want already stopping", res, err)
+	}
+	status = http.StatusForbidden
+	if _, err := c.Terminate(context.Background(), "p", "z", "vm"); err == nil {
+		t.Error("on 403: Terminate succeeded")
+	}
+}
+
+func TestTerminateReportsOperationWarnings(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	fake.opWarning = "disk data-1 was not deleted"
+
+	if _, err := term.Terminate(context.Background(), "my-project", "us-central1-a", "my-vm"); err != nil {
+		t.Fatalf("Terminate returned error: %v", err)
+	}
+	if got := term.OperationWarnings(); len(got) != 1 || got[0] != "WARN: disk data-1 was not deleted" {
+		t.Errorf("OperationWarnings() = %q", got)
+	}
+}
+
+func TestTerminateGroupReportsEachMember(t *testing.T) {
+	term, _ := newFakeTerminator(t, http.StatusForbidden, http.StatusOK)
+	members := []groupMember{{Zone: "us-central1-b", Name: "vm-3"}, {Zone: "us-central1-a", Name: "vm-2"}}
+
+	result, err := terminateGroup(context.Background(), term, "p", members, 1)
+	if err == nil || result.Deleted != 1 || result.Failed != 1 {
+		t.Fatalf("terminateGroup = %s, %v", result, err)
+	}
+	// Sorted by zone; the first delete, for vm-3, was the one refused
+	if len(result.Members) != 2 || result.Members[0].Name != "vm-2" || result.Members[0].Err != nil || result.Members[1].Err == nil {
+		t.Errorf("members = %+v", result.Members)
+	}
+}
+
+func TestTerminateGroupOnlyDeletesSiblings(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.steps = []string{"snapshot", "stop"}
+	fake.opWarning = "disk data-1 was not deleted"
+	members := []groupMember{{Zone: "us-central1-a", Name: "vm-2"}, {Zone: "us-central1-a", Name: "vm-3"}}
+
+	if _, err := terminateGroup(context.Background(), term, "p", members, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fake.requests {
+		if r.Method != http.MethodDelete {
+			t.Errorf("sibling request %s %s, want only deletes", r.Method, r.URL.Path)
+		}
+	}
+	if len(fake.requests) != 2 {
+		t.Errorf("got %d requests, want a delete for each sibling", len(fake.requests))
+	}
+	if w := term.OperationWarnings(); w != nil {
+		t.Errorf("OperationWarnings() = %q, want none of the siblings'", w)
+	}
+}
+
+func TestTerminateGroupKeepsDryRun(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.dryRun = true
+	members := []groupMember{{Zone: "us-central1-a", Name: "vm-2"}, {Zone: "us-central1-b", Name: "vm-3"}}
+
+	if !siblingTerminator(term).dryRun {
+		t.Error("siblingTerminator dropped dryRun")
+	}
+	result, err := terminateGroup(context.Background(), term, "p", members, 2)
+	if err != nil || !result.DryRun || result.Deleted != 0 || len(result.Members) != 2 {
+		t.Fatalf("terminateGroup = %s, %v, want a dry run over both siblings", result, err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("got %d requests in a dry run, want none", len(fake.requests))
+	}
+}
+
+func TestTerminateLabelsStoppedInstanceWithReason(t *testing.T) {
+	var labels map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/setLabels"):
+			var req struct{ Labels map[string]string }
+			json.NewDecoder(r.Body).Decode(&req)
+			labels = req.Labels
+			w.Write([]byte(`{"name":"operation-1","status":"DONE"}`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"name":"vm","status":"RUNNING","labels":{"team":"ml"}}`))
+		default:
+			w.Write([]byte(`{"name":"operation-2","status":"RUNNING"}`))
+		}
+	}))
+	defer srv.Close()
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	term.steps, term.minCallInterval = []string{"stop"}, 0
+
+	if _, err := term.TerminateFor(context.Background(), ReasonUnhealthy, "p", "z", "vm"); err != nil {
+		t.Fatal(err)
+	}
+	if labels["terminated-reason"] != string(ReasonUnhealthy) || labels["team"] != "ml" {
+		t.Errorf("labels = %v, want terminated-reason=%s alongside the existing ones", labels, ReasonUnhealthy)
+	}
+}
+
+// fakeSnapshotCompute serves an instance with two persistent disks, whose
+// snapshots report CREATING until polled pending times.
+type fakeSnapshotCompute struct {
+	mu       sync.Mutex
+	pending  int
+	polls    map[string]int
+	inFlight int
+	maxInFl  int
+}
+
+func (f *fakeSnapshotCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/instances/vm"):
+		w.Write([]byte(`{"name":"vm","disks":[{"type":"PERSISTENT","source":"zones/z/disks/boot"},{"type":"SCRATCH"},{"type":"PERSISTENT","source":"zones/z/disks/data"}]}`))
+	case strings.HasSuffix(r.URL.Path, "/createSnapshot"):
+		f.mu.Lock()
+		f.inFlight++
+		f.maxInFl = max(f.maxInFl, f.inFlight)
+		f.mu.Unlock()
+		time.Sleep(20 * time.Millisecond) // let the other disk's request overlap
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+		w.Write([]byte(`{"name":"op","status":"DONE"}`))
+	case strings.Contains(r.URL.Path, "/global/snapshots/"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.polls[r.URL.Path]++
+		status := "CREATING"
+		if f.polls[r.URL.Path] > f.pending {
+			status = "READY"
+		}
+		fmt.Fprintf(w, `{"status":%q}`, status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSnapshotDisksConcurrentlyUntilReady(t *testing.T) {
+	defer func(poll time.Duration) { snapshotPoll = poll }(snapshotPoll)
+	snapshotPoll = time.Millisecond
+	fake := &fakeSnapshotCompute{pending: 2, polls: map[string]int{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	term := newComputeTerminator(option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+
+	snapshots, err := term.SnapshotDisks(context.Background(), "p", "z", "vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || !strings.Contains(snapshots[0], "/snapshots/boot-") || !strings.Contains(snapshots[1], "/snapshots/data-") {
+		t.Errorf("snapshots = %v, want boot then data", snapshots)
+	}
+	if fake.maxInFl != 2 {
+		t.Errorf("at most %d snapshots in flight, want both disks at once", fake.maxInFl)
+	}
+
+	// One that never gets READY is given up on at the timeout
+	fake.pending, fake.polls = 1<<30, map[string]int{}
+	term.snapshotTimeout = 50 * time.Millisecond
+	if _, err := term.SnapshotDisks(context.Background(), "p", "z", "vm"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SnapshotDisks = %v, want a deadline error", err)
+	}
+}
+
+func TestTerminateSkipsSnapshotsWithoutTime(t *testing.T) {
+	term, fake := newFakeTerminator(t)
+	term.steps = []string{"snapshot", "delete"}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if _, err := term.Terminate(ctx, "p", "z", "vm"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 1 || fake.requests[0].Method != http.MethodDelete {
+		t.Errorf("got %d requests, want only the delete", len(fake.requests))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultMinCallInterval = time.Second
+
+// throttleTransport enforces a minimum gap between identical API calls
+// (same method and path), so a runaway retry or polling loop can't burn
+// through Compute API quota. Different calls aren't held up by each other.
+type throttleTransport struct {
+	base        http.RoundTripper
+	minInterval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time // when each call is next allowed
+}
+
+func newThrottleTransport(base http.RoundTripper, minInterval time.Duration) *throttleTransport {
+	return &throttleTransport{base: base, minInterval: minInterval, last: map[string]time.Time{}}
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.Path
+
+	// Reserve the next slot before waiting, so concurrent callers queue up
+	t.mu.Lock()
+	now := time.Now()
+	slot := now
+	if next := t.last[key].Add(t.minInterval); next.After(now) {
+		slot = next
+	}
+	t.last[key] = slot
+	t.mu.Unlock()
+
+	if wait := slot.Sub(now); wait > 0 {
+		log.Printf("Throttling %s for %v", key, wait.Truncate(time.Millisecond))
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestThrottleSpacesIdenticalCalls(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := &http.Client{Transport: newThrottleTransport(http.DefaultTransport, 50*time.Millisecond)}
+
+	get := func(path string) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	start := time.Now()
+	get("/a")
+	get("/b")
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("different calls took %v, want no throttling", elapsed)
+	}
+	get("/a")
+	get("/a")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("three identical calls took %v, want at least 100ms", elapsed)
+	}
+}
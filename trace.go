@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceInterval is how often tracePreemption logs once GCP has given notice.
+const traceInterval = 500 * time.Millisecond
+
+// tracePreemption logs the instance's preemption status and what is left of
+// GCP's notice every traceInterval until the process is killed, so the log
+// shows how long GCP actually took. Log timestamps are whole seconds, so
+// each line carries its own to the millisecond.
+func (m *Monitor) tracePreemption() {
+	for {
+		elapsed := m.Clock.Since(m.interruptedAt)
+		status, err := getMetadata("instance/preempted")
+		if err != nil {
+			status = "error: " + err.Error()
+		}
+		log.Printf("Trace %s +%v: preempted=%s, %v of the %v notice left",
+			m.Clock.Now().Format("15:04:05.000"), elapsed.Truncate(time.Millisecond),
+			strings.TrimSpace(status), max(preemptionBudget-elapsed, 0).Truncate(time.Millisecond), preemptionBudget)
+		m.Clock.Sleep(traceInterval)
+	}
+}
+
+// traceID returns the trace ID in traceparent, the W3C trace context that
+// OpenTelemetry hands child processes in TRACEPARENT, or "" without a
+// valid one.
+func traceID(traceparent string) string {
+	if traceparent == "" {
+		return ""
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceparent})
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// exemplar formats an OpenMetrics exemplar for a counter increment at at,
+// linking the sample to the trace it happened under.
+func exemplar(traceID string, at time.Time) string {
+	return fmt.Sprintf("# {trace_id=%q} 1 %.3f", traceID, float64(at.UnixMilli())/1000)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraceID(t *testing.T) {
+	for _, tc := range []struct{ traceparent, want string }{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""}, // all-zero IDs are invalid
+		{"not-a-traceparent", ""},
+		{"", ""},
+	} {
+		if got := traceID(tc.traceparent); got != tc.want {
+			t.Errorf("traceID(%q) = %q, want %q", tc.traceparent, got, tc.want)
+		}
+	}
+}
+
+func TestExemplar(t *testing.T) {
+	at := time.UnixMilli(1700000000123)
+	if got, want := exemplar("4bf92f3577b34da6a3ce929d0e0e4736", at), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 1 1700000000.123`; got != want {
+		t.Errorf("exemplar = %q, want %q", got, want)
+	}
+}
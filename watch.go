@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"spot-notifier-gcp/metadata"
+)
+
+const (
+	// metadataWatchTimeout is how long the metadata server holds each
+	// hanging GET open when nothing changes
+	metadataWatchTimeout = 60 * time.Second
+	// metadataWatchRetry spaces out attempts while the server is unhappy
+	metadataWatchRetry = 5 * time.Second
+)
+
+// metadataWatchClient holds the hanging GETs, on connections of their own
+// so they never starve the regular reads. Each request's context bounds it.
+var metadataWatchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		IdleConnTimeout: 90 * time.Second,
+	},
+}
+
+// watchMetadata returns a channel that receives whenever one of paths
+// changes, using the metadata server's wait_for_change hanging GET, so the
+// loop can check right away instead of at its next poll. Changes that
+// arrive while one is pending are folded into it.
+func watchMetadata(paths ...string) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	for _, path := range paths {
+		go func() {
+			var etag string
+			failing := false
+			for {
+				next, err := waitForMetadataChange(path, etag)
+				if err != nil {
+					if !failing {
+						log.Printf("Watching %s failed, retrying every %v: %v", path, metadataWatchRetry, err)
+						failing = true
+					}
+					time.Sleep(metadataWatchRetry)
+					continue
+				}
+				if failing {
+					log.Printf("Watching %s again", path)
+					failing = false
+				}
+				if etag != "" && next != etag {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+				etag = next
+			}
+		}()
+	}
+	return changed
+}
+
+// waitForMetadataChange returns path's ETag once it differs from etag, or
+// once metadataWatchTimeout passes without a change. Without an etag it
+// returns the current one right away.
+func waitForMetadataChange(path, etag string) (string, error) {
+	timeout := metadataTimeout
+	if etag != "" {
+		timeout += metadataWatchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := &metadata.Client{Base: metadataBase, HTTP: metadataWatchClient}
+	_, next, err := client.WaitForChange(ctx, path, etag, metadataWatchTimeout)
+	return next, err
+}
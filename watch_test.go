@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForMetadataChangeHangsUntilChange(t *testing.T) {
+	flip := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+		q := r.URL.Query()
+		if q.Get("wait_for_change") == "true" {
+			if q.Get("last_etag") != "e1" || q.Get("timeout_sec") != "60" {
+				t.Errorf("hanging GET query = %v", q)
+			}
+			<-flip
+			w.Header().Set("ETag", "e2")
+			w.Write([]byte("TRUE"))
+			return
+		}
+		w.Header().Set("ETag", "e1")
+		w.Write([]byte("FALSE"))
+	}))
+	defer srv.Close()
+	base := metadataBase
+	metadataBase = srv.URL + "/computeMetadata/v1/"
+	t.Cleanup(func() { metadataBase = base })
+
+	etag, err := waitForMetadataChange("instance/preempted", "")
+	if err != nil || etag != "e1" {
+		t.Fatalf("initial read = %q, %v, want e1", etag, err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { close(flip) })
+	start := time.Now()
+	etag, err = waitForMetadataChange("instance/preempted", etag)
+	if err != nil || etag != "e2" {
+		t.Fatalf("hanging GET = %q, %v, want e2", etag, err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("hanging GET returned after %v, before the change", waited)
+	}
+}
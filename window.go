@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily wall-clock range such as 22:00-07:00.
+// Ranges that cross midnight wrap into the next day.
+type timeWindow struct {
+	start, end time.Duration // offsets from local midnight
+	loc        *time.Location
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM" in the given location.
+func parseTimeWindow(spec string, loc *time.Location) (*timeWindow, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("time window %q must be in HH:MM-HH:MM form", spec)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("time window %q is empty", spec)
+	}
+
+	return &timeWindow{start: start, end: end, loc: loc}, nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String formats the window the way parseTimeWindow reads it.
+func (w *timeWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%s-%s %s", clock(w.start), clock(w.end), w.loc)
+}
+
+// contains reports whether t falls inside the window.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	// Wraps past midnight
+	return offset >= w.start || offset < w.end
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		at   time.Duration
+		want bool
+	}{
+		{"09:00-17:00", 9 * time.Hour, true},
+		{"09:00-17:00", 17 * time.Hour, false},
+		{"09:00-17:00", 8*time.Hour + 59*time.Minute, false},
+		{"22:00-07:00", 23 * time.Hour, true},
+		{"22:00-07:00", 6*time.Hour + 59*time.Minute, true},
+		{"22:00-07:00", 12 * time.Hour, false},
+	} {
+		w, err := parseTimeWindow(tc.spec, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(day.Add(tc.at)); got != tc.want {
+			t.Errorf("%s contains %v = %v, want %v", tc.spec, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestParseTimeWindowRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"22:00", "22:00-25:00", "night-07:00", "07:00-07:00"} {
+		if _, err := parseTimeWindow(spec, time.UTC); err == nil {
+			t.Errorf("parseTimeWindow(%q) succeeded", spec)
+		}
+	}
+}